@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"k8s-monitor/pkg/config"
+	"k8s-monitor/pkg/monitor"
+	"k8s-monitor/pkg/utils"
+)
+
+// apiPrefix is where the versioned API is served. The unversioned routes
+// under /api are deprecated aliases kept for existing clients.
+const apiPrefix = "/api/v1"
+
+// maxAckComment is the longest comment accepted with an acknowledgement
+const maxAckComment = 1000
+
+// openAPISpec describes the versioned API, keep it in sync with the routes
+// registered in registerAPIv1
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// ErrorResponse is the body of every failed /api/v1 request
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIError describes what went wrong
+type APIError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"` // stable, machine readable, e.g. not_found
+	Message string `json:"message"`
+}
+
+// ChangeListResponse is a page of changes. Total counts the matches on all
+// pages, NextCursor is passed as cursor to get the next page.
+type ChangeListResponse struct {
+	Changes    []monitor.Change `json:"changes"`
+	Total      int              `json:"total"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+// StatsResponse holds the statistics over the changes held in memory
+type StatsResponse struct {
+	User                         string                 `json:"user,omitempty"` // whose read state the unread counts are
+	TotalChanges                 int                    `json:"totalChanges"`
+	UnreadChanges                int                    `json:"unreadChanges"`
+	UnacknowledgedChanges        int                    `json:"unacknowledgedChanges"`
+	LoadedFromFile               int                    `json:"loadedFromFile"`
+	CurrentSession               int                    `json:"currentSession"`
+	StartTime                    time.Time              `json:"startTime"`
+	Uptime                       string                 `json:"uptime"`
+	EventCounts                  map[string]int         `json:"eventCounts"`
+	ResourceCounts               map[string]int         `json:"resourceCounts"`
+	SeverityCounts               map[string]int         `json:"severityCounts"`
+	UnreadSeverityCounts         map[string]int         `json:"unreadSeverityCounts"`
+	UnacknowledgedSeverityCounts map[string]int         `json:"unacknowledgedSeverityCounts"`
+	Retention                    map[string]interface{} `json:"retention,omitempty"`
+	Rules                        map[string]interface{} `json:"rules,omitempty"`
+	Stream                       map[string]interface{} `json:"stream,omitempty"`
+	Snapshots                    map[string]interface{} `json:"snapshots,omitempty"`
+	Storage                      map[string]interface{} `json:"storage,omitempty"`
+}
+
+// MarkReadRequest lists the changes to mark read
+type MarkReadRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// MarkReadResponse tells which changes were marked read and which are unknown
+type MarkReadResponse struct {
+	Marked   []string `json:"marked"`
+	NotFound []string `json:"notFound"`
+}
+
+// AcknowledgeRequest carries the optional comment of an acknowledgement
+type AcknowledgeRequest struct {
+	Comment string `json:"comment"`
+}
+
+// CountResponse reports how many items an operation affected
+type CountResponse struct {
+	Count int `json:"count"`
+}
+
+// SaveResponse reports when queued changes were written
+type SaveResponse struct {
+	SavedAt time.Time `json:"savedAt"`
+}
+
+// RulesResponse lists the active rules
+type RulesResponse struct {
+	Rules []config.RuleConfig `json:"rules"`
+}
+
+// StateResponse holds the objects as they were at a point in time
+type StateResponse struct {
+	Time    time.Time             `json:"time"`
+	Objects []monitor.ObjectState `json:"objects"`
+}
+
+// StatusResponse describes the running instance
+type StatusResponse struct {
+	Status               string                 `json:"status"`
+	Version              string                 `json:"version"`
+	BuildDate            string                 `json:"buildDate"`
+	GitCommit            string                 `json:"gitCommit"`
+	Monitoring           MonitoringStatus       `json:"monitoring"`
+	Recovery             []utils.RecoveryReport `json:"recovery,omitempty"`
+	WebSocketConnections int64                  `json:"websocketConnections"`
+}
+
+// MonitoringStatus tells whether the cluster is being watched
+type MonitoringStatus struct {
+	Active       bool   `json:"active"`
+	TotalChanges int    `json:"totalChanges,omitempty"`
+	Uptime       string `json:"uptime,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// HealthResponse is returned while the server is up
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// registerAPIv1 registers the versioned API on a subrouter for apiPrefix
+func (s *Server) registerAPIv1(api *mux.Router) {
+	api.HandleFunc("/changes", s.handleV1Changes).Methods("GET")
+	api.HandleFunc("/changes/stream", s.handleChangeStream).Methods("GET")
+	api.HandleFunc("/changes/read", s.handleV1MarkRead).Methods("POST")
+	api.HandleFunc("/changes/read-all", s.handleV1MarkAllRead).Methods("POST")
+	api.HandleFunc("/changes/{id}", s.handleChangeDetail).Methods("GET")
+	api.HandleFunc("/changes/{id}/manifest", s.handleChangeManifest).Methods("GET")
+	api.HandleFunc("/changes/{id}/acknowledge", s.handleV1Acknowledge).Methods("POST")
+	api.HandleFunc("/history", s.handleV1History).Methods("GET")
+	api.HandleFunc("/resources/{type}/{namespace}/{name}/at", s.handleManifestAt).Methods("GET")
+	api.HandleFunc("/resources/{type}/{namespace}/{name}/history", s.handleV1ObjectHistory).Methods("GET")
+	api.HandleFunc("/state", s.handleAPIState).Methods("GET")
+	api.HandleFunc("/stats", s.handleV1Stats).Methods("GET")
+	api.HandleFunc("/config", s.adminOnly(s.handleAPIConfig)).Methods("GET")
+	api.HandleFunc("/config/resources", s.adminOnly(s.handleV1UpdateResources)).Methods("PUT")
+	api.HandleFunc("/config/resources/{name}", s.adminOnly(s.handleV1UpdateResource)).Methods("PUT")
+	api.HandleFunc("/audit", s.adminOnly(s.handleV1Audit)).Methods("GET")
+	api.HandleFunc("/save", s.adminOnly(s.handleV1Save)).Methods("POST")
+	api.HandleFunc("/rules", s.handleV1Rules).Methods("GET")
+	api.HandleFunc("/rules/reload", s.adminOnly(s.handleV1ReloadRules)).Methods("POST")
+	api.HandleFunc("/ws", s.handleWebSocket).Methods("GET")
+	api.HandleFunc("/status", s.handleV1Status).Methods("GET")
+	api.HandleFunc("/whoami", s.handleV1WhoAmI).Methods("GET")
+	api.HandleFunc("/health", s.handleV1Health).Methods("GET")
+	api.HandleFunc("/openapi.json", handleOpenAPI).Methods("GET")
+
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpError(w, r, "No such endpoint", http.StatusNotFound)
+	})
+	api.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	})
+}
+
+// deprecated marks a response of an unversioned route as deprecated in
+// favour of its /api/v1 successor, whose {name} variables are filled in
+// from the request
+func deprecated(successor string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link := successor
+		for name, value := range mux.Vars(r) {
+			link = strings.Replace(link, "{"+name+"}", url.PathEscape(value), 1)
+		}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+apiPrefix+link+`>; rel="successor-version"`)
+		handler(w, r)
+	}
+}
+
+// httpError replies with the error envelope on /api/v1 and with plain text
+// on the deprecated routes
+func httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if !strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, ErrorResponse{Error: APIError{Status: status, Code: errorCode(status), Message: message}})
+}
+
+// errorCode names an HTTP status for the error envelope
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	default:
+		if status >= 500 {
+			return "internal"
+		}
+		return strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func (s *Server) handleV1Changes(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	page, err := s.pageChanges(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := ChangeListResponse{Changes: page.Changes, Total: page.Total}
+	if response.Changes == nil {
+		response.Changes = []monitor.Change{}
+	}
+	if page.Next != 0 {
+		response.NextCursor = strconv.FormatUint(page.Next, 10)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleV1History(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	filter, err := parseHistoryFilter(r, 1000)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	changes, err := s.monitor.QueryHistory(filter)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeChangeList(w, changes)
+}
+
+func (s *Server) handleV1ObjectHistory(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	if namespace == clusterScopedNamespace {
+		namespace = ""
+	}
+	filter, err := parseHistoryFilter(r, 0)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	changes, err := s.monitor.ObjectHistory(vars["type"], namespace, vars["name"], filter)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeChangeList(w, changes)
+}
+
+// writeChangeList replies with all changes on a single page
+func writeChangeList(w http.ResponseWriter, changes []monitor.Change) {
+	if changes == nil {
+		changes = []monitor.Change{}
+	}
+	writeJSON(w, http.StatusOK, ChangeListResponse{Changes: changes, Total: len(changes)})
+}
+
+func (s *Server) handleV1Stats(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	filter := monitor.ChangeFilter{Severities: parseSeverities(r.URL.Query())}
+	forCaller(r.Context(), &filter)
+	stats := s.monitor.GetStatsFiltered(filter)
+
+	var response StatsResponse
+	response.User, _ = stats["user"].(string)
+	response.TotalChanges, _ = stats["totalChanges"].(int)
+	response.UnreadChanges, _ = stats["unreadChanges"].(int)
+	response.UnacknowledgedChanges, _ = stats["unacknowledgedChanges"].(int)
+	response.LoadedFromFile, _ = stats["loadedFromFile"].(int)
+	response.CurrentSession, _ = stats["currentSession"].(int)
+	response.StartTime, _ = stats["startTime"].(time.Time)
+	response.Uptime, _ = stats["uptime"].(string)
+	response.EventCounts, _ = stats["eventCounts"].(map[string]int)
+	response.ResourceCounts, _ = stats["resourceCounts"].(map[string]int)
+	response.SeverityCounts, _ = stats["severityCounts"].(map[string]int)
+	response.UnreadSeverityCounts, _ = stats["unreadSeverityCounts"].(map[string]int)
+	response.UnacknowledgedSeverityCounts, _ = stats["unacknowledgedSeverityCounts"].(map[string]int)
+	response.Retention, _ = stats["retention"].(map[string]interface{})
+	response.Rules, _ = stats["rules"].(map[string]interface{})
+	response.Stream, _ = stats["stream"].(map[string]interface{})
+	response.Snapshots, _ = stats["snapshots"].(map[string]interface{})
+	response.Storage, _ = stats["storage"].(map[string]interface{})
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleV1MarkRead(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	var request MarkReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.IDs) == 0 {
+		httpError(w, r, "Invalid request body, expected {\"ids\": [...]}", http.StatusBadRequest)
+		return
+	}
+
+	response := MarkReadResponse{Marked: []string{}, NotFound: []string{}}
+	for _, id := range request.IDs {
+		if s.markRead(r.Context(), id) {
+			response.Marked = append(response.Marked, id)
+		} else {
+			response.NotFound = append(response.NotFound, id)
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleV1MarkAllRead(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, CountResponse{Count: s.markAllRead(r.Context())})
+}
+
+// handleV1Acknowledge acknowledges a change as the caller, with an optional
+// comment, and returns the updated change
+func (s *Server) handleV1Acknowledge(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	var request AcknowledgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		httpError(w, r, "Invalid request body, expected {\"comment\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	comment := strings.TrimSpace(request.Comment)
+	if len(comment) > maxAckComment {
+		httpError(w, r, "Comment is longer than "+strconv.Itoa(maxAckComment)+" characters", http.StatusBadRequest)
+		return
+	}
+
+	change, err := s.acknowledge(r.Context(), mux.Vars(r)["id"], requestActor(r), comment)
+	switch err {
+	case nil:
+		writeJSON(w, http.StatusOK, change)
+	case monitor.ErrChangeNotFound:
+		httpError(w, r, err.Error(), http.StatusNotFound)
+	case monitor.ErrAlreadyAcknowledged:
+		httpError(w, r, "Change was already acknowledged by "+change.Acknowledgement.User, http.StatusConflict)
+	default:
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) handleV1Save(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	if err := s.monitor.SaveToFileNow(); err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, SaveResponse{SavedAt: time.Now()})
+}
+
+func (s *Server) handleV1Rules(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, RulesResponse{Rules: s.monitor.GetRules()})
+}
+
+func (s *Server) handleV1ReloadRules(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	count, err := s.reloadRules()
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, CountResponse{Count: count})
+}
+
+func (s *Server) handleV1Status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.status(r.Context()))
+}
+
+// status describes the instance for /api/v1/status and /api/debug. Only
+// admins see totals, connections and recovery reports, which name files on
+// disk; everyone else gets the version and whether monitoring is active.
+func (s *Server) status(ctx context.Context) StatusResponse {
+	status := StatusResponse{
+		Status:    "healthy",
+		Version:   Version,
+		BuildDate: BuildDate,
+		GitCommit: GitCommit,
+	}
+	if s.monitor == nil {
+		status.Monitoring = MonitoringStatus{Active: false, Error: "Kubernetes client not available"}
+		return status
+	}
+	status.Monitoring.Active = true
+	if !s.isAdmin(ctx) {
+		return status
+	}
+
+	stats := s.monitor.GetStats()
+	status.WebSocketConnections = atomic.LoadInt64(&s.websockets)
+	status.Monitoring.TotalChanges, _ = stats["totalChanges"].(int)
+	status.Monitoring.Uptime, _ = stats["uptime"].(string)
+	status.Recovery = s.monitor.RecoveryReports()
+	return status
+}
+
+func (s *Server) handleV1Health(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, HealthResponse{Status: "healthy"})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"k8s-monitor/pkg/auth"
+	"k8s-monitor/pkg/monitor"
+)
+
+// isPublic reports whether a path can be reached without credentials: the
+// health checks, the API description and the static web files
+func isPublic(path string) bool {
+	switch path {
+	case "/health", apiPrefix + "/health", apiPrefix + "/openapi.json":
+		return true
+	}
+	return path != "/api" && !strings.HasPrefix(path, "/api/")
+}
+
+// acceptsQueryToken reports whether a path takes the bearer token as the
+// access_token parameter, browsers cannot set headers on EventSource and
+// WebSocket connections
+func acceptsQueryToken(path string) bool {
+	switch path {
+	case "/api/changes/stream", "/api/ws", apiPrefix + "/changes/stream", apiPrefix + "/ws":
+		return true
+	}
+	return false
+}
+
+// authenticate is the router middleware that rejects requests without valid
+// credentials and makes the identity of the others available through
+// auth.FromContext
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.authenticator == nil || isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		authorization := r.Header.Get("Authorization")
+		if authorization == "" && acceptsQueryToken(r.URL.Path) {
+			if token := r.URL.Query().Get("access_token"); token != "" {
+				authorization = "Bearer " + token
+			}
+		}
+		identity, err := s.authenticator.Authenticate(r.Context(), authorization)
+		if err != nil {
+			if s.config.Logging.Enabled && s.config.Logging.LogOperations {
+				log.Printf("Rejected %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			}
+			w.Header().Add("WWW-Authenticate", `Bearer realm="k8s-monitor"`)
+			if s.authenticator.BasicEnabled() {
+				w.Header().Add("WWW-Authenticate", `Basic realm="k8s-monitor"`)
+			}
+			message := "Authentication required"
+			if err != auth.ErrNoCredentials {
+				message = "Invalid credentials"
+			}
+			httpError(w, r, message, http.StatusUnauthorized)
+			return
+		}
+		ctx := auth.WithIdentity(r.Context(), identity)
+		next.ServeHTTP(w, r.WithContext(s.withVisibility(ctx, identity)))
+	})
+}
+
+type visibilityKey struct{}
+
+// reviewConcurrency bounds the SubjectAccessReviews one request runs at once
+const reviewConcurrency = 8
+
+// visibilityCheck decides which changes an identity may see
+type visibilityCheck struct {
+	authorizer *auth.Authorizer
+	identity   *auth.Identity
+}
+
+// allowed asks about one scope, which may wait for the API server
+func (v *visibilityCheck) allowed(scope monitor.Scope) bool {
+	return v.authorizer.Allowed(v.identity, monitor.ResourceGroup(scope.ResourceType), scope.ResourceType, scope.Namespace)
+}
+
+// prepare decides about scopes before the monitor filters changes under its
+// locks, a few reviews at a time
+func (v *visibilityCheck) prepare(scopes []monitor.Scope) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, reviewConcurrency)
+	for _, scope := range scopes {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(scope monitor.Scope) {
+			defer wg.Done()
+			v.allowed(scope)
+			<-slots
+		}(scope)
+	}
+	wg.Wait()
+}
+
+// allow looks up what prepare decided about a change, it never blocks
+func (v *visibilityCheck) allow(change monitor.Change) bool {
+	return v.authorizer.Decided(v.identity, monitor.ResourceGroup(change.ResourceType), change.ResourceType, change.Namespace)
+}
+
+// withVisibility attaches the check for the changes identity may see to a
+// context, when authorization is enabled
+func (s *Server) withVisibility(ctx context.Context, identity *auth.Identity) context.Context {
+	if s.authorizer == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, visibilityKey{}, &visibilityCheck{authorizer: s.authorizer, identity: identity})
+}
+
+// visibility returns the check for the changes a request may see, nil when
+// it may see all of them
+func visibility(ctx context.Context) *visibilityCheck {
+	check, _ := ctx.Value(visibilityKey{}).(*visibilityCheck)
+	return check
+}
+
+// forCaller limits a filter to the changes the caller may see and applies
+// the caller's read state
+func forCaller(ctx context.Context, filter *monitor.ChangeFilter) {
+	if check := visibility(ctx); check != nil {
+		filter.Allow = check.allow
+		filter.Prepare = check.prepare
+	}
+	filter.User = requestUser(ctx)
+}
+
+// canSee reports whether a request may see changes to objects of a type in
+// a namespace
+func canSee(ctx context.Context, resourceType, namespace string) bool {
+	check := visibility(ctx)
+	return check == nil || check.allowed(monitor.Scope{ResourceType: resourceType, Namespace: namespace})
+}
+
+// requestUser returns the authenticated user of a request, whose read state
+// is kept apart from everyone else's. Without authentication it is empty and
+// the shared read state is used.
+func requestUser(ctx context.Context) string {
+	if identity, ok := auth.FromContext(ctx); ok {
+		return identity.User
+	}
+	return ""
+}
+
+// markRead marks a change read for the caller, changes the caller may not
+// see are treated as unknown
+func (s *Server) markRead(ctx context.Context, id string) bool {
+	if visibility(ctx) != nil {
+		change, ok := s.monitor.GetChange(id)
+		if !ok || !canSee(ctx, change.ResourceType, change.Namespace) {
+			return false
+		}
+	}
+	return s.monitor.MarkAsReadBy(requestUser(ctx), id)
+}
+
+// markAllRead marks every change read for the caller, or only the ones the
+// caller may see
+func (s *Server) markAllRead(ctx context.Context) int {
+	user := requestUser(ctx)
+	if visibility(ctx) == nil {
+		return s.monitor.MarkAllAsReadBy(user)
+	}
+	count := 0
+	filter := monitor.ChangeFilter{UnreadOnly: true}
+	forCaller(ctx, &filter)
+	page := s.monitor.PageChanges(filter, false, 0, 0)
+	for _, change := range page.Changes {
+		if s.monitor.MarkAsReadBy(user, change.ID) {
+			count++
+		}
+	}
+	return count
+}
+
+// acknowledge acknowledges a change as actor and marks it read for the
+// caller. Changes the caller may not see are treated as unknown.
+func (s *Server) acknowledge(ctx context.Context, id, actor, comment string) (monitor.Change, error) {
+	change, ok := s.monitor.GetChange(id)
+	if !ok || !canSee(ctx, change.ResourceType, change.Namespace) {
+		return monitor.Change{}, monitor.ErrChangeNotFound
+	}
+	change, err := s.monitor.Acknowledge(id, actor, comment)
+	if err != nil {
+		return s.monitor.ViewAs(requestUser(ctx), change), err
+	}
+	s.monitor.MarkAsReadBy(requestUser(ctx), id)
+	change.IsRead = true
+	return change, nil
+}
+
+// requestActor names who made a request, for audit entries
+func requestActor(r *http.Request) string {
+	if identity, ok := auth.FromContext(r.Context()); ok {
+		return identity.User
+	}
+	return r.RemoteAddr
+}
+
+// isAdmin reports whether a request may use the administrative endpoints,
+// every request may when authentication is disabled
+func (s *Server) isAdmin(ctx context.Context) bool {
+	if s.authenticator == nil {
+		return true
+	}
+	identity, ok := auth.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	admin := s.config.Auth.Admin
+	for _, group := range identity.Groups {
+		for _, adminGroup := range admin.Groups {
+			if group == adminGroup {
+				return true
+			}
+		}
+	}
+	return s.admins != nil && s.admins.Can(identity, admin.Verb, admin.Group, admin.Resource, admin.Namespace)
+}
+
+// adminOnly rejects requests to an administrative endpoint by identities
+// that are not admins
+func (s *Server) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdmin(r.Context()) {
+			httpError(w, r, "Administrator access required", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// handleV1WhoAmI returns the identity the request was authenticated as
+func (s *Server) handleV1WhoAmI(w http.ResponseWriter, r *http.Request) {
+	identity, ok := auth.FromContext(r.Context())
+	if !ok {
+		identity = &auth.Identity{User: "anonymous", Method: "none"}
+	}
+	writeJSON(w, http.StatusOK, identity)
+}
+
+// grpcAuthenticate checks the authorization metadata of a gRPC call
+func (s *Server) grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+	identity, err := s.authenticator.Authenticate(ctx, authorization)
+	if err == auth.ErrNoCredentials {
+		return nil, status.Error(codes.Unauthenticated, "Authentication required")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid credentials")
+	}
+	return s.withVisibility(auth.WithIdentity(ctx, identity), identity), nil
+}
+
+func (s *Server) grpcUnaryAuth(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.grpcAuthenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, request)
+}
+
+func (s *Server) grpcStreamAuth(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.grpcAuthenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(server, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// authenticatedStream carries the identity of a streaming call
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (a *authenticatedStream) Context() context.Context {
+	return a.ctx
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s-monitor/pkg/grpcapi"
+	"k8s-monitor/pkg/monitor"
+)
+
+// grpcService implements the gRPC API on top of the monitor
+type grpcService struct {
+	grpcapi.UnimplementedMonitorServiceServer
+	server *Server
+}
+
+// serveGRPC serves the gRPC API on the configured port until it fails
+func (s *Server) serveGRPC() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.config.GRPC.Port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on gRPC port: %v", err)
+	}
+	var options []grpc.ServerOption
+	if s.authenticator != nil {
+		options = append(options, grpc.UnaryInterceptor(s.grpcUnaryAuth), grpc.StreamInterceptor(s.grpcStreamAuth))
+	}
+	server := grpc.NewServer(options...)
+	grpcapi.RegisterMonitorServiceServer(server, &grpcService{server: s})
+
+	if s.config.Logging.Enabled && s.config.Logging.LogOperations {
+		log.Printf("Serving gRPC API on port %d", s.config.GRPC.Port)
+	}
+	return server.Serve(listener)
+}
+
+// monitor returns the monitor, or Unavailable when there is no cluster
+func (g *grpcService) monitor() (*monitor.K8sMonitor, error) {
+	if g.server.monitor == nil {
+		return nil, status.Error(codes.Unavailable, "Monitor not available")
+	}
+	return g.server.monitor, nil
+}
+
+func (g *grpcService) ListChanges(ctx context.Context, request *grpcapi.ListChangesRequest) (*grpcapi.ListChangesResponse, error) {
+	m, err := g.monitor()
+	if err != nil {
+		return nil, err
+	}
+	if request.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "Invalid limit")
+	}
+	page := m.PageChanges(filterFromProto(ctx, request.Filter), request.NewestFirst, request.Cursor, int(request.Limit))
+	return &grpcapi.ListChangesResponse{
+		Changes:    changesToProto(page.Changes),
+		Total:      int32(page.Total),
+		NextCursor: page.Next,
+	}, nil
+}
+
+func (g *grpcService) QueryHistory(ctx context.Context, request *grpcapi.QueryHistoryRequest) (*grpcapi.QueryHistoryResponse, error) {
+	m, err := g.monitor()
+	if err != nil {
+		return nil, err
+	}
+	if request.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "Invalid limit")
+	}
+	filter := filterFromProto(ctx, request.Filter)
+	filter.Limit = int(request.Limit)
+	if filter.Limit == 0 {
+		filter.Limit = 1000
+	}
+	changes, err := m.QueryHistory(filter)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &grpcapi.QueryHistoryResponse{Changes: changesToProto(changes)}, nil
+}
+
+func (g *grpcService) GetChange(ctx context.Context, request *grpcapi.GetChangeRequest) (*grpcapi.Change, error) {
+	m, err := g.monitor()
+	if err != nil {
+		return nil, err
+	}
+	change, ok := m.GetChange(request.Id)
+	if !ok || !canSee(ctx, change.ResourceType, change.Namespace) {
+		return nil, status.Error(codes.NotFound, monitor.ErrChangeNotFound.Error())
+	}
+	return changeToProto(m.ViewAs(requestUser(ctx), change)), nil
+}
+
+func (g *grpcService) GetStats(ctx context.Context, request *grpcapi.GetStatsRequest) (*grpcapi.Stats, error) {
+	m, err := g.monitor()
+	if err != nil {
+		return nil, err
+	}
+	filter := monitor.ChangeFilter{Severities: request.Severities}
+	forCaller(ctx, &filter)
+	stats := m.GetStatsFiltered(filter)
+
+	response := &grpcapi.Stats{}
+	for key, field := range map[string]*int32{
+		"totalChanges":          &response.TotalChanges,
+		"unreadChanges":         &response.UnreadChanges,
+		"unacknowledgedChanges": &response.UnacknowledgedChanges,
+		"loadedFromFile":        &response.LoadedFromFile,
+		"currentSession":        &response.CurrentSession,
+	} {
+		count, _ := stats[key].(int)
+		*field = int32(count)
+	}
+	if startTime, ok := stats["startTime"].(time.Time); ok {
+		response.StartTime = timestamppb.New(startTime)
+	}
+	response.EventCounts = countsToProto(stats["eventCounts"])
+	response.ResourceCounts = countsToProto(stats["resourceCounts"])
+	response.SeverityCounts = countsToProto(stats["severityCounts"])
+	response.UnreadSeverityCounts = countsToProto(stats["unreadSeverityCounts"])
+	response.UnacknowledgedSeverityCounts = countsToProto(stats["unacknowledgedSeverityCounts"])
+	response.User, _ = stats["user"].(string)
+	return response, nil
+}
+
+func (g *grpcService) MarkRead(ctx context.Context, request *grpcapi.MarkReadRequest) (*grpcapi.MarkReadResponse, error) {
+	if _, err := g.monitor(); err != nil {
+		return nil, err
+	}
+	if len(request.Ids) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "No change IDs given")
+	}
+	response := &grpcapi.MarkReadResponse{}
+	for _, id := range request.Ids {
+		if g.server.markRead(ctx, id) {
+			response.Marked = append(response.Marked, id)
+		} else {
+			response.NotFound = append(response.NotFound, id)
+		}
+	}
+	return response, nil
+}
+
+func (g *grpcService) MarkAllRead(ctx context.Context, request *grpcapi.MarkAllReadRequest) (*grpcapi.MarkAllReadResponse, error) {
+	if _, err := g.monitor(); err != nil {
+		return nil, err
+	}
+	return &grpcapi.MarkAllReadResponse{Count: int32(g.server.markAllRead(ctx))}, nil
+}
+
+func (g *grpcService) Acknowledge(ctx context.Context, request *grpcapi.AcknowledgeRequest) (*grpcapi.Change, error) {
+	if _, err := g.monitor(); err != nil {
+		return nil, err
+	}
+	comment := strings.TrimSpace(request.Comment)
+	if len(comment) > maxAckComment {
+		return nil, status.Errorf(codes.InvalidArgument, "Comment is longer than %d characters", maxAckComment)
+	}
+	actor := requestUser(ctx)
+	if actor == "" {
+		if p, ok := peer.FromContext(ctx); ok {
+			actor = p.Addr.String()
+		}
+	}
+
+	change, err := g.server.acknowledge(ctx, request.Id, actor, comment)
+	switch err {
+	case nil:
+		return changeToProto(change), nil
+	case monitor.ErrChangeNotFound:
+		return nil, status.Error(codes.NotFound, err.Error())
+	case monitor.ErrAlreadyAcknowledged:
+		return nil, status.Errorf(codes.AlreadyExists, "Change was already acknowledged by %s", change.Acknowledgement.User)
+	default:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+}
+
+// WatchChanges streams change, read, acknowledgement and reset events. Stats events are left
+// out, clients call GetStats instead.
+func (g *grpcService) WatchChanges(request *grpcapi.WatchChangesRequest, stream grpcapi.MonitorService_WatchChangesServer) error {
+	m, err := g.monitor()
+	if err != nil {
+		return err
+	}
+	sub := m.Subscribe(filterFromProto(stream.Context(), request.Filter), request.LastEventId)
+	defer sub.Close()
+
+	lastEventID := request.LastEventId
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return status.Errorf(codes.ResourceExhausted, "Client fell behind, resume after event %d", lastEventID)
+			}
+			lastEventID = event.ID
+			response := watchResponse(event)
+			if response == nil {
+				continue
+			}
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// watchResponse converts a stream event, nil for events not sent over gRPC
+func watchResponse(event monitor.StreamEvent) *grpcapi.WatchChangesResponse {
+	response := &grpcapi.WatchChangesResponse{EventId: event.ID}
+	switch event.Type {
+	case monitor.StreamChange:
+		response.Event = &grpcapi.WatchChangesResponse_Change{Change: changeToProto(*event.Change)}
+	case monitor.StreamRead:
+		read := &grpcapi.ReadEvent{Ids: event.IDs}
+		if event.Before != nil {
+			read.Before = timestamppb.New(*event.Before)
+		}
+		response.Event = &grpcapi.WatchChangesResponse_Read{Read: read}
+	case monitor.StreamAck:
+		response.Event = &grpcapi.WatchChangesResponse_Ack{Ack: &grpcapi.AckEvent{Change: changeToProto(*event.Change)}}
+	case monitor.StreamReset:
+		response.Event = &grpcapi.WatchChangesResponse_Reset_{Reset_: &grpcapi.ResetEvent{}}
+	default:
+		return nil
+	}
+	return response
+}
+
+// filterFromProto converts a request filter, nil matches everything the
+// caller may see
+func filterFromProto(ctx context.Context, f *grpcapi.ChangeFilter) monitor.ChangeFilter {
+	var filter monitor.ChangeFilter
+	forCaller(ctx, &filter)
+	if f == nil {
+		return filter
+	}
+	filter = monitor.ChangeFilter{
+		Allow:         filter.Allow,
+		Prepare:       filter.Prepare,
+		User:          filter.User,
+		ResourceTypes: f.ResourceTypes,
+		Namespaces:    f.Namespaces,
+		Name:          f.Name,
+		EventTypes:    f.EventTypes,
+		Severities:    f.Severities,
+		UnreadOnly:    f.Read == grpcapi.ReadFilter_READ_FILTER_UNREAD,
+		ReadOnly:      f.Read == grpcapi.ReadFilter_READ_FILTER_READ,
+
+		UnacknowledgedOnly: f.Acknowledged == grpcapi.AckFilter_ACK_FILTER_UNACKNOWLEDGED,
+		AcknowledgedOnly:   f.Acknowledged == grpcapi.AckFilter_ACK_FILTER_ACKNOWLEDGED,
+	}
+	if f.Since != nil {
+		filter.From = f.Since.AsTime()
+	}
+	if f.Until != nil {
+		filter.To = f.Until.AsTime()
+	}
+	return filter
+}
+
+func changeToProto(change monitor.Change) *grpcapi.Change {
+	result := &grpcapi.Change{
+		Id:           change.ID,
+		Seq:          change.Seq,
+		Timestamp:    timestamppb.New(change.Timestamp),
+		EventType:    change.EventType,
+		ResourceType: change.ResourceType,
+		Namespace:    change.Namespace,
+		Name:         change.Name,
+		Details:      change.Details,
+		Severity:     change.Severity,
+		Actor:        change.Actor,
+		ChangedPaths: change.ChangedPaths,
+		Tags:         change.Tags,
+		BeforeHash:   change.BeforeHash,
+		AfterHash:    change.AfterHash,
+		IsRead:       change.IsRead,
+	}
+	if ack := change.Acknowledgement; ack != nil {
+		result.Acknowledgement = &grpcapi.Acknowledgement{User: ack.User, Time: timestamppb.New(ack.Time), Comment: ack.Comment}
+	}
+	return result
+}
+
+func changesToProto(changes []monitor.Change) []*grpcapi.Change {
+	result := make([]*grpcapi.Change, 0, len(changes))
+	for _, change := range changes {
+		result = append(result, changeToProto(change))
+	}
+	return result
+}
+
+func countsToProto(value interface{}) map[string]int32 {
+	counts, _ := value.(map[string]int)
+	result := make(map[string]int32, len(counts))
+	for key, count := range counts {
+		result[key] = int32(count)
+	}
+	return result
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s-monitor/pkg/config"
+	"k8s-monitor/pkg/monitor"
+)
+
+// historyFlags are the time range and filter flags shared by export and import
+type historyFlags struct {
+	from, to     *string
+	resourceType *string
+	namespace    *string
+	name         *string
+	eventType    *string
+	severity     *string
+	unread       *bool
+}
+
+func addHistoryFlags(flags *flag.FlagSet) historyFlags {
+	return historyFlags{
+		from:         flags.String("from", "", "only changes at or after this time (RFC3339)"),
+		to:           flags.String("to", "", "only changes at or before this time (RFC3339)"),
+		resourceType: flags.String("resource-type", "", "only these resource types, comma separated"),
+		namespace:    flags.String("namespace", "", "only these namespaces, comma separated"),
+		name:         flags.String("name", "", "only changes of objects with this name"),
+		eventType:    flags.String("event-type", "", "only these event types, comma separated"),
+		severity:     flags.String("severity", "", "only these severities, comma separated"),
+		unread:       flags.Bool("unread", false, "only unread changes"),
+	}
+}
+
+func (f historyFlags) filter() (monitor.ChangeFilter, error) {
+	filter := monitor.ChangeFilter{
+		ResourceTypes: splitList(*f.resourceType),
+		Namespaces:    splitList(*f.namespace),
+		Name:          *f.name,
+		EventTypes:    splitList(*f.eventType),
+		Severities:    splitList(strings.ToLower(*f.severity)),
+		UnreadOnly:    *f.unread,
+	}
+	for _, bound := range []struct {
+		value  string
+		target *time.Time
+	}{{*f.from, &filter.From}, {*f.to, &filter.To}} {
+		if bound.value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid time %q, expected RFC3339: %v", bound.value, err)
+		}
+		*bound.target = parsed
+	}
+	return filter, nil
+}
+
+func splitList(value string) []string {
+	var values []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+// formatForFile guesses the format from a file extension
+func formatForFile(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return monitor.FormatCSV
+	case ".json":
+		return monitor.FormatNative
+	default:
+		return monitor.FormatNDJSON
+	}
+}
+
+// runExportCommand writes the stored change history to a file
+func runExportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configFile := flags.String("config", configPath, "path to the configuration file")
+	format := flags.String("format", "", "ndjson, csv or native (default from the output extension, else ndjson)")
+	output := flags.String("output", "-", "file to write to, - for stdout")
+	history := addHistoryFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: k8s-monitor export [flags]\n\nWrites the stored change history in a portable format.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	filter, err := history.filter()
+	if err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = formatForFile(*output)
+	}
+
+	cfg, err := config.LoadConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("error loading configuration: %v", err)
+	}
+	m, err := monitor.LoadHistory(cfg)
+	if err != nil {
+		return fmt.Errorf("error loading history: %v", err)
+	}
+	defer m.Stop()
+	changes, err := m.QueryHistory(filter)
+	if err != nil {
+		return fmt.Errorf("error querying history: %v", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %v", err)
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := monitor.WriteChanges(w, *format, changes); err != nil {
+		return err
+	}
+	if *output != "-" {
+		fmt.Fprintf(os.Stderr, "Exported %d changes to %s\n", len(changes), *output)
+	}
+	return nil
+}
+
+// runImportCommand adds changes from exported files to the stored history,
+// skipping changes that are already stored
+func runImportCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	configFile := flags.String("config", configPath, "path to the configuration file")
+	format := flags.String("format", "", "ndjson, csv or native (default from each file's extension, else ndjson)")
+	history := addHistoryFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: k8s-monitor import [flags] FILE...\n\nAdds exported changes to the stored history, - reads stdin. Changes already\nstored are skipped by ID. Stop the monitor using the same storage first.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no files to import")
+	}
+
+	filter, err := history.filter()
+	if err != nil {
+		return err
+	}
+
+	var changes []monitor.Change
+	for _, path := range flags.Args() {
+		fileFormat := *format
+		if fileFormat == "" {
+			fileFormat = formatForFile(path)
+		}
+
+		var r io.Reader = os.Stdin
+		if path != "-" {
+			file, err := os.Open(path)
+			if err != nil {
+				return fmt.Errorf("failed to open %s: %v", path, err)
+			}
+			defer file.Close()
+			r = file
+		}
+		read, invalid, err := monitor.ReadChanges(r, fileFormat)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		if invalid > 0 {
+			fmt.Fprintf(os.Stderr, "Skipped %d invalid changes in %s\n", invalid, path)
+		}
+		changes = append(changes, filter.Apply(read)...)
+	}
+
+	cfg, err := config.LoadConfig(*configFile)
+	if err != nil {
+		return fmt.Errorf("error loading configuration: %v", err)
+	}
+	m, err := monitor.LoadHistory(cfg)
+	if err != nil {
+		return fmt.Errorf("error loading history: %v", err)
+	}
+	defer m.Stop()
+
+	imported, expired, err := m.ImportChanges(changes)
+	if err != nil {
+		return fmt.Errorf("error importing changes: %v", err)
+	}
+	if expired > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d changes older than persistence.historyMaxAge\n", expired)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d changes, %d were already stored\n", imported, len(changes)-imported-expired)
+	return nil
+}
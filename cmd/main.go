@@ -5,13 +5,22 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+	"k8s-monitor/pkg/auth"
 	"k8s-monitor/pkg/config"
 	"k8s-monitor/pkg/monitor"
 )
@@ -23,12 +32,36 @@ var (
 	GitCommit = "unknown"
 )
 
+// configPath is the configuration file read at startup and on rule reloads
+const configPath = "config.json"
+
 type Server struct {
-	monitor *monitor.K8sMonitor
-	config  *config.Config
+	monitor       *monitor.K8sMonitor
+	config        *config.Config
+	authenticator *auth.Authenticator // nil when authentication is disabled
+	authorizer    *auth.Authorizer    // nil when every user sees every change
+	admins        *auth.Authorizer    // reviews admin access when auth.admin.verb is set
+	websockets    int64               // open WebSocket connections, updated atomically
+	configMutex   sync.Mutex          // serializes runtime configuration changes
+}
+
+// commands are the subcommands that run instead of the server
+var commands = map[string]func(args []string) error{
+	"state":  runStateCommand,
+	"export": runExportCommand,
+	"import": runImportCommand,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatalf("Error: %s", err.Error())
+			}
+			return
+		}
+	}
+
 	// Print version information
 	log.Printf("🚀 Kubernetes Monitor")
 	log.Printf("   Version: %s", Version)
@@ -37,7 +70,7 @@ func main() {
 	log.Println()
 
 	// Load configuration
-	cfg, err := config.LoadConfig("config.json")
+	cfg, err := config.LoadConfig(configPath)
 	if err != nil {
 		log.Fatalf("Error loading configuration: %s", err.Error())
 	}
@@ -85,9 +118,42 @@ func main() {
 	}
 
 	server := &Server{monitor: m, config: cfg}
+	if cfg.Auth.Enabled {
+		var client kubernetes.Interface
+		if clientset != nil {
+			client = clientset
+		}
+		server.authenticator, err = auth.New(cfg.Auth, client)
+		if err != nil {
+			log.Fatalf("Error configuring authentication: %s", err.Error())
+		}
+		if cfg.Auth.Kubernetes.Authorize {
+			if client == nil {
+				log.Fatalf("Error configuring authentication: Kubernetes authorization needs a connection to the cluster")
+			}
+			server.authorizer = auth.NewAuthorizer(client, time.Duration(cfg.Auth.Kubernetes.CacheTTL)*time.Second)
+		}
+		if admin := cfg.Auth.Admin; admin.Verb != "" {
+			if admin.Resource == "" {
+				log.Fatalf("Error configuring authentication: auth.admin.verb needs auth.admin.resource")
+			}
+			if client == nil {
+				log.Fatalf("Error configuring authentication: auth.admin.verb needs a connection to the cluster")
+			}
+			server.admins = auth.NewAuthorizer(client, time.Duration(cfg.Auth.Kubernetes.CacheTTL)*time.Second)
+		} else if len(admin.Groups) == 0 {
+			log.Printf("Warning: auth.admin is not configured, nobody may change the configuration, save, reload rules or read the audit log")
+		}
+	}
+
+	// Reload rules from the configuration file on SIGHUP
+	if m != nil {
+		go server.reloadRulesOnSignal()
+	}
 
 	// Setup routes
 	router := mux.NewRouter()
+	router.Use(server.authenticate)
 
 	// Static file serving setup first
 	webDir := "web"
@@ -100,14 +166,27 @@ func main() {
 		}
 	}
 
-	// API routes (must be registered before static file handler)
-	router.HandleFunc("/api/changes", server.handleAPIChanges).Methods("GET")
-	router.HandleFunc("/api/stats", server.handleAPIStats).Methods("GET")
-	router.HandleFunc("/api/config", server.handleAPIConfig).Methods("GET")
-	router.HandleFunc("/api/mark-read", server.handleMarkRead).Methods("POST")
-	router.HandleFunc("/api/mark-all-read", server.handleMarkAllRead).Methods("POST")
-	router.HandleFunc("/api/save-now", server.handleSaveNow).Methods("POST")
-	router.HandleFunc("/api/debug", server.debugStatus).Methods("GET")
+	// Versioned API
+	server.registerAPIv1(router.PathPrefix(apiPrefix).Subrouter())
+
+	// Deprecated unversioned routes (must be registered before static file handler)
+	router.HandleFunc("/api/changes", deprecated("/changes", server.handleAPIChanges)).Methods("GET")
+	router.HandleFunc("/api/changes/stream", deprecated("/changes/stream", server.handleChangeStream)).Methods("GET")
+	router.HandleFunc("/api/ws", deprecated("/ws", server.handleWebSocket)).Methods("GET")
+	router.HandleFunc("/api/stats", deprecated("/stats", server.handleAPIStats)).Methods("GET")
+	router.HandleFunc("/api/config", deprecated("/config", server.adminOnly(server.handleAPIConfig))).Methods("GET")
+	router.HandleFunc("/api/mark-read", deprecated("/changes/read", server.handleMarkRead)).Methods("POST")
+	router.HandleFunc("/api/mark-all-read", deprecated("/changes/read-all", server.handleMarkAllRead)).Methods("POST")
+	router.HandleFunc("/api/save-now", deprecated("/save", server.adminOnly(server.handleSaveNow))).Methods("POST")
+	router.HandleFunc("/api/changes/{id}", deprecated("/changes/{id}", server.handleChangeDetail)).Methods("GET")
+	router.HandleFunc("/api/changes/{id}/manifest", deprecated("/changes/{id}/manifest", server.handleChangeManifest)).Methods("GET")
+	router.HandleFunc("/api/resources/{type}/{namespace}/{name}/at", deprecated("/resources/{type}/{namespace}/{name}/at", server.handleManifestAt)).Methods("GET")
+	router.HandleFunc("/api/resources/{type}/{namespace}/{name}/history", deprecated("/resources/{type}/{namespace}/{name}/history", server.handleObjectHistory)).Methods("GET")
+	router.HandleFunc("/api/state", deprecated("/state", server.handleAPIState)).Methods("GET")
+	router.HandleFunc("/api/history", deprecated("/history", server.handleAPIHistory)).Methods("GET")
+	router.HandleFunc("/api/rules", deprecated("/rules", server.handleAPIRules)).Methods("GET")
+	router.HandleFunc("/api/rules/reload", deprecated("/rules/reload", server.adminOnly(server.handleReloadRules))).Methods("POST")
+	router.HandleFunc("/api/debug", deprecated("/status", server.debugStatus)).Methods("GET")
 	router.HandleFunc("/health", server.healthCheck).Methods("GET")
 
 	// Serve static files (this must be last as it's a catch-all)
@@ -125,35 +204,21 @@ func main() {
 		fmt.Printf("🔗 Connected to Kubernetes cluster\n")
 	}
 	fmt.Printf("🌐 Open http://localhost:%s in your browser\n", port)
+
+	if cfg.GRPC.Enabled {
+		fmt.Printf("📡 gRPC API on port %d\n", cfg.GRPC.Port)
+		go func() {
+			if err := server.serveGRPC(); err != nil {
+				log.Fatalf("Error serving gRPC API: %s", err.Error())
+			}
+		}()
+	}
 	
 	log.Fatal(http.ListenAndServe(":"+port, router))
 }
 
 func (s *Server) debugStatus(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	status := map[string]interface{}{
-		"status":    "healthy",
-		"version":   Version,
-		"buildDate": BuildDate,
-		"gitCommit": GitCommit,
-	}
-	
-	if s.monitor != nil {
-		stats := s.monitor.GetStats()
-		status["monitoring"] = map[string]interface{}{
-			"active":       true,
-			"totalChanges": stats["totalChanges"],
-			"uptime":      stats["uptime"],
-		}
-	} else {
-		status["monitoring"] = map[string]interface{}{
-			"active": false,
-			"error":  "Kubernetes client not available",
-		}
-	}
-	
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(status)
+	writeJSON(w, http.StatusOK, s.status(r.Context()))
 }
 
 func (s *Server) healthCheck(w http.ResponseWriter, r *http.Request) {
@@ -162,39 +227,232 @@ func (s *Server) healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"status":"healthy"}`))
 }
 
+// handleAPIChanges returns the changes held in memory, filtered, sorted and
+// paged. The body stays a plain array, X-Total-Count holds the number of
+// matches on all pages and X-Next-Cursor the cursor of the next page.
 func (s *Server) handleAPIChanges(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	page, err := s.pageChanges(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.Next != 0 {
+		w.Header().Set("X-Next-Cursor", strconv.FormatUint(page.Next, 10))
+	}
+	json.NewEncoder(w).Encode(page.Changes)
+}
+
+// pageChanges returns the page of changes selected by the filter, sort,
+// cursor and limit query parameters
+func (s *Server) pageChanges(r *http.Request) (monitor.ChangePage, error) {
+	filter, err := parseChangeFilter(r, "since", "until")
+	if err != nil {
+		return monitor.ChangePage{}, err
+	}
+	query := r.URL.Query()
+	newestFirst := false
+	switch query.Get("sort") {
+	case "", "oldest":
+	case "newest":
+		newestFirst = true
+	default:
+		return monitor.ChangePage{}, fmt.Errorf("Invalid sort, expected newest or oldest")
+	}
+	var cursor uint64
+	if value := query.Get("cursor"); value != "" {
+		if cursor, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return monitor.ChangePage{}, fmt.Errorf("Invalid cursor")
+		}
+	}
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			return monitor.ChangePage{}, fmt.Errorf("Invalid limit")
+		}
+	}
+	return s.monitor.PageChanges(filter, newestFirst, cursor, limit), nil
+}
+
+// streamHeartbeat is how often an idle event stream sends a comment so
+// proxies keep the connection open
+const streamHeartbeat = 15 * time.Second
+
+// handleChangeStream pushes new changes, read updates and stats deltas as
+// server-sent events. It takes the filters of /api/changes and resumes after
+// the Last-Event-ID header or lastEventId parameter.
+func (s *Server) handleChangeStream(w http.ResponseWriter, r *http.Request) {
 	if s.monitor == nil {
-		http.Error(w, "Monitor not available", http.StatusServiceUnavailable)
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
 		return
 	}
-	changes := s.monitor.GetChanges()
-	json.NewEncoder(w).Encode(changes)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, r, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	filter, err := parseChangeFilter(r, "since", "until")
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var lastEventID uint64
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("lastEventId")
+	}
+	if value != "" {
+		if lastEventID, err = strconv.ParseUint(value, 10, 64); err != nil {
+			httpError(w, r, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub := s.monitor.Subscribe(filter, lastEventID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				// Too slow or shutting down, the client reconnects and resumes
+				return
+			}
+			data, err := json.Marshal(streamPayload(event))
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// streamPayload is the data of a stream event: the change, the stats delta
+// or the read update
+func streamPayload(event monitor.StreamEvent) interface{} {
+	switch event.Type {
+	case monitor.StreamChange, monitor.StreamAck:
+		return event.Change
+	case monitor.StreamStats:
+		return event.Stats
+	}
+	return event
+}
+
+// parseChangeFilter reads the filter query parameters shared by the change
+// endpoints, the time range comes from the fromKey and toKey parameters
+func parseChangeFilter(r *http.Request, fromKey, toKey string) (monitor.ChangeFilter, error) {
+	filter, err := changeFilterFromQuery(r.URL.Query(), fromKey, toKey)
+	forCaller(r.Context(), &filter)
+	return filter, err
+}
+
+// changeFilterFromQuery is parseChangeFilter for parameters that do not come
+// from a URL, like WebSocket subscriptions
+func changeFilterFromQuery(query url.Values, fromKey, toKey string) (monitor.ChangeFilter, error) {
+	filter := monitor.ChangeFilter{
+		ResourceTypes:      parseList(query, "resourceType"),
+		Namespaces:         parseList(query, "namespace"),
+		Name:               query.Get("name"),
+		EventTypes:         parseList(query, "eventType"),
+		Severities:         parseSeverities(query),
+		UnreadOnly:         query.Get("unread") == "true" || query.Get("read") == "false",
+		ReadOnly:           query.Get("read") == "true",
+		UnacknowledgedOnly: query.Get("acknowledged") == "false",
+		AcknowledgedOnly:   query.Get("acknowledged") == "true",
+	}
+	for i, namespace := range filter.Namespaces {
+		if namespace == clusterScopedNamespace {
+			filter.Namespaces[i] = ""
+		}
+	}
+	for key, target := range map[string]*time.Time{fromKey: &filter.From, toKey: &filter.To} {
+		if value := query.Get(key); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("Invalid %s, expected RFC3339", key)
+			}
+			*target = parsed
+		}
+	}
+	return filter, nil
 }
 
 func (s *Server) handleAPIStats(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if s.monitor == nil {
-		http.Error(w, "Monitor not available", http.StatusServiceUnavailable)
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
 		return
 	}
-	stats := s.monitor.GetStats()
+	filter := monitor.ChangeFilter{Severities: parseSeverities(r.URL.Query())}
+	forCaller(r.Context(), &filter)
+	stats := s.monitor.GetStatsFiltered(filter)
 	json.NewEncoder(w).Encode(stats)
 }
 
+// parseSeverities reads the comma separated severity query parameter
+func parseSeverities(query url.Values) []string {
+	severities := parseList(query, "severity")
+	for i := range severities {
+		severities[i] = strings.ToLower(severities[i])
+	}
+	return severities
+}
+
+// parseList collects a query parameter that may be repeated or comma separated
+func parseList(query url.Values, key string) []string {
+	var values []string
+	for _, value := range query[key] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+	return values
+}
+
+// handleAPIConfig returns the active configuration without secrets
 func (s *Server) handleAPIConfig(w http.ResponseWriter, r *http.Request) {
+	s.configMutex.Lock()
+	redacted := s.config.Redacted()
+	s.configMutex.Unlock()
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(s.config)
+	json.NewEncoder(w).Encode(redacted)
 }
 
 func (s *Server) handleMarkRead(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	if s.monitor == nil {
-		http.Error(w, "Monitor not available", http.StatusServiceUnavailable)
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
 		return
 	}
 
@@ -203,11 +461,11 @@ func (s *Server) handleMarkRead(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		httpError(w, r, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	success := s.monitor.MarkAsRead(req.ID)
+	success := s.markRead(r.Context(), req.ID)
 	
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]interface{}{
@@ -218,16 +476,16 @@ func (s *Server) handleMarkRead(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleMarkAllRead(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	if s.monitor == nil {
-		http.Error(w, "Monitor not available", http.StatusServiceUnavailable)
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
 		return
 	}
 
-	count := s.monitor.MarkAllAsRead()
+	count := s.markAllRead(r.Context())
 	
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]interface{}{
@@ -239,12 +497,12 @@ func (s *Server) handleMarkAllRead(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleSaveNow(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	if s.monitor == nil {
-		http.Error(w, "Monitor not available", http.StatusServiceUnavailable)
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
 		return
 	}
 
@@ -260,4 +518,308 @@ func (s *Server) handleSaveNow(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	json.NewEncoder(w).Encode(response)
-}
\ No newline at end of file
+}
+
+func (s *Server) handleAPIRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	json.NewEncoder(w).Encode(s.monitor.GetRules())
+}
+
+func (s *Server) handleReloadRules(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	count, err := s.reloadRules()
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{
+		"success": err == nil,
+		"count":   count,
+	}
+
+	if err != nil {
+		response["error"] = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// reloadRules re-reads the configuration file and swaps in its rules
+func (s *Server) reloadRules() (int, error) {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.monitor.ReloadRules(cfg.Rules); err != nil {
+		return 0, err
+	}
+	return len(cfg.Rules), nil
+}
+
+func (s *Server) reloadRulesOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		if count, err := s.reloadRules(); err != nil {
+			log.Printf("Error reloading rules: %v", err)
+		} else {
+			log.Printf("Reloaded %d rules", count)
+		}
+	}
+}
+
+func (s *Server) handleChangeManifest(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	changeID := mux.Vars(r)["id"]
+	change, ok := s.monitor.GetChange(changeID)
+	if ok && !canSee(r.Context(), change.ResourceType, change.Namespace) {
+		httpError(w, r, monitor.ErrChangeNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		version = monitor.VersionAfter
+		if ok && change.EventType == "DELETED" {
+			version = monitor.VersionBefore
+		}
+	}
+
+	content, err := s.monitor.GetManifest(changeID, version)
+	if err != nil {
+		httpError(w, r, err.Error(), manifestErrorStatus(err))
+		return
+	}
+	writeManifest(w, r, content)
+}
+
+func (s *Server) handleManifestAt(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	if namespace == clusterScopedNamespace {
+		namespace = ""
+	}
+
+	at := time.Now()
+	if value := r.URL.Query().Get("time"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			httpError(w, r, "Invalid time, expected RFC3339", http.StatusBadRequest)
+			return
+		}
+		at = parsed
+	}
+
+	if !canSee(r.Context(), vars["type"], namespace) {
+		httpError(w, r, monitor.ErrObjectNotFound.Error(), manifestErrorStatus(monitor.ErrObjectNotFound))
+		return
+	}
+	content, change, err := s.monitor.GetManifestAt(vars["type"], namespace, vars["name"], at)
+	if err != nil {
+		// Besides a missing object only reading the history can fail
+		status := http.StatusInternalServerError
+		if manifestErrorStatus(err) == http.StatusNotFound {
+			status = http.StatusNotFound
+		}
+		httpError(w, r, err.Error(), status)
+		return
+	}
+	w.Header().Set("X-Change-Id", change.ID)
+	w.Header().Set("X-Change-Timestamp", change.Timestamp.Format(time.RFC3339))
+	writeManifest(w, r, content)
+}
+
+func (s *Server) handleAPIState(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	at := time.Now()
+	if value := query.Get("time"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			httpError(w, r, "Invalid time, expected RFC3339", http.StatusBadRequest)
+			return
+		}
+		at = parsed
+	}
+
+	states, err := s.monitor.StateAt(at, query.Get("namespace"), query.Get("resourceType"))
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if visibility(r.Context()) != nil {
+		visible := []monitor.ObjectState{}
+		for _, state := range states {
+			if canSee(r.Context(), state.ResourceType, state.Namespace) {
+				visible = append(visible, state)
+			}
+		}
+		states = visible
+	}
+
+	if query.Get("format") == "yaml" {
+		w.Header().Set("Content-Type", "application/yaml")
+		if err := writeStateYAML(w, states); err != nil {
+			log.Printf("Error writing state: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StateResponse{Time: at, Objects: states})
+}
+
+func (s *Server) handleAPIHistory(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	filter, err := parseHistoryFilter(r, 1000)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	changes, err := s.monitor.QueryHistory(filter)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if changes == nil {
+		changes = []monitor.Change{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+// parseHistoryFilter reads the filter of the stored history endpoints, the
+// time range comes from the from and to parameters
+func parseHistoryFilter(r *http.Request, defaultLimit int) (monitor.ChangeFilter, error) {
+	filter, err := parseChangeFilter(r, "from", "to")
+	if err != nil {
+		return filter, err
+	}
+	filter.Limit = defaultLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return filter, fmt.Errorf("Invalid limit")
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+// clusterScopedNamespace stands in for the empty namespace of cluster-scoped
+// resources in URL paths
+const clusterScopedNamespace = "_"
+
+// handleChangeDetail returns a change with its diff, the previous and next
+// changes to the same object, its owners and related core Events
+func (s *Server) handleChangeDetail(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	detail, err := s.monitor.GetChangeDetail(mux.Vars(r)["id"])
+	if err == nil && !canSee(r.Context(), detail.Change.ResourceType, detail.Change.Namespace) {
+		err = monitor.ErrChangeNotFound
+	}
+	if err == monitor.ErrChangeNotFound {
+		httpError(w, r, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user := requestUser(r.Context())
+	detail.Change = s.monitor.ViewAs(user, detail.Change)
+	for _, neighbour := range []*monitor.Change{detail.Previous, detail.Next} {
+		if neighbour != nil {
+			*neighbour = s.monitor.ViewAs(user, *neighbour)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// handleObjectHistory returns the timeline of stored changes to one object,
+// oldest first, optionally limited to a time range and the newest limit
+func (s *Server) handleObjectHistory(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	vars := mux.Vars(r)
+	namespace := vars["namespace"]
+	if namespace == clusterScopedNamespace {
+		namespace = ""
+	}
+	filter, err := parseHistoryFilter(r, 0)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	changes, err := s.monitor.ObjectHistory(vars["type"], namespace, vars["name"], filter)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if changes == nil {
+		changes = []monitor.Change{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+func manifestErrorStatus(err error) int {
+	switch err {
+	case monitor.ErrChangeNotFound, monitor.ErrSnapshotNotFound, monitor.ErrObjectNotFound:
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// writeManifest writes an object as YAML, or as JSON with ?format=json
+func writeManifest(w http.ResponseWriter, r *http.Request, content map[string]interface{}) {
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(content)
+		return
+	}
+
+	data, err := yaml.Marshal(content)
+	if err != nil {
+		httpError(w, r, "Failed to render manifest", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"k8s-monitor/pkg/config"
+	"k8s-monitor/pkg/monitor"
+)
+
+// ResourcesRequest is the body of a bulk resource update. Resources that are
+// not listed keep their configuration.
+type ResourcesRequest struct {
+	Resources []config.ResourceConfig `json:"resources"`
+}
+
+// ResourcesResponse lists the resources an update changed and the resulting
+// configuration of all resources. Saved is false when the change is applied
+// but could not be written to the configuration file, it then lasts until the
+// monitor restarts.
+type ResourcesResponse struct {
+	Updated   []monitor.ResourceUpdate `json:"updated"`
+	Resources []config.ResourceConfig  `json:"resources"`
+	Saved     bool                     `json:"saved"`
+	SaveError string                   `json:"saveError,omitempty"`
+}
+
+// AuditResponse lists audit entries, oldest first
+type AuditResponse struct {
+	Entries []monitor.AuditEntry `json:"entries"`
+}
+
+// handleV1UpdateResource replaces the configuration of one resource
+func (s *Server) handleV1UpdateResource(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !monitor.IsSupportedResource(name) {
+		httpError(w, r, fmt.Sprintf("Unknown resource %q", name), http.StatusNotFound)
+		return
+	}
+	var resource config.ResourceConfig
+	if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+		httpError(w, r, "Invalid request body, expected a resource configuration", http.StatusBadRequest)
+		return
+	}
+	if resource.Name != "" && resource.Name != name {
+		httpError(w, r, "Resource name does not match the path", http.StatusBadRequest)
+		return
+	}
+	resource.Name = name
+	s.updateResources(w, r, []config.ResourceConfig{resource})
+}
+
+// handleV1UpdateResources replaces the configuration of several resources at
+// once, none is changed when one of them is invalid
+func (s *Server) handleV1UpdateResources(w http.ResponseWriter, r *http.Request) {
+	var request ResourcesRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Resources) == 0 {
+		httpError(w, r, "Invalid request body, expected {\"resources\": [...]}", http.StatusBadRequest)
+		return
+	}
+	s.updateResources(w, r, request.Resources)
+}
+
+// updateResources applies resource configurations to the running watchers,
+// saves them to the configuration file and records an audit entry for every
+// resource that changed. A failed save is reported in the response, the
+// watchers keep the new configuration.
+func (s *Server) updateResources(w http.ResponseWriter, r *http.Request, resources []config.ResourceConfig) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+
+	updates, err := s.monitor.UpdateResources(resources)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	current := s.monitor.GetConfig().Resources
+
+	response := ResourcesResponse{Updated: updates, Resources: current, Saved: true}
+	if len(updates) > 0 {
+		if err := config.SaveResources(configPath, current); err != nil {
+			// A read-only file, e.g. a mounted ConfigMap, does not undo the change
+			log.Printf("Warning: Resource configuration applied but not saved: %v", err)
+			response.Saved = false
+			response.SaveError = err.Error()
+		}
+	}
+
+	for _, update := range updates {
+		var before interface{}
+		if update.Before != nil {
+			before = update.Before
+		}
+		if err := s.monitor.RecordAudit(requestActor(r), "resource.update", "resources/"+update.After.Name, before, update.After); err != nil {
+			log.Printf("Warning: Could not write audit entry: %v", err)
+		}
+	}
+
+	if response.Updated == nil {
+		response.Updated = []monitor.ResourceUpdate{}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleV1Audit(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	limit := 0
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			httpError(w, r, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, AuditResponse{Entries: s.monitor.AuditEntries(limit)})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s-monitor/pkg/config"
+	"k8s-monitor/pkg/monitor"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newStreamServer returns a server whose monitor loaded the changes c0 to c3
+// stored by a previous run
+func newStreamServer(t *testing.T) (*Server, *monitor.K8sMonitor) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg, err := config.LoadConfig(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Persistence.FilePath = filepath.Join(dir, "changes.json")
+
+	previous, err := monitor.NewK8sMonitor(fake.NewSimpleClientset(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []monitor.Change
+	for i := 0; i < 4; i++ {
+		changes = append(changes, monitor.Change{
+			ID:           fmt.Sprintf("c%d", i),
+			Timestamp:    time.Now().Add(time.Duration(i-10) * time.Minute),
+			EventType:    "ADDED",
+			ResourceType: "pods",
+			Namespace:    "default",
+			Name:         fmt.Sprintf("web-%d", i),
+			Severity:     monitor.SeverityInfo,
+		})
+	}
+	if _, _, err := previous.ImportChanges(changes); err != nil {
+		t.Fatal(err)
+	}
+	previous.Stop()
+
+	m, err := monitor.NewK8sMonitor(fake.NewSimpleClientset(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Stop)
+	return &Server{monitor: m, config: cfg}, m
+}
+
+// sseEvent is one event read from an event stream
+type sseEvent struct {
+	id, event, data string
+}
+
+// openStream connects to the change stream and returns its events, the
+// stream is closed with the returned function
+func openStream(t *testing.T, url, lastEventID string) (<-chan sseEvent, func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("stream answered %s", response.Status)
+	}
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+		defer response.Body.Close()
+		var event sseEvent
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			case line == "" && event.event != "":
+				events <- event
+				event = sseEvent{}
+			}
+		}
+	}()
+	return events, cancel
+}
+
+// nextEvents reads count events, as "id:event"
+func nextEvents(t *testing.T, events <-chan sseEvent, count int) string {
+	t.Helper()
+	var got []string
+	for len(got) < count {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("stream ended after %v", got)
+			}
+			got = append(got, event.id+":"+event.event)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %v, want %d events", got, count)
+		}
+	}
+	return fmt.Sprint(got)
+}
+
+func TestChangeStreamResume(t *testing.T) {
+	s, m := newStreamServer(t)
+	server := httptest.NewServer(http.HandlerFunc(s.handleChangeStream))
+	defer server.Close()
+
+	events, closeStream := openStream(t, server.URL, "")
+	m.MarkAsRead("c0")
+	m.MarkAsRead("c1")
+	if got := nextEvents(t, events, 2); got != "[1:read 2:read]" {
+		t.Errorf("received %s, want [1:read 2:read]", got)
+	}
+	closeStream()
+
+	// Events published while the client is away are delivered on reconnect
+	if _, err := m.Acknowledge("c2", "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	m.MarkAsRead("c3")
+
+	tests := []struct {
+		name        string
+		url         string
+		lastEventID string
+		want        string
+	}{
+		{name: "Last-Event-ID header", url: server.URL, lastEventID: "2", want: "[3:ack 4:read]"},
+		{name: "lastEventId parameter", url: server.URL + "?lastEventId=3", want: "[4:read]"},
+		{name: "filters apply to missed events", url: server.URL + "?namespace=kube-system", lastEventID: "2", want: "[4:read]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, closeStream := openStream(t, test.url, test.lastEventID)
+			defer closeStream()
+			count := strings.Count(test.want, ":")
+			if got := nextEvents(t, events, count); got != test.want {
+				t.Errorf("received %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	response, err := http.Get(server.URL + "?lastEventId=latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid lastEventId answered %s, want 400", response.Status)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"k8s-monitor/pkg/monitor"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second    // time allowed to write one message
+	wsPongWait   = 60 * time.Second    // time allowed between pongs
+	wsPingPeriod = wsPongWait * 9 / 10 // must be shorter than wsPongWait
+	wsMaxMessage = 64 * 1024           // largest accepted client message
+)
+
+// wsRequest is a command sent by a client. ID is echoed in the reply.
+type wsRequest struct {
+	ID           string            `json:"id,omitempty"`
+	Type         string            `json:"type"` // subscribe, unsubscribe, markRead, markAllRead, acknowledge or ping
+	Subscription string            `json:"subscription,omitempty"`
+	Filter       map[string]string `json:"filter,omitempty"` // the /api/changes query parameters
+	LastEventID  uint64            `json:"lastEventId,omitempty"`
+	IDs          []string          `json:"ids,omitempty"`
+	Comment      string            `json:"comment,omitempty"` // acknowledge
+}
+
+// wsMessage is sent to the client: the reply to a command (ack or error),
+// a stream event of a subscription, or an overflow notice
+type wsMessage struct {
+	Type         string      `json:"type"`
+	ID           string      `json:"id,omitempty"`
+	Subscription string      `json:"subscription,omitempty"`
+	Event        string      `json:"event,omitempty"`
+	EventID      uint64      `json:"eventId,omitempty"`
+	LastEventID  uint64      `json:"lastEventId,omitempty"`
+	Data         interface{} `json:"data,omitempty"`
+	Error        string      `json:"error,omitempty"`
+}
+
+// wsClient is one WebSocket connection. Only the writer goroutine writes to
+// the connection, everything else queues messages on send.
+type wsClient struct {
+	server *Server
+	ctx    context.Context // identity and visibility of the connection
+	conn   *websocket.Conn
+	send   chan wsMessage
+	done   chan struct{}
+	once   sync.Once
+
+	mutex         sync.Mutex
+	subscriptions map[string]*monitor.Subscription
+	nextID        int
+}
+
+// handleWebSocket upgrades the connection and serves subscription and
+// mark-read commands on it
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if s.monitor == nil {
+		httpError(w, r, "Monitor not available", http.StatusServiceUnavailable)
+		return
+	}
+	if atomic.AddInt64(&s.websockets, 1) > int64(s.config.WebSocket.MaxConnections) {
+		atomic.AddInt64(&s.websockets, -1)
+		httpError(w, r, "Too many WebSocket connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer atomic.AddInt64(&s.websockets, -1)
+
+	upgrader := websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied
+		return
+	}
+
+	c := &wsClient{
+		server:        s,
+		ctx:           r.Context(),
+		conn:          conn,
+		send:          make(chan wsMessage, s.config.WebSocket.SendQueue),
+		done:          make(chan struct{}),
+		subscriptions: make(map[string]*monitor.Subscription),
+	}
+	go c.writeLoop()
+	c.readLoop()
+}
+
+// checkOrigin allows same-origin and non-browser clients, and cross-origin
+// clients from the configured origins
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	for _, allowed := range s.config.WebSocket.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// close closes the connection, code and reason are sent to the client first
+func (c *wsClient) close(code int, reason string) {
+	c.once.Do(func() {
+		close(c.done)
+		deadline := time.Now().Add(wsWriteWait)
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+		c.conn.Close()
+
+		c.mutex.Lock()
+		for name, sub := range c.subscriptions {
+			sub.Close()
+			delete(c.subscriptions, name)
+		}
+		c.mutex.Unlock()
+	})
+}
+
+// queue hands a command reply to the writer. A client that sends commands
+// without reading the replies is disconnected once the queue is full.
+func (c *wsClient) queue(message wsMessage) {
+	select {
+	case c.send <- message:
+	case <-c.done:
+	default:
+		if c.server.config.Logging.Enabled && c.server.config.Logging.LogOperations {
+			log.Printf("Closing WebSocket connection from %s: send queue full", c.conn.RemoteAddr())
+		}
+		c.close(websocket.CloseTryAgainLater, "client too slow")
+	}
+}
+
+// deliver waits for room in the queue, so a slow client holds up only its
+// subscription feeds until the monitor drops them
+func (c *wsClient) deliver(message wsMessage) {
+	select {
+	case c.send <- message:
+	case <-c.done:
+	}
+}
+
+func (c *wsClient) writeLoop() {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case message := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteJSON(message); err != nil {
+				c.close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				c.close(websocket.CloseGoingAway, "")
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wsClient) readLoop() {
+	defer c.close(websocket.CloseNormalClosure, "")
+
+	c.conn.SetReadLimit(wsMaxMessage)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+
+		var request wsRequest
+		if err := json.Unmarshal(data, &request); err != nil {
+			c.queue(wsMessage{Type: "error", Error: "Invalid message"})
+			continue
+		}
+
+		result, start, err := c.handle(request)
+		if err != nil {
+			c.queue(wsMessage{Type: "error", ID: request.ID, Error: err.Error()})
+			continue
+		}
+		c.queue(wsMessage{Type: "ack", ID: request.ID, Data: result})
+		if start != nil {
+			start()
+		}
+	}
+}
+
+// handle runs a command and returns the data of its acknowledgement, and for
+// subscriptions a function that starts the feed once the ack is queued
+func (c *wsClient) handle(request wsRequest) (interface{}, func(), error) {
+	switch request.Type {
+	case "subscribe":
+		return c.subscribe(request)
+	case "unsubscribe":
+		c.mutex.Lock()
+		sub, ok := c.subscriptions[request.Subscription]
+		delete(c.subscriptions, request.Subscription)
+		c.mutex.Unlock()
+		if !ok {
+			return nil, nil, fmt.Errorf("Unknown subscription %q", request.Subscription)
+		}
+		sub.Close()
+		return map[string]interface{}{"subscription": request.Subscription}, nil, nil
+	case "markRead":
+		if len(request.IDs) == 0 {
+			return nil, nil, fmt.Errorf("No change IDs given")
+		}
+		marked := []string{}
+		notFound := []string{}
+		for _, id := range request.IDs {
+			if c.server.markRead(c.ctx, id) {
+				marked = append(marked, id)
+			} else {
+				notFound = append(notFound, id)
+			}
+		}
+		return map[string]interface{}{"marked": marked, "notFound": notFound}, nil, nil
+	case "markAllRead":
+		return map[string]interface{}{"count": c.server.markAllRead(c.ctx)}, nil, nil
+	case "acknowledge":
+		if len(request.IDs) != 1 {
+			return nil, nil, fmt.Errorf("Expected one change ID")
+		}
+		comment := strings.TrimSpace(request.Comment)
+		if len(comment) > maxAckComment {
+			return nil, nil, fmt.Errorf("Comment is longer than %d characters", maxAckComment)
+		}
+		actor := requestUser(c.ctx)
+		if actor == "" {
+			actor = c.conn.RemoteAddr().String()
+		}
+		change, err := c.server.acknowledge(c.ctx, request.IDs[0], actor, comment)
+		if err == monitor.ErrAlreadyAcknowledged {
+			return nil, nil, fmt.Errorf("Change was already acknowledged by %s", change.Acknowledgement.User)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return change, nil, nil
+	case "ping":
+		return map[string]interface{}{"time": time.Now()}, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("Unknown command %q", request.Type)
+	}
+}
+
+// subscribe starts a filtered change feed named by the client, or numbered
+// when it gives no name
+func (c *wsClient) subscribe(request wsRequest) (interface{}, func(), error) {
+	query := url.Values{}
+	for key, value := range request.Filter {
+		query.Set(key, value)
+	}
+	filter, err := changeFilterFromQuery(query, "since", "until")
+	if err != nil {
+		return nil, nil, err
+	}
+	forCaller(c.ctx, &filter)
+
+	c.mutex.Lock()
+	select {
+	case <-c.done:
+		c.mutex.Unlock()
+		return nil, nil, fmt.Errorf("Connection closed")
+	default:
+	}
+	name := request.Subscription
+	if name == "" {
+		c.nextID++
+		name = strconv.Itoa(c.nextID)
+	}
+	if _, exists := c.subscriptions[name]; exists {
+		c.mutex.Unlock()
+		return nil, nil, fmt.Errorf("Subscription %q already exists", name)
+	}
+	sub := c.server.monitor.Subscribe(filter, request.LastEventID)
+	c.subscriptions[name] = sub
+	c.mutex.Unlock()
+
+	start := func() { go c.forward(name, sub, request.LastEventID) }
+	return map[string]interface{}{"subscription": name}, start, nil
+}
+
+// forward queues the events of a subscription. When the monitor drops the
+// subscription because the client fell behind, the client is told where to
+// resume with an overflow message.
+func (c *wsClient) forward(name string, sub *monitor.Subscription, lastEventID uint64) {
+	for event := range sub.C {
+		lastEventID = event.ID
+		c.deliver(wsMessage{
+			Type:         "event",
+			Subscription: name,
+			Event:        event.Type,
+			EventID:      event.ID,
+			Data:         streamPayload(event),
+		})
+	}
+
+	c.mutex.Lock()
+	dropped := c.subscriptions[name] == sub
+	if dropped {
+		delete(c.subscriptions, name)
+	}
+	c.mutex.Unlock()
+	if dropped {
+		c.deliver(wsMessage{Type: "overflow", Subscription: name, LastEventID: lastEventID})
+	}
+}
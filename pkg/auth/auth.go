@@ -0,0 +1,167 @@
+// Package auth authenticates API requests with static bearer tokens,
+// htpasswd basic auth, OIDC ID tokens or Kubernetes tokens, and authorizes
+// them against the cluster's RBAC
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s-monitor/pkg/config"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Authentication methods
+const (
+	MethodToken      = "token"
+	MethodBasic      = "basic"
+	MethodOIDC       = "oidc"
+	MethodKubernetes = "kubernetes"
+)
+
+var (
+	// ErrNoCredentials is returned for requests without credentials
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned for credentials no method accepts
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is the authenticated user of a request
+type Identity struct {
+	User   string              `json:"user"`
+	UID    string              `json:"uid,omitempty"`
+	Groups []string            `json:"groups,omitempty"`
+	Extra  map[string][]string `json:"extra,omitempty"`
+	Method string              `json:"method"` // token, basic, oidc or kubernetes
+}
+
+// Authenticator checks the credentials of requests against the configured
+// methods
+type Authenticator struct {
+	tokens   map[[sha256.Size]byte]Identity // keyed by the hash of the token
+	htpasswd *htpasswdFile
+	oidc     *oidcVerifier
+	kube     *tokenReviewer
+}
+
+// New creates an authenticator for the methods configured in cfg. The
+// clientset is only used for Kubernetes token reviews and may be nil when
+// they are not enabled.
+func New(cfg config.AuthConfig, client kubernetes.Interface) (*Authenticator, error) {
+	a := &Authenticator{tokens: make(map[[sha256.Size]byte]Identity)}
+
+	for i, token := range cfg.Tokens {
+		value := token.Token
+		if token.TokenEnv != "" {
+			value = os.Getenv(token.TokenEnv)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("token %d (%s) is empty", i, token.User)
+		}
+		if token.User == "" {
+			return nil, fmt.Errorf("token %d has no user", i)
+		}
+		a.tokens[sha256.Sum256([]byte(value))] = Identity{User: token.User, Groups: token.Groups, Method: MethodToken}
+	}
+
+	if cfg.HtpasswdFile != "" {
+		htpasswd, err := loadHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		a.htpasswd = htpasswd
+	}
+
+	if cfg.OIDC.IssuerURL != "" {
+		oidc, err := newOIDCVerifier(cfg.OIDC)
+		if err != nil {
+			return nil, err
+		}
+		a.oidc = oidc
+	}
+
+	if cfg.Kubernetes.Enabled {
+		if client == nil {
+			return nil, fmt.Errorf("Kubernetes authentication needs a connection to the cluster")
+		}
+		a.kube = newTokenReviewer(client, cfg.Kubernetes)
+	}
+
+	if len(a.tokens) == 0 && a.htpasswd == nil && a.oidc == nil && a.kube == nil {
+		return nil, fmt.Errorf("authentication is enabled but no method is configured")
+	}
+	return a, nil
+}
+
+// BasicEnabled reports whether users can log in with basic auth
+func (a *Authenticator) BasicEnabled() bool {
+	return a.htpasswd != nil
+}
+
+// Authenticate checks the value of an Authorization header
+func (a *Authenticator) Authenticate(ctx context.Context, authorization string) (*Identity, error) {
+	scheme, credentials, _ := strings.Cut(strings.TrimSpace(authorization), " ")
+	credentials = strings.TrimSpace(credentials)
+	if credentials == "" {
+		return nil, ErrNoCredentials
+	}
+
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		return a.authenticateBearer(ctx, credentials)
+	case "basic":
+		if a.htpasswd == nil {
+			return nil, ErrInvalidCredentials
+		}
+		user, password, ok := parseBasic(credentials)
+		if !ok || !a.htpasswd.verify(user, password) {
+			return nil, ErrInvalidCredentials
+		}
+		return &Identity{User: user, Method: MethodBasic}, nil
+	default:
+		return nil, ErrNoCredentials
+	}
+}
+
+// authenticateBearer accepts a static token, an OIDC ID token or a token the
+// cluster vouches for. Service account tokens are JWTs too, so a token the
+// OIDC issuer did not sign is still reviewed by the cluster.
+func (a *Authenticator) authenticateBearer(ctx context.Context, token string) (*Identity, error) {
+	if identity, ok := a.tokens[sha256.Sum256([]byte(token))]; ok {
+		return &identity, nil
+	}
+	var err error
+	if a.oidc != nil && strings.Count(token, ".") == 2 {
+		var identity *Identity
+		if identity, err = a.oidc.verify(ctx, token); err == nil {
+			return identity, nil
+		}
+	}
+	if a.kube != nil {
+		var identity *Identity
+		if identity, err = a.kube.review(ctx, token); err == nil {
+			return identity, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return nil, ErrInvalidCredentials
+}
+
+type contextKey struct{}
+
+// WithIdentity returns a context carrying the authenticated identity
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// FromContext returns the identity of an authenticated request
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(contextKey{}).(*Identity)
+	return identity, ok && identity != nil
+}
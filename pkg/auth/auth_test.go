@@ -0,0 +1,501 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"k8s-monitor/pkg/config"
+)
+
+func basic(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestAuthenticateTokens(t *testing.T) {
+	t.Setenv("TEST_TOKEN", "from-env")
+	authenticator, err := New(config.AuthConfig{
+		Tokens: []config.TokenConfig{
+			{User: "alice", Groups: []string{"ops"}, Token: "alice-token"},
+			{User: "bob", TokenEnv: "TEST_TOKEN"},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantUser      string
+		wantErr       error
+	}{
+		{name: "static token", authorization: "Bearer alice-token", wantUser: "alice"},
+		{name: "scheme is case insensitive", authorization: "bearer  alice-token ", wantUser: "alice"},
+		{name: "token from environment", authorization: "Bearer from-env", wantUser: "bob"},
+		{name: "unknown token", authorization: "Bearer guess", wantErr: ErrInvalidCredentials},
+		{name: "no header", authorization: "", wantErr: ErrNoCredentials},
+		{name: "scheme only", authorization: "Bearer", wantErr: ErrNoCredentials},
+		{name: "unknown scheme", authorization: "Digest alice-token", wantErr: ErrNoCredentials},
+		{name: "basic without htpasswd", authorization: basic("alice", "alice-token"), wantErr: ErrInvalidCredentials},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := authenticator.Authenticate(context.Background(), test.authorization)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, test.wantErr)
+			}
+			if err == nil && (identity.User != test.wantUser || identity.Method != MethodToken) {
+				t.Errorf("Authenticate() = %+v, want %s by token", identity, test.wantUser)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.AuthConfig
+		wantErr bool
+	}{
+		{name: "no method", cfg: config.AuthConfig{Enabled: true}, wantErr: true},
+		{name: "empty token", cfg: config.AuthConfig{Tokens: []config.TokenConfig{{User: "alice"}}}, wantErr: true},
+		{name: "token without user", cfg: config.AuthConfig{Tokens: []config.TokenConfig{{Token: "secret"}}}, wantErr: true},
+		{name: "missing htpasswd file", cfg: config.AuthConfig{HtpasswdFile: "/nonexistent/htpasswd"}, wantErr: true},
+		{name: "kubernetes without cluster", cfg: config.AuthConfig{Kubernetes: config.KubeAuthConfig{Enabled: true}}, wantErr: true},
+		{name: "token", cfg: config.AuthConfig{Tokens: []config.TokenConfig{{User: "alice", Token: "secret"}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := New(test.cfg, nil)
+			if (err != nil) != test.wantErr {
+				t.Errorf("New() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	content := "# users\n" +
+		"bcrypt:" + string(bcryptHash) + "\n" +
+		"apr1:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n" +
+		"\n" +
+		"sha:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authenticator, err := New(config.AuthConfig{HtpasswdFile: file}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantUser      string
+	}{
+		{name: "bcrypt", authorization: basic("bcrypt", "secret"), wantUser: "bcrypt"},
+		{name: "apr1", authorization: basic("apr1", "secret"), wantUser: "apr1"},
+		{name: "sha", authorization: basic("sha", "secret"), wantUser: "sha"},
+		{name: "wrong bcrypt password", authorization: basic("bcrypt", "guess")},
+		{name: "wrong apr1 password", authorization: basic("apr1", "guess")},
+		{name: "wrong sha password", authorization: basic("sha", "guess")},
+		{name: "unknown user", authorization: basic("mallory", "secret")},
+		{name: "not base64", authorization: "Basic !!!"},
+		{name: "no colon", authorization: "Basic " + base64.StdEncoding.EncodeToString([]byte("bcrypt"))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := authenticator.Authenticate(context.Background(), test.authorization)
+			if test.wantUser == "" {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Errorf("Authenticate() = %v, %v, want ErrInvalidCredentials", identity, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.User != test.wantUser || identity.Method != MethodBasic {
+				t.Errorf("Authenticate() = %+v, want %s by basic auth", identity, test.wantUser)
+			}
+		})
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	write := func(content string, modTime time.Time) {
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", now.Add(-time.Hour))
+	htpasswd, err := loadHtpasswd(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		content string
+		want    map[string]bool // user -> accepted with "secret"
+	}{
+		{name: "user added", content: "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nbob:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n", want: map[string]bool{"alice": true, "bob": true}},
+		{name: "user removed", content: "bob:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\n", want: map[string]bool{"alice": false, "bob": true}},
+		{name: "broken file keeps the users", content: "carol:plaintext\n", want: map[string]bool{"bob": true, "carol": false}},
+	}
+	for i, step := range steps {
+		write(step.content, now.Add(time.Duration(i-len(steps))*time.Minute))
+		for user, want := range step.want {
+			if got := htpasswd.verify(user, "secret"); got != want {
+				t.Errorf("%s: verify(%s) = %v, want %v", step.name, user, got, want)
+			}
+		}
+	}
+}
+
+// testIssuer signs ID tokens with an RSA key and EC keys on P-256 and P-384
+type testIssuer struct {
+	url      string
+	rsaKey   *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+	ec384Key *ecdsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T, url string) *testIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{url: url, rsaKey: rsaKey, ecKey: ecKey, ec384Key: ec384Key}
+}
+
+func encodeBigInt(value *big.Int, size int) string {
+	data := value.Bytes()
+	if len(data) < size {
+		data = append(make([]byte, size-len(data)), data...)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// jwks returns the public key set of the issuer. "rs256" is the RSA key
+// restricted to RS256, keys the monitor cannot use come last.
+func (i *testIssuer) jwks() []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encodeBigInt(i.rsaKey.N, 0), "e": encodeBigInt(big.NewInt(int64(i.rsaKey.E)), 0)},
+			{"kty": "RSA", "kid": "rs256", "alg": "RS256", "n": encodeBigInt(i.rsaKey.N, 0), "e": encodeBigInt(big.NewInt(int64(i.rsaKey.E)), 0)},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encodeBigInt(i.ecKey.X, 32), "y": encodeBigInt(i.ecKey.Y, 32)},
+			{"kty": "EC", "kid": "ec384", "crv": "P-384", "x": encodeBigInt(i.ec384Key.X, 48), "y": encodeBigInt(i.ec384Key.Y, 48)},
+			{"kty": "RSA", "kid": "encryption", "use": "enc", "n": "AQAB", "e": "AQAB"},
+			{"kty": "EC", "kid": "secp256k1", "crv": "secp256k1", "x": "AQAB", "y": "AQAB"},
+			{"kty": "OKP", "kid": "ed25519", "crv": "Ed25519", "x": "AQAB"},
+			{"kty": "EC", "kid": "off-curve", "crv": "P-256", "x": "AQAB", "y": "AQAB"},
+		},
+	})
+	return data
+}
+
+// sign returns a token with the given claims signed with alg, one of the RS,
+// PS and ES algorithms, and the key kid names. The key does not have to fit
+// the algorithm.
+func (i *testIssuer) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := crypto.SHA256
+	switch strings.TrimLeft(alg, "RSPE") {
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	digest := hash.New()
+	digest.Write([]byte(signed))
+	sum := digest.Sum(nil)
+	ecKey := i.ecKey
+	if kid == "ec384" {
+		ecKey = i.ec384Key
+	}
+
+	var signature []byte
+	var err error
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		signature, err = rsa.SignPKCS1v15(rand.Reader, i.rsaKey, hash, sum)
+	case strings.HasPrefix(alg, "PS"):
+		signature, err = rsa.SignPSS(rand.Reader, i.rsaKey, hash, sum, nil)
+	case strings.HasPrefix(alg, "ES"):
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, ecKey, sum)
+		if err == nil {
+			size := (ecKey.Curve.Params().BitSize + 7) / 8
+			signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		}
+	default:
+		signature = []byte("unsigned")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (i *testIssuer) claims(overrides map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":    i.url,
+		"aud":    []string{"monitor", "other"},
+		"sub":    "alice",
+		"groups": []string{"ops", "dev"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"iat":    time.Now().Unix(),
+	}
+	for key, value := range overrides {
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+	}
+	return claims
+}
+
+func TestOIDCLocalKeySet(t *testing.T) {
+	issuer := newTestIssuer(t, "https://issuer.example.com")
+	other := newTestIssuer(t, issuer.url)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, issuer.jwks(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authenticator, err := New(config.AuthConfig{OIDC: config.OIDCConfig{
+		IssuerURL:     issuer.url,
+		Audience:      "monitor",
+		JWKSFile:      jwksFile,
+		UsernameClaim: "sub",
+		GroupsClaim:   "groups",
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		token      string
+		wantUser   string
+		wantGroups string
+	}{
+		{name: "RS256", token: issuer.sign(t, "RS256", "rsa", issuer.claims(nil)), wantUser: issuer.url + "#alice", wantGroups: "[ops dev]"},
+		{name: "PS256", token: issuer.sign(t, "PS256", "rsa", issuer.claims(nil)), wantUser: issuer.url + "#alice", wantGroups: "[ops dev]"},
+		{name: "ES256", token: issuer.sign(t, "ES256", "ec", issuer.claims(nil)), wantUser: issuer.url + "#alice", wantGroups: "[ops dev]"},
+		{name: "ES384", token: issuer.sign(t, "ES384", "ec384", issuer.claims(nil)), wantUser: issuer.url + "#alice", wantGroups: "[ops dev]"},
+		{name: "RS384", token: issuer.sign(t, "RS384", "rsa", issuer.claims(nil)), wantUser: issuer.url + "#alice", wantGroups: "[ops dev]"},
+		{name: "algorithm the key is restricted to", token: issuer.sign(t, "RS256", "rs256", issuer.claims(nil)), wantUser: issuer.url + "#alice", wantGroups: "[ops dev]"},
+		{name: "single audience and group", token: issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"aud": "monitor", "groups": "ops"})), wantUser: issuer.url + "#alice", wantGroups: "[ops]"},
+		{name: "within clock skew", token: issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})), wantUser: issuer.url + "#alice", wantGroups: "[ops dev]"},
+		{name: "signed by another key", token: other.sign(t, "RS256", "rsa", issuer.claims(nil))},
+		{name: "unknown key ID", token: issuer.sign(t, "RS256", "rotated", issuer.claims(nil))},
+		{name: "key of another algorithm", token: issuer.sign(t, "ES256", "rsa", issuer.claims(nil))},
+		{name: "ES256 with a P-384 key", token: issuer.sign(t, "ES256", "ec384", issuer.claims(nil))},
+		{name: "ES384 with a P-256 key", token: issuer.sign(t, "ES384", "ec", issuer.claims(nil))},
+		{name: "algorithm the key is not restricted to", token: issuer.sign(t, "PS256", "rs256", issuer.claims(nil))},
+		{name: "unsupported key", token: issuer.sign(t, "ES256", "secp256k1", issuer.claims(nil))},
+		{name: "encryption key", token: issuer.sign(t, "RS256", "encryption", issuer.claims(nil))},
+		{name: "algorithm none", token: issuer.sign(t, "none", "rsa", issuer.claims(nil))},
+		{name: "other issuer", token: issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"iss": "https://evil.example.com"}))},
+		{name: "other audience", token: issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"aud": "dashboard"}))},
+		{name: "expired", token: issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}))},
+		{name: "no expiry", token: issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"exp": nil}))},
+		{name: "not valid yet", token: issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}))},
+		{name: "no username", token: issuer.sign(t, "RS256", "rsa", issuer.claims(map[string]interface{}{"sub": nil}))},
+		{name: "changed claims", token: func() string {
+			parts := strings.Split(issuer.sign(t, "RS256", "rsa", issuer.claims(nil)), ".")
+			forged, _ := json.Marshal(issuer.claims(map[string]interface{}{"sub": "admin"}))
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2]
+		}()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := authenticator.Authenticate(context.Background(), "Bearer "+test.token)
+			if test.wantUser == "" {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Errorf("Authenticate() = %v, %v, want ErrInvalidCredentials", identity, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.User != test.wantUser || identity.Method != MethodOIDC {
+				t.Errorf("Authenticate() = %+v, want %s by OIDC", identity, test.wantUser)
+			}
+			if groups := strings.Join(identity.Groups, " "); "["+groups+"]" != test.wantGroups {
+				t.Errorf("groups [%s], want %s", groups, test.wantGroups)
+			}
+		})
+	}
+}
+
+func TestOIDCUsernamePrefix(t *testing.T) {
+	issuer := newTestIssuer(t, "https://issuer.example.com")
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksFile, issuer.jwks(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		prefix   string
+		wantUser string
+	}{
+		{name: "issuer by default", wantUser: "https://issuer.example.com#alice"},
+		{name: "configured prefix", prefix: "oidc:", wantUser: "oidc:alice"},
+		{name: "no prefix", prefix: "-", wantUser: "alice"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authenticator, err := New(config.AuthConfig{
+				Tokens: []config.TokenConfig{{User: "alice", Token: "alice-token"}},
+				OIDC: config.OIDCConfig{
+					IssuerURL:      issuer.url,
+					JWKSFile:       jwksFile,
+					UsernameClaim:  "sub",
+					GroupsClaim:    "groups",
+					UsernamePrefix: test.prefix,
+				},
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			identity, err := authenticator.Authenticate(context.Background(), "Bearer "+issuer.sign(t, "RS256", "rsa", issuer.claims(nil)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.User != test.wantUser {
+				t.Errorf("Authenticate() user = %s, want %s", identity.User, test.wantUser)
+			}
+		})
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	issuer := newTestIssuer(t, "https://issuer.example.com")
+
+	tests := []struct {
+		name     string
+		jwks     string
+		wantKeys string
+		wantErr  bool
+	}{
+		{name: "unusable keys are skipped", jwks: string(issuer.jwks()), wantKeys: "[ec ec384 rs256 rsa]"},
+		{name: "EC key restricted to another curve's algorithm", jwks: `{"keys":[{"kty":"EC","kid":"ec","alg":"ES384","crv":"P-256","x":"` + encodeBigInt(issuer.ecKey.X, 32) + `","y":"` + encodeBigInt(issuer.ecKey.Y, 32) + `"}]}`, wantErr: true},
+		{name: "only unusable keys", jwks: `{"keys":[{"kty":"OKP","kid":"ed25519","crv":"Ed25519","x":"AQAB"}]}`, wantErr: true},
+		{name: "not a key set", jwks: `[]`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := parseJWKS([]byte(test.jwks))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseJWKS() error = %v, want error %v", err, test.wantErr)
+			}
+			var ids []string
+			for id := range keys {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			if err == nil && fmt.Sprint(ids) != test.wantKeys {
+				t.Errorf("parseJWKS() keys %v, want %s", ids, test.wantKeys)
+			}
+		})
+	}
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	var issuer *testIssuer
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.url, "jwks_uri": issuer.url + "/keys"})
+		case "/keys":
+			fetches++
+			w.Write(issuer.jwks())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	issuer = newTestIssuer(t, server.URL)
+
+	verifier, err := newOIDCVerifier(config.OIDCConfig{IssuerURL: server.URL, UsernameClaim: "sub", GroupsClaim: "groups"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := verifier.verify(ctx, issuer.sign(t, "ES256", "ec", issuer.claims(nil))); err != nil {
+		t.Fatalf("verify() error = %v", err)
+	}
+	if _, err := verifier.verify(ctx, issuer.sign(t, "RS256", "rsa", issuer.claims(nil))); err != nil {
+		t.Fatalf("verify() error = %v", err)
+	}
+	if fetches != 1 {
+		t.Errorf("key set fetched %d times, want once", fetches)
+	}
+
+	// An unknown key is looked up again, but not more than once a minute
+	if _, err := verifier.verify(ctx, issuer.sign(t, "RS256", "rotated", issuer.claims(nil))); err == nil {
+		t.Error("verify() accepted a token signed with an unknown key")
+	}
+	if fetches != 1 {
+		t.Errorf("key set fetched %d times within a minute, want once", fetches)
+	}
+	verifier.fetched = time.Now().Add(-2 * jwksMinRefresh)
+	if _, err := verifier.verify(ctx, issuer.sign(t, "RS256", "rotated", issuer.claims(nil))); err == nil {
+		t.Error("verify() accepted a token signed with an unknown key")
+	}
+	if fetches != 2 {
+		t.Errorf("key set fetched %d times, want a refresh for the unknown key", fetches)
+	}
+}
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdFile holds the users of an htpasswd file. The file is read again
+// when it changes, so users can be added without a restart.
+type htpasswdFile struct {
+	path    string
+	mutex   sync.Mutex
+	modTime time.Time
+	users   map[string]string // user -> password hash
+}
+
+func loadHtpasswd(path string) (*htpasswdFile, error) {
+	h := &htpasswdFile{path: path}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// load reads the file, lines are user:hash with bcrypt, apr1 or SHA hashes
+func (h *htpasswdFile) load() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %v", err)
+	}
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd file: %v", err)
+	}
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("invalid htpasswd entry on line %d", line)
+		}
+		if !supportedHash(hash) {
+			return fmt.Errorf("unsupported password hash for %s on line %d, use bcrypt, apr1 or SHA", user, line)
+		}
+		users[user] = hash
+	}
+
+	h.users = users
+	h.modTime = info.ModTime()
+	return nil
+}
+
+// refresh reloads the file when it was modified, keeping the old users when
+// the new file cannot be read
+func (h *htpasswdFile) refresh() {
+	info, err := os.Stat(h.path)
+	if err != nil || info.ModTime().Equal(h.modTime) {
+		return
+	}
+	if err := h.load(); err != nil {
+		log.Printf("Warning: Keeping previous htpasswd users: %v", err)
+		h.modTime = info.ModTime()
+	}
+}
+
+func (h *htpasswdFile) verify(user, password string) bool {
+	h.mutex.Lock()
+	h.refresh()
+	hash, ok := h.users[user]
+	h.mutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(hash[len("$apr1$"):], "$", 2)[0]
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+	default:
+		return false
+	}
+}
+
+func supportedHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2") || strings.HasPrefix(hash, "$apr1$") || strings.HasPrefix(hash, "{SHA}")
+}
+
+// parseBasic decodes basic auth credentials
+func parseBasic(credentials string) (string, string, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// apr1 computes Apache's MD5 based password hash, the default of htpasswd
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alternate := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(alternate[:])
+		} else {
+			h.Write(alternate[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 == 1 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	const alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var encoded strings.Builder
+	encode := func(value uint32, n int) {
+		for ; n > 0; n-- {
+			encoded.WriteByte(alphabet[value&0x3f])
+			value >>= 6
+		}
+	}
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[group[0]])<<16|uint32(final[group[1]])<<8|uint32(final[group[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return magic + salt + "$" + encoded.String()
+}
@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s-monitor/pkg/config"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Time allowed for one TokenReview or SubjectAccessReview
+	reviewTimeout = 5 * time.Second
+	// Failed reviews are retried after this long, a denial is cached for the full TTL
+	reviewErrorTTL = 5 * time.Second
+	// Rejected tokens are reviewed again after this long
+	tokenRejectTTL = 30 * time.Second
+	// Caches hold at most this many entries, expired ones are swept first and
+	// then arbitrary ones are evicted
+	reviewCacheSize = 10000
+)
+
+// tokenReviewer validates bearer tokens with the cluster's TokenReview API.
+// Accepted tokens are cached for the TTL, rejected ones for tokenRejectTTL
+// and failed reviews for reviewErrorTTL.
+type tokenReviewer struct {
+	client    kubernetes.Interface
+	audiences []string
+	ttl       time.Duration
+
+	mutex sync.Mutex
+	cache map[[sha256.Size]byte]cachedReview
+}
+
+type cachedReview struct {
+	identity Identity
+	err      error // why the token was not accepted
+	expires  time.Time
+}
+
+func newTokenReviewer(client kubernetes.Interface, cfg config.KubeAuthConfig) *tokenReviewer {
+	return &tokenReviewer{
+		client:    client,
+		audiences: cfg.Audiences,
+		ttl:       time.Duration(cfg.CacheTTL) * time.Second,
+		cache:     make(map[[sha256.Size]byte]cachedReview),
+	}
+}
+
+func (t *tokenReviewer) review(ctx context.Context, token string) (*Identity, error) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+	t.mutex.Lock()
+	cached, ok := t.cache[key]
+	t.mutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		if cached.err != nil {
+			return nil, cached.err
+		}
+		identity := cached.identity
+		return &identity, nil
+	}
+
+	entry, ttl := t.ask(ctx, token)
+	entry.expires = now.Add(ttl)
+
+	t.mutex.Lock()
+	if _, ok := t.cache[key]; !ok && len(t.cache) >= reviewCacheSize {
+		for key, entry := range t.cache {
+			if !now.Before(entry.expires) {
+				delete(t.cache, key)
+			}
+		}
+		for key := range t.cache {
+			if len(t.cache) < reviewCacheSize {
+				break
+			}
+			delete(t.cache, key)
+		}
+	}
+	t.cache[key] = entry
+	t.mutex.Unlock()
+
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	identity := entry.identity
+	return &identity, nil
+}
+
+// ask sends a TokenReview and returns its outcome with how long to cache it
+func (t *tokenReviewer) ask(ctx context.Context, token string) (cachedReview, time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, reviewTimeout)
+	defer cancel()
+	review := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: t.audiences},
+	}
+	result, err := t.client.AuthenticationV1().TokenReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return cachedReview{err: fmt.Errorf("failed to review token: %v", err)}, reviewErrorTTL
+	}
+	if !result.Status.Authenticated {
+		if result.Status.Error != "" {
+			return cachedReview{err: fmt.Errorf("token rejected: %s", result.Status.Error)}, tokenRejectTTL
+		}
+		return cachedReview{err: fmt.Errorf("token rejected")}, tokenRejectTTL
+	}
+
+	user := result.Status.User
+	identity := Identity{User: user.Username, UID: user.UID, Groups: user.Groups, Method: MethodKubernetes}
+	if len(user.Extra) > 0 {
+		identity.Extra = make(map[string][]string, len(user.Extra))
+		for key, values := range user.Extra {
+			identity.Extra[key] = values
+		}
+	}
+	return cachedReview{identity: identity}, t.ttl
+}
+
+// Authorizer decides with the cluster's SubjectAccessReview API whether a
+// user may get a resource type in a namespace. Decisions are cached per user,
+// namespace and resource type.
+type Authorizer struct {
+	client kubernetes.Interface
+	ttl    time.Duration
+
+	mutex     sync.Mutex
+	decisions map[decisionKey]decision
+}
+
+type decisionKey struct {
+	user      string // see subjectKey
+	verb      string
+	group     string
+	resource  string
+	namespace string
+}
+
+type decision struct {
+	allowed bool
+	expires time.Time
+}
+
+// NewAuthorizer creates an authorizer that caches decisions for ttl
+func NewAuthorizer(client kubernetes.Interface, ttl time.Duration) *Authorizer {
+	return &Authorizer{client: client, ttl: ttl, decisions: make(map[decisionKey]decision)}
+}
+
+// Allowed reports whether identity may get resources of the given API group
+// and type in namespace, an empty namespace asks about cluster-scoped
+// resources. Failed reviews deny access.
+func (a *Authorizer) Allowed(identity *Identity, group, resource, namespace string) bool {
+	return a.Can(identity, "get", group, resource, namespace)
+}
+
+// Can reports whether identity may use verb on resources of the given API
+// group and type in namespace. Failed reviews deny access.
+func (a *Authorizer) Can(identity *Identity, verb, group, resource, namespace string) bool {
+	if identity == nil {
+		return false
+	}
+	key := decisionKey{user: subjectKey(identity), verb: verb, group: group, resource: resource, namespace: namespace}
+	now := time.Now()
+	a.mutex.Lock()
+	cached, ok := a.decisions[key]
+	a.mutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.allowed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reviewTimeout)
+	defer cancel()
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   identity.User,
+			UID:    identity.UID,
+			Groups: identity.Groups,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      verb,
+				Group:     group,
+				Resource:  resource,
+			},
+		},
+	}
+	for key, values := range identity.Extra {
+		if review.Spec.Extra == nil {
+			review.Spec.Extra = make(map[string]authorizationv1.ExtraValue)
+		}
+		review.Spec.Extra[key] = values
+	}
+
+	allowed := false
+	ttl := a.ttl
+	result, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err == nil {
+		allowed = result.Status.Allowed && !result.Status.Denied
+	} else {
+		ttl = reviewErrorTTL
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, ok := a.decisions[key]; !ok && len(a.decisions) >= reviewCacheSize {
+		for key, entry := range a.decisions {
+			if !now.Before(entry.expires) {
+				delete(a.decisions, key)
+			}
+		}
+		for key := range a.decisions {
+			if len(a.decisions) < reviewCacheSize {
+				break
+			}
+			delete(a.decisions, key)
+		}
+	}
+	a.decisions[key] = decision{allowed: allowed, expires: now.Add(ttl)}
+	return allowed
+}
+
+// Decided returns the decision Allowed made about identity, resource and
+// namespace without asking the API server. Without a decision, or when it
+// expired, access is denied. It never blocks on the network, so it can be
+// used while holding locks after Allowed was called.
+func (a *Authorizer) Decided(identity *Identity, group, resource, namespace string) bool {
+	if identity == nil {
+		return false
+	}
+	key := decisionKey{user: subjectKey(identity), verb: "get", group: group, resource: resource, namespace: namespace}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	cached, ok := a.decisions[key]
+	return ok && time.Now().Before(cached.expires) && cached.allowed
+}
+
+// subjectKey identifies everything about a user that a review depends on
+func subjectKey(identity *Identity) string {
+	groups := append([]string(nil), identity.Groups...)
+	sort.Strings(groups)
+	parts := []string{identity.User, identity.UID, strings.Join(groups, "\x01")}
+	extra := make([]string, 0, len(identity.Extra))
+	for key, values := range identity.Extra {
+		extra = append(extra, key+"="+strings.Join(values, "\x01"))
+	}
+	sort.Strings(extra)
+	return strings.Join(append(parts, extra...), "\x00")
+}
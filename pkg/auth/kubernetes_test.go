@@ -0,0 +1,254 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"k8s-monitor/pkg/config"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// reviewTokens answers TokenReviews from users, keyed by token
+func reviewTokens(client *fake.Clientset, users map[string]authenticationv1.UserInfo, calls *int) {
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		*calls++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "unavailable" {
+			return true, nil, errors.New("connection refused")
+		}
+		if len(review.Spec.Audiences) != 1 || review.Spec.Audiences[0] != "monitor" {
+			return true, nil, fmt.Errorf("unexpected audiences %v", review.Spec.Audiences)
+		}
+		user, ok := users[review.Spec.Token]
+		review = review.DeepCopy()
+		review.Status = authenticationv1.TokenReviewStatus{Authenticated: ok, User: user}
+		if !ok {
+			review.Status.Error = "invalid bearer token"
+		}
+		return true, review, nil
+	})
+}
+
+func TestKubernetesTokenReview(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	calls := 0
+	reviewTokens(client, map[string]authenticationv1.UserInfo{
+		"sa-token": {
+			Username: "system:serviceaccount:monitoring:viewer",
+			UID:      "1234",
+			Groups:   []string{"system:serviceaccounts"},
+			Extra:    map[string]authenticationv1.ExtraValue{"authentication.kubernetes.io/pod-name": {"viewer-0"}},
+		},
+	}, &calls)
+	authenticator, err := New(config.AuthConfig{
+		Tokens:     []config.TokenConfig{{User: "alice", Token: "static-token"}},
+		Kubernetes: config.KubeAuthConfig{Enabled: true, Audiences: []string{"monitor"}, CacheTTL: 60},
+	}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		token     string
+		wantUser  string
+		wantCalls int // reviews made so far
+	}{
+		{name: "service account token", token: "sa-token", wantUser: "system:serviceaccount:monitoring:viewer", wantCalls: 1},
+		{name: "accepted token is cached", token: "sa-token", wantUser: "system:serviceaccount:monitoring:viewer", wantCalls: 1},
+		{name: "static token is not reviewed", token: "static-token", wantUser: "alice", wantCalls: 1},
+		{name: "rejected token", token: "guess", wantCalls: 2},
+		{name: "rejected token is cached", token: "guess", wantCalls: 2},
+		{name: "API server unavailable", token: "unavailable", wantCalls: 3},
+		{name: "failed review is cached", token: "unavailable", wantCalls: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := authenticator.Authenticate(context.Background(), "Bearer "+test.token)
+			if test.wantUser == "" {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Errorf("Authenticate() = %v, %v, want ErrInvalidCredentials", identity, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if identity.User != test.wantUser {
+				t.Errorf("Authenticate() user = %s, want %s", identity.User, test.wantUser)
+			}
+			if calls != test.wantCalls {
+				t.Errorf("%d token reviews, want %d", calls, test.wantCalls)
+			}
+		})
+	}
+
+	identity, err := authenticator.Authenticate(context.Background(), "Bearer sa-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Method != MethodKubernetes || identity.UID != "1234" || len(identity.Groups) != 1 || identity.Extra["authentication.kubernetes.io/pod-name"][0] != "viewer-0" {
+		t.Errorf("Authenticate() = %+v, want the reviewed user info", identity)
+	}
+
+	// A full cache evicts entries instead of growing
+	reviewer := authenticator.kube
+	reviewer.mutex.Lock()
+	for i := len(reviewer.cache); i < reviewCacheSize; i++ {
+		reviewer.cache[sha256.Sum256([]byte(fmt.Sprintf("filler-%d", i)))] = cachedReview{err: errors.New("token rejected"), expires: time.Now().Add(time.Hour)}
+	}
+	reviewer.mutex.Unlock()
+	if _, err := authenticator.Authenticate(context.Background(), "Bearer another-guess"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Authenticate() error = %v, want ErrInvalidCredentials", err)
+	}
+	if size := len(reviewer.cache); size != reviewCacheSize {
+		t.Errorf("cache holds %d entries, want %d", size, reviewCacheSize)
+	}
+}
+
+// reviewAccess answers SubjectAccessReviews with allow, recording every review
+func reviewAccess(client *fake.Clientset, allow func(spec authorizationv1.SubjectAccessReviewSpec) (bool, error), reviews *[]authorizationv1.SubjectAccessReviewSpec) {
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview).DeepCopy()
+		*reviews = append(*reviews, review.Spec)
+		allowed, err := allow(review.Spec)
+		if err != nil {
+			return true, nil, err
+		}
+		review.Status.Allowed = allowed
+		return true, review, nil
+	})
+}
+
+func TestAuthorizer(t *testing.T) {
+	alice := &Identity{User: "alice", Groups: []string{"dev", "ops"}, Extra: map[string][]string{"scopes": {"read"}}}
+	aliceReordered := &Identity{User: "alice", Groups: []string{"ops", "dev"}, Extra: map[string][]string{"scopes": {"read"}}}
+	aliceWithoutOps := &Identity{User: "alice", Groups: []string{"dev"}, Extra: map[string][]string{"scopes": {"read"}}}
+	failing := &Identity{User: "failing"}
+
+	// ops may get everything in kube-system, everyone may get pods in default
+	allow := func(spec authorizationv1.SubjectAccessReviewSpec) (bool, error) {
+		if spec.User == "failing" {
+			return false, errors.New("connection refused")
+		}
+		attributes := spec.ResourceAttributes
+		if attributes.Verb == "update" {
+			return attributes.Resource == "configmaps" && containsGroup(spec.Groups, "ops"), nil
+		}
+		if attributes.Namespace == "kube-system" {
+			return containsGroup(spec.Groups, "ops"), nil
+		}
+		return attributes.Namespace == "default" && attributes.Group == "" && attributes.Resource == "pods", nil
+	}
+
+	tests := []struct {
+		name        string
+		identity    *Identity
+		verb        string
+		group       string
+		resource    string
+		namespace   string
+		want        bool
+		wantReviews int // reviews made so far
+	}{
+		{name: "allowed", identity: alice, verb: "get", resource: "pods", namespace: "default", want: true, wantReviews: 1},
+		{name: "decision is cached", identity: alice, verb: "get", resource: "pods", namespace: "default", want: true, wantReviews: 1},
+		{name: "group order does not matter", identity: aliceReordered, verb: "get", resource: "pods", namespace: "default", want: true, wantReviews: 1},
+		{name: "denied", identity: alice, verb: "get", resource: "secrets", namespace: "default", want: false, wantReviews: 2},
+		{name: "by group", identity: alice, verb: "get", resource: "secrets", namespace: "kube-system", want: true, wantReviews: 3},
+		{name: "other groups are asked again", identity: aliceWithoutOps, verb: "get", resource: "secrets", namespace: "kube-system", want: false, wantReviews: 4},
+		{name: "API group is part of the decision", identity: alice, verb: "get", group: "apps", resource: "pods", namespace: "default", want: false, wantReviews: 5},
+		{name: "other verb", identity: alice, verb: "update", resource: "configmaps", namespace: "default", want: true, wantReviews: 6},
+		{name: "other verb denied", identity: aliceWithoutOps, verb: "update", resource: "configmaps", namespace: "default", want: false, wantReviews: 7},
+		{name: "failed review denies", identity: failing, verb: "get", resource: "pods", namespace: "default", want: false, wantReviews: 8},
+		{name: "no identity", identity: nil, verb: "get", resource: "pods", namespace: "default", want: false, wantReviews: 8},
+	}
+
+	client := fake.NewSimpleClientset()
+	var reviews []authorizationv1.SubjectAccessReviewSpec
+	reviewAccess(client, allow, &reviews)
+	authorizer := NewAuthorizer(client, time.Minute)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := authorizer.Can(test.identity, test.verb, test.group, test.resource, test.namespace); got != test.want {
+				t.Errorf("Can() = %v, want %v", got, test.want)
+			}
+			if len(reviews) != test.wantReviews {
+				t.Fatalf("%d reviews, want %d", len(reviews), test.wantReviews)
+			}
+			if test.identity == nil {
+				return
+			}
+			spec := reviews[len(reviews)-1]
+			if spec.User != test.identity.User || len(spec.Extra) != len(test.identity.Extra) {
+				t.Errorf("review for %+v, want the identity's user and extra", spec)
+			}
+		})
+	}
+}
+
+func TestAuthorizerExpiry(t *testing.T) {
+	alice := &Identity{User: "alice"}
+	allowed := true
+	client := fake.NewSimpleClientset()
+	var reviews []authorizationv1.SubjectAccessReviewSpec
+	reviewAccess(client, func(authorizationv1.SubjectAccessReviewSpec) (bool, error) {
+		if !allowed {
+			return false, errors.New("connection refused")
+		}
+		return true, nil
+	}, &reviews)
+	authorizer := NewAuthorizer(client, time.Minute)
+
+	if authorizer.Decided(alice, "", "pods", "default") {
+		t.Error("Decided() allowed before any review")
+	}
+	if !authorizer.Allowed(alice, "", "pods", "default") || !authorizer.Decided(alice, "", "pods", "default") {
+		t.Fatal("Allowed() or Decided() denied a permitted user")
+	}
+	if authorizer.Decided(alice, "", "pods", "kube-system") {
+		t.Error("Decided() allowed a namespace that was never reviewed")
+	}
+
+	// An expired decision is reviewed again, a failed review denies and is
+	// retried sooner than a decision expires
+	expire := func() {
+		authorizer.mutex.Lock()
+		for key, entry := range authorizer.decisions {
+			entry.expires = time.Now().Add(-time.Second)
+			authorizer.decisions[key] = entry
+		}
+		authorizer.mutex.Unlock()
+	}
+	expire()
+	if authorizer.Decided(alice, "", "pods", "default") {
+		t.Error("Decided() allowed an expired decision")
+	}
+	allowed = false
+	if authorizer.Allowed(alice, "", "pods", "default") {
+		t.Error("Allowed() granted access when the review failed")
+	}
+	if len(reviews) != 2 {
+		t.Errorf("%d reviews, want 2", len(reviews))
+	}
+	key := decisionKey{user: subjectKey(alice), verb: "get", resource: "pods", namespace: "default"}
+	if ttl := time.Until(authorizer.decisions[key].expires); ttl > reviewErrorTTL {
+		t.Errorf("failed review cached for %v, want at most %v", ttl, reviewErrorTTL)
+	}
+}
+
+func containsGroup(groups []string, group string) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,402 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // hashes of the supported JWT algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s-monitor/pkg/config"
+)
+
+const (
+	// Fetched key sets are used for this long before they are fetched again
+	jwksMaxAge = time.Hour
+	// A token signed with an unknown key triggers at most one fetch per interval
+	jwksMinRefresh = time.Minute
+	// Allowed difference between our clock and the issuer's
+	clockSkew = time.Minute
+	// Time allowed for discovery and key set requests
+	oidcTimeout = 10 * time.Second
+)
+
+// oidcVerifier verifies ID tokens signed by the configured issuer
+type oidcVerifier struct {
+	cfg    config.OIDCConfig
+	client *http.Client
+	static bool   // keys come from JWKSFile and are never fetched
+	prefix string // put before user names
+
+	mutex   sync.Mutex
+	jwksURL string
+	keys    map[string]signingKey // key ID -> key
+	fetched time.Time
+}
+
+func newOIDCVerifier(cfg config.OIDCConfig) (*oidcVerifier, error) {
+	v := &oidcVerifier{cfg: cfg, client: &http.Client{Timeout: oidcTimeout}, jwksURL: cfg.JWKSURL}
+	switch cfg.UsernamePrefix {
+	case "":
+		v.prefix = cfg.IssuerURL + "#"
+	case "-":
+	default:
+		v.prefix = cfg.UsernamePrefix
+	}
+	if cfg.JWKSFile != "" {
+		data, err := os.ReadFile(cfg.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWKS file: %v", err)
+		}
+		keys, err := parseJWKS(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JWKS file: %v", err)
+		}
+		v.keys = keys
+		v.static = true
+	}
+	return v, nil
+}
+
+// signingKey is a verification key of the issuer
+type signingKey struct {
+	key crypto.PublicKey
+	alg string // the only algorithm the key may be used with, any that fits the key when empty
+}
+
+// jwtHeader is the JOSE header of a token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks the signature and claims of a token and returns its identity
+func (v *oidcVerifier) verify(ctx context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	return v.checkClaims(claims, time.Now())
+}
+
+// checkClaims validates issuer, audience and lifetime and reads the identity
+func (v *oidcVerifier) checkClaims(claims map[string]interface{}, now time.Time) (*Identity, error) {
+	if issuer, _ := claims["iss"].(string); issuer != v.cfg.IssuerURL {
+		return nil, fmt.Errorf("token issued by %q", issuer)
+	}
+	if v.cfg.Audience != "" && !hasAudience(claims["aud"], v.cfg.Audience) {
+		return nil, fmt.Errorf("token not issued for %q", v.cfg.Audience)
+	}
+	expires, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if now.Add(-clockSkew).After(time.Unix(int64(expires), 0)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if notBefore, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(notBefore), 0)) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+
+	user, _ := claims[v.cfg.UsernameClaim].(string)
+	if user == "" {
+		return nil, fmt.Errorf("token has no %s claim", v.cfg.UsernameClaim)
+	}
+	identity := &Identity{User: v.prefix + user, Method: MethodOIDC}
+	switch groups := claims[v.cfg.GroupsClaim].(type) {
+	case string:
+		identity.Groups = []string{groups}
+	case []interface{}:
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	}
+	return identity, nil
+}
+
+func hasAudience(claim interface{}, audience string) bool {
+	switch value := claim.(type) {
+	case string:
+		return value == audience
+	case []interface{}:
+		for _, entry := range value {
+			if entry == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the verification key with the given ID, fetching the key set
+// when it is old or does not have the key
+func (v *oidcVerifier) key(ctx context.Context, kid string) (signingKey, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if !v.static {
+		age := time.Since(v.fetched)
+		_, known := lookupKey(v.keys, kid)
+		if v.keys == nil || age > jwksMaxAge || (!known && age > jwksMinRefresh) {
+			if err := v.fetchKeys(ctx); err != nil && v.keys == nil {
+				return signingKey{}, err
+			}
+		}
+	}
+	key, ok := lookupKey(v.keys, kid)
+	if !ok {
+		return signingKey{}, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// lookupKey finds a key by ID, a token without key ID needs a single key
+func lookupKey(keys map[string]signingKey, kid string) (signingKey, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+// fetchKeys downloads the issuer's key set, discovering its URL first when
+// it is not configured. Called with the mutex held.
+func (v *oidcVerifier) fetchKeys(ctx context.Context) error {
+	v.fetched = time.Now()
+	if v.jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		url := strings.TrimSuffix(v.cfg.IssuerURL, "/") + "/.well-known/openid-configuration"
+		if err := v.getJSON(ctx, url, &discovery); err != nil {
+			return fmt.Errorf("failed to discover OIDC provider: %v", err)
+		}
+		if discovery.Issuer != v.cfg.IssuerURL {
+			return fmt.Errorf("OIDC provider reports issuer %q instead of %q", discovery.Issuer, v.cfg.IssuerURL)
+		}
+		if discovery.JWKSURI == "" {
+			return fmt.Errorf("OIDC provider has no jwks_uri")
+		}
+		v.jwksURL = discovery.JWKSURI
+	}
+
+	var raw json.RawMessage
+	if err := v.getJSON(ctx, v.jwksURL, &raw); err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return fmt.Errorf("failed to parse JWKS: %v", err)
+	}
+	v.keys = keys
+	return nil
+}
+
+func (v *oidcVerifier) getJSON(ctx context.Context, url string, target interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, oidcTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := v.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(target)
+}
+
+// jsonWebKey is a public key of a JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// curves are the curves of the ES algorithms, by JWK curve name
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// parseJWKS reads the RSA and EC signing keys of a key set. Keys of other
+// types, curves or algorithms and invalid keys are skipped, so one of them
+// does not disable the others.
+func parseJWKS(data []byte) (map[string]signingKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]signingKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.Kty {
+		case "RSA":
+			if jwk.Alg != "" && !strings.HasPrefix(jwk.Alg, "RS") && !strings.HasPrefix(jwk.Alg, "PS") {
+				continue
+			}
+			n, errN := decodeBigInt(jwk.N)
+			e, errE := decodeBigInt(jwk.E)
+			if errN != nil || errE != nil || !e.IsInt64() {
+				continue
+			}
+			keys[jwk.Kid] = signingKey{key: &rsa.PublicKey{N: n, E: int(e.Int64())}, alg: jwk.Alg}
+		case "EC":
+			curve, ok := curves[jwk.Crv]
+			if !ok || (jwk.Alg != "" && jwk.Alg != curveAlgorithm(curve)) {
+				continue
+			}
+			x, errX := decodeBigInt(jwk.X)
+			y, errY := decodeBigInt(jwk.Y)
+			if errX != nil || errY != nil || !curve.IsOnCurve(x, y) {
+				continue
+			}
+			keys[jwk.Kid] = signingKey{key: &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, alg: jwk.Alg}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable signing keys")
+	}
+	return keys, nil
+}
+
+// curveAlgorithm is the ES algorithm that signs with keys on curve
+func curveAlgorithm(curve elliptic.Curve) string {
+	size := curve.Params().BitSize
+	if size == 521 {
+		size = 512
+	}
+	return fmt.Sprintf("ES%d", size)
+}
+
+// verifySignature checks a JWS signature made with one of the RS, PS or ES
+// algorithms. The algorithm must fit the key: RS and PS need an RSA key, each
+// ES algorithm the key of its curve.
+func verifySignature(alg string, key signingKey, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	if key.alg != "" && key.alg != alg {
+		return fmt.Errorf("key does not match token algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	digest := hash.New()
+	digest.Write([]byte(signed))
+	sum := digest.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		rsaKey, ok := key.key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match token algorithm %q", alg)
+		}
+		var err error
+		if alg[:2] == "RS" {
+			err = rsa.VerifyPKCS1v15(rsaKey, hash, sum, signature)
+		} else {
+			err = rsa.VerifyPSS(rsaKey, hash, sum, signature, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+	case "ES":
+		ecKey, ok := key.key.(*ecdsa.PublicKey)
+		if !ok || curveAlgorithm(ecKey.Curve) != alg {
+			return fmt.Errorf("key does not match token algorithm %q", alg)
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(ecKey, sum, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	return nil
+}
+
+func decodeSegment(segment string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
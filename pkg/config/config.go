@@ -1,30 +1,244 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
+
+	"k8s-monitor/pkg/utils"
 )
 
 type ResourceConfig struct {
-	Name        string `json:"name"`
-	Enabled     bool   `json:"enabled"`
-	Namespace   string `json:"namespace,omitempty"` // empty means all namespaces
-	Description string `json:"description"`
+	Name          string `json:"name"`
+	Enabled       bool   `json:"enabled"`
+	Namespace     string `json:"namespace,omitempty"`     // empty means all namespaces
+	LabelSelector string `json:"labelSelector,omitempty"` // e.g. app=web,tier!=cache
+	FieldSelector string `json:"fieldSelector,omitempty"` // e.g. status.phase=Running
+	Description   string `json:"description"`
 }
 
 type Config struct {
 	WebPort     int               `json:"webPort"`
 	Resources   []ResourceConfig  `json:"resources"`
 	Persistence PersistenceConfig `json:"persistence"`
+	Retention   RetentionConfig   `json:"retention"`
 	Logging     LoggingConfig     `json:"logging"`
+	WebSocket   WebSocketConfig   `json:"websocket"`
+	GRPC        GRPCConfig        `json:"grpc"`
+	Auth        AuthConfig        `json:"auth"`
+
+	SeverityOverrides []SeverityOverride `json:"severityOverrides,omitempty"`
+	Rules             []RuleConfig       `json:"rules,omitempty"`
 }
 
+// Storage backends
+const (
+	StorageBackendFile      = "file"
+	StorageBackendBolt      = "bolt"
+	StorageBackendMemory    = "memory"
+	StorageBackendConfigMap = "configmap"
+)
+
 type PersistenceConfig struct {
 	Enabled      bool   `json:"enabled"`
 	FilePath     string `json:"filePath"`
 	AutoSave     bool   `json:"autoSave"`
 	SaveInterval int    `json:"saveInterval"` // in seconds
+	// Queued records are written in one batch once FlushMaxRecords are
+	// queued, or when the oldest has waited SaveInterval seconds with
+	// AutoSave and FlushDelay milliseconds without
+	FlushMaxRecords int `json:"flushMaxRecords,omitempty"`
+	FlushDelay      int `json:"flushDelay,omitempty"`
+	// While writes fail at most MaxQueuedRecords are kept queued, the oldest
+	// are dropped beyond that
+	MaxQueuedRecords int `json:"maxQueuedRecords,omitempty"`
+
+	// Backend selects where changes are stored: "file" (the journal below),
+	// "bolt" (an embedded database at DatabasePath), "configmap" or "memory"
+	Backend      string `json:"backend,omitempty"`
+	DatabasePath string `json:"databasePath,omitempty"` // defaults to <filePath>.db
+	// The configmap backend keeps changes in chunked ConfigMaps named
+	// <ConfigMapPrefix>-<sequence> in ConfigMapNamespace, which defaults to
+	// the namespace the monitor runs in
+	ConfigMapNamespace string `json:"configMapNamespace,omitempty"`
+	ConfigMapPrefix    string `json:"configMapPrefix,omitempty"`
+	// HistoryMaxAge keeps stored changes for this many seconds, independent
+	// of memory retention, 0 keeps them forever
+	HistoryMaxAge int `json:"historyMaxAge,omitempty"`
+
+	// Changes are appended to a journal of NDJSON segments, the file at
+	// FilePath is only read once to migrate data from older versions
+	JournalDir      string `json:"journalDir,omitempty"` // defaults to <filePath>-journal
+	SegmentMaxBytes int64  `json:"segmentMaxBytes"`      // rotate segments after this size
+	SegmentMaxAge   int    `json:"segmentMaxAge"`        // in seconds, rotate segments after this age
+	// Closed segments older than ArchiveAfter seconds are gzipped, 0 disables
+	// archival. MaxDiskBytes bounds the journal including its archives,
+	// evicting the oldest archives first, 0 means unlimited.
+	ArchiveAfter int   `json:"archiveAfter,omitempty"`
+	MaxDiskBytes int64 `json:"maxDiskBytes,omitempty"`
+
+	// StoreSnapshots keeps a redacted copy of the object before and after
+	// each change next to the journal, the configmap backend refuses it
+	StoreSnapshots bool `json:"storeSnapshots"`
+
+	Encryption EncryptionConfig `json:"encryption"`
+	// ObjectStorage ships closed journal segments to an S3 compatible bucket
+	ObjectStorage ObjectStorageConfig `json:"objectStorage"`
+}
+
+// EncryptionConfig enables AES-GCM encryption of persisted changes and
+// snapshots. Keys are base64 encoded 16, 24 or 32 byte AES keys; the first
+// key encrypts and every key decrypts, so a key is rotated by adding the new
+// key in front of the old one.
+type EncryptionConfig struct {
+	Enabled bool   `json:"enabled"`
+	KeyFile string `json:"keyFile,omitempty"` // one key per line
+	KeyEnv  string `json:"keyEnv,omitempty"`  // comma separated keys, defaults to K8S_MONITOR_ENCRYPTION_KEYS
+}
+
+// ObjectStorageConfig configures long-term history in an S3 compatible
+// bucket. Closed journal segments are copied to SpoolDir and uploaded from
+// there, uploads that fail are retried on every retention sweep. Queries
+// reaching past the local journal read the older segments from the bucket.
+type ObjectStorageConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Endpoint string `json:"endpoint"` // host[:port], e.g. s3.amazonaws.com or minio:9000
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix,omitempty"` // key prefix, defaults to k8s-monitor/
+	Region   string `json:"region,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"` // plain HTTP, e.g. for a local MinIO
+	// Credentials are read from files, e.g. a mounted secret, or else from
+	// environment variables, which default to AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY
+	AccessKeyFile string `json:"accessKeyFile,omitempty"`
+	SecretKeyFile string `json:"secretKeyFile,omitempty"`
+	AccessKeyEnv  string `json:"accessKeyEnv,omitempty"`
+	SecretKeyEnv  string `json:"secretKeyEnv,omitempty"`
+	SpoolDir      string `json:"spoolDir,omitempty"` // defaults to <journalDir>/spool
+	// MaxAge removes segments from the bucket after this many seconds, 0 keeps them
+	MaxAge int `json:"maxAge,omitempty"`
+}
+
+// RetentionConfig controls how many changes are kept in memory and for how long.
+// Zero values disable the corresponding limit, except MaxCount and SweepInterval
+// which fall back to their defaults.
+type RetentionConfig struct {
+	MaxCount        int            `json:"maxCount"`                  // maximum number of changes kept
+	MaxAge          int            `json:"maxAge"`                    // in seconds, 0 keeps changes forever
+	ReadMaxAge      int            `json:"readMaxAge"`                // in seconds, lets read changes expire sooner
+	ResourceQuotas  map[string]int `json:"resourceQuotas,omitempty"`  // resource type -> max changes
+	NamespaceQuotas map[string]int `json:"namespaceQuotas,omitempty"` // namespace -> max changes
+	SweepInterval   int            `json:"sweepInterval"`             // in seconds
+}
+
+// SeverityOverride replaces the built-in severity of matching changes.
+// Empty match fields match everything, the first matching override wins.
+type SeverityOverride struct {
+	ResourceType string `json:"resourceType,omitempty"`
+	EventType    string `json:"eventType,omitempty"`
+	Severity     string `json:"severity"` // info, warning or critical
+}
+
+// RuleConfig tags, routes or suppresses the changes its match conditions select.
+// All matching rules are applied in order.
+type RuleConfig struct {
+	Name    string      `json:"name"`
+	Match   RuleMatch   `json:"match"`
+	Actions RuleActions `json:"actions"`
+}
+
+// RuleMatch holds the conditions of a rule. Every non-empty condition must
+// match, list conditions match when any of their entries matches.
+type RuleMatch struct {
+	ResourceTypes   []string          `json:"resourceTypes,omitempty"`
+	EventTypes      []string          `json:"eventTypes,omitempty"`
+	Namespaces      []string          `json:"namespaces,omitempty"`      // glob patterns
+	NamespaceLabels map[string]string `json:"namespaceLabels,omitempty"` // labels of the namespace itself
+	Names           []string          `json:"names,omitempty"`           // glob patterns
+	Labels          map[string]string `json:"labels,omitempty"`          // labels of the object
+	Actors          []string          `json:"actors,omitempty"`          // glob patterns on the field manager
+	DiffPaths       []string          `json:"diffPaths,omitempty"`       // glob patterns on changed field paths
+}
+
+// RuleActions are applied to every change a rule matches
+type RuleActions struct {
+	Severity string   `json:"severity,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Suppress bool     `json:"suppress,omitempty"`
+	MarkRead bool     `json:"markRead,omitempty"`
+}
+
+// WebSocketConfig limits the /api/ws endpoint
+type WebSocketConfig struct {
+	MaxConnections int `json:"maxConnections"` // further connections are refused with 503
+	// SendQueue messages are buffered per connection, a client that falls
+	// further behind is disconnected
+	SendQueue int `json:"sendQueue"`
+	// AllowedOrigins lists the origins of cross-origin clients, "*" allows
+	// any. Same-origin and non-browser clients are always allowed.
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+}
+
+// GRPCConfig configures the gRPC API, served next to the web server
+type GRPCConfig struct {
+	Enabled bool `json:"enabled"`
+	Port    int  `json:"port"`
+}
+
+// AuthConfig protects the API. When several methods are configured a request
+// is accepted by the first one that recognizes its credentials.
+type AuthConfig struct {
+	Enabled      bool           `json:"enabled"`
+	Tokens       []TokenConfig  `json:"tokens,omitempty"`       // static bearer tokens
+	HtpasswdFile string         `json:"htpasswdFile,omitempty"` // users for basic auth
+	OIDC         OIDCConfig     `json:"oidc"`
+	Kubernetes   KubeAuthConfig `json:"kubernetes"`
+	Admin        AdminConfig    `json:"admin"`
+}
+
+// TokenConfig is a static bearer token and the identity it grants
+type TokenConfig struct {
+	User     string   `json:"user"`
+	Groups   []string `json:"groups,omitempty"`
+	Token    string   `json:"token,omitempty"`
+	TokenEnv string   `json:"tokenEnv,omitempty"` // environment variable holding the token instead
+}
+
+// OIDCConfig verifies JWTs issued by an OpenID Connect provider. It is
+// enabled when IssuerURL is set.
+type OIDCConfig struct {
+	IssuerURL     string `json:"issuerUrl,omitempty"`
+	Audience      string `json:"audience,omitempty"` // usually the client ID
+	JWKSURL       string `json:"jwksUrl,omitempty"`  // discovered from the issuer when empty
+	JWKSFile      string `json:"jwksFile,omitempty"` // local key set used instead of fetching one
+	UsernameClaim string `json:"usernameClaim,omitempty"`
+	GroupsClaim   string `json:"groupsClaim,omitempty"`
+	// UsernamePrefix is put before user names so they cannot collide with
+	// users of the other methods, the issuer URL and "#" when empty and
+	// nothing when "-"
+	UsernamePrefix string `json:"usernamePrefix,omitempty"`
+}
+
+// AdminConfig decides who may change the configuration, save, reload rules
+// and read the audit log: members of Groups, and with Verb and Resource set
+// those the cluster allows that verb, checked with SubjectAccessReview. With
+// authentication enabled and neither set nobody may.
+type AdminConfig struct {
+	Groups    []string `json:"groups,omitempty"`
+	Verb      string   `json:"verb,omitempty"`
+	Group     string   `json:"group,omitempty"` // API group of Resource, empty for the core group
+	Resource  string   `json:"resource,omitempty"`
+	Namespace string   `json:"namespace,omitempty"` // empty asks about the whole cluster
+}
+
+// KubeAuthConfig delegates authentication and authorization to the cluster
+// the monitor runs in
+type KubeAuthConfig struct {
+	Enabled   bool     `json:"enabled"`             // validate bearer tokens with TokenReview
+	Authorize bool     `json:"authorize"`           // only show changes users may get, checked with SubjectAccessReview
+	Audiences []string `json:"audiences,omitempty"` // audiences tokens must be issued for, default the API server's
+	CacheTTL  int      `json:"cacheTTL"`            // seconds review results are cached
 }
 
 type LoggingConfig struct {
@@ -38,10 +252,21 @@ func LoadConfig(configPath string) (*Config, error) {
 	defaultConfig := &Config{
 		WebPort: 8080,
 		Persistence: PersistenceConfig{
-			Enabled:      true,
-			FilePath:     "changes.json",
-			AutoSave:     true,
-			SaveInterval: 30, // Save every 30 seconds
+			Enabled:         true,
+			FilePath:        "changes.json",
+			AutoSave:        true,
+			SaveInterval:    30, // Save every 30 seconds
+			Backend:         StorageBackendFile,
+			SegmentMaxBytes: 16 * 1024 * 1024, // Rotate journal segments at 16 MiB
+			SegmentMaxAge:   3600,             // or after an hour
+		},
+		Retention: RetentionConfig{
+			MaxCount:      10000,
+			SweepInterval: 60,
+		},
+		GRPC: GRPCConfig{
+			Enabled: false, // opt in, it opens a second port
+			Port:    50051,
 		},
 		Logging: LoggingConfig{
 			Enabled:       false, // Master switch for all logging
@@ -65,6 +290,7 @@ func LoadConfig(configPath string) (*Config, error) {
 			{Name: "networkpolicies", Enabled: false, Description: "Kubernetes NetworkPolicies"},
 		},
 	}
+	applyDefaults(defaultConfig)
 
 	// Check if config file exists
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
@@ -80,6 +306,20 @@ func LoadConfig(configPath string) (*Config, error) {
 	}
 
 	// Load existing config file
+	config, err := LoadConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply environment variable overrides to loaded config
+	applyEnvironmentOverrides(config)
+
+	return config, nil
+}
+
+// LoadConfigFile reads a configuration file as it is on disk, without the
+// environment variable overrides, so it can be changed and saved again
+func LoadConfigFile(configPath string) (*Config, error) {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %v", err)
@@ -90,12 +330,76 @@ func LoadConfig(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %v", err)
 	}
 
-	// Apply environment variable overrides to loaded config
-	applyEnvironmentOverrides(&config)
+	// Fill in settings that older config files don't have
+	applyDefaults(&config)
 
 	return &config, nil
 }
 
+// applyDefaults fills in zero-valued settings with their defaults
+func applyDefaults(config *Config) {
+	if config.Persistence.Encryption.KeyEnv == "" {
+		config.Persistence.Encryption.KeyEnv = "K8S_MONITOR_ENCRYPTION_KEYS"
+	}
+	if config.Persistence.ObjectStorage.Prefix == "" {
+		config.Persistence.ObjectStorage.Prefix = "k8s-monitor/"
+	}
+	if config.Persistence.ObjectStorage.AccessKeyEnv == "" {
+		config.Persistence.ObjectStorage.AccessKeyEnv = "AWS_ACCESS_KEY_ID"
+	}
+	if config.Persistence.ObjectStorage.SecretKeyEnv == "" {
+		config.Persistence.ObjectStorage.SecretKeyEnv = "AWS_SECRET_ACCESS_KEY"
+	}
+	if config.Persistence.ConfigMapPrefix == "" {
+		config.Persistence.ConfigMapPrefix = "k8s-monitor-changes"
+	}
+	if config.WebSocket.MaxConnections <= 0 {
+		config.WebSocket.MaxConnections = 100
+	}
+	if config.WebSocket.SendQueue <= 0 {
+		config.WebSocket.SendQueue = 256
+	}
+	if config.Auth.OIDC.UsernameClaim == "" {
+		config.Auth.OIDC.UsernameClaim = "sub"
+	}
+	if config.Auth.OIDC.GroupsClaim == "" {
+		config.Auth.OIDC.GroupsClaim = "groups"
+	}
+	if config.Auth.Kubernetes.CacheTTL <= 0 {
+		config.Auth.Kubernetes.CacheTTL = 60
+	}
+	if config.GRPC.Port <= 0 {
+		config.GRPC.Port = 50051
+	}
+	if config.Persistence.SaveInterval <= 0 {
+		config.Persistence.SaveInterval = 30
+	}
+	if config.Persistence.FlushMaxRecords <= 0 {
+		config.Persistence.FlushMaxRecords = 1000
+	}
+	if config.Persistence.FlushDelay <= 0 {
+		config.Persistence.FlushDelay = 100
+	}
+	if config.Persistence.MaxQueuedRecords <= 0 {
+		config.Persistence.MaxQueuedRecords = 100000
+	}
+	if config.Persistence.Backend == "" {
+		config.Persistence.Backend = StorageBackendFile
+	}
+	if config.Persistence.SegmentMaxBytes <= 0 {
+		config.Persistence.SegmentMaxBytes = 16 * 1024 * 1024
+	}
+	if config.Persistence.SegmentMaxAge <= 0 {
+		config.Persistence.SegmentMaxAge = 3600
+	}
+	if config.Retention.MaxCount <= 0 {
+		config.Retention.MaxCount = 10000
+	}
+	if config.Retention.SweepInterval <= 0 {
+		config.Retention.SweepInterval = 60
+	}
+}
+
 // applyEnvironmentOverrides applies environment variable overrides to the configuration
 func applyEnvironmentOverrides(config *Config) {
 	// Override persistence file path if environment variable is set
@@ -112,6 +416,14 @@ func applyEnvironmentOverrides(config *Config) {
 			fmt.Printf("Using web port from environment: %d\n", port)
 		}
 	}
+
+	// Override gRPC port if environment variable is set
+	if envGRPCPort := os.Getenv("GRPC_PORT"); envGRPCPort != "" {
+		if port := parsePort(envGRPCPort); port > 0 {
+			config.GRPC.Port = port
+			fmt.Printf("Using gRPC port from environment: %d\n", port)
+		}
+	}
 }
 
 // parsePort safely parses a port number from string
@@ -123,19 +435,40 @@ func parsePort(portStr string) int {
 	return 0
 }
 
+// SaveConfig writes a whole configuration, as it is in memory. The running
+// configuration carries defaults and environment overrides, so changes made
+// at runtime are written with SaveResources instead.
 func SaveConfig(configPath string, config *Config) error {
 	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal config: %v", err)
 	}
 
-	if err := os.WriteFile(configPath, data, 0644); err != nil {
+	if err := utils.WriteFileAtomic(configPath, data, 0644); err != nil {
 		return fmt.Errorf("failed to write config file: %v", err)
 	}
 
 	return nil
 }
 
+// Redacted returns a copy of the configuration that is safe to show to API
+// clients: static tokens and the locations of credential files are removed
+func (c *Config) Redacted() Config {
+	redacted := *c
+	redacted.Resources = append([]ResourceConfig(nil), c.Resources...)
+
+	redacted.Auth.Tokens = make([]TokenConfig, len(c.Auth.Tokens))
+	for i, token := range c.Auth.Tokens {
+		redacted.Auth.Tokens[i] = TokenConfig{User: token.User, Groups: token.Groups}
+	}
+	redacted.Auth.HtpasswdFile = ""
+	redacted.Auth.OIDC.JWKSFile = ""
+	redacted.Persistence.Encryption.KeyFile = ""
+	redacted.Persistence.ObjectStorage.AccessKeyFile = ""
+	redacted.Persistence.ObjectStorage.SecretKeyFile = ""
+	return redacted
+}
+
 func (c *Config) GetEnabledResources() []ResourceConfig {
 	var enabled []ResourceConfig
 	for _, resource := range c.Resources {
@@ -154,3 +487,87 @@ func (c *Config) IsResourceEnabled(resourceName string) bool {
 	}
 	return false
 }
+
+// SaveResources replaces the resources in a configuration file. Every other
+// setting is kept as it is written, defaults and environment overrides are
+// not added to the file.
+func SaveResources(configPath string, resources []ResourceConfig) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(configPath); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	patched, err := setJSONKey(data, "resources", resources)
+	if err != nil {
+		return fmt.Errorf("failed to update config file: %v", err)
+	}
+	if err := utils.WriteFileAtomic(configPath, patched, perm); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+	return nil
+}
+
+// setJSONKey sets one key of a JSON object and keeps the other keys and their
+// order untouched
+func setJSONKey(data []byte, key string, value interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	type member struct {
+		key   string
+		value json.RawMessage
+	}
+	var members []member
+	if len(bytes.TrimSpace(data)) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+			return nil, fmt.Errorf("expected a JSON object")
+		}
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			var raw json.RawMessage
+			if err := decoder.Decode(&raw); err != nil {
+				return nil, err
+			}
+			members = append(members, member{key: token.(string), value: raw})
+		}
+	}
+
+	found := false
+	for i := range members {
+		if members[i].key == key {
+			members[i].value = encoded
+			found = true
+		}
+	}
+	if !found {
+		members = append(members, member{key: key, value: encoded})
+	}
+
+	var out bytes.Buffer
+	out.WriteString("{\n")
+	for i, m := range members {
+		name, _ := json.Marshal(m.key)
+		out.WriteString("  ")
+		out.Write(name)
+		out.WriteString(": ")
+		if err := json.Indent(&out, m.value, "  ", "  "); err != nil {
+			return nil, err
+		}
+		if i < len(members)-1 {
+			out.WriteString(",")
+		}
+		out.WriteString("\n")
+	}
+	out.WriteString("}")
+	return out.Bytes(), nil
+}
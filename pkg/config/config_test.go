@@ -0,0 +1,100 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveResources(t *testing.T) {
+	resources := []ResourceConfig{{Name: "pods", Enabled: true}}
+
+	tests := []struct {
+		name    string
+		file    string // empty means the file does not exist
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "only resources are replaced",
+			file: `{"webPort": 9090, "resources": [], "logging": {"enabled": false}}`,
+			want: `{
+  "webPort": 9090,
+  "resources": [
+    {
+      "name": "pods",
+      "enabled": true,
+      "description": ""
+    }
+  ],
+  "logging": {
+    "enabled": false
+  }
+}`,
+		},
+		{
+			name: "resources are added",
+			file: `{"webPort": 9090}`,
+			want: `{
+  "webPort": 9090,
+  "resources": [
+    {
+      "name": "pods",
+      "enabled": true,
+      "description": ""
+    }
+  ]
+}`,
+		},
+		{
+			name: "missing file",
+			want: `{
+  "resources": [
+    {
+      "name": "pods",
+      "enabled": true,
+      "description": ""
+    }
+  ]
+}`,
+		},
+		{
+			name:    "not an object",
+			file:    `[1, 2]`,
+			want:    `[1, 2]`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if test.file != "" {
+				if err := os.WriteFile(path, []byte(test.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := SaveResources(path, resources)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("SaveResources() error = %v, want error %v", err, test.wantErr)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.want {
+				t.Errorf("file is\n%s\nwant\n%s", data, test.want)
+			}
+			if test.file != "" {
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != 0600 {
+					t.Errorf("file mode %v, want 0600", info.Mode().Perm())
+				}
+			}
+		})
+	}
+}
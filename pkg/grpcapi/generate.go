@@ -0,0 +1,10 @@
+// Package grpcapi holds the gRPC API definition and the code generated from it
+package grpcapi
+
+// The generators are pinned so the generated code only changes with the
+// .proto file. goprotoc is a Go implementation of protoc, it needs no
+// installed protoc and finds the plugins in $GOBIN.
+//go:generate go install github.com/jhump/goprotoc/cmd/goprotoc@v0.5.0
+//go:generate go install google.golang.org/protobuf/cmd/protoc-gen-go@v1.27.1
+//go:generate go install google.golang.org/grpc/cmd/protoc-gen-go-grpc@v1.2.0
+//go:generate goprotoc --go_out=paths=source_relative:. --go-grpc_out=paths=source_relative:. monitor.proto
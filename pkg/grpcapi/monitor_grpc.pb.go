@@ -0,0 +1,407 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.5.1-go
+// source: monitor.proto
+
+package grpcapi
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// MonitorServiceClient is the client API for MonitorService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MonitorServiceClient interface {
+	// ListChanges returns a page of the changes held in memory
+	ListChanges(ctx context.Context, in *ListChangesRequest, opts ...grpc.CallOption) (*ListChangesResponse, error)
+	// QueryHistory returns stored changes, including those evicted from memory
+	QueryHistory(ctx context.Context, in *QueryHistoryRequest, opts ...grpc.CallOption) (*QueryHistoryResponse, error)
+	// GetChange returns one change held in memory
+	GetChange(ctx context.Context, in *GetChangeRequest, opts ...grpc.CallOption) (*Change, error)
+	// GetStats returns the statistics over the changes held in memory
+	GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error)
+	// MarkRead marks changes read
+	MarkRead(ctx context.Context, in *MarkReadRequest, opts ...grpc.CallOption) (*MarkReadResponse, error)
+	// MarkAllRead marks every change read
+	MarkAllRead(ctx context.Context, in *MarkAllReadRequest, opts ...grpc.CallOption) (*MarkAllReadResponse, error)
+	// Acknowledge records that the caller looked into a change, once per
+	// change. A second acknowledgement fails with ALREADY_EXISTS.
+	Acknowledge(ctx context.Context, in *AcknowledgeRequest, opts ...grpc.CallOption) (*Change, error)
+	// WatchChanges streams new changes matching the filter and read updates.
+	// A client that falls behind gets RESOURCE_EXHAUSTED and resumes by
+	// passing the last event ID it received.
+	WatchChanges(ctx context.Context, in *WatchChangesRequest, opts ...grpc.CallOption) (MonitorService_WatchChangesClient, error)
+}
+
+type monitorServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMonitorServiceClient(cc grpc.ClientConnInterface) MonitorServiceClient {
+	return &monitorServiceClient{cc}
+}
+
+func (c *monitorServiceClient) ListChanges(ctx context.Context, in *ListChangesRequest, opts ...grpc.CallOption) (*ListChangesResponse, error) {
+	out := new(ListChangesResponse)
+	err := c.cc.Invoke(ctx, "/k8smonitor.v1.MonitorService/ListChanges", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *monitorServiceClient) QueryHistory(ctx context.Context, in *QueryHistoryRequest, opts ...grpc.CallOption) (*QueryHistoryResponse, error) {
+	out := new(QueryHistoryResponse)
+	err := c.cc.Invoke(ctx, "/k8smonitor.v1.MonitorService/QueryHistory", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *monitorServiceClient) GetChange(ctx context.Context, in *GetChangeRequest, opts ...grpc.CallOption) (*Change, error) {
+	out := new(Change)
+	err := c.cc.Invoke(ctx, "/k8smonitor.v1.MonitorService/GetChange", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *monitorServiceClient) GetStats(ctx context.Context, in *GetStatsRequest, opts ...grpc.CallOption) (*Stats, error) {
+	out := new(Stats)
+	err := c.cc.Invoke(ctx, "/k8smonitor.v1.MonitorService/GetStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *monitorServiceClient) MarkRead(ctx context.Context, in *MarkReadRequest, opts ...grpc.CallOption) (*MarkReadResponse, error) {
+	out := new(MarkReadResponse)
+	err := c.cc.Invoke(ctx, "/k8smonitor.v1.MonitorService/MarkRead", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *monitorServiceClient) MarkAllRead(ctx context.Context, in *MarkAllReadRequest, opts ...grpc.CallOption) (*MarkAllReadResponse, error) {
+	out := new(MarkAllReadResponse)
+	err := c.cc.Invoke(ctx, "/k8smonitor.v1.MonitorService/MarkAllRead", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *monitorServiceClient) Acknowledge(ctx context.Context, in *AcknowledgeRequest, opts ...grpc.CallOption) (*Change, error) {
+	out := new(Change)
+	err := c.cc.Invoke(ctx, "/k8smonitor.v1.MonitorService/Acknowledge", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *monitorServiceClient) WatchChanges(ctx context.Context, in *WatchChangesRequest, opts ...grpc.CallOption) (MonitorService_WatchChangesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MonitorService_ServiceDesc.Streams[0], "/k8smonitor.v1.MonitorService/WatchChanges", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &monitorServiceWatchChangesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MonitorService_WatchChangesClient interface {
+	Recv() (*WatchChangesResponse, error)
+	grpc.ClientStream
+}
+
+type monitorServiceWatchChangesClient struct {
+	grpc.ClientStream
+}
+
+func (x *monitorServiceWatchChangesClient) Recv() (*WatchChangesResponse, error) {
+	m := new(WatchChangesResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MonitorServiceServer is the server API for MonitorService service.
+// All implementations must embed UnimplementedMonitorServiceServer
+// for forward compatibility
+type MonitorServiceServer interface {
+	// ListChanges returns a page of the changes held in memory
+	ListChanges(context.Context, *ListChangesRequest) (*ListChangesResponse, error)
+	// QueryHistory returns stored changes, including those evicted from memory
+	QueryHistory(context.Context, *QueryHistoryRequest) (*QueryHistoryResponse, error)
+	// GetChange returns one change held in memory
+	GetChange(context.Context, *GetChangeRequest) (*Change, error)
+	// GetStats returns the statistics over the changes held in memory
+	GetStats(context.Context, *GetStatsRequest) (*Stats, error)
+	// MarkRead marks changes read
+	MarkRead(context.Context, *MarkReadRequest) (*MarkReadResponse, error)
+	// MarkAllRead marks every change read
+	MarkAllRead(context.Context, *MarkAllReadRequest) (*MarkAllReadResponse, error)
+	// Acknowledge records that the caller looked into a change, once per
+	// change. A second acknowledgement fails with ALREADY_EXISTS.
+	Acknowledge(context.Context, *AcknowledgeRequest) (*Change, error)
+	// WatchChanges streams new changes matching the filter and read updates.
+	// A client that falls behind gets RESOURCE_EXHAUSTED and resumes by
+	// passing the last event ID it received.
+	WatchChanges(*WatchChangesRequest, MonitorService_WatchChangesServer) error
+	mustEmbedUnimplementedMonitorServiceServer()
+}
+
+// UnimplementedMonitorServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedMonitorServiceServer struct {
+}
+
+func (UnimplementedMonitorServiceServer) ListChanges(context.Context, *ListChangesRequest) (*ListChangesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListChanges not implemented")
+}
+func (UnimplementedMonitorServiceServer) QueryHistory(context.Context, *QueryHistoryRequest) (*QueryHistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryHistory not implemented")
+}
+func (UnimplementedMonitorServiceServer) GetChange(context.Context, *GetChangeRequest) (*Change, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetChange not implemented")
+}
+func (UnimplementedMonitorServiceServer) GetStats(context.Context, *GetStatsRequest) (*Stats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedMonitorServiceServer) MarkRead(context.Context, *MarkReadRequest) (*MarkReadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MarkRead not implemented")
+}
+func (UnimplementedMonitorServiceServer) MarkAllRead(context.Context, *MarkAllReadRequest) (*MarkAllReadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MarkAllRead not implemented")
+}
+func (UnimplementedMonitorServiceServer) Acknowledge(context.Context, *AcknowledgeRequest) (*Change, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Acknowledge not implemented")
+}
+func (UnimplementedMonitorServiceServer) WatchChanges(*WatchChangesRequest, MonitorService_WatchChangesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchChanges not implemented")
+}
+func (UnimplementedMonitorServiceServer) mustEmbedUnimplementedMonitorServiceServer() {}
+
+// UnsafeMonitorServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MonitorServiceServer will
+// result in compilation errors.
+type UnsafeMonitorServiceServer interface {
+	mustEmbedUnimplementedMonitorServiceServer()
+}
+
+func RegisterMonitorServiceServer(s grpc.ServiceRegistrar, srv MonitorServiceServer) {
+	s.RegisterService(&MonitorService_ServiceDesc, srv)
+}
+
+func _MonitorService_ListChanges_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListChangesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MonitorServiceServer).ListChanges(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/k8smonitor.v1.MonitorService/ListChanges",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MonitorServiceServer).ListChanges(ctx, req.(*ListChangesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MonitorService_QueryHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryHistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MonitorServiceServer).QueryHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/k8smonitor.v1.MonitorService/QueryHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MonitorServiceServer).QueryHistory(ctx, req.(*QueryHistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MonitorService_GetChange_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetChangeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MonitorServiceServer).GetChange(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/k8smonitor.v1.MonitorService/GetChange",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MonitorServiceServer).GetChange(ctx, req.(*GetChangeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MonitorService_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MonitorServiceServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/k8smonitor.v1.MonitorService/GetStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MonitorServiceServer).GetStats(ctx, req.(*GetStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MonitorService_MarkRead_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MarkReadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MonitorServiceServer).MarkRead(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/k8smonitor.v1.MonitorService/MarkRead",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MonitorServiceServer).MarkRead(ctx, req.(*MarkReadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MonitorService_MarkAllRead_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MarkAllReadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MonitorServiceServer).MarkAllRead(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/k8smonitor.v1.MonitorService/MarkAllRead",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MonitorServiceServer).MarkAllRead(ctx, req.(*MarkAllReadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MonitorService_Acknowledge_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AcknowledgeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MonitorServiceServer).Acknowledge(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/k8smonitor.v1.MonitorService/Acknowledge",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MonitorServiceServer).Acknowledge(ctx, req.(*AcknowledgeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MonitorService_WatchChanges_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchChangesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MonitorServiceServer).WatchChanges(m, &monitorServiceWatchChangesServer{stream})
+}
+
+type MonitorService_WatchChangesServer interface {
+	Send(*WatchChangesResponse) error
+	grpc.ServerStream
+}
+
+type monitorServiceWatchChangesServer struct {
+	grpc.ServerStream
+}
+
+func (x *monitorServiceWatchChangesServer) Send(m *WatchChangesResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// MonitorService_ServiceDesc is the grpc.ServiceDesc for MonitorService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MonitorService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "k8smonitor.v1.MonitorService",
+	HandlerType: (*MonitorServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListChanges",
+			Handler:    _MonitorService_ListChanges_Handler,
+		},
+		{
+			MethodName: "QueryHistory",
+			Handler:    _MonitorService_QueryHistory_Handler,
+		},
+		{
+			MethodName: "GetChange",
+			Handler:    _MonitorService_GetChange_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _MonitorService_GetStats_Handler,
+		},
+		{
+			MethodName: "MarkRead",
+			Handler:    _MonitorService_MarkRead_Handler,
+		},
+		{
+			MethodName: "MarkAllRead",
+			Handler:    _MonitorService_MarkAllRead_Handler,
+		},
+		{
+			MethodName: "Acknowledge",
+			Handler:    _MonitorService_Acknowledge_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchChanges",
+			Handler:       _MonitorService_WatchChanges_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "monitor.proto",
+}
@@ -0,0 +1,178 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"k8s-monitor/pkg/config"
+)
+
+// auditMemory entries are kept in memory, older ones only in the audit file
+const auditMemory = 1000
+
+// AuditEntry records a change made to the monitor at runtime
+type AuditEntry struct {
+	Time   time.Time       `json:"time"`
+	Actor  string          `json:"actor"`
+	Action string          `json:"action"` // e.g. resource.update
+	Target string          `json:"target"` // what was changed, e.g. resources/pods
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// auditStore persists audit entries
+type auditStore interface {
+	// LoadAudit returns the newest stored entries, oldest first
+	LoadAudit() ([]AuditEntry, error)
+	// AppendAudit stores a new entry
+	AppendAudit(entry AuditEntry) error
+}
+
+// auditLog keeps the recent audit entries and stores every entry when
+// persistence is enabled: in a JSON lines file next to the journal, or in a
+// ConfigMap with the configmap backend
+type auditLog struct {
+	mutex   sync.Mutex
+	store   auditStore   // nil when nothing is persisted
+	entries []AuditEntry // oldest first
+}
+
+func newAuditLog() *auditLog {
+	return &auditLog{}
+}
+
+// open loads the newest stored entries and stores new entries from now on
+func (a *auditLog) open(store auditStore) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.store = store
+
+	entries, err := store.LoadAudit()
+	if len(entries) > auditMemory {
+		entries = entries[len(entries)-auditMemory:]
+	}
+	a.entries = append([]AuditEntry(nil), entries...)
+	return err
+}
+
+// add appends an entry, it is kept in memory even when storing it fails
+func (a *auditLog) add(entry AuditEntry) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > auditMemory {
+		a.entries = append([]AuditEntry(nil), a.entries[len(a.entries)-auditMemory:]...)
+	}
+	if a.store == nil {
+		return nil
+	}
+	return a.store.AppendAudit(entry)
+}
+
+// auditFile keeps audit entries in a JSON lines file
+type auditFile struct {
+	path string
+}
+
+func (f auditFile) LoadAudit() ([]AuditEntry, error) {
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var entries []AuditEntry
+	skipped := 0
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			skipped++
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) > 2*auditMemory {
+			entries = append([]AuditEntry(nil), entries[len(entries)-auditMemory:]...)
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Warning: Skipped %d unreadable audit log entries in %s", skipped, f.path)
+	}
+	return entries, scanner.Err()
+}
+
+func (f auditFile) AppendAudit(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %v", err)
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return file.Sync()
+}
+
+// auditBackend returns where audit entries are stored, nil when nowhere
+func (m *K8sMonitor) auditBackend() auditStore {
+	if m.config.Persistence.Backend != config.StorageBackendConfigMap {
+		return auditFile{path: filepath.Join(m.journalDir(), "audit.jsonl")}
+	}
+	// Nothing is written to the local disk with the configmap backend
+	if store, ok := m.store.(*configMapStore); ok {
+		return store
+	}
+	return nil
+}
+
+// RecordAudit adds an entry to the audit log, before and after are stored
+// as JSON
+func (m *K8sMonitor) RecordAudit(actor, action, target string, before, after interface{}) error {
+	entry := AuditEntry{Time: time.Now(), Actor: actor, Action: action, Target: target}
+	var err error
+	if before != nil {
+		if entry.Before, err = json.Marshal(before); err != nil {
+			return fmt.Errorf("failed to marshal audit entry: %v", err)
+		}
+	}
+	if after != nil {
+		if entry.After, err = json.Marshal(after); err != nil {
+			return fmt.Errorf("failed to marshal audit entry: %v", err)
+		}
+	}
+	if m.config.Logging.Enabled && m.config.Logging.LogOperations {
+		log.Printf("Audit: %s %s %s", actor, action, target)
+	}
+	return m.audit.add(entry)
+}
+
+// AuditEntries returns the newest limit audit entries held in memory, oldest
+// first. A limit of 0 returns all of them.
+func (m *K8sMonitor) AuditEntries(limit int) []AuditEntry {
+	m.audit.mutex.Lock()
+	defer m.audit.mutex.Unlock()
+
+	entries := m.audit.entries
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return append([]AuditEntry{}, entries...)
+}
@@ -0,0 +1,379 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// Core Events this close to a change are reported with it
+	eventWindow = 5 * time.Minute
+	// Owner references are followed this many levels up
+	maxOwnerDepth = 5
+	// Time allowed for the API calls of a change detail
+	detailTimeout = 5 * time.Second
+	// Stored changes read to find the one before a change, a few more than
+	// one in case several share its timestamp
+	previousQueryLimit = 4
+)
+
+// resourceKinds maps the monitored resource types to their kinds
+var resourceKinds = map[string]string{
+	"pods":                   "Pod",
+	"deployments":            "Deployment",
+	"services":               "Service",
+	"configmaps":             "ConfigMap",
+	"secrets":                "Secret",
+	"replicasets":            "ReplicaSet",
+	"daemonsets":             "DaemonSet",
+	"statefulsets":           "StatefulSet",
+	"jobs":                   "Job",
+	"cronjobs":               "CronJob",
+	"persistentvolumes":      "PersistentVolume",
+	"persistentvolumeclaims": "PersistentVolumeClaim",
+	"ingresses":              "Ingress",
+	"networkpolicies":        "NetworkPolicy",
+}
+
+// ChangeDetail is a change together with its diff, its neighbours in the
+// object's history and what the cluster says about the object
+type ChangeDetail struct {
+	Change      Change      `json:"change"`
+	Diff        []FieldDiff `json:"diff,omitempty"`
+	Previous    *Change     `json:"previous,omitempty"` // the change before this one to the same object
+	Next        *Change     `json:"next,omitempty"`     // the change after this one to the same object
+	Owners      []Owner     `json:"owners,omitempty"`
+	Events      []CoreEvent `json:"events,omitempty"`
+	EventsError string      `json:"eventsError,omitempty"`
+}
+
+// Owner is an owner reference of an object, with the owner's own owners
+type Owner struct {
+	Kind         string  `json:"kind"`
+	Name         string  `json:"name"`
+	UID          string  `json:"uid,omitempty"`
+	Controller   bool    `json:"controller,omitempty"`
+	ResourceType string  `json:"resourceType,omitempty"` // set for monitored kinds
+	Owners       []Owner `json:"owners,omitempty"`
+}
+
+// CoreEvent is a Kubernetes Event about the changed object
+type CoreEvent struct {
+	Type      string    `json:"type"` // Normal or Warning
+	Reason    string    `json:"reason"`
+	Message   string    `json:"message"`
+	Count     int32     `json:"count,omitempty"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Source    string    `json:"source,omitempty"`
+}
+
+// ObjectHistory returns the stored changes to one object, oldest first. The
+// filter's resource type, namespace and name are replaced by the object's.
+func (m *K8sMonitor) ObjectHistory(resourceType, namespace, name string, filter ChangeFilter) ([]Change, error) {
+	filter.ResourceTypes = []string{resourceType}
+	filter.Namespaces = []string{namespace}
+	filter.Name = name
+	changes, err := m.QueryHistory(filter)
+	if err != nil {
+		return nil, err
+	}
+	// Names are matched as globs, only keep the exact name
+	matched := changes[:0]
+	for _, change := range changes {
+		if change.Name == name {
+			matched = append(matched, change)
+		}
+	}
+	return matched, nil
+}
+
+// neighbours returns the changes before and after a change to the same
+// object. They are looked up in memory, the store is only asked, bounded by
+// the change's time, for a neighbour that is not held there.
+func (m *K8sMonitor) neighbours(change Change) (previous, next *Change, err error) {
+	sameObject := func(other Change) bool {
+		return other.ResourceType == change.ResourceType && other.Namespace == change.Namespace && other.Name == change.Name
+	}
+
+	m.changesMutex.RLock()
+	for i := range m.changes {
+		if m.changes[i].ID != change.ID {
+			continue
+		}
+		for j := i - 1; j >= 0 && previous == nil; j-- {
+			if sameObject(m.changes[j]) {
+				found := m.changes[j]
+				previous = &found
+			}
+		}
+		for j := i + 1; j < len(m.changes) && next == nil; j++ {
+			if sameObject(m.changes[j]) {
+				found := m.changes[j]
+				next = &found
+			}
+		}
+		break
+	}
+	m.changesMutex.RUnlock()
+
+	if m.store == nil || previous != nil && next != nil {
+		return m.viewNeighbour(previous), m.viewNeighbour(next), nil
+	}
+	object := ChangeFilter{
+		ResourceTypes: []string{change.ResourceType},
+		Namespaces:    []string{change.Namespace},
+		Name:          change.Name,
+	}
+	if previous == nil {
+		filter := object
+		filter.To = change.Timestamp
+		filter.Limit = previousQueryLimit
+		stored, err := m.store.Query(filter)
+		if err != nil {
+			return nil, nil, err
+		}
+		previous = adjacentChange(stored, change, -1)
+	}
+	if next == nil {
+		filter := object
+		filter.From = change.Timestamp
+		stored, err := m.store.Query(filter)
+		if err != nil {
+			return nil, nil, err
+		}
+		next = adjacentChange(stored, change, 1)
+	}
+	return m.viewNeighbour(previous), m.viewNeighbour(next), nil
+}
+
+// adjacentChange returns the change step places from change among stored
+// changes, nil when change is not among them or has no such neighbour
+func adjacentChange(stored []Change, change Change, step int) *Change {
+	var matched []Change
+	for _, other := range stored {
+		// Names are matched as globs, only keep the exact name
+		if other.Name == change.Name {
+			matched = append(matched, other)
+		}
+	}
+	for i := range matched {
+		if matched[i].ID == change.ID {
+			if j := i + step; j >= 0 && j < len(matched) {
+				return &matched[j]
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// viewNeighbour adds the shared read state and acknowledgement to a neighbour
+func (m *K8sMonitor) viewNeighbour(change *Change) *Change {
+	if change == nil {
+		return nil
+	}
+	viewed := m.reads.view("", *change)
+	return &viewed
+}
+
+// GetChangeDetail returns a change held in memory with everything known about it
+func (m *K8sMonitor) GetChangeDetail(changeID string) (*ChangeDetail, error) {
+	change, ok := m.GetChange(changeID)
+	if !ok {
+		return nil, ErrChangeNotFound
+	}
+	detail := &ChangeDetail{Change: change}
+
+	previous, next, err := m.neighbours(change)
+	if err != nil {
+		return nil, err
+	}
+	detail.Previous, detail.Next = previous, next
+
+	before, hasBefore := m.snapshot(change.BeforeHash)
+	after, hasAfter := m.snapshot(change.AfterHash)
+	if hasBefore || hasAfter {
+		detail.Diff = diffFields(before, after)
+	} else {
+		for _, path := range change.ChangedPaths {
+			detail.Diff = append(detail.Diff, FieldDiff{Path: path})
+		}
+	}
+
+	// The owners come from the version of the object the change produced,
+	// or from the latest version seen when no snapshots are kept
+	object := after
+	if !hasAfter {
+		object = before
+	}
+	if object == nil {
+		m.objectsMutex.Lock()
+		object = m.objects[change.ResourceType+"/"+change.Namespace+"/"+change.Name]
+		m.objectsMutex.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), detailTimeout)
+	defer cancel()
+	if object != nil {
+		detail.Owners = m.resolveOwners(ctx, change.Namespace, ownerReferences(object), 1)
+	}
+	if detail.Events, err = m.relatedEvents(ctx, change); err != nil {
+		detail.EventsError = err.Error()
+	}
+	return detail, nil
+}
+
+// ownerReferences reads metadata.ownerReferences of an unstructured object
+func ownerReferences(object map[string]interface{}) []metav1.OwnerReference {
+	metadata, _ := object["metadata"].(map[string]interface{})
+	entries, _ := metadata["ownerReferences"].([]interface{})
+	var refs []metav1.OwnerReference
+	for _, entry := range entries {
+		fields, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ref := metav1.OwnerReference{}
+		ref.Kind, _ = fields["kind"].(string)
+		ref.Name, _ = fields["name"].(string)
+		uid, _ := fields["uid"].(string)
+		ref.UID = types.UID(uid)
+		if controller, ok := fields["controller"].(bool); ok {
+			ref.Controller = &controller
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// resolveOwners turns owner references into owners and follows them upwards,
+// through the objects the monitor has seen or else the API
+func (m *K8sMonitor) resolveOwners(ctx context.Context, namespace string, refs []metav1.OwnerReference, depth int) []Owner {
+	var owners []Owner
+	for _, ref := range refs {
+		owner := Owner{
+			Kind:       ref.Kind,
+			Name:       ref.Name,
+			UID:        string(ref.UID),
+			Controller: ref.Controller != nil && *ref.Controller,
+		}
+		for resourceType, kind := range resourceKinds {
+			if kind == ref.Kind {
+				owner.ResourceType = resourceType
+			}
+		}
+		if depth < maxOwnerDepth {
+			owner.Owners = m.resolveOwners(ctx, namespace, m.ownerReferencesOf(ctx, owner, namespace), depth+1)
+		}
+		owners = append(owners, owner)
+	}
+	return owners
+}
+
+// ownerReferencesOf returns the owner references of an owner, nil when it
+// is unknown
+func (m *K8sMonitor) ownerReferencesOf(ctx context.Context, owner Owner, namespace string) []metav1.OwnerReference {
+	if owner.ResourceType != "" {
+		m.objectsMutex.Lock()
+		object := m.objects[owner.ResourceType+"/"+namespace+"/"+owner.Name]
+		m.objectsMutex.Unlock()
+		if object != nil {
+			return ownerReferences(object)
+		}
+	}
+
+	if m.clientset == nil {
+		return nil
+	}
+	var obj metav1.Object
+	var err error
+	options := metav1.GetOptions{}
+	switch owner.Kind {
+	case "ReplicaSet":
+		obj, err = m.clientset.AppsV1().ReplicaSets(namespace).Get(ctx, owner.Name, options)
+	case "Deployment":
+		obj, err = m.clientset.AppsV1().Deployments(namespace).Get(ctx, owner.Name, options)
+	case "StatefulSet":
+		obj, err = m.clientset.AppsV1().StatefulSets(namespace).Get(ctx, owner.Name, options)
+	case "DaemonSet":
+		obj, err = m.clientset.AppsV1().DaemonSets(namespace).Get(ctx, owner.Name, options)
+	case "Job":
+		obj, err = m.clientset.BatchV1().Jobs(namespace).Get(ctx, owner.Name, options)
+	default:
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	return obj.GetOwnerReferences()
+}
+
+// relatedEvents returns the core Events about the changed object that were
+// seen within eventWindow of the change, oldest first
+func (m *K8sMonitor) relatedEvents(ctx context.Context, change Change) ([]CoreEvent, error) {
+	kind, ok := resourceKinds[change.ResourceType]
+	if !ok || m.clientset == nil {
+		return nil, nil
+	}
+	selector := fields.Set{
+		"involvedObject.kind": kind,
+		"involvedObject.name": change.Name,
+	}.AsSelector().String()
+	list, err := m.clientset.CoreV1().Events(change.Namespace).List(ctx, metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list events: %v", err)
+	}
+
+	from, to := change.Timestamp.Add(-eventWindow), change.Timestamp.Add(eventWindow)
+	var events []CoreEvent
+	for i := range list.Items {
+		event := &list.Items[i]
+		if event.InvolvedObject.Kind != kind || event.InvolvedObject.Name != change.Name {
+			continue
+		}
+		first, last := eventTimes(event)
+		if last.Before(from) || first.After(to) {
+			continue
+		}
+		events = append(events, CoreEvent{
+			Type:      event.Type,
+			Reason:    event.Reason,
+			Message:   event.Message,
+			Count:     event.Count,
+			FirstSeen: first,
+			LastSeen:  last,
+			Source:    event.Source.Component,
+		})
+	}
+	sort.SliceStable(events, func(a, b int) bool {
+		return events[a].FirstSeen.Before(events[b].FirstSeen)
+	})
+	return events, nil
+}
+
+// eventTimes returns when an Event was first and last seen, events.k8s.io
+// style events only set EventTime
+func eventTimes(event *v1.Event) (time.Time, time.Time) {
+	first, last := event.FirstTimestamp.Time, event.LastTimestamp.Time
+	if first.IsZero() {
+		first = event.EventTime.Time
+	}
+	if first.IsZero() {
+		first = event.CreationTimestamp.Time
+	}
+	if event.Series != nil && !event.Series.LastObservedTime.IsZero() {
+		last = event.Series.LastObservedTime.Time
+	}
+	if last.IsZero() {
+		last = first
+	}
+	return first, last
+}
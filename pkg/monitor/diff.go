@@ -0,0 +1,112 @@
+package monitor
+
+import (
+	"reflect"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// toUnstructured converts a typed object into its generic map form, dropping
+// bookkeeping fields that change on every update
+func toUnstructured(obj runtime.Object) map[string]interface{} {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil
+	}
+	if metadata, ok := content["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "managedFields")
+		delete(metadata, "resourceVersion")
+	}
+	return content
+}
+
+// FieldDiff is a field that differs between two versions of an object
+type FieldDiff struct {
+	Path   string      `json:"path"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// diffPaths returns the sorted dotted paths of all fields that differ between
+// two objects. Lists are compared as a whole.
+func diffPaths(before, after map[string]interface{}) []string {
+	var paths []string
+	for _, diff := range diffFields(before, after) {
+		paths = append(paths, diff.Path)
+	}
+	return paths
+}
+
+// diffFields returns the fields that differ between two objects with their
+// old and new values, sorted by path
+func diffFields(before, after map[string]interface{}) []FieldDiff {
+	var diffs []FieldDiff
+	collectDiffs("", before, after, &diffs)
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Path < diffs[j].Path
+	})
+	return diffs
+}
+
+func collectDiffs(prefix string, before, after map[string]interface{}, diffs *[]FieldDiff) {
+	for key, oldValue := range before {
+		path := joinPath(prefix, key)
+		newValue, ok := after[key]
+		if !ok {
+			*diffs = append(*diffs, FieldDiff{Path: path, Before: oldValue})
+			continue
+		}
+		oldMap, oldIsMap := oldValue.(map[string]interface{})
+		newMap, newIsMap := newValue.(map[string]interface{})
+		if oldIsMap && newIsMap {
+			collectDiffs(path, oldMap, newMap, diffs)
+		} else if !reflect.DeepEqual(oldValue, newValue) {
+			*diffs = append(*diffs, FieldDiff{Path: path, Before: oldValue, After: newValue})
+		}
+	}
+	for key, newValue := range after {
+		if _, ok := before[key]; !ok {
+			*diffs = append(*diffs, FieldDiff{Path: joinPath(prefix, key), After: newValue})
+		}
+	}
+}
+
+func joinPath(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// lastActor returns the field manager that most recently touched the object
+func lastActor(obj metav1.Object) string {
+	var actor string
+	var latest metav1.Time
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Time != nil && !entry.Time.Before(&latest) {
+			latest = *entry.Time
+			actor = entry.Manager
+		}
+	}
+	return actor
+}
+
+// recordObject remembers the latest version of an object and returns it
+// together with the previous version that was seen, if any
+func (m *K8sMonitor) recordObject(resourceType, resourceKey, eventType string, obj runtime.Object) (previous, current map[string]interface{}) {
+	key := resourceType + "/" + resourceKey
+	current = toUnstructured(obj)
+
+	m.objectsMutex.Lock()
+	defer m.objectsMutex.Unlock()
+
+	previous = m.objects[key]
+	if eventType == "DELETED" {
+		delete(m.objects, key)
+	} else if current != nil {
+		m.objects[key] = current
+	}
+	return previous, current
+}
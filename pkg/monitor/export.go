@@ -0,0 +1,260 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s-monitor/pkg/utils"
+)
+
+// Export formats
+const (
+	FormatNDJSON = "ndjson" // one change per line
+	FormatCSV    = "csv"    // one change per row, lists joined with ";"
+	FormatNative = "native" // the changes.json format
+)
+
+// ExportFormats lists the supported export and import formats
+var ExportFormats = []string{FormatNDJSON, FormatCSV, FormatNative}
+
+// csvColumns are the columns of the CSV format, in order
+var csvColumns = []string{
+	"id", "timestamp", "resourceType", "namespace", "name", "eventType", "severity",
+	"details", "actor", "changedPaths", "tags", "beforeHash", "afterHash", "isRead",
+}
+
+// WriteChanges writes changes to w in the given format
+func WriteChanges(w io.Writer, format string, changes []Change) error {
+	switch format {
+	case FormatNDJSON:
+		encoder := json.NewEncoder(w)
+		for _, change := range changes {
+			if err := encoder.Encode(change); err != nil {
+				return fmt.Errorf("failed to write change: %v", err)
+			}
+		}
+		return nil
+	case FormatCSV:
+		return writeChangesCSV(w, changes)
+	case FormatNative:
+		raw := make([]json.RawMessage, 0, len(changes))
+		for _, change := range changes {
+			data, err := json.Marshal(change)
+			if err != nil {
+				return fmt.Errorf("failed to marshal change: %v", err)
+			}
+			raw = append(raw, data)
+		}
+		data, err := json.MarshalIndent(utils.ChangeFileData{SavedAt: time.Now(), SchemaVersion: currentSchema, Changes: raw}, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal changes: %v", err)
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	default:
+		return fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(ExportFormats, ", "))
+	}
+}
+
+func writeChangesCSV(w io.Writer, changes []Change) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvColumns); err != nil {
+		return fmt.Errorf("failed to write CSV: %v", err)
+	}
+	for _, c := range changes {
+		row := []string{
+			c.ID, c.Timestamp.Format(time.RFC3339Nano), c.ResourceType, c.Namespace, c.Name, c.EventType, c.Severity,
+			c.Details, c.Actor, strings.Join(c.ChangedPaths, ";"), strings.Join(c.Tags, ";"), c.BeforeHash, c.AfterHash,
+			strconv.FormatBool(c.IsRead),
+		}
+		if err := writer.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV: %v", err)
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ReadChanges reads changes written by WriteChanges or by older versions in
+// the native format, upgrading them to the current schema. Records that
+// cannot be decoded are skipped, the second result says how many.
+func ReadChanges(r io.Reader, format string) ([]Change, int, error) {
+	switch format {
+	case FormatNDJSON:
+		var changes []Change
+		invalid := 0
+		reader := bufio.NewReader(r)
+		for {
+			line, readErr := reader.ReadBytes('\n')
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				if change, err := decodeChange(currentSchema, line); err == nil {
+					changes = append(changes, change)
+				} else {
+					invalid++
+				}
+			}
+			if readErr == io.EOF {
+				return changes, invalid, nil
+			}
+			if readErr != nil {
+				return nil, invalid, fmt.Errorf("failed to read changes: %v", readErr)
+			}
+		}
+	case FormatCSV:
+		return readChangesCSV(r)
+	case FormatNative:
+		var fileData utils.ChangeFileData
+		if err := json.NewDecoder(r).Decode(&fileData); err != nil {
+			return nil, 0, fmt.Errorf("failed to parse changes: %v", err)
+		}
+		schema := fileData.SchemaVersion
+		if schema == 0 {
+			schema = schemaBaseline
+		}
+		var changes []Change
+		invalid := 0
+		for _, data := range fileData.Changes {
+			if change, err := decodeChange(schema, data); err == nil {
+				changes = append(changes, change)
+			} else {
+				invalid++
+			}
+		}
+		return changes, invalid, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown format %q, expected one of %s", format, strings.Join(ExportFormats, ", "))
+	}
+}
+
+// readChangesCSV reads CSV with a header row, columns may come in any order
+func readChangesCSV(r io.Reader) ([]Change, int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read CSV: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+
+	var changes []Change
+	invalid := 0
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return changes, invalid, nil
+		}
+		if err != nil {
+			return nil, invalid, fmt.Errorf("failed to read CSV: %v", err)
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		list := func(name string) []string {
+			if value := field(name); value != "" {
+				return strings.Split(value, ";")
+			}
+			return nil
+		}
+
+		timestamp, err := time.Parse(time.RFC3339Nano, field("timestamp"))
+		if err != nil || field("id") == "" {
+			invalid++
+			continue
+		}
+		isRead, _ := strconv.ParseBool(field("isRead"))
+		changes = append(changes, Change{
+			ID:           field("id"),
+			Timestamp:    timestamp,
+			ResourceType: field("resourceType"),
+			Namespace:    field("namespace"),
+			Name:         field("name"),
+			EventType:    field("eventType"),
+			Severity:     field("severity"),
+			Details:      field("details"),
+			Actor:        field("actor"),
+			ChangedPaths: list("changedPaths"),
+			Tags:         list("tags"),
+			BeforeHash:   field("beforeHash"),
+			AfterHash:    field("afterHash"),
+			IsRead:       isRead,
+		})
+	}
+}
+
+// ImportChanges stores the changes whose ID is not stored yet and returns how
+// many were imported, so merging the histories of two instances is safe.
+// Changes older than persistence.historyMaxAge would be removed by the next
+// compaction, they are skipped and counted as expired.
+func (m *K8sMonitor) ImportChanges(changes []Change) (imported, expired int, err error) {
+	if m.store == nil {
+		return 0, 0, fmt.Errorf("the change store could not be opened")
+	}
+
+	if horizon := m.historyHorizon(time.Now()); !horizon.IsZero() {
+		kept := changes[:0]
+		for _, change := range changes {
+			if change.Timestamp.Before(horizon) {
+				expired++
+				continue
+			}
+			kept = append(kept, change)
+		}
+		changes = kept
+	}
+	if len(changes) == 0 {
+		return 0, expired, nil
+	}
+
+	sort.SliceStable(changes, func(a, b int) bool {
+		return changes[a].Timestamp.Before(changes[b].Timestamp)
+	})
+	existing, err := m.QueryHistory(ChangeFilter{From: changes[0].Timestamp, To: changes[len(changes)-1].Timestamp})
+	if err != nil {
+		return 0, expired, err
+	}
+	seen := make(map[string]bool, len(existing))
+	for _, change := range existing {
+		seen[change.ID] = true
+	}
+
+	var added []Change
+	for i := range changes {
+		change := changes[i]
+		if seen[change.ID] {
+			continue
+		}
+		seen[change.ID] = true
+		// Sequence numbers belong to the instance that recorded the change
+		change.Seq = 0
+		if !IsValidSeverity(change.Severity) {
+			change.Severity = m.classifySeverity(change.ResourceType, change.EventType, nil)
+		}
+		added = append(added, change)
+	}
+
+	// Offline the store is written directly, there is no writer
+	if m.writer == nil {
+		return len(added), expired, m.store.Append(added...)
+	}
+	for i := range added {
+		m.record(journalRecord{Op: opChange, Time: added[i].Timestamp, Change: &added[i]})
+	}
+	return len(added), expired, m.writer.Flush()
+}
@@ -13,7 +13,9 @@ import (
 	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	v1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 
@@ -23,27 +25,117 @@ import (
 
 type Change struct {
 	ID           string    `json:"id"`
+	Seq          uint64    `json:"seq,omitempty"` // increases with every change this instance records
 	Timestamp    time.Time `json:"timestamp"`
 	EventType    string    `json:"eventType"`
 	ResourceType string    `json:"resourceType"`
 	Namespace    string    `json:"namespace"`
 	Name         string    `json:"name"`
 	Details      string    `json:"details"`
+	Severity     string    `json:"severity"`
+	Actor        string    `json:"actor,omitempty"`
+	ChangedPaths []string  `json:"changedPaths,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+	BeforeHash   string    `json:"beforeHash,omitempty"` // snapshot of the object before the change
+	AfterHash    string    `json:"afterHash,omitempty"`  // snapshot of the object after the change
 	IsRead       bool      `json:"isRead"`
+
+	// Acknowledgement is added when a change is served, see readState
+	Acknowledgement *Acknowledgement `json:"acknowledgement,omitempty"`
 }
 
 type K8sMonitor struct {
-	clientset      *kubernetes.Clientset
+	clientset      kubernetes.Interface
 	config         *config.Config
 	changes        []Change
 	changesMutex   sync.RWMutex
+	lastSeq        uint64 // sequence number of the newest change, guarded by changesMutex
 	startTime      time.Time
 	stopChan       chan struct{}
 	knownResources map[string]map[string]string // resourceType -> namespace/name -> resourceVersion
 	resourcesMutex sync.RWMutex
+
+	// Retention bookkeeping, guarded by changesMutex
+	evictions        map[string]int64 // eviction reason -> count
+	lastRetentionRun time.Time
+
+	rules        *ruleEngine
+	snapshots    *snapshotStore
+	objects      map[string]map[string]interface{} // resourceType/namespace/name -> last seen object
+	objectsMutex sync.Mutex
+
+	// Persistence, records are queued in the writer until the next flush
+	store    ChangeStore
+	writer   *storeWriter
+	blobs    *utils.BlobStore
+	recovery []utils.RecoveryReport // damaged files salvaged on load
+	invalid  *invalidRecords        // persisted records that could not be decoded
+	keyring  *utils.Keyring         // encrypts persisted data when set
+
+	stream *streamHub // pushes changes, read updates and stats to subscribers
+
+	watchers      map[string]context.CancelFunc // resource name -> stops its watcher
+	watchersMutex sync.Mutex
+	// resourceConfigMutex serializes updates of config.Resources
+	resourceConfigMutex sync.Mutex
+	audit               *auditLog
+	reads               *readState // per-user read state and acknowledgements
 }
 
-func NewK8sMonitor(clientset *kubernetes.Clientset, cfg *config.Config) (*K8sMonitor, error) {
+func NewK8sMonitor(clientset kubernetes.Interface, cfg *config.Config) (*K8sMonitor, error) {
+	monitor, err := newMonitor(clientset, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load existing changes from file if persistence is enabled
+	if cfg.Persistence.Enabled {
+		if err := checkPersistence(cfg.Persistence); err != nil {
+			return nil, err
+		}
+		monitor.loadFromFile()
+
+		// Populate known resources from loaded changes to avoid duplicate ADDED events
+		monitor.populateKnownResourcesFromChanges()
+
+		if store := monitor.auditBackend(); store != nil {
+			if err := monitor.audit.open(store); err != nil {
+				log.Printf("Warning: Could not load audit log: %v", err)
+			}
+		}
+		if monitor.store != nil {
+			if err := monitor.reads.open(monitor.store); err != nil {
+				log.Printf("Warning: Could not load read state: %v", err)
+			}
+		}
+		monitor.pruneReadState()
+	}
+
+	return monitor, nil
+}
+
+// LoadHistory creates a monitor without a cluster connection that only holds
+// the persisted history, for offline queries such as the CLI subcommands.
+// The store is opened as it is, nothing is migrated or removed.
+func LoadHistory(cfg *config.Config) (*K8sMonitor, error) {
+	monitor, err := newMonitor(nil, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Persistence.Enabled {
+		return nil, fmt.Errorf("persistence is not enabled")
+	}
+	if err := checkPersistence(cfg.Persistence); err != nil {
+		return nil, err
+	}
+
+	if err := monitor.openHistory(); err != nil {
+		return nil, err
+	}
+	return monitor, nil
+}
+
+func newMonitor(clientset kubernetes.Interface, cfg *config.Config) (*K8sMonitor, error) {
 	monitor := &K8sMonitor{
 		clientset:      clientset,
 		config:         cfg,
@@ -51,6 +143,19 @@ func NewK8sMonitor(clientset *kubernetes.Clientset, cfg *config.Config) (*K8sMon
 		startTime:      time.Now(),
 		stopChan:       make(chan struct{}),
 		knownResources: make(map[string]map[string]string),
+		evictions:      make(map[string]int64),
+		rules:          newRuleEngine(),
+		snapshots:      newSnapshotStore(),
+		invalid:        newInvalidRecords(),
+		objects:        make(map[string]map[string]interface{}),
+		stream:         newStreamHub(),
+		watchers:       make(map[string]context.CancelFunc),
+		audit:          newAuditLog(),
+		reads:          newReadState(),
+	}
+
+	if err := monitor.ReloadRules(cfg.Rules); err != nil {
+		return nil, fmt.Errorf("invalid rules: %v", err)
 	}
 
 	// Initialize known resources map
@@ -60,41 +165,6 @@ func NewK8sMonitor(clientset *kubernetes.Clientset, cfg *config.Config) (*K8sMon
 		}
 	}
 
-	// Load existing changes from file if persistence is enabled
-	if cfg.Persistence.Enabled {
-		if loadedChanges, err := utils.LoadChangesFromFile(cfg.Persistence.FilePath); err == nil {
-			// Convert loaded changes back to Change structs
-			for _, changeData := range loadedChanges {
-				if changeMap, ok := changeData.(map[string]interface{}); ok {
-					change := Change{
-						ID:           getString(changeMap, "id"),
-						Timestamp:    getTime(changeMap, "timestamp"),
-						EventType:    getString(changeMap, "eventType"),
-						ResourceType: getString(changeMap, "resourceType"),
-						Namespace:    getString(changeMap, "namespace"),
-						Name:         getString(changeMap, "name"),
-						Details:      getString(changeMap, "details"),
-						IsRead:       getBool(changeMap, "isRead"),
-					}
-					monitor.changes = append(monitor.changes, change)
-				}
-			}
-			if cfg.Logging.Enabled && cfg.Logging.LogOperations {
-				log.Printf("Loaded %d changes from %s", len(monitor.changes), cfg.Persistence.FilePath)
-			}
-		} else {
-			if cfg.Logging.Enabled && cfg.Logging.LogOperations {
-				log.Printf("Could not load changes from file: %v", err)
-			}
-		}
-
-		// Populate known resources from loaded changes to avoid duplicate ADDED events
-		monitor.populateKnownResourcesFromChanges()
-
-		// Create initial empty file if it doesn't exist
-		monitor.saveToFile()
-	}
-
 	return monitor, nil
 }
 
@@ -107,19 +177,41 @@ func (m *K8sMonitor) StartMonitoring() error {
 	}
 
 	for _, resource := range enabledResources {
-		go m.startResourceWatcher(resource)
+		m.startWatcher(resource)
 	}
 
-	// Start auto-save goroutine if persistence is enabled
-	if m.config.Persistence.Enabled && m.config.Persistence.AutoSave {
-		go m.startAutoSave()
-	}
+	go m.startRetention()
+	go m.startStreamStats()
 
 	log.Printf("Started monitoring %d enabled Kubernetes resources...", len(enabledResources))
 	return nil
 }
 
-func (m *K8sMonitor) startResourceWatcher(resource config.ResourceConfig) {
+// startWatcher starts watching a resource, stopping its previous watcher
+func (m *K8sMonitor) startWatcher(resource config.ResourceConfig) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.watchersMutex.Lock()
+	if stop, ok := m.watchers[resource.Name]; ok {
+		stop()
+	}
+	m.watchers[resource.Name] = cancel
+	m.watchersMutex.Unlock()
+
+	go m.startResourceWatcher(ctx, resource)
+}
+
+// stopWatcher stops the watcher of a resource, if it has one
+func (m *K8sMonitor) stopWatcher(name string) {
+	m.watchersMutex.Lock()
+	defer m.watchersMutex.Unlock()
+	if stop, ok := m.watchers[name]; ok {
+		stop()
+		delete(m.watchers, name)
+		log.Printf("Stopped watcher for %s", name)
+	}
+}
+
+func (m *K8sMonitor) startResourceWatcher(ctx context.Context, resource config.ResourceConfig) {
 	log.Printf("Starting watcher for %s (namespace: %s)", resource.Name, resource.Namespace)
 
 	for {
@@ -133,55 +225,86 @@ func (m *K8sMonitor) startResourceWatcher(resource config.ResourceConfig) {
 
 		listOptions := metav1.ListOptions{
 			ResourceVersion: "0", // Start from current version to only get new changes
+			LabelSelector:   resource.LabelSelector,
+			FieldSelector:   resource.FieldSelector,
 		}
 
 		switch resource.Name {
 		case "pods":
-			watcher, err = m.clientset.CoreV1().Pods(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.CoreV1().Pods(namespace).Watch(ctx, listOptions)
 		case "deployments":
-			watcher, err = m.clientset.AppsV1().Deployments(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.AppsV1().Deployments(namespace).Watch(ctx, listOptions)
 		case "services":
-			watcher, err = m.clientset.CoreV1().Services(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.CoreV1().Services(namespace).Watch(ctx, listOptions)
 		case "configmaps":
-			watcher, err = m.clientset.CoreV1().ConfigMaps(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.CoreV1().ConfigMaps(namespace).Watch(ctx, listOptions)
 		case "secrets":
-			watcher, err = m.clientset.CoreV1().Secrets(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.CoreV1().Secrets(namespace).Watch(ctx, listOptions)
 		case "replicasets":
-			watcher, err = m.clientset.AppsV1().ReplicaSets(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.AppsV1().ReplicaSets(namespace).Watch(ctx, listOptions)
 		case "daemonsets":
-			watcher, err = m.clientset.AppsV1().DaemonSets(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.AppsV1().DaemonSets(namespace).Watch(ctx, listOptions)
 		case "statefulsets":
-			watcher, err = m.clientset.AppsV1().StatefulSets(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.AppsV1().StatefulSets(namespace).Watch(ctx, listOptions)
 		case "jobs":
-			watcher, err = m.clientset.BatchV1().Jobs(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.BatchV1().Jobs(namespace).Watch(ctx, listOptions)
 		case "cronjobs":
-			watcher, err = m.clientset.BatchV1beta1().CronJobs(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.BatchV1beta1().CronJobs(namespace).Watch(ctx, listOptions)
 		case "persistentvolumes":
-			watcher, err = m.clientset.CoreV1().PersistentVolumes().Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.CoreV1().PersistentVolumes().Watch(ctx, listOptions)
 		case "persistentvolumeclaims":
-			watcher, err = m.clientset.CoreV1().PersistentVolumeClaims(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.CoreV1().PersistentVolumeClaims(namespace).Watch(ctx, listOptions)
 		case "ingresses":
-			watcher, err = m.clientset.NetworkingV1().Ingresses(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.NetworkingV1().Ingresses(namespace).Watch(ctx, listOptions)
 		case "networkpolicies":
-			watcher, err = m.clientset.NetworkingV1().NetworkPolicies(namespace).Watch(context.TODO(), listOptions)
+			watcher, err = m.clientset.NetworkingV1().NetworkPolicies(namespace).Watch(ctx, listOptions)
 		default:
 			log.Printf("Unknown resource type: %s", resource.Name)
 			return
 		}
 
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			log.Printf("Error watching %s: %v", resource.Name, err)
-			time.Sleep(5 * time.Second)
+			if !sleepContext(ctx, 5*time.Second) {
+				return
+			}
 			continue
 		}
 
-		for event := range watcher.ResultChan() {
-			m.handleEvent(resource.Name, event)
+	events:
+		for {
+			select {
+			case event, ok := <-watcher.ResultChan():
+				if !ok {
+					break events
+				}
+				m.handleEvent(resource.Name, event)
+			case <-ctx.Done():
+				watcher.Stop()
+				return
+			}
 		}
 
 		// If we reach here, the watcher closed, restart it
 		log.Printf("Watcher for %s closed, restarting...", resource.Name)
-		time.Sleep(1 * time.Second)
+		if !sleepContext(ctx, 1*time.Second) {
+			return
+		}
+	}
+}
+
+// sleepContext waits for d, false when ctx was cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
@@ -278,6 +401,7 @@ func (m *K8sMonitor) handleEvent(resourceType string, event watch.Event) {
 	}
 
 	resourceKey := fmt.Sprintf("%s/%s", namespace, name)
+	previous, current := m.recordObject(resourceType, resourceKey, string(event.Type), event.Object)
 
 	// Check if this is a truly new resource or just a restart
 	m.resourcesMutex.Lock()
@@ -301,26 +425,43 @@ func (m *K8sMonitor) handleEvent(resourceType string, event watch.Event) {
 		Namespace:    namespace,
 		Name:         name,
 		Details:      details,
+		Severity:     m.classifySeverity(resourceType, string(event.Type), event.Object),
 		IsRead:       false,
 	}
+	if change.EventType == "MODIFIED" && previous != nil && current != nil {
+		change.ChangedPaths = diffPaths(previous, current)
+	}
+
+	var labels map[string]string
+	if metaObj, ok := event.Object.(metav1.Object); ok {
+		labels = metaObj.GetLabels()
+		change.Actor = lastActor(metaObj)
+	}
+
+	if m.applyRules(&change, labels) {
+		return
+	}
+
+	m.storeSnapshots(&change, previous, current)
 
 	m.changesMutex.Lock()
+	m.lastSeq++
+	change.Seq = m.lastSeq
 	m.changes = append(m.changes, change)
-	// Keep only last 1000 changes to prevent memory issues
-	if len(m.changes) > 1000 {
-		m.changes = m.changes[len(m.changes)-1000:]
+	// Enforce the retention policy early once the count limit is exceeded by
+	// more than 10%, the background sweep takes care of everything else
+	if maxCount := m.config.Retention.MaxCount; maxCount > 0 && len(m.changes) > maxCount+maxCount/10 {
+		m.evictLocked(change.Timestamp)
 	}
 	m.changesMutex.Unlock()
 
+	m.record(journalRecord{Op: opChange, Time: change.Timestamp, Change: &change}, change.BeforeHash, change.AfterHash)
+	m.stream.publish(StreamEvent{Type: StreamChange, Change: &change})
+
 	if m.config.Logging.Enabled && m.config.Logging.LogChanges {
 		log.Printf("Change detected: %s %s/%s in %s",
 			change.EventType, change.ResourceType, change.Name, change.Namespace)
 	}
-
-	// Save to file immediately if persistence is enabled and not auto-saving
-	if m.config.Persistence.Enabled && !m.config.Persistence.AutoSave {
-		go m.saveToFile()
-	}
 }
 
 func (m *K8sMonitor) isPodReady(pod *v1.Pod) bool {
@@ -342,51 +483,180 @@ func (m *K8sMonitor) GetChanges() []Change {
 	return changes
 }
 
+// GetChangesBySeverity returns a copy of the changes with one of the given severities
+func (m *K8sMonitor) GetChangesBySeverity(severities ...string) []Change {
+	m.changesMutex.RLock()
+	defer m.changesMutex.RUnlock()
+
+	wanted := make(map[string]bool, len(severities))
+	for _, severity := range severities {
+		wanted[severity] = true
+	}
+
+	changes := []Change{}
+	for _, change := range m.changes {
+		if wanted[change.Severity] {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// prepareFilter lets a filter make its authorization decisions about the
+// changes held in memory before they are filtered under the lock
+func (m *K8sMonitor) prepareFilter(filter ChangeFilter) {
+	if filter.Prepare == nil {
+		return
+	}
+	m.changesMutex.RLock()
+	scopes := distinctScopes(m.changes)
+	m.changesMutex.RUnlock()
+	if len(scopes) > 0 {
+		filter.Prepare(scopes)
+	}
+}
+
+// ChangePage is one page of the changes held in memory
+type ChangePage struct {
+	Changes []Change
+	Total   int    // changes matching the filter on all pages
+	Next    uint64 // cursor of the next page, 0 on the last page
+}
+
+// PageChanges returns up to limit changes matching filter, newest or oldest
+// first. Pages continue after the change whose sequence number is cursor, so
+// changes recorded while paging do not shift later pages. A limit of 0
+// returns every match.
+func (m *K8sMonitor) PageChanges(filter ChangeFilter, newestFirst bool, cursor uint64, limit int) ChangePage {
+	m.prepareFilter(filter)
+	m.changesMutex.RLock()
+	defer m.changesMutex.RUnlock()
+
+	m.reads.mutex.Lock()
+	defer m.reads.mutex.Unlock()
+
+	page := ChangePage{Changes: []Change{}}
+	for i := range m.changes {
+		change := m.changes[i]
+		if newestFirst {
+			change = m.changes[len(m.changes)-1-i]
+		}
+		change = m.reads.viewLocked(filter.User, change)
+		if !filter.inRange(change.Timestamp) || !filter.matches(change) {
+			continue
+		}
+		page.Total++
+
+		if cursor != 0 && (newestFirst && change.Seq >= cursor || !newestFirst && change.Seq <= cursor) {
+			continue
+		}
+		if limit > 0 && len(page.Changes) == limit {
+			page.Next = page.Changes[limit-1].Seq
+			continue
+		}
+		page.Changes = append(page.Changes, change)
+	}
+	return page
+}
+
 func (m *K8sMonitor) GetStats() map[string]interface{} {
+	return m.GetStatsBySeverity()
+}
+
+// GetStatsBySeverity computes the statistics over the changes with one of the
+// given severities. Without severities all changes are counted.
+func (m *K8sMonitor) GetStatsBySeverity(severities ...string) map[string]interface{} {
+	return m.GetStatsFiltered(ChangeFilter{Severities: severities})
+}
+
+// GetStatsFiltered computes the statistics over the changes matching filter,
+// unread counts are those of the filter's user. With an Allow check the
+// sections about the monitor itself, which count every change, are left out.
+func (m *K8sMonitor) GetStatsFiltered(filter ChangeFilter) map[string]interface{} {
+	m.prepareFilter(filter)
 	m.changesMutex.RLock()
 	defer m.changesMutex.RUnlock()
+	m.reads.mutex.Lock()
+	defer m.reads.mutex.Unlock()
 
+	totalCount := 0
 	unreadCount := 0
+	unacknowledgedCount := 0
 	loadedFromFile := 0
 
+	// Count by event type, resource type and severity
+	eventCounts := make(map[string]int)
+	resourceCounts := make(map[string]int)
+	severityCounts := make(map[string]int)
+	unreadSeverityCounts := make(map[string]int)
+	unacknowledgedSeverityCounts := make(map[string]int)
+	for _, severity := range Severities {
+		severityCounts[severity] = 0
+		unreadSeverityCounts[severity] = 0
+		unacknowledgedSeverityCounts[severity] = 0
+	}
+
 	for _, change := range m.changes {
+		change = m.reads.viewLocked(filter.User, change)
+		if !filter.inRange(change.Timestamp) || !filter.matches(change) {
+			continue
+		}
+		totalCount++
 		if !change.IsRead {
 			unreadCount++
+			unreadSeverityCounts[change.Severity]++
+		}
+		if change.Acknowledgement == nil {
+			unacknowledgedCount++
+			unacknowledgedSeverityCounts[change.Severity]++
 		}
 		// Count changes that were loaded from file (before current session)
 		if change.Timestamp.Before(m.startTime) {
 			loadedFromFile++
 		}
+		eventCounts[change.EventType]++
+		resourceCounts[change.ResourceType]++
+		severityCounts[change.Severity]++
 	}
 
 	stats := map[string]interface{}{
-		"totalChanges":   len(m.changes),
-		"unreadChanges":  unreadCount,
-		"loadedFromFile": loadedFromFile,
-		"currentSession": len(m.changes) - loadedFromFile,
-		"startTime":      m.startTime,
-		"uptime":         time.Since(m.startTime).String(),
-	}
-
-	// Count by event type
-	eventCounts := make(map[string]int)
-	resourceCounts := make(map[string]int)
-
-	for _, change := range m.changes {
-		eventCounts[change.EventType]++
-		resourceCounts[change.ResourceType]++
+		"totalChanges":          totalCount,
+		"unreadChanges":         unreadCount,
+		"unacknowledgedChanges": unacknowledgedCount,
+		"loadedFromFile":        loadedFromFile,
+		"currentSession":        totalCount - loadedFromFile,
+		"startTime":             m.startTime,
+		"uptime":                time.Since(m.startTime).String(),
 	}
 
 	stats["eventCounts"] = eventCounts
 	stats["resourceCounts"] = resourceCounts
+	stats["severityCounts"] = severityCounts
+	stats["unreadSeverityCounts"] = unreadSeverityCounts
+	stats["unacknowledgedSeverityCounts"] = unacknowledgedSeverityCounts
+	if filter.User != "" {
+		stats["user"] = filter.User
+	}
+	if filter.Allow != nil {
+		return stats
+	}
+	stats["retention"] = m.retentionStats()
+	stats["rules"] = m.rulesStats()
+	stats["stream"] = m.stream.stats()
+	if m.config.Persistence.StoreSnapshots {
+		stats["snapshots"] = m.snapshots.stats()
+	}
+	if storage := m.storeStats(); storage != nil {
+		stats["storage"] = storage
+	}
 
 	return stats
 }
 
 func (m *K8sMonitor) MarkAllAsRead() int {
-	m.changesMutex.Lock()
-	defer m.changesMutex.Unlock()
+	now := time.Now()
 
+	m.changesMutex.Lock()
 	count := 0
 	for i := range m.changes {
 		if !m.changes[i].IsRead {
@@ -394,6 +664,12 @@ func (m *K8sMonitor) MarkAllAsRead() int {
 			count++
 		}
 	}
+	m.changesMutex.Unlock()
+
+	if count > 0 {
+		m.record(journalRecord{Op: opReadAll, Time: now})
+		m.stream.publish(StreamEvent{Type: StreamRead, Before: &now})
+	}
 
 	if m.config.Logging.Enabled && m.config.Logging.LogOperations {
 		log.Printf("Marked %d changes as read", count)
@@ -403,16 +679,21 @@ func (m *K8sMonitor) MarkAllAsRead() int {
 
 func (m *K8sMonitor) MarkAsRead(changeID string) bool {
 	m.changesMutex.Lock()
-	defer m.changesMutex.Unlock()
-
+	found := false
 	for i := range m.changes {
 		if m.changes[i].ID == changeID {
 			m.changes[i].IsRead = true
-			return true
+			found = true
+			break
 		}
 	}
+	m.changesMutex.Unlock()
 
-	return false
+	if found {
+		m.record(journalRecord{Op: opRead, Time: time.Now(), IDs: []string{changeID}})
+		m.stream.publish(StreamEvent{Type: StreamRead, IDs: []string{changeID}})
+	}
+	return found
 }
 
 func generateID() string {
@@ -425,90 +706,42 @@ func (m *K8sMonitor) GetConfig() *config.Config {
 	return m.config
 }
 
-func (m *K8sMonitor) startAutoSave() {
-	interval := time.Duration(m.config.Persistence.SaveInterval) * time.Second
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			m.saveToFile()
-		case <-m.stopChan:
-			return
-		}
-	}
-}
-
-func (m *K8sMonitor) saveToFile() {
-	if !m.config.Persistence.Enabled {
-		return
-	}
-
-	m.changesMutex.RLock()
-	// Convert changes to interface{} slice for utils function
-	changes := make([]interface{}, len(m.changes))
-	for i, change := range m.changes {
-		changes[i] = change
-	}
-	m.changesMutex.RUnlock()
-
-	if err := utils.SaveChangesToFile(m.config.Persistence.FilePath, changes); err != nil {
-		if m.config.Logging.Enabled && m.config.Logging.LogOperations {
-			log.Printf("Error saving changes to file: %v", err)
-		}
-	} else {
-		if m.config.Logging.Enabled && m.config.Logging.LogOperations {
-			log.Printf("Saved %d changes to %s", len(changes), m.config.Persistence.FilePath)
-		}
-	}
-}
-
 func (m *K8sMonitor) SaveToFileNow() error {
 	if !m.config.Persistence.Enabled {
 		return fmt.Errorf("persistence is not enabled")
 	}
 
-	m.saveToFile()
-	return nil
+	if m.writer == nil {
+		return fmt.Errorf("the change store could not be opened")
+	}
+	return m.writer.Flush()
 }
 
 func (m *K8sMonitor) Stop() {
 	close(m.stopChan)
+	m.stream.closeAll()
+
+	m.watchersMutex.Lock()
+	for name, stop := range m.watchers {
+		stop()
+		delete(m.watchers, name)
+	}
+	m.watchersMutex.Unlock()
 
 	// Save changes one last time before stopping
 	if m.config.Persistence.Enabled {
-		m.saveToFile()
+		if m.writer != nil {
+			m.writer.close()
+		}
+		if m.store != nil {
+			m.store.Close()
+		}
 		if m.config.Logging.Enabled && m.config.Logging.LogOperations {
 			log.Println("Final save completed")
 		}
 	}
 }
 
-// Helper functions for loading changes from file
-func getString(m map[string]interface{}, key string) string {
-	if val, ok := m[key].(string); ok {
-		return val
-	}
-	return ""
-}
-
-func getBool(m map[string]interface{}, key string) bool {
-	if val, ok := m[key].(bool); ok {
-		return val
-	}
-	return false
-}
-
-func getTime(m map[string]interface{}, key string) time.Time {
-	if val, ok := m[key].(string); ok {
-		if t, err := time.Parse(time.RFC3339, val); err == nil {
-			return t
-		}
-	}
-	return time.Now()
-}
-
 func (m *K8sMonitor) populateKnownResourcesFromChanges() {
 	m.resourcesMutex.Lock()
 	defer m.resourcesMutex.Unlock()
@@ -530,90 +763,85 @@ func (m *K8sMonitor) populateCurrentState() error {
 	enabledResources := m.config.GetEnabledResources()
 
 	for _, resource := range enabledResources {
-		namespace := resource.Namespace
-		if namespace == "" {
-			namespace = metav1.NamespaceAll
-		}
-
-		switch resource.Name {
-		case "pods":
-			if err := m.populatePods(namespace); err != nil {
-				log.Printf("Error populating pods: %v", err)
-			}
-		case "deployments":
-			if err := m.populateDeployments(namespace); err != nil {
-				log.Printf("Error populating deployments: %v", err)
-			}
-		case "services":
-			if err := m.populateServices(namespace); err != nil {
-				log.Printf("Error populating services: %v", err)
-			}
-			// Add other resource types as needed
-		}
+		m.populateResource(resource)
 	}
 
 	return nil
 }
 
-func (m *K8sMonitor) populatePods(namespace string) error {
-	pods, err := m.clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		return err
+// populateResource records the existing objects of one resource, so its
+// watcher does not report them as added. What was known about the resource
+// is replaced, objects outside a new namespace or selector are forgotten.
+func (m *K8sMonitor) populateResource(resource config.ResourceConfig) {
+	namespace := resource.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceAll
 	}
-
-	m.resourcesMutex.Lock()
-	defer m.resourcesMutex.Unlock()
-
-	for _, pod := range pods.Items {
-		resourceKey := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
-		if m.knownResources["pods"] == nil {
-			m.knownResources["pods"] = make(map[string]string)
-		}
-		m.knownResources["pods"][resourceKey] = pod.ResourceVersion
+	options := metav1.ListOptions{
+		LabelSelector: resource.LabelSelector,
+		FieldSelector: resource.FieldSelector,
 	}
 
-	log.Printf("Populated %d existing pods", len(pods.Items))
-	return nil
-}
-
-func (m *K8sMonitor) populateDeployments(namespace string) error {
-	deployments, err := m.clientset.AppsV1().Deployments(namespace).List(context.TODO(), metav1.ListOptions{})
+	list, err := m.listResource(context.TODO(), resource.Name, namespace, options)
 	if err != nil {
-		return err
+		log.Printf("Error populating %s: %v", resource.Name, err)
+		return
 	}
-
-	m.resourcesMutex.Lock()
-	defer m.resourcesMutex.Unlock()
-
-	for _, deployment := range deployments.Items {
-		resourceKey := fmt.Sprintf("%s/%s", deployment.Namespace, deployment.Name)
-		if m.knownResources["deployments"] == nil {
-			m.knownResources["deployments"] = make(map[string]string)
-		}
-		m.knownResources["deployments"][resourceKey] = deployment.ResourceVersion
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		log.Printf("Error populating %s: %v", resource.Name, err)
+		return
 	}
 
-	log.Printf("Populated %d existing deployments", len(deployments.Items))
-	return nil
-}
-
-func (m *K8sMonitor) populateServices(namespace string) error {
-	services, err := m.clientset.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{})
-	if err != nil {
-		return err
+	known := make(map[string]string, len(items))
+	for _, item := range items {
+		object, err := meta.Accessor(item)
+		if err != nil {
+			continue
+		}
+		resourceKey := fmt.Sprintf("%s/%s", object.GetNamespace(), object.GetName())
+		known[resourceKey] = object.GetResourceVersion()
+		m.recordObject(resource.Name, resourceKey, "ADDED", item)
 	}
 
 	m.resourcesMutex.Lock()
-	defer m.resourcesMutex.Unlock()
+	m.knownResources[resource.Name] = known
+	m.resourcesMutex.Unlock()
 
-	for _, service := range services.Items {
-		resourceKey := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
-		if m.knownResources["services"] == nil {
-			m.knownResources["services"] = make(map[string]string)
-		}
-		m.knownResources["services"][resourceKey] = service.ResourceVersion
-	}
+	log.Printf("Populated %d existing %s", len(items), resource.Name)
+}
 
-	log.Printf("Populated %d existing services", len(services.Items))
-	return nil
+// listResource lists the objects of a resource type in namespace
+func (m *K8sMonitor) listResource(ctx context.Context, name, namespace string, options metav1.ListOptions) (runtime.Object, error) {
+	switch name {
+	case "pods":
+		return m.clientset.CoreV1().Pods(namespace).List(ctx, options)
+	case "deployments":
+		return m.clientset.AppsV1().Deployments(namespace).List(ctx, options)
+	case "services":
+		return m.clientset.CoreV1().Services(namespace).List(ctx, options)
+	case "configmaps":
+		return m.clientset.CoreV1().ConfigMaps(namespace).List(ctx, options)
+	case "secrets":
+		return m.clientset.CoreV1().Secrets(namespace).List(ctx, options)
+	case "replicasets":
+		return m.clientset.AppsV1().ReplicaSets(namespace).List(ctx, options)
+	case "daemonsets":
+		return m.clientset.AppsV1().DaemonSets(namespace).List(ctx, options)
+	case "statefulsets":
+		return m.clientset.AppsV1().StatefulSets(namespace).List(ctx, options)
+	case "jobs":
+		return m.clientset.BatchV1().Jobs(namespace).List(ctx, options)
+	case "cronjobs":
+		return m.clientset.BatchV1beta1().CronJobs(namespace).List(ctx, options)
+	case "persistentvolumes":
+		return m.clientset.CoreV1().PersistentVolumes().List(ctx, options)
+	case "persistentvolumeclaims":
+		return m.clientset.CoreV1().PersistentVolumeClaims(namespace).List(ctx, options)
+	case "ingresses":
+		return m.clientset.NetworkingV1().Ingresses(namespace).List(ctx, options)
+	case "networkpolicies":
+		return m.clientset.NetworkingV1().NetworkPolicies(namespace).List(ctx, options)
+	}
+	return nil, fmt.Errorf("unknown resource type %s", name)
 }
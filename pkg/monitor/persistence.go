@@ -0,0 +1,452 @@
+package monitor
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s-monitor/pkg/config"
+	"k8s-monitor/pkg/utils"
+)
+
+// journalDir returns where the journal is kept, next to the changes file by default
+func (m *K8sMonitor) journalDir() string {
+	if m.config.Persistence.JournalDir != "" {
+		return m.config.Persistence.JournalDir
+	}
+	return strings.TrimSuffix(m.config.Persistence.FilePath, ".json") + "-journal"
+}
+
+// record queues a journal record for the store writer
+func (m *K8sMonitor) record(record journalRecord, blobs ...string) {
+	if m.writer != nil {
+		m.writer.enqueue(record, blobs...)
+	}
+}
+
+// loadFromFile opens the configured store and loads the most recent changes
+// into memory, migrating the legacy changes file on first start
+func (m *K8sMonitor) loadFromFile() {
+	cfg := m.config
+
+	// Never fall back to plaintext when encryption was asked for
+	if encryption := cfg.Persistence.Encryption; encryption.Enabled {
+		keyring, err := utils.LoadKeyring(encryption.KeyFile, encryption.KeyEnv)
+		if err != nil {
+			log.Printf("Warning: Could not load encryption keys, changes will not be persisted: %v", err)
+			return
+		}
+		m.keyring = keyring
+	}
+
+	store, err := m.openStore()
+	if err != nil {
+		log.Printf("Warning: Could not open %s change store, changes will not be persisted: %v", cfg.Persistence.Backend, err)
+		return
+	}
+	blobs, err := m.openBlobs()
+	if err != nil {
+		store.Close()
+		log.Printf("Warning: Could not open snapshot store, changes will not be persisted: %v", err)
+		return
+	}
+	m.store = store
+	m.blobs = blobs
+	if recovering, ok := store.(interface{ Recovered() []utils.RecoveryReport }); ok {
+		for _, report := range recovering.Recovered() {
+			m.reportRecovery(report)
+		}
+	}
+
+	if existing, err := store.Query(ChangeFilter{Limit: 1}); err == nil && len(existing) == 0 {
+		m.migrateLegacyFiles()
+	}
+
+	if err := m.loadStoredChanges(); err != nil {
+		log.Printf("Warning: Could not load changes from %s store: %v", cfg.Persistence.Backend, err)
+	}
+	if cfg.Logging.Enabled && cfg.Logging.LogOperations {
+		log.Printf("Loaded %d changes from %s store", len(m.changes), cfg.Persistence.Backend)
+	}
+
+	if cfg.Persistence.StoreSnapshots {
+		m.loadSnapshots()
+	}
+
+	m.applyRetention(time.Now())
+	m.collectSnapshotGarbage()
+	m.shipStore()
+	m.compactStore()
+	m.archiveStore()
+
+	m.writer = newStoreWriter(m)
+	go m.writer.run()
+}
+
+// openHistory opens the configured store for reading and loads the most
+// recent changes, without migrating, compacting or archiving anything and
+// without starting the writer
+func (m *K8sMonitor) openHistory() error {
+	cfg := m.config
+	if encryption := cfg.Persistence.Encryption; encryption.Enabled {
+		keyring, err := utils.LoadKeyring(encryption.KeyFile, encryption.KeyEnv)
+		if err != nil {
+			return fmt.Errorf("failed to load encryption keys: %v", err)
+		}
+		m.keyring = keyring
+	}
+
+	store, err := m.openStore()
+	if err != nil {
+		return fmt.Errorf("failed to open %s change store: %v", cfg.Persistence.Backend, err)
+	}
+	blobs, err := m.openBlobs()
+	if err != nil {
+		store.Close()
+		return fmt.Errorf("failed to open snapshot store: %v", err)
+	}
+	m.store = store
+	m.blobs = blobs
+
+	if err := m.loadStoredChanges(); err != nil {
+		return fmt.Errorf("failed to load changes from %s store: %v", cfg.Persistence.Backend, err)
+	}
+	if len(m.changes) == 0 {
+		if _, err := os.Stat(cfg.Persistence.FilePath); err == nil {
+			return fmt.Errorf("%s has not been migrated to the %s store yet, start the monitor once first", cfg.Persistence.FilePath, cfg.Persistence.Backend)
+		}
+	}
+	return nil
+}
+
+// openBlobs opens the snapshot store next to the journal. The configmap
+// backend keeps nothing on the local disk and has none.
+func (m *K8sMonitor) openBlobs() (*utils.BlobStore, error) {
+	if m.config.Persistence.Backend == config.StorageBackendConfigMap {
+		return nil, nil
+	}
+	return utils.OpenBlobStore(filepath.Join(m.journalDir(), "objects"), m.keyring)
+}
+
+// loadStoredChanges loads what retention would keep in memory from the
+// store, older changes stay queryable there
+func (m *K8sMonitor) loadStoredChanges() error {
+	changes, err := m.store.Query(ChangeFilter{Limit: m.config.Retention.MaxCount})
+	for i := range changes {
+		if !IsValidSeverity(changes[i].Severity) {
+			changes[i].Severity = m.classifySeverity(changes[i].ResourceType, changes[i].EventType, nil)
+		}
+		// Changes stored before sequence numbers, or imported, are numbered
+		// in time order
+		if changes[i].Seq <= m.lastSeq {
+			changes[i].Seq = m.lastSeq + 1
+		}
+		m.lastSeq = changes[i].Seq
+	}
+	m.changes = changes
+	return err
+}
+
+// migrateLegacyFiles imports the changes and snapshots files written by older
+// versions into the store and moves them aside
+func (m *K8sMonitor) migrateLegacyFiles() {
+	cfg := m.config
+	filePath := cfg.Persistence.FilePath
+	if _, err := os.Stat(filePath); err != nil {
+		return
+	}
+
+	fileData, err := utils.LoadChangesFromFile(filePath)
+	if err != nil {
+		// A torn write of the legacy file still holds most of its changes
+		recovered, report, recoverErr := utils.RecoverChangesFromFile(filePath)
+		if recoverErr != nil {
+			log.Printf("Warning: Could not migrate %s: %v", filePath, err)
+			return
+		}
+		m.reportRecovery(*report)
+		fileData = recovered
+	}
+
+	// Files without a version were written before versioning, the
+	// migrations only fill in what is missing so the oldest version is safe
+	schema := fileData.SchemaVersion
+	if schema == 0 {
+		schema = schemaBaseline
+	}
+	var changes []Change
+	for i, data := range fileData.Changes {
+		change, err := decodeChange(schema, data)
+		if err != nil {
+			m.invalid.add(fmt.Sprintf("%s#%d", filePath, i), data, err)
+			continue
+		}
+		changes = append(changes, change)
+	}
+
+	snapshotPath := strings.TrimSuffix(filePath, ".json") + "-snapshots.json"
+	if snapshots, err := utils.LoadSnapshotsFromFile(snapshotPath); err == nil && m.blobs != nil {
+		for hash, data := range snapshots {
+			if err := m.blobs.Put(hash, data); err != nil {
+				log.Printf("Warning: Could not migrate snapshot %s: %v", hash, err)
+			}
+		}
+		if len(snapshots) > 0 {
+			os.Rename(snapshotPath, snapshotPath+".migrated")
+		}
+	}
+
+	if err := m.store.Append(changes...); err != nil {
+		log.Printf("Warning: Could not migrate %s: %v", filePath, err)
+		return
+	}
+	if err := os.Rename(filePath, filePath+".migrated"); err != nil {
+		log.Printf("Warning: Could not move %s aside: %v", filePath, err)
+	}
+	log.Printf("Migrated %d changes from %s to the %s store", len(changes), filePath, cfg.Persistence.Backend)
+}
+
+// reportRecovery records and logs a damaged file that was salvaged
+func (m *K8sMonitor) reportRecovery(report utils.RecoveryReport) {
+	m.recovery = append(m.recovery, report)
+	log.Printf("Warning: Recovered damaged file %s, kept %d records and lost %d, original moved to %s",
+		report.File, report.Recovered, report.Lost, report.MovedTo)
+}
+
+// RecoveryReports returns the damaged files that were salvaged on load
+func (m *K8sMonitor) RecoveryReports() []utils.RecoveryReport {
+	reports := make([]utils.RecoveryReport, len(m.recovery))
+	copy(reports, m.recovery)
+	return reports
+}
+
+// historyHorizon returns the time before which stored changes are removed,
+// zero when persistence.historyMaxAge keeps them forever
+func (m *K8sMonitor) historyHorizon(now time.Time) time.Time {
+	maxAge := m.config.Persistence.HistoryMaxAge
+	if maxAge <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-time.Duration(maxAge) * time.Second)
+}
+
+// compactStore removes stored changes that are past the history horizon and
+// the snapshots only they referenced. Without persistence.historyMaxAge the
+// store keeps everything, memory retention never shortens it.
+func (m *K8sMonitor) compactStore() {
+	horizon := m.historyHorizon(time.Now())
+	if m.store == nil || horizon.IsZero() {
+		return
+	}
+
+	removed, err := m.store.Compact(horizon)
+	if err != nil {
+		log.Printf("Error compacting change store: %v", err)
+		return
+	}
+	if removed > 0 && m.config.Logging.Enabled && m.config.Logging.LogOperations {
+		log.Printf("Removed %d stored records older than %s", removed, horizon.Format(time.RFC3339))
+	}
+	if removed > 0 {
+		m.deleteStoredSnapshots()
+	}
+}
+
+// archiveStore compresses stored changes older than persistence.archiveAfter
+// and keeps the store within persistence.maxDiskBytes
+func (m *K8sMonitor) archiveStore() {
+	archiver, ok := m.store.(archivingStore)
+	if !ok {
+		return
+	}
+	cfg := m.config.Persistence
+	logOperations := m.config.Logging.Enabled && m.config.Logging.LogOperations
+
+	if cfg.ArchiveAfter > 0 {
+		before := time.Now().Add(-time.Duration(cfg.ArchiveAfter) * time.Second)
+		if archived, err := archiver.Archive(before); err != nil {
+			log.Printf("Error archiving change store: %v", err)
+		} else if archived > 0 && logOperations {
+			log.Printf("Archived %d journal segments older than %s", archived, before.Format(time.RFC3339))
+		}
+	}
+
+	if cfg.MaxDiskBytes > 0 {
+		if removed, err := archiver.EnforceBudget(cfg.MaxDiskBytes); err != nil {
+			log.Printf("Error enforcing disk budget: %v", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d oldest journal segments to stay within %d bytes", removed, cfg.MaxDiskBytes)
+		}
+	}
+}
+
+// shipStore uploads closed segments to object storage before compaction can
+// remove them locally. Failed uploads stay spooled and are retried next time.
+func (m *K8sMonitor) shipStore() {
+	shipper, ok := m.store.(shippingStore)
+	if !ok {
+		return
+	}
+	uploaded, err := shipper.Ship(time.Now())
+	if err != nil {
+		log.Printf("Error uploading to object storage, will retry: %v", err)
+	}
+	if uploaded > 0 && m.config.Logging.Enabled && m.config.Logging.LogOperations {
+		log.Printf("Uploaded %d journal segments to object storage", uploaded)
+	}
+}
+
+// diskUsage reports how much disk the store and snapshots take
+func (m *K8sMonitor) diskUsage(storage map[string]interface{}) map[string]interface{} {
+	var storeBytes int64
+	switch bytes := storage["bytes"].(type) {
+	case int64:
+		storeBytes = bytes
+	case int:
+		storeBytes = int64(bytes)
+	}
+
+	var snapshotBytes int64
+	if m.blobs != nil {
+		snapshotBytes, _ = m.blobs.Size()
+	}
+
+	usage := map[string]interface{}{
+		"storeBytes":    storeBytes,
+		"snapshotBytes": snapshotBytes,
+		"totalBytes":    storeBytes + snapshotBytes,
+	}
+	if m.config.Persistence.MaxDiskBytes > 0 {
+		usage["budgetBytes"] = m.config.Persistence.MaxDiskBytes
+	}
+	return usage
+}
+
+// QueryHistory returns stored changes matching filter, oldest first. Without
+// a store only the changes held in memory are searched.
+func (m *K8sMonitor) QueryHistory(filter ChangeFilter) ([]Change, error) {
+	// Stores only know the shared read state and no acknowledgements, those
+	// conditions are checked after the read state was added. Authorization
+	// is checked last too, stores scan under their own locks.
+	query := filter
+	overlaid := filter.AcknowledgedOnly || filter.UnacknowledgedOnly || filter.Allow != nil ||
+		filter.User != "" && (filter.UnreadOnly || filter.ReadOnly)
+	if overlaid {
+		query.AcknowledgedOnly, query.UnacknowledgedOnly = false, false
+		query.Allow, query.Prepare = nil, nil
+		query.Limit = 0
+		if filter.User != "" {
+			query.UnreadOnly, query.ReadOnly = false, false
+		}
+	}
+
+	var changes []Change
+	var queued []journalRecord
+	if m.store != nil {
+		// Queued records are not in the store yet, they are merged into what
+		// the store returns. They are taken first, so a record written in
+		// between is seen twice rather than not at all.
+		if m.writer != nil {
+			queued = m.writer.queuedRecords()
+		}
+		if queuedReads(queued) && (query.UnreadOnly || query.ReadOnly) {
+			query.UnreadOnly, query.ReadOnly = false, false
+			query.Limit = 0
+		}
+		stored, err := m.store.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		changes = mergeQueued(stored, queued, query)
+	} else {
+		m.changesMutex.RLock()
+		changes = query.Apply(m.changes)
+		m.changesMutex.RUnlock()
+	}
+
+	m.reads.mutex.Lock()
+	for i := range changes {
+		changes[i] = m.reads.viewLocked(filter.User, changes[i])
+	}
+	m.reads.mutex.Unlock()
+	if overlaid {
+		filter.prepare(changes)
+	}
+	if overlaid || len(queued) > 0 {
+		changes = filter.Apply(changes)
+	}
+	return changes, nil
+}
+
+// queuedReads reports whether records mark changes read
+func queuedReads(records []journalRecord) bool {
+	for _, record := range records {
+		if record.Op != opChange {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeQueued adds the queued changes matching filter to stored changes and
+// applies the queued read marks, as writing the records would
+func mergeQueued(changes []Change, records []journalRecord, filter ChangeFilter) []Change {
+	if len(records) == 0 {
+		return changes
+	}
+	seen := make(map[string]bool, len(changes))
+	for _, change := range changes {
+		seen[change.ID] = true
+	}
+	for _, record := range records {
+		switch record.Op {
+		case opChange:
+			change := *record.Change
+			if !seen[change.ID] && filter.inRange(change.Timestamp) && filter.matches(change) {
+				changes = append(changes, change)
+				seen[change.ID] = true
+			}
+		case opRead:
+			for i := range changes {
+				if containsString(record.IDs, changes[i].ID) {
+					changes[i].IsRead = true
+				}
+			}
+		case opReadAll:
+			for i := range changes {
+				if !changes[i].Timestamp.After(record.Time) {
+					changes[i].IsRead = true
+				}
+			}
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Timestamp.Before(changes[j].Timestamp)
+	})
+	return changes
+}
+
+// storeStats describes the change store
+func (m *K8sMonitor) storeStats() map[string]interface{} {
+	if m.store == nil {
+		return nil
+	}
+	stats := m.store.Stats()
+	stats["schemaVersion"] = currentSchema
+	stats["unparseable"] = m.invalid.stats()
+	stats["disk"] = m.diskUsage(stats)
+	if m.writer != nil {
+		stats["writer"] = m.writer.stats()
+	}
+	if m.keyring != nil {
+		stats["encryption"] = map[string]interface{}{
+			"keyId":  m.keyring.KeyID(),
+			"keyIds": m.keyring.KeyIDs(),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,506 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s-monitor/pkg/utils"
+)
+
+// ErrAlreadyAcknowledged is returned when acknowledging a change twice
+var ErrAlreadyAcknowledged = errors.New("change already acknowledged")
+
+// Acknowledgement records that someone looked into a change
+type Acknowledgement struct {
+	User    string    `json:"user"`
+	Time    time.Time `json:"time"`
+	Comment string    `json:"comment,omitempty"`
+}
+
+// Read state operations
+const (
+	readOpRead    = "read"
+	readOpReadAll = "readAll"
+	readOpAck     = "ack"
+)
+
+// readRecord is one line of the read state file
+type readRecord struct {
+	Op      string    `json:"op"`
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	IDs     []string  `json:"ids,omitempty"`     // read and ack
+	Comment string    `json:"comment,omitempty"` // ack
+}
+
+// userReads is what one user has read: everything up to before, and the
+// changes in ids after it, with the time they were read
+type userReads struct {
+	before time.Time
+	ids    map[string]time.Time
+}
+
+// readStateStore persists read state records. Every ChangeStore keeps them
+// next to the changes, so they survive wherever the changes do.
+type readStateStore interface {
+	// LoadReadState returns the stored read state records, oldest first
+	LoadReadState() ([]readRecord, error)
+	// AppendReadState stores new read state records
+	AppendReadState(records ...readRecord) error
+	// ReplaceReadState replaces every stored record, after compaction or pruning
+	ReplaceReadState(records []readRecord) error
+}
+
+// errReadStateFull is returned by stores that have no room for more read
+// state records until the stored ones are compacted
+var errReadStateFull = errors.New("no room for more read state records")
+
+// readState tracks which changes every authenticated user has read and the
+// acknowledgements of changes. The shared IsRead flag of a change is still
+// used for requests without a user, and a change it marks read, for example
+// by a rule, is read for everyone. When persistence is enabled every update
+// is appended to the change store, which is compacted when it is opened.
+// Marks and acknowledgements of changes that are no longer kept are pruned.
+type readState struct {
+	mutex sync.Mutex
+	store readStateStore // nil when nothing is persisted
+	users map[string]*userReads
+	acks  map[string]Acknowledgement // change ID -> acknowledgement
+}
+
+func newReadState() *readState {
+	return &readState{users: make(map[string]*userReads), acks: make(map[string]Acknowledgement)}
+}
+
+// open replays the read state kept in store, rewrites it with one record per
+// user and acknowledgement, and appends to it from now on
+func (s *readState) open(store readStateStore) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	records, err := store.LoadReadState()
+	if err != nil {
+		return fmt.Errorf("failed to load read state: %v", err)
+	}
+	for _, record := range records {
+		s.apply(record)
+	}
+	s.store = store
+	return s.compactLocked()
+}
+
+// apply updates the state with a record, called with the mutex held
+func (s *readState) apply(record readRecord) {
+	switch record.Op {
+	case readOpRead:
+		reads := s.userLocked(record.User)
+		for _, id := range record.IDs {
+			if _, ok := reads.ids[id]; !ok {
+				reads.ids[id] = record.Time
+			}
+		}
+	case readOpReadAll:
+		reads := s.userLocked(record.User)
+		if record.Time.After(reads.before) {
+			reads.before = record.Time
+			reads.ids = make(map[string]time.Time)
+		}
+	case readOpAck:
+		for _, id := range record.IDs {
+			if _, exists := s.acks[id]; !exists {
+				s.acks[id] = Acknowledgement{User: record.User, Time: record.Time, Comment: record.Comment}
+			}
+		}
+	}
+}
+
+func (s *readState) userLocked(user string) *userReads {
+	reads, ok := s.users[user]
+	if !ok {
+		reads = &userReads{ids: make(map[string]time.Time)}
+		s.users[user] = reads
+	}
+	return reads
+}
+
+// compactLocked replaces the stored records with the current state, called
+// with the mutex held
+func (s *readState) compactLocked() error {
+	var records []readRecord
+	for user, reads := range s.users {
+		if !reads.before.IsZero() {
+			records = append(records, readRecord{Op: readOpReadAll, Time: reads.before, User: user})
+		}
+		// One record per time the changes were read, so they can still be
+		// pruned by age after the next start
+		byTime := make(map[time.Time][]string)
+		for id, at := range reads.ids {
+			byTime[at] = append(byTime[at], id)
+		}
+		for at, ids := range byTime {
+			sort.Strings(ids)
+			records = append(records, readRecord{Op: readOpRead, Time: at, User: user, IDs: ids})
+		}
+	}
+	for id, ack := range s.acks {
+		records = append(records, readRecord{Op: readOpAck, Time: ack.Time, User: ack.User, IDs: []string{id}, Comment: ack.Comment})
+	}
+	sort.SliceStable(records, func(a, b int) bool {
+		return records[a].Time.Before(records[b].Time)
+	})
+
+	if err := s.store.ReplaceReadState(records); err != nil {
+		return fmt.Errorf("failed to compact read state: %v", err)
+	}
+	return nil
+}
+
+// prune forgets the read marks and acknowledgements made before horizon,
+// their changes are older than that, and compacts the store when it dropped
+// any. It returns how many were dropped.
+func (s *readState) prune(horizon time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pruned := 0
+	for user, reads := range s.users {
+		for id, at := range reads.ids {
+			if at.Before(horizon) {
+				delete(reads.ids, id)
+				pruned++
+			}
+		}
+		if len(reads.ids) == 0 && reads.before.IsZero() {
+			delete(s.users, user)
+		}
+	}
+	for id, ack := range s.acks {
+		if ack.Time.Before(horizon) {
+			delete(s.acks, id)
+			pruned++
+		}
+	}
+	if pruned == 0 || s.store == nil {
+		return pruned, nil
+	}
+	return pruned, s.compactLocked()
+}
+
+// add applies a record and stores it
+func (s *readState) add(record readRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.apply(record)
+	return s.appendLocked(record)
+}
+
+// acknowledge stores the first acknowledgement of a change, a later one
+// returns the first with ErrAlreadyAcknowledged. An acknowledgement that
+// could not be stored is forgotten, so it can be given again.
+func (s *readState) acknowledge(changeID string, ack Acknowledgement) (Acknowledgement, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if existing, ok := s.acks[changeID]; ok {
+		return existing, ErrAlreadyAcknowledged
+	}
+	record := readRecord{Op: readOpAck, Time: ack.Time, User: ack.User, IDs: []string{changeID}, Comment: ack.Comment}
+	s.apply(record)
+	if err := s.appendLocked(record); err != nil {
+		delete(s.acks, changeID)
+		return Acknowledgement{}, fmt.Errorf("failed to save acknowledgement: %v", err)
+	}
+	return ack, nil
+}
+
+// appendLocked stores a record that was already applied, compacting the
+// store when it is full. Called with the mutex held.
+func (s *readState) appendLocked(record readRecord) error {
+	if s.store == nil {
+		return nil
+	}
+
+	err := s.store.AppendReadState(record)
+	if errors.Is(err, errReadStateFull) {
+		// The compacted state includes the record
+		err = s.compactLocked()
+	}
+	return err
+}
+
+// view returns a change as user sees it, with its acknowledgement
+func (s *readState) view(user string, change Change) Change {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.viewLocked(user, change)
+}
+
+// viewLocked adds the acknowledgement to a change and, for a user, marks it
+// read when they or a rule read it. Called with the mutex held.
+func (s *readState) viewLocked(user string, change Change) Change {
+	if ack, ok := s.acks[change.ID]; ok {
+		change.Acknowledgement = &ack
+	}
+	if user != "" && !change.IsRead {
+		if reads := s.users[user]; reads != nil {
+			_, read := reads.ids[change.ID]
+			change.IsRead = read || !change.Timestamp.After(reads.before)
+		}
+	}
+	return change
+}
+
+// pruneReadState forgets the read marks and acknowledgements of changes that
+// are no longer kept: those past the history horizon, or without a store
+// those older than every change held in memory
+func (m *K8sMonitor) pruneReadState() {
+	horizon := m.historyHorizon(time.Now())
+	if m.store == nil {
+		m.changesMutex.RLock()
+		if len(m.changes) > 0 {
+			horizon = m.changes[0].Timestamp
+		}
+		m.changesMutex.RUnlock()
+	}
+	if horizon.IsZero() {
+		return
+	}
+
+	pruned, err := m.reads.prune(horizon)
+	if err != nil {
+		log.Printf("Error pruning read state: %v", err)
+	}
+	if pruned > 0 && m.config.Logging.Enabled && m.config.Logging.LogOperations {
+		log.Printf("Pruned %d read marks and acknowledgements older than %s", pruned, horizon.Format(time.RFC3339))
+	}
+}
+
+// ViewAs returns a change with its acknowledgement and the read state of
+// user, the shared read state when user is empty
+func (m *K8sMonitor) ViewAs(user string, change Change) Change {
+	return m.reads.view(user, change)
+}
+
+// MarkAsReadBy marks a change read for one user, or for everyone when user
+// is empty
+func (m *K8sMonitor) MarkAsReadBy(user, changeID string) bool {
+	if user == "" {
+		return m.MarkAsRead(changeID)
+	}
+	if _, ok := m.GetChange(changeID); !ok {
+		return false
+	}
+
+	if err := m.reads.add(readRecord{Op: readOpRead, Time: time.Now(), User: user, IDs: []string{changeID}}); err != nil {
+		log.Printf("Warning: Could not save read state: %v", err)
+	}
+	m.stream.publish(StreamEvent{Type: StreamRead, IDs: []string{changeID}, User: user})
+	return true
+}
+
+// MarkAllAsReadBy marks every change read for one user, or for everyone when
+// user is empty, and returns how many were unread
+func (m *K8sMonitor) MarkAllAsReadBy(user string) int {
+	if user == "" {
+		return m.MarkAllAsRead()
+	}
+	now := time.Now()
+
+	m.changesMutex.RLock()
+	m.reads.mutex.Lock()
+	count := 0
+	for _, change := range m.changes {
+		if !m.reads.viewLocked(user, change).IsRead {
+			count++
+		}
+	}
+	m.reads.mutex.Unlock()
+	m.changesMutex.RUnlock()
+
+	if count > 0 {
+		if err := m.reads.add(readRecord{Op: readOpReadAll, Time: now, User: user}); err != nil {
+			log.Printf("Warning: Could not save read state: %v", err)
+		}
+		m.stream.publish(StreamEvent{Type: StreamRead, Before: &now, User: user})
+	}
+
+	if m.config.Logging.Enabled && m.config.Logging.LogOperations {
+		log.Printf("Marked %d changes as read for %s", count, user)
+	}
+	return count
+}
+
+// Acknowledge records that user acknowledged a change, with an optional
+// comment. A change is acknowledged once, later attempts return the change
+// with ErrAlreadyAcknowledged.
+func (m *K8sMonitor) Acknowledge(changeID, user, comment string) (Change, error) {
+	change, ok := m.GetChange(changeID)
+	if !ok {
+		return Change{}, ErrChangeNotFound
+	}
+
+	ack, err := m.reads.acknowledge(changeID, Acknowledgement{User: user, Time: time.Now(), Comment: comment})
+	if err != nil {
+		if err == ErrAlreadyAcknowledged {
+			change.Acknowledgement = &ack
+		}
+		return change, err
+	}
+	change.Acknowledgement = &ack
+
+	m.stream.publish(StreamEvent{Type: StreamAck, Change: &change})
+	if m.config.Logging.Enabled && m.config.Logging.LogOperations {
+		log.Printf("%s acknowledged change %s", user, changeID)
+	}
+	return change, nil
+}
+
+// encodeReadRecord marshals a read state record, sealed when keyring is set
+func encodeReadRecord(keyring *utils.Keyring, record readRecord) ([]byte, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal read state: %v", err)
+	}
+	if keyring == nil {
+		return data, nil
+	}
+	ciphertext, err := keyring.Seal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedRecord{Time: record.Time, Sealed: string(ciphertext)})
+}
+
+// encodeReadRecords encodes records as JSON lines
+func encodeReadRecords(keyring *utils.Keyring, records []readRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, record := range records {
+		line, err := encodeReadRecord(keyring, record)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeReadRecord reads a line written by encodeReadRecord, records written
+// before encryption was enabled are read as they are
+func decodeReadRecord(keyring *utils.Keyring, line []byte) (readRecord, error) {
+	var sealed sealedRecord
+	if err := json.Unmarshal(line, &sealed); err != nil {
+		return readRecord{}, err
+	}
+	if sealed.Sealed != "" {
+		if keyring == nil {
+			return readRecord{}, fmt.Errorf("record is encrypted but no encryption keys are configured")
+		}
+		plaintext, err := keyring.Open([]byte(sealed.Sealed))
+		if err != nil {
+			return readRecord{}, err
+		}
+		line = plaintext
+	}
+	var record readRecord
+	err := json.Unmarshal(line, &record)
+	return record, err
+}
+
+// decodeReadRecords reads JSON lines of read state records, skipping the
+// ones that cannot be read
+func decodeReadRecords(source string, keyring *utils.Keyring, data []byte) []readRecord {
+	var records []readRecord
+	skipped := 0
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		record, err := decodeReadRecord(keyring, line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		records = append(records, record)
+	}
+	if skipped > 0 {
+		log.Printf("Warning: Skipped %d unreadable read state records in %s", skipped, source)
+	}
+	return records
+}
+
+// readStateFile keeps read state records in a JSON lines file, for the
+// stores that live on disk
+type readStateFile struct {
+	path    string
+	keyring *utils.Keyring // encrypts records when set
+}
+
+func (f readStateFile) LoadReadState() ([]readRecord, error) {
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read read state: %v", err)
+	}
+	return decodeReadRecords(f.path, f.keyring, data), nil
+}
+
+func (f readStateFile) AppendReadState(records ...readRecord) error {
+	data, err := encodeReadRecords(f.keyring, records)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return fmt.Errorf("failed to create read state directory: %v", err)
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open read state: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("failed to write read state: %v", err)
+	}
+	return file.Sync()
+}
+
+// ReplaceReadState writes the records to a temporary file and renames it
+// over the old one
+func (f readStateFile) ReplaceReadState(records []readRecord) error {
+	data, err := encodeReadRecords(f.keyring, records)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return fmt.Errorf("failed to create read state directory: %v", err)
+	}
+	tmp := f.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write read state: %v", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmp, f.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write read state: %v", err)
+	}
+	return nil
+}
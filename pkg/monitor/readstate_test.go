@@ -0,0 +1,276 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeReadState writes records as a read state file, raw lines are written as they are
+func writeReadState(t *testing.T, lines ...interface{}) string {
+	t.Helper()
+	var content strings.Builder
+	for _, line := range lines {
+		if raw, ok := line.(string); ok {
+			content.WriteString(raw + "\n")
+			continue
+		}
+		data, err := json.Marshal(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content.Write(append(data, '\n'))
+	}
+	path := filepath.Join(t.TempDir(), "reads.jsonl")
+	if err := os.WriteFile(path, []byte(content.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+// readView summarizes how user sees the changes: the IDs they have read and
+// the IDs with an acknowledgement
+func readView(s *readState, user string, changes []Change) (string, string) {
+	var read, acked []Change
+	for _, change := range changes {
+		view := s.view(user, change)
+		if view.IsRead {
+			read = append(read, view)
+		}
+		if view.Acknowledgement != nil {
+			acked = append(acked, view)
+		}
+	}
+	return changeIDs(read), changeIDs(acked)
+}
+
+func TestReadStateReplay(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	changes := storeFixture(start)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+
+	tests := []struct {
+		name      string
+		records   []interface{}
+		user      string
+		wantRead  string
+		wantAcked string
+		wantLines int // records left after compaction
+	}{
+		{
+			name:      "empty",
+			user:      "alice",
+			wantRead:  "[]",
+			wantAcked: "[]",
+		},
+		{
+			name: "reads by ID",
+			records: []interface{}{
+				readRecord{Op: readOpRead, Time: at(10), User: "alice", IDs: []string{"c1"}},
+				readRecord{Op: readOpRead, Time: at(11), User: "alice", IDs: []string{"c3", "c1"}},
+				readRecord{Op: readOpRead, Time: at(11), User: "bob", IDs: []string{"c5"}},
+			},
+			user:      "alice",
+			wantRead:  "[c1 c3]",
+			wantAcked: "[]",
+			wantLines: 3,
+		},
+		{
+			name: "read all replaces earlier reads",
+			records: []interface{}{
+				readRecord{Op: readOpRead, Time: at(10), User: "alice", IDs: []string{"c1", "c5"}},
+				readRecord{Op: readOpReadAll, Time: at(2), User: "alice"},
+				readRecord{Op: readOpRead, Time: at(12), User: "alice", IDs: []string{"c4"}},
+			},
+			user:      "alice",
+			wantRead:  "[c0 c1 c2 c4]",
+			wantAcked: "[]",
+			wantLines: 2,
+		},
+		{
+			name: "an older read all is ignored",
+			records: []interface{}{
+				readRecord{Op: readOpReadAll, Time: at(3), User: "alice"},
+				readRecord{Op: readOpReadAll, Time: at(1), User: "alice"},
+			},
+			user:      "alice",
+			wantRead:  "[c0 c1 c2 c3]",
+			wantAcked: "[]",
+			wantLines: 1,
+		},
+		{
+			name: "other users read separately",
+			records: []interface{}{
+				readRecord{Op: readOpReadAll, Time: at(5), User: "bob"},
+			},
+			user:      "alice",
+			wantRead:  "[]",
+			wantAcked: "[]",
+			wantLines: 1,
+		},
+		{
+			name: "first acknowledgement wins",
+			records: []interface{}{
+				readRecord{Op: readOpAck, Time: at(10), User: "bob", IDs: []string{"c2"}, Comment: "expected"},
+				readRecord{Op: readOpAck, Time: at(11), User: "carol", IDs: []string{"c2"}},
+				readRecord{Op: readOpAck, Time: at(12), User: "carol", IDs: []string{"c4"}},
+			},
+			user:      "alice",
+			wantRead:  "[]",
+			wantAcked: "[c2 c4]",
+			wantLines: 2,
+		},
+		{
+			name: "damaged lines are skipped",
+			records: []interface{}{
+				readRecord{Op: readOpRead, Time: at(10), User: "alice", IDs: []string{"c0"}},
+				`{"op":"read","time":`,
+				readRecord{Op: "unknown", Time: at(11), User: "alice", IDs: []string{"c1"}},
+				readRecord{Op: readOpRead, Time: at(12), User: "alice", IDs: []string{"c2"}},
+			},
+			user:      "alice",
+			wantRead:  "[c0 c2]",
+			wantAcked: "[]",
+			wantLines: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeReadState(t, test.records...)
+			state := newReadState()
+			if err := state.open(readStateFile{path: path}); err != nil {
+				t.Fatal(err)
+			}
+			read, acked := readView(state, test.user, changes)
+			if read != test.wantRead || acked != test.wantAcked {
+				t.Errorf("read %s, acknowledged %s, want %s and %s", read, acked, test.wantRead, test.wantAcked)
+			}
+			if lines := countLines(t, path); lines != test.wantLines {
+				t.Errorf("compacted to %d records, want %d", lines, test.wantLines)
+			}
+
+			// The compacted file replays to the same state
+			reopened := newReadState()
+			if err := reopened.open(readStateFile{path: path}); err != nil {
+				t.Fatal(err)
+			}
+			if read, acked := readView(reopened, test.user, changes); read != test.wantRead || acked != test.wantAcked {
+				t.Errorf("after compaction read %s, acknowledged %s, want %s and %s", read, acked, test.wantRead, test.wantAcked)
+			}
+		})
+	}
+}
+
+func TestReadStatePrune(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	changes := storeFixture(start)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+
+	tests := []struct {
+		name       string
+		horizon    time.Time
+		wantPruned int
+		wantRead   string // as alice sees it
+		wantAcked  string
+		wantLines  int
+	}{
+		{name: "nothing old enough", horizon: at(0), wantRead: "[c0 c1 c2 c3 c4]", wantAcked: "[c1 c4]", wantLines: 6},
+		{name: "oldest marks", horizon: at(11), wantPruned: 2, wantRead: "[c0 c1 c3 c4]", wantAcked: "[c4]", wantLines: 4},
+		{name: "everything but read all", horizon: at(60), wantPruned: 6, wantRead: "[c0 c1]", wantAcked: "[]", wantLines: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeReadState(t,
+				readRecord{Op: readOpReadAll, Time: at(1), User: "alice"},
+				readRecord{Op: readOpRead, Time: at(10), User: "alice", IDs: []string{"c2"}},
+				readRecord{Op: readOpAck, Time: at(10), User: "bob", IDs: []string{"c1"}},
+				readRecord{Op: readOpRead, Time: at(20), User: "alice", IDs: []string{"c3", "c4"}},
+				readRecord{Op: readOpAck, Time: at(20), User: "bob", IDs: []string{"c4"}},
+				readRecord{Op: readOpRead, Time: at(20), User: "bob", IDs: []string{"c5"}},
+			)
+			state := newReadState()
+			if err := state.open(readStateFile{path: path}); err != nil {
+				t.Fatal(err)
+			}
+
+			pruned, err := state.prune(test.horizon)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pruned != test.wantPruned {
+				t.Errorf("pruned %d, want %d", pruned, test.wantPruned)
+			}
+			if read, acked := readView(state, "alice", changes); read != test.wantRead || acked != test.wantAcked {
+				t.Errorf("read %s, acknowledged %s, want %s and %s", read, acked, test.wantRead, test.wantAcked)
+			}
+			if lines := countLines(t, path); lines != test.wantLines {
+				t.Errorf("file holds %d records, want %d", lines, test.wantLines)
+			}
+		})
+	}
+}
+
+func TestReadStateAcknowledge(t *testing.T) {
+	store := &flakyStore{ChangeStore: newMemoryStore()}
+	state := newReadState()
+	if err := state.open(store); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// An acknowledgement that could not be stored is not kept
+	store.fail = errors.New("store unavailable")
+	if _, err := state.acknowledge("c1", Acknowledgement{User: "carol", Time: now}); err == nil {
+		t.Fatal("acknowledge() succeeded while the store fails")
+	}
+	if view := state.view("", Change{ID: "c1", Timestamp: now}); view.Acknowledgement != nil {
+		t.Errorf("failed acknowledgement kept: %+v", view.Acknowledgement)
+	}
+	store.fail = nil
+
+	first, err := state.acknowledge("c1", Acknowledgement{User: "alice", Time: now, Comment: "rollout"})
+	if err != nil || first.User != "alice" {
+		t.Fatalf("acknowledge() = %+v, %v", first, err)
+	}
+	second, err := state.acknowledge("c1", Acknowledgement{User: "bob", Time: now.Add(time.Minute)})
+	if !errors.Is(err, ErrAlreadyAcknowledged) || second.User != "alice" || second.Comment != "rollout" {
+		t.Errorf("second acknowledge() = %+v, %v, want alice's with ErrAlreadyAcknowledged", second, err)
+	}
+	if err := state.add(readRecord{Op: readOpRead, Time: now, User: "bob", IDs: []string{"c2"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := newReadState()
+	if err := reopened.open(store); err != nil {
+		t.Fatal(err)
+	}
+	view := reopened.view("bob", Change{ID: "c1", Timestamp: now})
+	if view.Acknowledgement == nil || *view.Acknowledgement != first {
+		t.Errorf("acknowledgement after reopening = %+v, want %+v", view.Acknowledgement, first)
+	}
+	if view := reopened.view("bob", Change{ID: "c2", Timestamp: now}); !view.IsRead {
+		t.Error("read mark lost after reopening")
+	}
+}
@@ -0,0 +1,140 @@
+package monitor
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s-monitor/pkg/config"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ResourceUpdate is the configuration of a resource before and after an update
+type ResourceUpdate struct {
+	Before *config.ResourceConfig `json:"before"` // nil when the resource was not configured
+	After  config.ResourceConfig  `json:"after"`
+}
+
+// IsSupportedResource reports whether a resource type can be watched
+func IsSupportedResource(name string) bool {
+	_, ok := resourceKinds[name]
+	return ok
+}
+
+// resourceGroups maps the monitored resource types outside the core API
+// group to their group
+var resourceGroups = map[string]string{
+	"deployments":     "apps",
+	"replicasets":     "apps",
+	"daemonsets":      "apps",
+	"statefulsets":    "apps",
+	"jobs":            "batch",
+	"cronjobs":        "batch",
+	"ingresses":       "networking.k8s.io",
+	"networkpolicies": "networking.k8s.io",
+}
+
+// ResourceGroup returns the API group of a resource type, empty for the core
+// group
+func ResourceGroup(resourceType string) string {
+	return resourceGroups[resourceType]
+}
+
+// ValidateResource checks a resource configuration before it is applied
+func ValidateResource(resource config.ResourceConfig) error {
+	if !IsSupportedResource(resource.Name) {
+		return fmt.Errorf("unknown resource %q", resource.Name)
+	}
+	if resource.Namespace != "" {
+		if resource.Name == "persistentvolumes" {
+			return fmt.Errorf("%s are not namespaced", resource.Name)
+		}
+		if errs := validation.IsDNS1123Label(resource.Namespace); len(errs) > 0 {
+			return fmt.Errorf("invalid namespace %q: %s", resource.Namespace, strings.Join(errs, ", "))
+		}
+	}
+	if _, err := labels.Parse(resource.LabelSelector); err != nil {
+		return fmt.Errorf("invalid label selector for %s: %v", resource.Name, err)
+	}
+	if _, err := fields.ParseSelector(resource.FieldSelector); err != nil {
+		return fmt.Errorf("invalid field selector for %s: %v", resource.Name, err)
+	}
+	return nil
+}
+
+// UpdateResources validates resource configurations and applies them to the
+// running monitor: the watchers of changed resources are started, stopped or
+// restarted with the new namespace and selectors. Nothing is applied when
+// one of them is invalid. An empty description keeps the current one. The
+// resources that actually changed are returned.
+func (m *K8sMonitor) UpdateResources(resources []config.ResourceConfig) ([]ResourceUpdate, error) {
+	seen := make(map[string]bool, len(resources))
+	for _, resource := range resources {
+		if err := ValidateResource(resource); err != nil {
+			return nil, err
+		}
+		if seen[resource.Name] {
+			return nil, fmt.Errorf("resource %q given more than once", resource.Name)
+		}
+		seen[resource.Name] = true
+	}
+
+	m.resourceConfigMutex.Lock()
+	defer m.resourceConfigMutex.Unlock()
+
+	current := append([]config.ResourceConfig(nil), m.config.Resources...)
+	var updates []ResourceUpdate
+	for _, resource := range resources {
+		index := -1
+		for i := range current {
+			if current[i].Name == resource.Name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			current = append(current, resource)
+			updates = append(updates, ResourceUpdate{After: resource})
+			continue
+		}
+		if resource.Description == "" {
+			resource.Description = current[index].Description
+		}
+		if current[index] == resource {
+			continue
+		}
+		before := current[index]
+		current[index] = resource
+		updates = append(updates, ResourceUpdate{Before: &before, After: resource})
+	}
+	m.config.Resources = current
+
+	for _, update := range updates {
+		m.applyResource(update.After)
+	}
+	return updates, nil
+}
+
+// applyResource starts or stops the watcher of a resource to match its
+// configuration
+func (m *K8sMonitor) applyResource(resource config.ResourceConfig) {
+	if !resource.Enabled {
+		m.stopWatcher(resource.Name)
+		return
+	}
+	if m.clientset == nil {
+		return
+	}
+
+	// The previous watcher may have been watching another namespace or
+	// selector, what it saw says nothing about the new target
+	m.stopWatcher(resource.Name)
+	m.resourcesMutex.Lock()
+	m.knownResources[resource.Name] = make(map[string]string)
+	m.resourcesMutex.Unlock()
+
+	// Objects that already exist are not reported as added
+	m.populateResource(resource)
+	m.startWatcher(resource)
+}
@@ -0,0 +1,110 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"k8s-monitor/pkg/config"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func objectMeta(namespace, name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Namespace: namespace, Name: name, ResourceVersion: "1"}
+}
+
+func knownKeys(m *K8sMonitor, resourceType string) string {
+	m.resourcesMutex.RLock()
+	defer m.resourcesMutex.RUnlock()
+	keys := make([]string, 0, len(m.knownResources[resourceType]))
+	for key := range m.knownResources[resourceType] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return fmt.Sprint(keys)
+}
+
+func TestPopulateResource(t *testing.T) {
+	tests := []struct {
+		resourceType string
+		existing     runtime.Object
+		added        runtime.Object
+	}{
+		{
+			resourceType: "configmaps",
+			existing:     &v1.ConfigMap{ObjectMeta: objectMeta("default", "settings")},
+			added:        &v1.ConfigMap{ObjectMeta: objectMeta("default", "other")},
+		},
+		{
+			resourceType: "secrets",
+			existing:     &v1.Secret{ObjectMeta: objectMeta("default", "credentials")},
+			added:        &v1.Secret{ObjectMeta: objectMeta("default", "other")},
+		},
+		{
+			resourceType: "jobs",
+			existing:     &batchv1.Job{ObjectMeta: objectMeta("default", "backup")},
+			added:        &batchv1.Job{ObjectMeta: objectMeta("default", "other")},
+		},
+		{
+			resourceType: "persistentvolumes",
+			existing:     &v1.PersistentVolume{ObjectMeta: objectMeta("", "data")},
+			added:        &v1.PersistentVolume{ObjectMeta: objectMeta("", "other")},
+		},
+		{
+			resourceType: "ingresses",
+			existing:     &networkingv1.Ingress{ObjectMeta: objectMeta("default", "web")},
+			added:        &networkingv1.Ingress{ObjectMeta: objectMeta("default", "other")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.resourceType, func(t *testing.T) {
+			resource := config.ResourceConfig{Name: test.resourceType, Enabled: true}
+			m, err := newMonitor(fake.NewSimpleClientset(test.existing), &config.Config{Resources: []config.ResourceConfig{resource}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.populateResource(resource)
+
+			// The watcher starts from the current state and reports what
+			// exists as added, only the new object is a change
+			m.handleEvent(test.resourceType, watch.Event{Type: watch.Added, Object: test.existing})
+			m.handleEvent(test.resourceType, watch.Event{Type: watch.Added, Object: test.added})
+			changes := m.GetChanges()
+			if len(changes) != 1 || changes[0].Name != "other" {
+				t.Errorf("recorded %+v, want only the new object", changes)
+			}
+		})
+	}
+}
+
+func TestApplyResourceRetarget(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.ConfigMap{ObjectMeta: objectMeta("team-a", "settings")},
+		&v1.ConfigMap{ObjectMeta: objectMeta("team-b", "settings")},
+		&v1.ConfigMap{ObjectMeta: objectMeta("team-b", "flags")},
+	)
+	resource := config.ResourceConfig{Name: "configmaps", Enabled: true, Namespace: "team-a"}
+	m, err := newMonitor(client, &config.Config{Resources: []config.ResourceConfig{resource}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.stopWatcher("configmaps")
+
+	m.applyResource(resource)
+	if got := knownKeys(m, "configmaps"); got != "[team-a/settings]" {
+		t.Errorf("known %s, want [team-a/settings]", got)
+	}
+
+	resource.Namespace = "team-b"
+	m.applyResource(resource)
+	if got := knownKeys(m, "configmaps"); got != "[team-b/flags team-b/settings]" {
+		t.Errorf("known after retargeting %s, want only team-b", got)
+	}
+}
@@ -0,0 +1,156 @@
+package monitor
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// Eviction reasons reported in the retention statistics
+const (
+	evictMaxCount       = "maxCount"
+	evictMaxAge         = "maxAge"
+	evictReadMaxAge     = "readMaxAge"
+	evictResourceQuota  = "resourceQuota"
+	evictNamespaceQuota = "namespaceQuota"
+)
+
+func (m *K8sMonitor) startRetention() {
+	interval := time.Duration(m.config.Retention.SweepInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.applyRetention(time.Now())
+			m.collectSnapshotGarbage()
+			m.shipStore()
+			m.compactStore()
+			m.pruneReadState()
+			m.archiveStore()
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+// applyRetention evicts every change that falls outside the configured
+// age limits or quotas and returns the number of evicted changes.
+func (m *K8sMonitor) applyRetention(now time.Time) int {
+	m.changesMutex.Lock()
+	defer m.changesMutex.Unlock()
+
+	evicted := m.evictLocked(now)
+	m.lastRetentionRun = now
+	if evicted > 0 {
+		m.stream.touch()
+	}
+
+	if evicted > 0 && m.config.Logging.Enabled && m.config.Logging.LogOperations {
+		log.Printf("Retention evicted %d changes, %d remaining", evicted, len(m.changes))
+	}
+	return evicted
+}
+
+// evictLocked applies the retention policy to m.changes. The caller must hold changesMutex.
+func (m *K8sMonitor) evictLocked(now time.Time) int {
+	retention := m.config.Retention
+	keep := make([]bool, len(m.changes))
+	for i := range keep {
+		keep[i] = true
+	}
+
+	evict := func(i int, reason string) {
+		keep[i] = false
+		m.evictions[reason]++
+	}
+
+	// Age limits, read changes may expire sooner than unread ones
+	for i, change := range m.changes {
+		age := now.Sub(change.Timestamp)
+		if change.IsRead && retention.ReadMaxAge > 0 && age > time.Duration(retention.ReadMaxAge)*time.Second {
+			evict(i, evictReadMaxAge)
+		} else if retention.MaxAge > 0 && age > time.Duration(retention.MaxAge)*time.Second {
+			evict(i, evictMaxAge)
+		}
+	}
+
+	// Per-resource-type and per-namespace quotas keep the newest changes
+	if len(retention.ResourceQuotas) > 0 || len(retention.NamespaceQuotas) > 0 {
+		resourceCounts := make(map[string]int)
+		namespaceCounts := make(map[string]int)
+		for i := len(m.changes) - 1; i >= 0; i-- {
+			if !keep[i] {
+				continue
+			}
+			change := m.changes[i]
+			if quota, ok := retention.ResourceQuotas[change.ResourceType]; ok && resourceCounts[change.ResourceType] >= quota {
+				evict(i, evictResourceQuota)
+				continue
+			}
+			if quota, ok := retention.NamespaceQuotas[change.Namespace]; ok && namespaceCounts[change.Namespace] >= quota {
+				evict(i, evictNamespaceQuota)
+				continue
+			}
+			resourceCounts[change.ResourceType]++
+			namespaceCounts[change.Namespace]++
+		}
+	}
+
+	// Overall count limit, oldest read changes go first
+	remaining := 0
+	for _, k := range keep {
+		if k {
+			remaining++
+		}
+	}
+	if excess := remaining - retention.MaxCount; retention.MaxCount > 0 && excess > 0 {
+		candidates := make([]int, 0, remaining)
+		for i, k := range keep {
+			if k {
+				candidates = append(candidates, i)
+			}
+		}
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return m.changes[candidates[a]].IsRead && !m.changes[candidates[b]].IsRead
+		})
+		for _, i := range candidates[:excess] {
+			evict(i, evictMaxCount)
+		}
+	}
+
+	kept := m.changes[:0]
+	for i, change := range m.changes {
+		if keep[i] {
+			kept = append(kept, change)
+		}
+	}
+	evicted := len(m.changes) - len(kept)
+	// Clear the tail so evicted changes can be garbage collected
+	for i := len(kept); i < len(m.changes); i++ {
+		m.changes[i] = Change{}
+	}
+	m.changes = kept
+	return evicted
+}
+
+// retentionStats returns the eviction counters. The caller must hold changesMutex.
+func (m *K8sMonitor) retentionStats() map[string]interface{} {
+	total := int64(0)
+	byReason := make(map[string]int64, len(m.evictions))
+	for reason, count := range m.evictions {
+		byReason[reason] = count
+		total += count
+	}
+
+	stats := map[string]interface{}{
+		"maxCount":          m.config.Retention.MaxCount,
+		"evictions":         total,
+		"evictionsByReason": byReason,
+	}
+	if !m.lastRetentionRun.IsZero() {
+		stats["lastRun"] = m.lastRetentionRun
+	}
+	return stats
+}
@@ -0,0 +1,265 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"k8s-monitor/pkg/config"
+)
+
+// namespaceLabelsTTL is how long namespace labels are cached for rule matching
+const namespaceLabelsTTL = 5 * time.Minute
+
+// namespaceLabelsTimeout bounds fetching the labels of a namespace
+const namespaceLabelsTimeout = 5 * time.Second
+
+type ruleEngine struct {
+	mutex     sync.RWMutex
+	rules     []config.RuleConfig
+	matched   map[string]int64 // rule name -> matched changes
+	suppress  int64
+	loadedAt  time.Time
+	nsLabels  map[string]map[string]string
+	nsFetched map[string]time.Time
+	nsMutex   sync.Mutex
+}
+
+func newRuleEngine() *ruleEngine {
+	return &ruleEngine{
+		matched:   make(map[string]int64),
+		nsLabels:  make(map[string]map[string]string),
+		nsFetched: make(map[string]time.Time),
+	}
+}
+
+// ValidateRules checks that every rule has a name, valid glob patterns and a
+// known severity
+func ValidateRules(rules []config.RuleConfig) error {
+	names := make(map[string]bool)
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return fmt.Errorf("rule %d has no name", i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if rule.Actions.Severity != "" && !IsValidSeverity(rule.Actions.Severity) {
+			return fmt.Errorf("rule %q has unknown severity %q", rule.Name, rule.Actions.Severity)
+		}
+		for _, patterns := range [][]string{rule.Match.Namespaces, rule.Match.Names, rule.Match.Actors, rule.Match.DiffPaths} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("rule %q has invalid pattern %q: %v", rule.Name, pattern, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ReloadRules validates and atomically replaces the active rule set
+func (m *K8sMonitor) ReloadRules(rules []config.RuleConfig) error {
+	if err := ValidateRules(rules); err != nil {
+		return err
+	}
+
+	m.rules.mutex.Lock()
+	m.rules.rules = rules
+	m.rules.loadedAt = time.Now()
+	m.rules.mutex.Unlock()
+
+	if m.config.Logging.Enabled && m.config.Logging.LogOperations {
+		log.Printf("Loaded %d rules", len(rules))
+	}
+	return nil
+}
+
+// GetRules returns the active rule set
+func (m *K8sMonitor) GetRules() []config.RuleConfig {
+	m.rules.mutex.RLock()
+	defer m.rules.mutex.RUnlock()
+
+	rules := make([]config.RuleConfig, len(m.rules.rules))
+	copy(rules, m.rules.rules)
+	return rules
+}
+
+// applyRules runs all matching rules against the change and reports whether
+// the change should be suppressed
+func (m *K8sMonitor) applyRules(change *Change, labels map[string]string) bool {
+	// The slice is replaced, never modified, on reload so it can be used unlocked
+	m.rules.mutex.RLock()
+	rules := m.rules.rules
+	m.rules.mutex.RUnlock()
+
+	for _, rule := range rules {
+		if !m.ruleMatches(rule.Match, change, labels) {
+			continue
+		}
+
+		m.rules.mutex.Lock()
+		m.rules.matched[rule.Name]++
+		if rule.Actions.Suppress {
+			m.rules.suppress++
+		}
+		m.rules.mutex.Unlock()
+
+		if rule.Actions.Suppress {
+			if m.config.Logging.Enabled && m.config.Logging.LogChanges {
+				log.Printf("Rule %s suppressed %s %s/%s", rule.Name, change.EventType, change.ResourceType, change.Name)
+			}
+			return true
+		}
+		if rule.Actions.Severity != "" {
+			change.Severity = rule.Actions.Severity
+		}
+		for _, tag := range rule.Actions.Tags {
+			if !containsString(change.Tags, tag) {
+				change.Tags = append(change.Tags, tag)
+			}
+		}
+		if rule.Actions.MarkRead {
+			change.IsRead = true
+		}
+	}
+	return false
+}
+
+func (m *K8sMonitor) ruleMatches(match config.RuleMatch, change *Change, labels map[string]string) bool {
+	if len(match.ResourceTypes) > 0 && !containsString(match.ResourceTypes, change.ResourceType) {
+		return false
+	}
+	if len(match.EventTypes) > 0 && !containsFold(match.EventTypes, change.EventType) {
+		return false
+	}
+	if len(match.Namespaces) > 0 && !matchesAny(match.Namespaces, change.Namespace) {
+		return false
+	}
+	if len(match.Names) > 0 && !matchesAny(match.Names, change.Name) {
+		return false
+	}
+	if len(match.Actors) > 0 && !matchesAny(match.Actors, change.Actor) {
+		return false
+	}
+	if len(match.DiffPaths) > 0 && !matchesAnyPath(match.DiffPaths, change.ChangedPaths) {
+		return false
+	}
+	if !labelsMatch(match.Labels, labels) {
+		return false
+	}
+	if len(match.NamespaceLabels) > 0 && !labelsMatch(match.NamespaceLabels, m.namespaceLabels(change.Namespace)) {
+		return false
+	}
+	return true
+}
+
+// namespaceLabels returns the (cached) labels of a namespace. The namespace
+// is fetched without holding the cache lock, so a slow API server only delays
+// the changes of that namespace.
+func (m *K8sMonitor) namespaceLabels(namespace string) map[string]string {
+	if namespace == "" || m.clientset == nil {
+		return nil
+	}
+
+	m.rules.nsMutex.Lock()
+	cached := m.rules.nsLabels[namespace]
+	fetched, ok := m.rules.nsFetched[namespace]
+	m.rules.nsMutex.Unlock()
+	if ok && time.Since(fetched) < namespaceLabelsTTL {
+		return cached
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), namespaceLabelsTimeout)
+	defer cancel()
+	ns, err := m.clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		if m.config.Logging.Enabled && m.config.Logging.LogOperations {
+			log.Printf("Could not get labels of namespace %s: %v", namespace, err)
+		}
+		return cached
+	}
+
+	m.rules.nsMutex.Lock()
+	m.rules.nsLabels[namespace] = ns.Labels
+	m.rules.nsFetched[namespace] = time.Now()
+	m.rules.nsMutex.Unlock()
+	return ns.Labels
+}
+
+// rulesStats returns the rule counters
+func (m *K8sMonitor) rulesStats() map[string]interface{} {
+	m.rules.mutex.RLock()
+	defer m.rules.mutex.RUnlock()
+
+	matched := make(map[string]int64, len(m.rules.matched))
+	for name, count := range m.rules.matched {
+		matched[name] = count
+	}
+	stats := map[string]interface{}{
+		"active":     len(m.rules.rules),
+		"matched":    matched,
+		"suppressed": m.rules.suppress,
+	}
+	if !m.rules.loadedAt.IsZero() {
+		stats["loadedAt"] = m.rules.loadedAt
+	}
+	return stats
+}
+
+func labelsMatch(want, have map[string]string) bool {
+	for key, value := range want {
+		if actual, ok := have[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAnyPath reports whether a pattern matches a changed path or one of
+// its parents, so "data" matches a change to "data.key"
+func matchesAnyPath(patterns []string, paths []string) bool {
+	for _, p := range paths {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, p); ok || strings.HasPrefix(p, pattern+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package monitor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// Versions of the persisted change format. Records carry the version they
+// were written with and are migrated to the current one when read.
+const (
+	schemaBaseline  = 1 // id, timestamp, type, resource, details and read state
+	schemaSeverity  = 2 // severity
+	schemaDiffs     = 3 // actor, changed paths and rule tags
+	schemaSnapshots = 4 // before and after snapshot hashes
+	schemaSequence  = 5 // sequence number
+
+	currentSchema = schemaSequence
+)
+
+// schemaMigration upgrades a raw change record from version From to From+1.
+// Versions that only added optional fields need no migration.
+type schemaMigration struct {
+	From        int
+	Description string
+	Apply       func(record map[string]interface{})
+}
+
+// schemaMigrations are applied in order to records older than currentSchema
+var schemaMigrations = []schemaMigration{
+	{
+		From:        schemaBaseline,
+		Description: "classify severity",
+		Apply: func(record map[string]interface{}) {
+			if severity, _ := record["severity"].(string); IsValidSeverity(severity) {
+				return
+			}
+			resourceType, _ := record["resourceType"].(string)
+			eventType, _ := record["eventType"].(string)
+			record["severity"] = builtinSeverity(resourceType, eventType, nil)
+		},
+	},
+}
+
+// storedChange is the versioned envelope a change is persisted in
+type storedChange struct {
+	Schema int             `json:"schema"`
+	Change json.RawMessage `json:"change"`
+}
+
+func encodeChange(change Change) ([]byte, error) {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal change: %v", err)
+	}
+	return json.Marshal(storedChange{Schema: currentSchema, Change: data})
+}
+
+// decodeChange migrates a change record written with the given schema
+// version and decodes it. Records that cannot be decoded are returned as an
+// error, never patched with made-up values.
+func decodeChange(schema int, data []byte) (Change, error) {
+	var change Change
+	if schema > currentSchema {
+		return change, fmt.Errorf("written with schema %d, this version reads up to %d", schema, currentSchema)
+	}
+
+	if schema < currentSchema {
+		var record map[string]interface{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			return change, fmt.Errorf("invalid JSON: %v", err)
+		}
+		for _, migration := range schemaMigrations {
+			if migration.From >= schema {
+				migration.Apply(record)
+			}
+		}
+		migrated, err := json.Marshal(record)
+		if err != nil {
+			return change, fmt.Errorf("failed to marshal migrated record: %v", err)
+		}
+		data = migrated
+	}
+
+	if err := json.Unmarshal(data, &change); err != nil {
+		return change, err
+	}
+	if change.ID == "" {
+		return change, errors.New("missing id")
+	}
+	if change.Timestamp.IsZero() {
+		return change, errors.New("missing timestamp")
+	}
+	return change, nil
+}
+
+// invalidRecords tracks persisted records that could not be decoded, so
+// they are reported once instead of silently dropped or rewritten
+type invalidRecords struct {
+	mutex   sync.Mutex
+	records map[string]string // record key -> error
+}
+
+func newInvalidRecords() *invalidRecords {
+	return &invalidRecords{records: make(map[string]string)}
+}
+
+// add reports an unparseable record. Keys identify the record so repeated
+// reads of the same history don't report it twice.
+func (r *invalidRecords) add(source string, data []byte, err error) {
+	sum := sha256.Sum256(data)
+	key := source + ":" + hex.EncodeToString(sum[:6])
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.records[key]; ok {
+		return
+	}
+	r.records[key] = err.Error()
+	log.Printf("Warning: Skipping unparseable change record %s: %v", key, err)
+}
+
+func (r *invalidRecords) stats() map[string]interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	keys := make([]string, 0, len(r.records))
+	for key := range r.records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// A handful of examples is enough to find the damage
+	const maxExamples = 20
+	examples := make(map[string]string)
+	for _, key := range keys {
+		if len(examples) == maxExamples {
+			break
+		}
+		examples[key] = r.records[key]
+	}
+	return map[string]interface{}{
+		"count":    len(r.records),
+		"examples": examples,
+	}
+}
@@ -0,0 +1,104 @@
+package monitor
+
+import (
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Severity levels assigned to changes
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Severities lists all severity levels from lowest to highest
+var Severities = []string{SeverityInfo, SeverityWarning, SeverityCritical}
+
+// IsValidSeverity reports whether s is a known severity level
+func IsValidSeverity(s string) bool {
+	for _, severity := range Severities {
+		if s == severity {
+			return true
+		}
+	}
+	return false
+}
+
+// severityClassifier decides the severity of an event for one resource type.
+// The object is nil when the change was loaded from file.
+type severityClassifier func(eventType string, obj runtime.Object) string
+
+// byEventType builds a classifier from a fixed severity per event type,
+// falling back to info for event types that are not listed
+func byEventType(severities map[string]string) severityClassifier {
+	return func(eventType string, obj runtime.Object) string {
+		if severity, ok := severities[eventType]; ok {
+			return severity
+		}
+		return SeverityInfo
+	}
+}
+
+// builtinClassifiers holds the default severity rules per resource type
+var builtinClassifiers = map[string]severityClassifier{
+	"pods": func(eventType string, obj runtime.Object) string {
+		if pod, ok := obj.(*v1.Pod); ok && pod.Status.Phase == v1.PodFailed {
+			return SeverityWarning
+		}
+		return SeverityInfo
+	},
+	"jobs": func(eventType string, obj runtime.Object) string {
+		if job, ok := obj.(*batchv1.Job); ok && job.Status.Failed > 0 {
+			return SeverityWarning
+		}
+		return SeverityInfo
+	},
+	"secrets":                byEventType(map[string]string{"ADDED": SeverityWarning, "MODIFIED": SeverityWarning, "DELETED": SeverityCritical}),
+	"networkpolicies":        byEventType(map[string]string{"ADDED": SeverityWarning, "MODIFIED": SeverityWarning, "DELETED": SeverityCritical}),
+	"persistentvolumes":      byEventType(map[string]string{"DELETED": SeverityCritical}),
+	"persistentvolumeclaims": byEventType(map[string]string{"DELETED": SeverityCritical}),
+	"deployments":            byEventType(map[string]string{"DELETED": SeverityWarning}),
+	"statefulsets":           byEventType(map[string]string{"DELETED": SeverityWarning}),
+	"daemonsets":             byEventType(map[string]string{"DELETED": SeverityWarning}),
+	"services":               byEventType(map[string]string{"DELETED": SeverityWarning}),
+	"ingresses":              byEventType(map[string]string{"DELETED": SeverityWarning}),
+	"configmaps":             byEventType(map[string]string{"DELETED": SeverityWarning}),
+	"cronjobs":               byEventType(map[string]string{"DELETED": SeverityWarning}),
+	"roles":                  byEventType(map[string]string{"ADDED": SeverityWarning, "MODIFIED": SeverityWarning, "DELETED": SeverityWarning}),
+	"rolebindings":           byEventType(map[string]string{"ADDED": SeverityWarning, "MODIFIED": SeverityWarning, "DELETED": SeverityWarning}),
+	"clusterroles":           byEventType(map[string]string{"ADDED": SeverityCritical, "MODIFIED": SeverityCritical, "DELETED": SeverityCritical}),
+	"clusterrolebindings":    byEventType(map[string]string{"ADDED": SeverityCritical, "MODIFIED": SeverityCritical, "DELETED": SeverityCritical}),
+}
+
+// classifySeverity returns the severity for an event, applying the first
+// matching configured override before falling back to the built-in classifiers
+func (m *K8sMonitor) classifySeverity(resourceType, eventType string, obj runtime.Object) string {
+	for _, override := range m.config.SeverityOverrides {
+		if override.ResourceType != "" && override.ResourceType != resourceType {
+			continue
+		}
+		if override.EventType != "" && !strings.EqualFold(override.EventType, eventType) {
+			continue
+		}
+		if IsValidSeverity(override.Severity) {
+			return override.Severity
+		}
+	}
+
+	return builtinSeverity(resourceType, eventType, obj)
+}
+
+// builtinSeverity classifies a change by the built-in rules only
+func builtinSeverity(resourceType, eventType string, obj runtime.Object) string {
+	if eventType == "ERROR" {
+		return SeverityWarning
+	}
+	if classifier, ok := builtinClassifiers[resourceType]; ok {
+		return classifier(eventType, obj)
+	}
+	return SeverityInfo
+}
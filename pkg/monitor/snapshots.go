@@ -0,0 +1,378 @@
+package monitor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"k8s-monitor/pkg/utils"
+)
+
+// Manifest versions of a change
+const (
+	VersionBefore = "before"
+	VersionAfter  = "after"
+)
+
+const redactedValue = "<redacted>"
+
+var (
+	ErrChangeNotFound   = errors.New("change not found")
+	ErrSnapshotNotFound = errors.New("no snapshot stored")
+	ErrObjectNotFound   = errors.New("object did not exist at that time")
+)
+
+// snapshotStore keeps redacted object snapshots deduplicated by content hash
+type snapshotStore struct {
+	mutex   sync.RWMutex
+	objects map[string]json.RawMessage // sha256 -> object JSON
+}
+
+func newSnapshotStore() *snapshotStore {
+	return &snapshotStore{objects: make(map[string]json.RawMessage)}
+}
+
+// put stores a snapshot and returns its hash
+func (s *snapshotStore) put(content map[string]interface{}) string {
+	if content == nil {
+		return ""
+	}
+	// encoding/json sorts map keys, so equal objects produce equal bytes
+	data, err := json.Marshal(content)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	s.mutex.Lock()
+	if _, ok := s.objects[hash]; !ok {
+		s.objects[hash] = data
+	}
+	s.mutex.Unlock()
+	return hash
+}
+
+func (s *snapshotStore) get(hash string) (map[string]interface{}, bool) {
+	s.mutex.RLock()
+	data, ok := s.objects[hash]
+	s.mutex.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	var content map[string]interface{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, false
+	}
+	return content, true
+}
+
+// raw returns the stored JSON of a snapshot
+func (s *snapshotStore) raw(hash string) (json.RawMessage, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	data, ok := s.objects[hash]
+	return data, ok
+}
+
+// retain drops every snapshot whose hash is not in live and returns the dropped hashes
+func (s *snapshotStore) retain(live map[string]bool) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var dropped []string
+	for hash := range s.objects {
+		if !live[hash] {
+			delete(s.objects, hash)
+			dropped = append(dropped, hash)
+		}
+	}
+	return dropped
+}
+
+func (s *snapshotStore) stats() map[string]interface{} {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	size := 0
+	for _, data := range s.objects {
+		size += len(data)
+	}
+	return map[string]interface{}{
+		"stored": len(s.objects),
+		"bytes":  size,
+	}
+}
+
+// redactObject removes sensitive values from a snapshot. Secret values are
+// replaced while their keys are kept so diffs still show what changed.
+func redactObject(resourceType string, content map[string]interface{}) map[string]interface{} {
+	if content == nil || resourceType != "secrets" {
+		return content
+	}
+
+	redacted := make(map[string]interface{}, len(content))
+	for key, value := range content {
+		redacted[key] = value
+	}
+	for _, field := range []string{"data", "stringData"} {
+		if data, ok := content[field].(map[string]interface{}); ok {
+			masked := make(map[string]interface{}, len(data))
+			for key := range data {
+				masked[key] = redactedValue
+			}
+			redacted[field] = masked
+		}
+	}
+	if metadata, ok := content["metadata"].(map[string]interface{}); ok {
+		if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+			if _, ok := annotations["kubectl.kubernetes.io/last-applied-configuration"]; ok {
+				maskedMetadata := make(map[string]interface{}, len(metadata))
+				for key, value := range metadata {
+					maskedMetadata[key] = value
+				}
+				maskedAnnotations := make(map[string]interface{}, len(annotations))
+				for key, value := range annotations {
+					maskedAnnotations[key] = value
+				}
+				maskedAnnotations["kubectl.kubernetes.io/last-applied-configuration"] = redactedValue
+				maskedMetadata["annotations"] = maskedAnnotations
+				redacted["metadata"] = maskedMetadata
+			}
+		}
+	}
+	return redacted
+}
+
+// storeSnapshots records the redacted before and after versions of a change
+func (m *K8sMonitor) storeSnapshots(change *Change, previous, current map[string]interface{}) {
+	if !m.config.Persistence.StoreSnapshots {
+		return
+	}
+
+	switch change.EventType {
+	case "ADDED":
+		change.AfterHash = m.snapshots.put(redactObject(change.ResourceType, current))
+	case "MODIFIED":
+		change.BeforeHash = m.snapshots.put(redactObject(change.ResourceType, previous))
+		change.AfterHash = m.snapshots.put(redactObject(change.ResourceType, current))
+	case "DELETED":
+		// The deleted object carries its final state, prefer it over the cached copy
+		if current == nil {
+			current = previous
+		}
+		change.BeforeHash = m.snapshots.put(redactObject(change.ResourceType, current))
+	}
+}
+
+// GetChange returns a single change by ID
+func (m *K8sMonitor) GetChange(changeID string) (Change, bool) {
+	m.changesMutex.RLock()
+	defer m.changesMutex.RUnlock()
+
+	for _, change := range m.changes {
+		if change.ID == changeID {
+			return m.reads.view("", change), true
+		}
+	}
+	return Change{}, false
+}
+
+// GetManifest returns the stored object before or after a change
+func (m *K8sMonitor) GetManifest(changeID, version string) (map[string]interface{}, error) {
+	change, ok := m.GetChange(changeID)
+	if !ok {
+		return nil, ErrChangeNotFound
+	}
+
+	var hash string
+	switch version {
+	case VersionBefore:
+		hash = change.BeforeHash
+	case VersionAfter:
+		hash = change.AfterHash
+	default:
+		return nil, fmt.Errorf("unknown version %q, expected %s or %s", version, VersionBefore, VersionAfter)
+	}
+
+	content, ok := m.snapshot(hash)
+	if !ok {
+		return nil, ErrSnapshotNotFound
+	}
+	return content, nil
+}
+
+// snapshot returns a stored object version, read from the snapshot store
+// when it is no longer held in memory
+func (m *K8sMonitor) snapshot(hash string) (map[string]interface{}, bool) {
+	if content, ok := m.snapshots.get(hash); ok {
+		return content, true
+	}
+	if hash == "" || m.blobs == nil {
+		return nil, false
+	}
+	data, err := m.blobs.Get(hash)
+	if err != nil {
+		return nil, false
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, false
+	}
+	return content, true
+}
+
+// GetManifestAt returns the object as it was at the given time, together with
+// the change that produced that version. Stored history older than what is
+// held in memory is searched too.
+func (m *K8sMonitor) GetManifestAt(resourceType, namespace, name string, at time.Time) (map[string]interface{}, Change, error) {
+	changes, err := m.QueryHistory(ChangeFilter{
+		To:            at,
+		ResourceTypes: []string{resourceType},
+		Namespaces:    []string{namespace},
+		Name:          name,
+	})
+	if err != nil {
+		return nil, Change{}, err
+	}
+	var found Change
+	for _, change := range changes {
+		// Name is a pattern in filters, only the exact name counts
+		if change.Name == name {
+			found = change
+		}
+	}
+
+	if found.ID == "" || found.EventType == "DELETED" {
+		return nil, found, ErrObjectNotFound
+	}
+
+	content, ok := m.snapshot(found.AfterHash)
+	if !ok {
+		return nil, found, ErrSnapshotNotFound
+	}
+	return content, found, nil
+}
+
+// collectSnapshotGarbage drops snapshots no longer referenced by a change in
+// memory from memory. Without a store nothing else can refer to them; with
+// one they stay on disk until the stored changes are compacted.
+func (m *K8sMonitor) collectSnapshotGarbage() {
+	if !m.config.Persistence.StoreSnapshots {
+		return
+	}
+	// Queued snapshots are written from memory, they have to reach the
+	// snapshot store before they are dropped
+	if m.writer != nil {
+		if err := m.writer.Flush(); err != nil {
+			log.Printf("Error writing snapshots, keeping them in memory: %v", err)
+			return
+		}
+	}
+
+	m.changesMutex.RLock()
+	live := make(map[string]bool)
+	for _, change := range m.changes {
+		addSnapshotHashes(live, change)
+	}
+	m.changesMutex.RUnlock()
+
+	dropped := m.snapshots.retain(live)
+	if len(dropped) > 0 && m.config.Logging.Enabled && m.config.Logging.LogOperations {
+		log.Printf("Dropped %d unreferenced snapshots from memory", len(dropped))
+	}
+}
+
+// deleteStoredSnapshots deletes the persisted snapshots that no stored or
+// in-memory change refers to any more, called after compaction
+func (m *K8sMonitor) deleteStoredSnapshots() {
+	if m.blobs == nil || !m.config.Persistence.StoreSnapshots {
+		return
+	}
+	stored, err := m.store.Query(ChangeFilter{})
+	if err != nil {
+		log.Printf("Error listing stored changes, snapshots are kept: %v", err)
+		return
+	}
+	live := make(map[string]bool)
+	for _, change := range stored {
+		addSnapshotHashes(live, change)
+	}
+	m.changesMutex.RLock()
+	for _, change := range m.changes {
+		addSnapshotHashes(live, change)
+	}
+	m.changesMutex.RUnlock()
+
+	hashes, err := m.blobs.List()
+	if err != nil {
+		log.Printf("Error listing snapshots: %v", err)
+		return
+	}
+	deleted := 0
+	for _, hash := range hashes {
+		if live[hash] {
+			continue
+		}
+		if err := m.blobs.Delete(hash); err != nil {
+			log.Printf("Error deleting snapshot %s: %v", hash, err)
+			continue
+		}
+		deleted++
+	}
+	if deleted > 0 && m.config.Logging.Enabled && m.config.Logging.LogOperations {
+		log.Printf("Deleted %d snapshots of compacted changes", deleted)
+	}
+}
+
+func addSnapshotHashes(hashes map[string]bool, change Change) {
+	if change.BeforeHash != "" {
+		hashes[change.BeforeHash] = true
+	}
+	if change.AfterHash != "" {
+		hashes[change.AfterHash] = true
+	}
+}
+
+// loadSnapshots reads all persisted snapshots into memory
+func (m *K8sMonitor) loadSnapshots() {
+	hashes, err := m.blobs.List()
+	if err != nil {
+		log.Printf("Warning: Could not load snapshots: %v", err)
+		return
+	}
+
+	m.snapshots.mutex.Lock()
+	defer m.snapshots.mutex.Unlock()
+
+	damaged := 0
+	for _, hash := range hashes {
+		data, err := m.blobs.Get(hash)
+		if err != nil {
+			log.Printf("Warning: Could not load snapshot %s: %v", hash, err)
+			continue
+		}
+		// A damaged blob is dropped, its manifest reads as missing
+		if !json.Valid(data) {
+			m.blobs.Delete(hash)
+			damaged++
+			continue
+		}
+		m.snapshots.objects[hash] = data
+	}
+	if damaged > 0 {
+		m.reportRecovery(utils.RecoveryReport{
+			File:      m.journalDir() + "/objects",
+			Recovered: len(m.snapshots.objects),
+			Lost:      damaged,
+			At:        time.Now(),
+		})
+	}
+}
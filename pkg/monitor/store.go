@@ -0,0 +1,322 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s-monitor/pkg/config"
+)
+
+// ChangeFilter selects stored changes. Empty fields match everything.
+type ChangeFilter struct {
+	From          time.Time // inclusive
+	To            time.Time // inclusive
+	ResourceTypes []string
+	Namespaces    []string
+	Name          string // glob pattern
+	EventTypes    []string
+	Severities    []string
+	UnreadOnly    bool
+	ReadOnly      bool
+	Limit         int // keep only the newest matches, 0 means no limit
+
+	// User whose read state UnreadOnly and ReadOnly refer to, the shared
+	// read state when empty
+	User               string
+	UnacknowledgedOnly bool
+	AcknowledgedOnly   bool
+
+	// Allow hides the changes it rejects, used to show callers only what
+	// they are authorized to see. It is called while the monitor holds locks
+	// and must not block: Prepare, when set, is called first without locks
+	// with the scopes of the changes Allow will be asked about, and Allow
+	// only looks up what Prepare decided.
+	Allow   func(Change) bool
+	Prepare func([]Scope)
+}
+
+// Scope is the resource type and namespace of a change, what authorization
+// decisions are made on
+type Scope struct {
+	ResourceType string
+	Namespace    string
+}
+
+// ScopeOf returns the scope of a change
+func ScopeOf(change Change) Scope {
+	return Scope{ResourceType: change.ResourceType, Namespace: change.Namespace}
+}
+
+// prepare calls Prepare with the distinct scopes of changes
+func (f ChangeFilter) prepare(changes []Change) {
+	if f.Prepare != nil {
+		if scopes := distinctScopes(changes); len(scopes) > 0 {
+			f.Prepare(scopes)
+		}
+	}
+}
+
+func distinctScopes(changes []Change) []Scope {
+	seen := make(map[Scope]bool)
+	var scopes []Scope
+	for _, change := range changes {
+		scope := ScopeOf(change)
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// matches reports whether a change passes every condition except the time
+// range and limit, which stores apply while scanning
+func (f ChangeFilter) matches(change Change) bool {
+	if len(f.ResourceTypes) > 0 && !containsString(f.ResourceTypes, change.ResourceType) {
+		return false
+	}
+	if len(f.Namespaces) > 0 && !containsString(f.Namespaces, change.Namespace) {
+		return false
+	}
+	if f.Name != "" && f.Name != change.Name && !matchesAny([]string{f.Name}, change.Name) {
+		return false
+	}
+	if len(f.EventTypes) > 0 && !containsString(f.EventTypes, change.EventType) {
+		return false
+	}
+	if len(f.Severities) > 0 && !containsString(f.Severities, change.Severity) {
+		return false
+	}
+	if f.UnreadOnly && change.IsRead {
+		return false
+	}
+	if f.ReadOnly && !change.IsRead {
+		return false
+	}
+	if f.UnacknowledgedOnly && change.Acknowledgement != nil {
+		return false
+	}
+	if f.AcknowledgedOnly && change.Acknowledgement == nil {
+		return false
+	}
+	if f.Allow != nil && !f.Allow(change) {
+		return false
+	}
+	return true
+}
+
+// inRange reports whether t lies within the filter's time range
+func (f ChangeFilter) inRange(t time.Time) bool {
+	if !f.From.IsZero() && t.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && t.After(f.To) {
+		return false
+	}
+	return true
+}
+
+// Apply filters changes that are ordered oldest first and applies the limit
+func (f ChangeFilter) Apply(changes []Change) []Change {
+	var matched []Change
+	for _, change := range changes {
+		if f.inRange(change.Timestamp) && f.matches(change) {
+			matched = append(matched, change)
+		}
+	}
+	if f.Limit > 0 && len(matched) > f.Limit {
+		matched = matched[len(matched)-f.Limit:]
+	}
+	return matched
+}
+
+// ChangeStore persists changes and the per-user read state. Changes are
+// appended in time order and returned oldest first.
+type ChangeStore interface {
+	// Append stores new changes
+	Append(changes ...Change) error
+	// Query returns the stored changes matching filter, oldest first
+	Query(filter ChangeFilter) ([]Change, error)
+	// MarkRead marks the changes with the given IDs as read
+	MarkRead(at time.Time, ids ...string) error
+	// MarkAllRead marks every change up to before as read
+	MarkAllRead(before time.Time) error
+	// Compact removes changes older than before and returns how many went away
+	Compact(before time.Time) (int, error)
+	// Stats describes the backend and what it holds
+	Stats() map[string]interface{}
+	Close() error
+
+	readStateStore
+}
+
+// archivingStore is implemented by stores that can compress old changes
+// while keeping them queryable and stay within a disk budget
+type archivingStore interface {
+	// Archive compresses changes older than before and returns how many units were archived
+	Archive(before time.Time) (int, error)
+	// EnforceBudget removes the oldest archived data until the store fits in maxBytes
+	EnforceBudget(maxBytes int64) (int, error)
+}
+
+// shippingStore is implemented by stores that copy old changes to long-term
+// storage elsewhere
+type shippingStore interface {
+	// Ship uploads what is ready for long-term storage and returns how many units were uploaded
+	Ship(now time.Time) (int, error)
+}
+
+// openStore opens the storage backend selected in the configuration
+func (m *K8sMonitor) openStore() (ChangeStore, error) {
+	cfg := m.config.Persistence
+	switch cfg.Backend {
+	case config.StorageBackendFile, "":
+		store, err := openJournalStore(m.journalDir(), cfg.SegmentMaxBytes, time.Duration(cfg.SegmentMaxAge)*time.Second, m.keyring, m.invalid)
+		if err != nil {
+			return nil, err
+		}
+		if !cfg.ObjectStorage.Enabled {
+			return store, nil
+		}
+		if store.objects, err = openObjectArchive(cfg.ObjectStorage, m.journalDir()); err != nil {
+			store.Close()
+			return nil, err
+		}
+		return store, nil
+	case config.StorageBackendBolt:
+		return openBoltStore(m.databasePath(), m.keyring, m.invalid)
+	case config.StorageBackendConfigMap:
+		return openConfigMapStore(m.clientset, cfg.ConfigMapNamespace, cfg.ConfigMapPrefix, m.keyring, m.invalid)
+	case config.StorageBackendMemory:
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+// checkPersistence refuses settings that would keep data on the local disk
+// with a backend that is meant to need none. Snapshots are too large for
+// ConfigMaps, so the configmap backend only starts without them.
+func checkPersistence(cfg config.PersistenceConfig) error {
+	if cfg.Backend == config.StorageBackendConfigMap && cfg.StoreSnapshots {
+		return fmt.Errorf("the configmap backend cannot keep snapshots, set persistence.storeSnapshots to false")
+	}
+	return nil
+}
+
+// databasePath returns where the embedded database is kept, next to the changes file by default
+func (m *K8sMonitor) databasePath() string {
+	if m.config.Persistence.DatabasePath != "" {
+		return m.config.Persistence.DatabasePath
+	}
+	return strings.TrimSuffix(m.config.Persistence.FilePath, ".json") + ".db"
+}
+
+// memoryStore keeps changes in memory only, nothing survives a restart
+type memoryStore struct {
+	mutex   sync.RWMutex
+	changes []Change
+	reads   []readRecord
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+func (s *memoryStore) Append(changes ...Change) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.changes = append(s.changes, changes...)
+	// Changes normally arrive in order, only sort when they did not
+	if !sort.SliceIsSorted(s.changes, func(a, b int) bool {
+		return s.changes[a].Timestamp.Before(s.changes[b].Timestamp)
+	}) {
+		sort.SliceStable(s.changes, func(a, b int) bool {
+			return s.changes[a].Timestamp.Before(s.changes[b].Timestamp)
+		})
+	}
+	return nil
+}
+
+func (s *memoryStore) Query(filter ChangeFilter) ([]Change, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return filter.Apply(s.changes), nil
+}
+
+func (s *memoryStore) MarkRead(at time.Time, ids ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.changes {
+		if containsString(ids, s.changes[i].ID) {
+			s.changes[i].IsRead = true
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) MarkAllRead(before time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.changes {
+		if !s.changes[i].Timestamp.After(before) {
+			s.changes[i].IsRead = true
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Compact(before time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed := sort.Search(len(s.changes), func(i int) bool {
+		return !s.changes[i].Timestamp.Before(before)
+	})
+	s.changes = append([]Change(nil), s.changes[removed:]...)
+	return removed, nil
+}
+
+func (s *memoryStore) LoadReadState() ([]readRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return append([]readRecord(nil), s.reads...), nil
+}
+
+func (s *memoryStore) AppendReadState(records ...readRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.reads = append(s.reads, records...)
+	return nil
+}
+
+func (s *memoryStore) ReplaceReadState(records []readRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.reads = append([]readRecord(nil), records...)
+	return nil
+}
+
+func (s *memoryStore) Stats() map[string]interface{} {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return map[string]interface{}{
+		"backend": config.StorageBackendMemory,
+		"changes": len(s.changes),
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,436 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"k8s-monitor/pkg/config"
+	"k8s-monitor/pkg/utils"
+)
+
+// Buckets of the embedded database. Changes are keyed by timestamp and ID so
+// time ranges are a cursor seek, the index buckets map a resource type or
+// namespace followed by the change key to nothing. Read state records are
+// keyed by a sequence number.
+var (
+	bucketChanges     = []byte("changes")
+	bucketIDs         = []byte("ids") // change ID -> change key
+	bucketByResource  = []byte("byResourceType")
+	bucketByNamespace = []byte("byNamespace")
+	bucketReadState   = []byte("readState")
+)
+
+// boltStore keeps changes in an embedded bbolt database, so history is not
+// limited by memory and filtered queries only read the matching keys
+type boltStore struct {
+	db      *bolt.DB
+	path    string
+	keyring *utils.Keyring // encrypts stored changes when set, index keys stay readable
+	invalid *invalidRecords
+}
+
+func openBoltStore(path string, keyring *utils.Keyring, invalid *invalidRecords) (*boltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %v", err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketChanges, bucketIDs, bucketByResource, bucketByNamespace, bucketReadState} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize database: %v", err)
+	}
+	return &boltStore{db: db, path: path, keyring: keyring, invalid: invalid}, nil
+}
+
+// timeKey encodes a timestamp so byte order matches time order
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+func changeKey(change Change) []byte {
+	return append(timeKey(change.Timestamp), change.ID...)
+}
+
+func indexKey(value string, key []byte) []byte {
+	indexed := append([]byte(value), 0)
+	return append(indexed, key...)
+}
+
+// keyRange returns the [low, high) bounds of filter's time range below prefix.
+// A nil high bound means up to the end of the bucket.
+func keyRange(prefix []byte, filter ChangeFilter) ([]byte, []byte) {
+	low := append([]byte(nil), prefix...)
+	if !filter.From.IsZero() {
+		low = append(low, timeKey(filter.From)...)
+	}
+
+	var high []byte
+	if !filter.To.IsZero() {
+		high = append(append([]byte(nil), prefix...), timeKey(filter.To.Add(time.Nanosecond))...)
+	} else if len(prefix) > 0 {
+		// The prefix ends with the 0 separator, the next byte value ends the value's range
+		high = append([]byte(nil), prefix...)
+		high[len(high)-1]++
+	}
+	return low, high
+}
+
+// scanDescending walks the keys in [low, high) from newest to oldest until fn returns false
+func scanDescending(c *bolt.Cursor, low, high []byte, fn func(key, value []byte) bool) {
+	var key, value []byte
+	if high == nil {
+		key, value = c.Last()
+	} else if key, value = c.Seek(high); key == nil {
+		key, value = c.Last()
+	} else {
+		key, value = c.Prev()
+	}
+
+	for ; key != nil && bytes.Compare(key, low) >= 0; key, value = c.Prev() {
+		if high != nil && bytes.Compare(key, high) >= 0 {
+			continue
+		}
+		if !fn(key, value) {
+			return
+		}
+	}
+}
+
+func (s *boltStore) Append(changes ...Change) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		changesBucket := tx.Bucket(bucketChanges)
+		ids := tx.Bucket(bucketIDs)
+		byResource := tx.Bucket(bucketByResource)
+		byNamespace := tx.Bucket(bucketByNamespace)
+
+		for _, change := range changes {
+			data, err := s.encode(change)
+			if err != nil {
+				return err
+			}
+			key := changeKey(change)
+			if err := changesBucket.Put(key, data); err != nil {
+				return err
+			}
+			if err := ids.Put([]byte(change.ID), key); err != nil {
+				return err
+			}
+			if err := byResource.Put(indexKey(change.ResourceType, key), nil); err != nil {
+				return err
+			}
+			if err := byNamespace.Put(indexKey(change.Namespace, key), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Query(filter ChangeFilter) ([]Change, error) {
+	var newestFirst []Change
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		changesBucket := tx.Bucket(bucketChanges)
+		full := func() bool {
+			return filter.Limit > 0 && len(newestFirst) >= filter.Limit
+		}
+		decode := func(value []byte) {
+			change, err := s.decode(value)
+			if err != nil {
+				return
+			}
+			if filter.matches(change) {
+				newestFirst = append(newestFirst, change)
+			}
+		}
+
+		// Prefer an index when the filter narrows by resource type or namespace
+		index, values := bucketByResource, filter.ResourceTypes
+		if len(values) == 0 {
+			index, values = bucketByNamespace, filter.Namespaces
+		}
+		if len(values) == 0 {
+			low, high := keyRange(nil, filter)
+			scanDescending(changesBucket.Cursor(), low, high, func(key, value []byte) bool {
+				decode(value)
+				return !full()
+			})
+			return nil
+		}
+
+		var keys [][]byte
+		indexBucket := tx.Bucket(index)
+		for _, value := range values {
+			prefix := indexKey(value, nil)
+			low, high := keyRange(prefix, filter)
+			scanDescending(indexBucket.Cursor(), low, high, func(key, _ []byte) bool {
+				keys = append(keys, append([]byte(nil), key[len(prefix):]...))
+				return true
+			})
+		}
+		sort.Slice(keys, func(a, b int) bool {
+			return bytes.Compare(keys[a], keys[b]) > 0
+		})
+		for _, key := range keys {
+			if value := changesBucket.Get(key); value != nil {
+				decode(value)
+			}
+			if full() {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]Change, len(newestFirst))
+	for i, change := range newestFirst {
+		changes[len(newestFirst)-1-i] = change
+	}
+	return changes, nil
+}
+
+// encode serializes a change for storage, sealing it when encrypting
+func (s *boltStore) encode(change Change) ([]byte, error) {
+	data, err := encodeChange(change)
+	if err != nil || s.keyring == nil {
+		return data, err
+	}
+	return s.keyring.Seal(data)
+}
+
+// decode reads a stored change, values written before the versioned
+// envelope hold the bare change in the snapshot format
+func (s *boltStore) decode(value []byte) (Change, error) {
+	if utils.IsSealed(value) {
+		if s.keyring == nil {
+			err := fmt.Errorf("change is encrypted but no encryption keys are configured")
+			s.invalid.add("bolt", value, err)
+			return Change{}, err
+		}
+		plaintext, err := s.keyring.Open(value)
+		if err != nil {
+			s.invalid.add("bolt", value, err)
+			return Change{}, err
+		}
+		value = plaintext
+	}
+
+	var stored storedChange
+	if err := json.Unmarshal(value, &stored); err != nil || stored.Change == nil {
+		stored = storedChange{Schema: schemaSnapshots, Change: value}
+	}
+	change, err := decodeChange(stored.Schema, stored.Change)
+	if err != nil {
+		s.invalid.add("bolt", value, err)
+	}
+	return change, err
+}
+
+// updateChange rewrites the stored change at key, migrating it to the current schema
+func (s *boltStore) updateChange(bucket *bolt.Bucket, key []byte, fn func(change *Change) bool) error {
+	value := bucket.Get(key)
+	if value == nil {
+		return nil
+	}
+	change, err := s.decode(value)
+	if err != nil {
+		return nil
+	}
+	if !fn(&change) {
+		return nil
+	}
+	data, err := s.encode(change)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, data)
+}
+
+func (s *boltStore) MarkRead(at time.Time, ids ...string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		changesBucket := tx.Bucket(bucketChanges)
+		idBucket := tx.Bucket(bucketIDs)
+		for _, id := range ids {
+			key := idBucket.Get([]byte(id))
+			if key == nil {
+				continue
+			}
+			err := s.updateChange(changesBucket, key, func(change *Change) bool {
+				if change.IsRead {
+					return false
+				}
+				change.IsRead = true
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) MarkAllRead(before time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		changesBucket := tx.Bucket(bucketChanges)
+		high := timeKey(before.Add(time.Nanosecond))
+
+		// Collect first, bbolt cursors must not be used while the bucket changes
+		var unread [][]byte
+		c := changesBucket.Cursor()
+		for key, value := c.First(); key != nil && bytes.Compare(key, high) < 0; key, value = c.Next() {
+			if change, err := s.decode(value); err == nil && !change.IsRead {
+				unread = append(unread, append([]byte(nil), key...))
+			}
+		}
+		for _, key := range unread {
+			err := s.updateChange(changesBucket, key, func(change *Change) bool {
+				change.IsRead = true
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Compact(before time.Time) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		changesBucket := tx.Bucket(bucketChanges)
+		high := timeKey(before)
+
+		var expired []Change
+		var keys [][]byte
+		c := changesBucket.Cursor()
+		for key, value := c.First(); key != nil && bytes.Compare(key, high) < 0; key, value = c.Next() {
+			// Index entries of an unreadable change stay behind, they point nowhere
+			change, _ := s.decode(value)
+			expired = append(expired, change)
+			keys = append(keys, append([]byte(nil), key...))
+		}
+
+		for i, key := range keys {
+			change := expired[i]
+			if err := changesBucket.Delete(key); err != nil {
+				return err
+			}
+			if change.ID != "" {
+				tx.Bucket(bucketIDs).Delete([]byte(change.ID))
+				tx.Bucket(bucketByResource).Delete(indexKey(change.ResourceType, key))
+				tx.Bucket(bucketByNamespace).Delete(indexKey(change.Namespace, key))
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+func (s *boltStore) LoadReadState() ([]readRecord, error) {
+	var data bytes.Buffer
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketReadState).ForEach(func(key, value []byte) error {
+			data.Write(value)
+			data.WriteByte('\n')
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read read state: %v", err)
+	}
+	return decodeReadRecords(s.path, s.keyring, data.Bytes()), nil
+}
+
+func (s *boltStore) AppendReadState(records ...readRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.putReadState(tx.Bucket(bucketReadState), records)
+	})
+}
+
+func (s *boltStore) ReplaceReadState(records []readRecord) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bucketReadState); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket(bucketReadState)
+		if err != nil {
+			return err
+		}
+		return s.putReadState(bucket, records)
+	})
+}
+
+// putReadState adds records after the ones in bucket
+func (s *boltStore) putReadState(bucket *bolt.Bucket, records []readRecord) error {
+	for _, record := range records {
+		data, err := encodeReadRecord(s.keyring, record)
+		if err != nil {
+			return err
+		}
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, sequence)
+		if err := bucket.Put(key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) Stats() map[string]interface{} {
+	stats := map[string]interface{}{
+		"backend": config.StorageBackendBolt,
+		"path":    s.path,
+	}
+	s.db.View(func(tx *bolt.Tx) error {
+		stats["changes"] = tx.Bucket(bucketChanges).Stats().KeyN
+		stats["bytes"] = tx.Size()
+
+		c := tx.Bucket(bucketChanges).Cursor()
+		if key, _ := c.First(); key != nil {
+			stats["first"] = time.Unix(0, int64(binary.BigEndian.Uint64(key[:8])))
+		}
+		if key, _ := c.Last(); key != nil {
+			stats["last"] = time.Unix(0, int64(binary.BigEndian.Uint64(key[:8])))
+		}
+		return nil
+	})
+	return stats
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
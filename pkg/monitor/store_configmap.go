@@ -0,0 +1,480 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"k8s-monitor/pkg/config"
+	"k8s-monitor/pkg/utils"
+)
+
+const (
+	// Kubernetes objects are limited to 1 MiB, the rest is left for metadata
+	configMapChunkBytes = 900 * 1024
+	configMapDataKey    = "records.ndjson"
+
+	labelManagedBy       = "app.kubernetes.io/managed-by"
+	labelStore           = "k8s-monitor.io/store"
+	annotationFirst      = "k8s-monitor.io/first"
+	annotationLast       = "k8s-monitor.io/last"
+	annotationRecords    = "k8s-monitor.io/records"
+	serviceAccountNSFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	// Writes that lose a race with another writer are retried this often
+	// after reloading the chunks
+	configMapConflictRetries = 5
+)
+
+// configMapStore keeps changes in ConfigMaps in the cluster so history
+// survives pod reschedules without a volume. Records are journal lines
+// appended to the newest chunk until it is full, then a new chunk is created.
+// The read state and the audit log are kept in two more ConfigMaps, which
+// are not chunks.
+type configMapStore struct {
+	client    kubernetes.Interface
+	namespace string
+	prefix    string
+	keyring   *utils.Keyring
+	invalid   *invalidRecords
+	maxBytes  int // size limit of a chunk's records
+
+	maxReadStateBytes int // size limit of the read state records
+	maxAuditBytes     int // size limit of the audit entries, the oldest make room
+
+	mutex  sync.Mutex
+	active *v1.ConfigMap // newest chunk, nil until known
+	next   int           // sequence number of the next chunk
+}
+
+func openConfigMapStore(client kubernetes.Interface, namespace, prefix string, keyring *utils.Keyring, invalid *invalidRecords) (*configMapStore, error) {
+	if client == nil {
+		return nil, fmt.Errorf("the configmap backend needs access to a cluster")
+	}
+	if namespace == "" {
+		namespace = currentNamespace()
+	}
+
+	s := &configMapStore{client: client, namespace: namespace, prefix: prefix, keyring: keyring, invalid: invalid, maxBytes: configMapChunkBytes, maxReadStateBytes: configMapChunkBytes, maxAuditBytes: configMapChunkBytes}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads the newest chunk and the next sequence number from the
+// cluster. The caller must hold the mutex, or own the store.
+func (s *configMapStore) reload() error {
+	chunks, err := s.chunks()
+	if err != nil {
+		return err
+	}
+	s.active = nil
+	if len(chunks) > 0 {
+		s.active = chunks[len(chunks)-1].DeepCopy()
+		s.next = s.sequence(s.active.Name) + 1
+	}
+	return nil
+}
+
+// currentNamespace returns the namespace the monitor runs in
+func currentNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	if data, err := os.ReadFile(serviceAccountNSFile); err == nil {
+		if namespace := strings.TrimSpace(string(data)); namespace != "" {
+			return namespace
+		}
+	}
+	return "default"
+}
+
+func (s *configMapStore) chunkName(sequence int) string {
+	return fmt.Sprintf("%s-%010d", s.prefix, sequence)
+}
+
+func (s *configMapStore) sequence(name string) int {
+	sequence, _ := strconv.Atoi(strings.TrimPrefix(name, s.prefix+"-"))
+	return sequence
+}
+
+// chunks lists the chunks of this store, oldest first
+func (s *configMapStore) chunks() ([]v1.ConfigMap, error) {
+	list, err := s.client.CoreV1().ConfigMaps(s.namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=k8s-monitor,%s=%s", labelManagedBy, labelStore, s.prefix),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list change chunks: %v", err)
+	}
+	chunks := list.Items
+	sort.Slice(chunks, func(a, b int) bool {
+		return s.sequence(chunks[a].Name) < s.sequence(chunks[b].Name)
+	})
+	return chunks, nil
+}
+
+// chunkTimes returns the time range and record count noted on a chunk
+func chunkTimes(chunk *v1.ConfigMap) (time.Time, time.Time, int) {
+	first, _ := time.Parse(time.RFC3339Nano, chunk.Annotations[annotationFirst])
+	last, _ := time.Parse(time.RFC3339Nano, chunk.Annotations[annotationLast])
+	records, _ := strconv.Atoi(chunk.Annotations[annotationRecords])
+	return first, last, records
+}
+
+// append writes records to the newest chunk, creating new chunks when it is full
+func (s *configMapStore) append(records ...journalRecord) error {
+	sealed, err := sealRecords(s.keyring, records)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var lines [][]byte
+	var times []time.Time
+	for _, record := range sealed {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal change record: %v", err)
+		}
+		if len(line)+1 > s.maxBytes {
+			log.Printf("Warning: Dropping change record of %d bytes, it does not fit in a ConfigMap", len(line))
+			continue
+		}
+		lines = append(lines, line)
+		times = append(times, record.RecordTime())
+	}
+
+	conflicts := 0
+	for len(lines) > 0 {
+		chunk := s.active
+		create := chunk == nil || len(chunk.Data[configMapDataKey])+len(lines[0])+1 > s.maxBytes
+		if create {
+			chunk = s.newChunk()
+		} else {
+			chunk = chunk.DeepCopy()
+		}
+
+		// Fill the chunk with as many records as fit
+		var buf bytes.Buffer
+		buf.WriteString(chunk.Data[configMapDataKey])
+		first, last, count := chunkTimes(chunk)
+		written := 0
+		for written < len(lines) && buf.Len()+len(lines[written])+1 <= s.maxBytes {
+			buf.Write(lines[written])
+			buf.WriteByte('\n')
+			if at := times[written]; count == 0 || at.Before(first) {
+				first = at
+			}
+			if at := times[written]; at.After(last) {
+				last = at
+			}
+			count++
+			written++
+		}
+		chunk.Data[configMapDataKey] = buf.String()
+		chunk.Annotations[annotationFirst] = first.Format(time.RFC3339Nano)
+		chunk.Annotations[annotationLast] = last.Format(time.RFC3339Nano)
+		chunk.Annotations[annotationRecords] = strconv.Itoa(count)
+
+		saved, err := s.saveChunk(chunk, create)
+		if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+			// Another writer got there first, write the same records again
+			// after what it wrote
+			if conflicts++; conflicts > configMapConflictRetries {
+				return fmt.Errorf("failed to write change chunk %s, it keeps being modified concurrently: %v", chunk.Name, err)
+			}
+			if err := s.reload(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write change chunk %s: %v", chunk.Name, err)
+		}
+		conflicts = 0
+		s.active = saved
+		lines, times = lines[written:], times[written:]
+	}
+	return nil
+}
+
+// newChunk returns an empty chunk with the next sequence number
+func (s *configMapStore) newChunk() *v1.ConfigMap {
+	chunk := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.chunkName(s.next),
+			Namespace: s.namespace,
+			Labels: map[string]string{
+				labelManagedBy: "k8s-monitor",
+				labelStore:     s.prefix,
+			},
+			Annotations: map[string]string{},
+		},
+		Data: map[string]string{},
+	}
+	s.next++
+	return chunk
+}
+
+// saveChunk creates or updates a chunk and returns the API error unchanged,
+// so conflicts can be told apart. The caller must hold the mutex.
+func (s *configMapStore) saveChunk(chunk *v1.ConfigMap, create bool) (*v1.ConfigMap, error) {
+	configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+	if create {
+		return configMaps.Create(context.TODO(), chunk, metav1.CreateOptions{})
+	}
+	return configMaps.Update(context.TODO(), chunk, metav1.UpdateOptions{})
+}
+
+func (s *configMapStore) Append(changes ...Change) error {
+	return s.append(changeRecords(changes)...)
+}
+
+func (s *configMapStore) Query(filter ChangeFilter) ([]Change, error) {
+	chunks, err := s.chunks()
+	if err != nil {
+		return nil, err
+	}
+
+	replay := newRecordReplay("configmap", filter, s.keyring, s.invalid)
+	for i := range chunks {
+		// Read records for a change can live in any later chunk, so only the
+		// start of the range narrows the replay
+		if _, last, count := chunkTimes(&chunks[i]); count > 0 && !filter.From.IsZero() && last.Before(filter.From) {
+			continue
+		}
+		for _, line := range strings.Split(chunks[i].Data[configMapDataKey], "\n") {
+			if line != "" {
+				replay.add([]byte(line))
+			}
+		}
+	}
+	return replay.result(), nil
+}
+
+func (s *configMapStore) MarkRead(at time.Time, ids ...string) error {
+	return s.append(journalRecord{Op: opRead, Time: at, IDs: ids})
+}
+
+func (s *configMapStore) MarkAllRead(before time.Time) error {
+	return s.append(journalRecord{Op: opReadAll, Time: before})
+}
+
+// Compact deletes whole chunks whose newest record is older than before, the
+// newest chunk is kept so appends can continue
+func (s *configMapStore) Compact(before time.Time) (int, error) {
+	chunks, err := s.chunks()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for i := 0; i < len(chunks)-1; i++ {
+		_, last, count := chunkTimes(&chunks[i])
+		if !last.Before(before) {
+			continue
+		}
+		err := s.client.CoreV1().ConfigMaps(s.namespace).Delete(context.TODO(), chunks[i].Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return removed, fmt.Errorf("failed to delete change chunk %s: %v", chunks[i].Name, err)
+		}
+		removed += count
+	}
+	return removed, nil
+}
+
+// readStateName is the ConfigMap holding the read state records
+func (s *configMapStore) readStateName() string {
+	return s.prefix + "-readstate"
+}
+
+// auditName is the ConfigMap holding the audit entries
+func (s *configMapStore) auditName() string {
+	return s.prefix + "-audit"
+}
+
+// getRecords returns the records kept in a ConfigMap that is not a chunk,
+// nil when there is no such ConfigMap yet
+func (s *configMapStore) getRecords(name string) (*v1.ConfigMap, error) {
+	configMap, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", name, err)
+	}
+	return configMap, nil
+}
+
+func (s *configMapStore) LoadReadState() ([]readRecord, error) {
+	configMap, err := s.getRecords(s.readStateName())
+	if err != nil || configMap == nil {
+		return nil, err
+	}
+	return decodeReadRecords(s.readStateName(), s.keyring, []byte(configMap.Data[configMapDataKey])), nil
+}
+
+// AppendReadState returns errReadStateFull when the records do not fit in
+// the ConfigMap any more
+func (s *configMapStore) AppendReadState(records ...readRecord) error {
+	data, err := encodeReadRecords(s.keyring, records)
+	if err != nil {
+		return err
+	}
+	return s.updateRecords(s.readStateName(), func(current string) (string, error) {
+		if len(current)+len(data) > s.maxReadStateBytes {
+			return "", errReadStateFull
+		}
+		return current + string(data), nil
+	})
+}
+
+func (s *configMapStore) ReplaceReadState(records []readRecord) error {
+	data, err := encodeReadRecords(s.keyring, records)
+	if err != nil {
+		return err
+	}
+	if len(data) > s.maxReadStateBytes {
+		return fmt.Errorf("read state of %d bytes does not fit in a ConfigMap", len(data))
+	}
+	return s.updateRecords(s.readStateName(), func(string) (string, error) {
+		return string(data), nil
+	})
+}
+
+// updateRecords rewrites the records of a ConfigMap that is not a chunk with
+// what update makes of them, starting over when another writer changed them
+// in between
+func (s *configMapStore) updateRecords(name string, update func(current string) (string, error)) error {
+	configMaps := s.client.CoreV1().ConfigMaps(s.namespace)
+	for conflicts := 0; ; conflicts++ {
+		configMap, err := s.getRecords(name)
+		if err != nil {
+			return err
+		}
+		create := configMap == nil
+		if create {
+			configMap = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: s.namespace,
+					Labels:    map[string]string{labelManagedBy: "k8s-monitor"},
+				},
+			}
+		}
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		data, err := update(configMap.Data[configMapDataKey])
+		if err != nil {
+			return err
+		}
+		configMap.Data[configMapDataKey] = data
+
+		if create {
+			_, err = configMaps.Create(context.TODO(), configMap, metav1.CreateOptions{})
+		} else {
+			_, err = configMaps.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+		}
+		if (apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)) && conflicts < configMapConflictRetries {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %v", name, err)
+		}
+		return nil
+	}
+}
+
+func (s *configMapStore) LoadAudit() ([]AuditEntry, error) {
+	configMap, err := s.getRecords(s.auditName())
+	if err != nil || configMap == nil {
+		return nil, err
+	}
+	var entries []AuditEntry
+	skipped := 0
+	for _, line := range strings.Split(configMap.Data[configMapDataKey], "\n") {
+		if line == "" {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			skipped++
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if skipped > 0 {
+		log.Printf("Warning: Skipped %d unreadable audit log entries in %s", skipped, s.auditName())
+	}
+	return entries, nil
+}
+
+// AppendAudit drops the oldest entries when the new one does not fit
+func (s *configMapStore) AppendAudit(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %v", err)
+	}
+	if len(line)+1 > s.maxAuditBytes {
+		return fmt.Errorf("audit entry of %d bytes does not fit in a ConfigMap", len(line))
+	}
+	return s.updateRecords(s.auditName(), func(current string) (string, error) {
+		data := current + string(line) + "\n"
+		for len(data) > s.maxAuditBytes {
+			data = data[strings.IndexByte(data, '\n')+1:]
+		}
+		return data, nil
+	})
+}
+
+func (s *configMapStore) Stats() map[string]interface{} {
+	stats := map[string]interface{}{
+		"backend":   config.StorageBackendConfigMap,
+		"namespace": s.namespace,
+		"prefix":    s.prefix,
+	}
+	chunks, err := s.chunks()
+	if err != nil {
+		stats["error"] = err.Error()
+		return stats
+	}
+
+	records := 0
+	var bytes int64
+	for i := range chunks {
+		_, _, count := chunkTimes(&chunks[i])
+		records += count
+		bytes += int64(len(chunks[i].Data[configMapDataKey]))
+	}
+	stats["chunks"] = len(chunks)
+	stats["records"] = records
+	stats["bytes"] = bytes
+	if len(chunks) > 0 {
+		first, _, _ := chunkTimes(&chunks[0])
+		_, last, _ := chunkTimes(&chunks[len(chunks)-1])
+		stats["first"] = first
+		stats["last"] = last
+	}
+	return stats
+}
+
+func (s *configMapStore) Close() error {
+	return nil
+}
@@ -0,0 +1,386 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s-monitor/pkg/config"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testChange(id string, at time.Time) Change {
+	return Change{ID: id, Timestamp: at, EventType: "ADDED", ResourceType: "pods", Namespace: "default", Name: id, Severity: SeverityInfo}
+}
+
+func changeIDs(changes []Change) string {
+	ids := make([]string, 0, len(changes))
+	for _, change := range changes {
+		ids = append(ids, change.ID)
+	}
+	return fmt.Sprint(ids)
+}
+
+// checkResourceVersions makes the fake clientset reject updates of
+// ConfigMaps that were changed since they were read, as the API server does
+func checkResourceVersions(client *fake.Clientset) {
+	client.PrependReactor("create", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		action.(k8stesting.CreateAction).GetObject().(*v1.ConfigMap).ResourceVersion = "1"
+		return false, nil, nil
+	})
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		update := action.(k8stesting.UpdateAction).GetObject().(*v1.ConfigMap)
+		current, err := client.Tracker().Get(action.GetResource(), update.Namespace, update.Name)
+		if err != nil {
+			return false, nil, nil
+		}
+		version := current.(*v1.ConfigMap).ResourceVersion
+		if update.ResourceVersion != version {
+			return true, nil, apierrors.NewConflict(action.GetResource().GroupResource(), update.Name, fmt.Errorf("the object has been modified"))
+		}
+		next, _ := strconv.Atoi(version)
+		update.ResourceVersion = strconv.Itoa(next + 1)
+		return false, nil, nil
+	})
+}
+
+func TestConfigMapStoreConflicts(t *testing.T) {
+	resource := schema.GroupResource{Resource: "configmaps"}
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name string
+		seed bool // the first store writes a change before the second opens
+		// setup runs after both stores are opened and before the second
+		// store appends "b"
+		setup   func(t *testing.T, client *fake.Clientset, first *configMapStore)
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "create races with another writer",
+			setup: func(t *testing.T, client *fake.Clientset, first *configMapStore) {
+				// Both stores start without chunks, the first one creates chunk 0
+				if err := first.Append(testChange("a", now)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "update conflicts with another writer",
+			seed: true,
+			setup: func(t *testing.T, client *fake.Clientset, first *configMapStore) {
+				// The second store still holds chunk 0 as it was before this
+				if err := first.Append(testChange("a", now)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"seed", "a", "b"},
+		},
+		{
+			name: "conflicts do not stop",
+			seed: true,
+			setup: func(t *testing.T, client *fake.Clientset, first *configMapStore) {
+				client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, apierrors.NewConflict(resource, first.chunkName(0), fmt.Errorf("stale"))
+				})
+			},
+			want:    []string{"seed"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			checkResourceVersions(client)
+			first, err := openConfigMapStore(client, "monitor", "changes", nil, newInvalidRecords())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.seed {
+				if err := first.Append(testChange("seed", now.Add(-time.Minute))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			second, err := openConfigMapStore(client, "monitor", "changes", nil, newInvalidRecords())
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.setup(t, client, first)
+
+			err = second.Append(testChange("b", now.Add(time.Second)))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Append() error = %v, want error %v", err, test.wantErr)
+			}
+
+			stored, err := first.Query(ChangeFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, change := range stored {
+				ids = append(ids, change.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(test.want) {
+				t.Errorf("stored %v, want %v", ids, test.want)
+			}
+		})
+	}
+}
+
+// recordBytes returns the size of the chunk line of a change
+func recordBytes(t *testing.T, change Change) int {
+	t.Helper()
+	line, err := json.Marshal(changeRecords([]Change{change})[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(line) + 1
+}
+
+func TestConfigMapStoreChunks(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	changes := make([]Change, 5)
+	for i := range changes {
+		changes[i] = testChange(fmt.Sprintf("c%d", i), start.Add(time.Duration(i)*time.Minute))
+	}
+	// Changes of equal size, two fit in a chunk
+	size := recordBytes(t, changes[0])
+
+	tests := []struct {
+		name string
+		// write stores the changes
+		write       func(store *configMapStore) error
+		compact     time.Time // compaction cutoff, zero skips compaction
+		wantChunks  []string  // IDs per chunk, oldest chunk first
+		wantRemoved int
+	}{
+		{
+			name:       "one batch",
+			write:      func(store *configMapStore) error { return store.Append(changes...) },
+			wantChunks: []string{"[c0 c1]", "[c2 c3]", "[c4]"},
+		},
+		{
+			name: "one change at a time",
+			write: func(store *configMapStore) error {
+				for _, change := range changes {
+					if err := store.Append(change); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			wantChunks: []string{"[c0 c1]", "[c2 c3]", "[c4]"},
+		},
+		{
+			name: "too large for a chunk",
+			write: func(store *configMapStore) error {
+				large := testChange("large", start)
+				large.Name = strings.Repeat("x", 3*size)
+				return store.Append(large, changes[0])
+			},
+			wantChunks: []string{"[c0]"},
+		},
+		{
+			name:        "compaction drops whole chunks",
+			write:       func(store *configMapStore) error { return store.Append(changes...) },
+			compact:     start.Add(2 * time.Minute),
+			wantChunks:  []string{"[c2 c3]", "[c4]"},
+			wantRemoved: 2,
+		},
+		{
+			name:        "compaction keeps the newest chunk",
+			write:       func(store *configMapStore) error { return store.Append(changes...) },
+			compact:     start.Add(time.Hour),
+			wantChunks:  []string{"[c4]"},
+			wantRemoved: 4,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			checkResourceVersions(client)
+			store, err := openConfigMapStore(client, "monitor", "changes", nil, newInvalidRecords())
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.maxBytes = 2 * size
+			if err := test.write(store); err != nil {
+				t.Fatal(err)
+			}
+			if !test.compact.IsZero() {
+				removed, err := store.Compact(test.compact)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if removed != test.wantRemoved {
+					t.Errorf("Compact() removed %d, want %d", removed, test.wantRemoved)
+				}
+			}
+
+			list, err := client.CoreV1().ConfigMaps("monitor").List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var chunks []string
+			for _, chunk := range list.Items {
+				if len(chunk.Data[configMapDataKey]) > store.maxBytes {
+					t.Errorf("chunk %s holds %d bytes, more than %d", chunk.Name, len(chunk.Data[configMapDataKey]), store.maxBytes)
+				}
+				replay := newRecordReplay("test", ChangeFilter{}, nil, newInvalidRecords())
+				for _, line := range strings.Split(strings.TrimSpace(chunk.Data[configMapDataKey]), "\n") {
+					replay.add([]byte(line))
+				}
+				stored := replay.result()
+				first, last, count := chunkTimes(&chunk)
+				if count != len(stored) || !first.Equal(stored[0].Timestamp) || !last.Equal(stored[len(stored)-1].Timestamp) {
+					t.Errorf("chunk %s notes %d records from %v to %v, holds %s", chunk.Name, count, first, last, changeIDs(stored))
+				}
+				chunks = append(chunks, changeIDs(stored))
+			}
+			if fmt.Sprint(chunks) != fmt.Sprint(test.wantChunks) {
+				t.Errorf("chunks %v, want %v", chunks, test.wantChunks)
+			}
+		})
+	}
+}
+
+func TestConfigMapStoreReadStateFull(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	client := fake.NewSimpleClientset()
+	checkResourceVersions(client)
+	store, err := openConfigMapStore(client, "monitor", "changes", nil, newInvalidRecords())
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := readRecord{Op: readOpRead, Time: start, User: "alice", IDs: []string{"c0"}}
+	line, err := encodeReadRecord(nil, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room for three records
+	store.maxReadStateBytes = 3 * (len(line) + 1)
+
+	state := newReadState()
+	if err := state.open(store); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		record.Time = start.Add(time.Duration(i) * time.Minute)
+		if err := state.add(record); err != nil {
+			t.Fatalf("add() of record %d: %v", i, err)
+		}
+	}
+	if err := state.add(readRecord{Op: readOpReadAll, Time: start.Add(time.Hour), User: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Six records were added, the repeated reads were compacted to make room
+	stored, err := store.LoadReadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) > 3 || stored[len(stored)-1].Op != readOpReadAll {
+		t.Errorf("stored %+v, want at most three records ending with bob's read all", stored)
+	}
+	chunks, err := store.chunks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("read state listed as %d change chunks", len(chunks))
+	}
+}
+
+func TestConfigMapStoreAudit(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	client := fake.NewSimpleClientset()
+	checkResourceVersions(client)
+	store, err := openConfigMapStore(client, "monitor", "changes", nil, newInvalidRecords())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := func(i int) AuditEntry {
+		return AuditEntry{Time: start.Add(time.Duration(i) * time.Minute), Actor: "alice", Action: "resource.update", Target: fmt.Sprintf("resources/r%d", i)}
+	}
+	line, err := json.Marshal(entry(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room for three entries
+	store.maxAuditBytes = 3 * (len(line) + 1)
+
+	for i := 0; i < 5; i++ {
+		if err := store.AppendAudit(entry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	audit := newAuditLog()
+	if err := audit.open(store); err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	for _, entry := range audit.entries {
+		targets = append(targets, entry.Target)
+	}
+	if got := fmt.Sprint(targets); got != "[resources/r2 resources/r3 resources/r4]" {
+		t.Errorf("audit log holds %s, want the newest three", got)
+	}
+}
+
+func TestConfigMapBackendLocalFiles(t *testing.T) {
+	dir := t.TempDir()
+	persistence := config.PersistenceConfig{
+		Enabled:         true,
+		FilePath:        filepath.Join(dir, "changes.json"),
+		Backend:         config.StorageBackendConfigMap,
+		ConfigMapPrefix: "changes",
+		StoreSnapshots:  true,
+	}
+	os.Setenv("POD_NAMESPACE", "monitor")
+	defer os.Unsetenv("POD_NAMESPACE")
+
+	client := fake.NewSimpleClientset()
+	if _, err := NewK8sMonitor(client, &config.Config{Persistence: persistence}); err == nil {
+		t.Fatal("NewK8sMonitor() kept snapshots with the configmap backend")
+	}
+
+	persistence.StoreSnapshots = false
+	m, err := NewK8sMonitor(client, &config.Config{Persistence: persistence})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	change := testChange("c0", time.Now())
+	m.changes = append(m.changes, change)
+	if err := m.RecordAudit("alice", "resource.update", "resources/pods", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Acknowledge("c0", "alice", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"changes-audit", "changes-readstate"} {
+		if _, err := client.CoreV1().ConfigMaps("monitor").Get(context.TODO(), name, metav1.GetOptions{}); err != nil {
+			t.Errorf("ConfigMap %s: %v", name, err)
+		}
+	}
+	if files, err := os.ReadDir(dir); err != nil || len(files) != 0 {
+		t.Errorf("local files %v, %v, want none", files, err)
+	}
+}
@@ -0,0 +1,355 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"k8s-monitor/pkg/config"
+	"k8s-monitor/pkg/utils"
+)
+
+// Journal operations
+const (
+	opChange  = "change"
+	opRead    = "read"
+	opReadAll = "readAll"
+)
+
+// journalRecord is one line of the change journal
+type journalRecord struct {
+	Op     string    `json:"op"`
+	Time   time.Time `json:"time"`
+	Schema int       `json:"schema,omitempty"` // opChange, format version of Change
+	Change *Change   `json:"change,omitempty"` // opChange
+	IDs    []string  `json:"ids,omitempty"`    // opRead
+}
+
+// journalLine is how journal records are read back, the change is decoded
+// separately once its schema version is known
+type journalLine struct {
+	Op     string          `json:"op"`
+	Time   time.Time       `json:"time"`
+	Schema int             `json:"schema"`
+	Change json.RawMessage `json:"change"`
+	IDs    []string        `json:"ids"`
+	Sealed string          `json:"sealed"`
+}
+
+// sealedRecord is an encrypted journal record. The time stays readable so
+// segment time ranges can be rebuilt without the key.
+type sealedRecord struct {
+	Time   time.Time `json:"time"`
+	Sealed string    `json:"sealed"`
+}
+
+func (r sealedRecord) RecordTime() time.Time {
+	return r.Time
+}
+
+// Journal records without a schema version were written before versioning
+// was introduced, with the snapshot format
+const unversionedJournalSchema = schemaSnapshots
+
+func (r journalRecord) RecordTime() time.Time {
+	return r.Time
+}
+
+// journalStore keeps changes in the append-only NDJSON journal. Queries
+// replay the segments overlapping the requested time range.
+type journalStore struct {
+	journal *utils.Journal
+	keyring *utils.Keyring // encrypts records when set
+	invalid *invalidRecords
+	objects *objectArchive // long-term history in a bucket, optional
+
+	readStateFile // per-user read state next to the segments
+}
+
+func openJournalStore(dir string, maxBytes int64, maxAge time.Duration, keyring *utils.Keyring, invalid *invalidRecords) (*journalStore, error) {
+	journal, err := utils.OpenJournal(dir, maxBytes, maxAge)
+	if err != nil {
+		return nil, err
+	}
+	return &journalStore{
+		journal:       journal,
+		keyring:       keyring,
+		invalid:       invalid,
+		readStateFile: readStateFile{path: filepath.Join(dir, "readstate.jsonl"), keyring: keyring},
+	}, nil
+}
+
+// append writes records to the journal, sealing them first when encrypting
+func (s *journalStore) append(records ...journalRecord) error {
+	sealed, err := sealRecords(s.keyring, records)
+	if err != nil {
+		return err
+	}
+	return s.journal.Append(sealed...)
+}
+
+// sealRecords encrypts records with keyring, a nil keyring leaves them as they are
+func sealRecords(keyring *utils.Keyring, records []journalRecord) ([]utils.JournalRecord, error) {
+	sealed := make([]utils.JournalRecord, 0, len(records))
+	for _, record := range records {
+		if keyring == nil {
+			sealed = append(sealed, record)
+			continue
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal journal record: %v", err)
+		}
+		ciphertext, err := keyring.Seal(data)
+		if err != nil {
+			return nil, err
+		}
+		sealed = append(sealed, sealedRecord{Time: record.Time, Sealed: string(ciphertext)})
+	}
+	return sealed, nil
+}
+
+// changeRecords wraps changes in journal records
+func changeRecords(changes []Change) []journalRecord {
+	records := make([]journalRecord, 0, len(changes))
+	for i := range changes {
+		records = append(records, journalRecord{Op: opChange, Time: changes[i].Timestamp, Schema: currentSchema, Change: &changes[i]})
+	}
+	return records
+}
+
+func (s *journalStore) Append(changes ...Change) error {
+	return s.append(changeRecords(changes)...)
+}
+
+// recordReplay rebuilds changes and their read state from journal records
+type recordReplay struct {
+	source  string
+	filter  ChangeFilter
+	keyring *utils.Keyring
+	invalid *invalidRecords
+
+	changes []Change
+	index   map[string]int // change ID -> position in changes
+}
+
+func newRecordReplay(source string, filter ChangeFilter, keyring *utils.Keyring, invalid *invalidRecords) *recordReplay {
+	return &recordReplay{
+		source:  source,
+		filter:  filter,
+		keyring: keyring,
+		invalid: invalid,
+		index:   make(map[string]int),
+	}
+}
+
+// add applies one journal record
+func (r *recordReplay) add(line []byte) error {
+	var record journalLine
+	if err := json.Unmarshal(line, &record); err != nil {
+		r.invalid.add(r.source, line, err)
+		return nil
+	}
+	// Records written before encryption was enabled are read as they are
+	if record.Sealed != "" {
+		if r.keyring == nil {
+			r.invalid.add(r.source, line, fmt.Errorf("record is encrypted but no encryption keys are configured"))
+			return nil
+		}
+		plaintext, err := r.keyring.Open([]byte(record.Sealed))
+		if err == nil {
+			record = journalLine{}
+			err = json.Unmarshal(plaintext, &record)
+		}
+		if err != nil {
+			r.invalid.add(r.source, line, err)
+			return nil
+		}
+	}
+
+	switch record.Op {
+	case opChange:
+		schema := record.Schema
+		if schema == 0 {
+			schema = unversionedJournalSchema
+		}
+		change, err := decodeChange(schema, record.Change)
+		if err != nil {
+			r.invalid.add(r.source, line, err)
+			return nil
+		}
+		// A batch that was retried after a partial write can repeat changes
+		if _, seen := r.index[change.ID]; seen || !r.filter.inRange(change.Timestamp) {
+			return nil
+		}
+		r.index[change.ID] = len(r.changes)
+		r.changes = append(r.changes, change)
+	case opRead:
+		for _, id := range record.IDs {
+			if i, ok := r.index[id]; ok {
+				r.changes[i].IsRead = true
+			}
+		}
+	case opReadAll:
+		for i := range r.changes {
+			if !r.changes[i].Timestamp.After(record.Time) {
+				r.changes[i].IsRead = true
+			}
+		}
+	default:
+		r.invalid.add(r.source, line, fmt.Errorf("unknown operation %q", record.Op))
+	}
+	return nil
+}
+
+// result returns the replayed changes that match the filter
+func (r *recordReplay) result() []Change {
+	// Imported history can be appended after newer changes
+	sort.SliceStable(r.changes, func(a, b int) bool {
+		return r.changes[a].Timestamp.Before(r.changes[b].Timestamp)
+	})
+	return r.filter.Apply(r.changes)
+}
+
+func (s *journalStore) Query(filter ChangeFilter) ([]Change, error) {
+	replay := func(remote []remoteSegment) (*recordReplay, error) {
+		replay := newRecordReplay("journal", filter, s.keyring, s.invalid)
+		for _, segment := range remote {
+			if err := s.objects.read(segment, replay.add); err != nil {
+				return nil, err
+			}
+		}
+		// Read records for a change can live in any later segment, so only the
+		// start of the range narrows the replay
+		if err := s.journal.Replay(filter.From, time.Time{}, replay.add); err != nil {
+			return nil, err
+		}
+		return replay, nil
+	}
+
+	local, err := replay(nil)
+	if err != nil {
+		return nil, err
+	}
+	result := local.result()
+	if s.objects == nil {
+		return result, nil
+	}
+	if filter.Limit > 0 && len(result) >= filter.Limit {
+		return result, nil
+	}
+
+	// The range reaches past the local journal, add older segments from the
+	// bucket. With a limit, only as many as needed, newest first.
+	remote, err := s.objects.older(s.journal.Segments(), filter.From, filter.To)
+	if err != nil || len(remote) == 0 {
+		return result, err
+	}
+	start := 0
+	if filter.Limit > 0 {
+		start = len(remote) - 1
+	}
+	for ; start >= 0; start-- {
+		combined, err := replay(remote[start:])
+		if err != nil {
+			return nil, err
+		}
+		result = combined.result()
+		if filter.Limit == 0 || len(result) >= filter.Limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (s *journalStore) MarkRead(at time.Time, ids ...string) error {
+	return s.append(journalRecord{Op: opRead, Time: at, IDs: ids})
+}
+
+func (s *journalStore) MarkAllRead(before time.Time) error {
+	return s.append(journalRecord{Op: opReadAll, Time: before})
+}
+
+// Compact removes whole segments, so changes just before the cutoff can survive
+func (s *journalStore) Compact(before time.Time) (int, error) {
+	records := func() int {
+		total := 0
+		for _, segment := range s.journal.Segments() {
+			total += segment.Records
+		}
+		return total
+	}
+
+	stored := records()
+	if _, err := s.journal.RemoveSegmentsBefore(before); err != nil {
+		return 0, err
+	}
+	return stored - records(), nil
+}
+
+// Archive gzips closed segments whose newest change is older than before
+func (s *journalStore) Archive(before time.Time) (int, error) {
+	return s.journal.ArchiveSegmentsBefore(before)
+}
+
+func (s *journalStore) EnforceBudget(maxBytes int64) (int, error) {
+	return s.journal.EnforceBudget(maxBytes)
+}
+
+// Ship spools closed segments and uploads them to the bucket, removing
+// segments from the bucket once they are older than its maximum age
+func (s *journalStore) Ship(now time.Time) (int, error) {
+	if s.objects == nil {
+		return 0, nil
+	}
+	if _, err := s.objects.spool(s.journal); err != nil {
+		return 0, err
+	}
+	uploaded, err := s.objects.upload()
+	if err != nil {
+		return uploaded, err
+	}
+	_, err = s.objects.expire(now)
+	return uploaded, err
+}
+
+func (s *journalStore) Stats() map[string]interface{} {
+	segments := s.journal.Segments()
+	var bytes, archivedBytes int64
+	records, archives := 0, 0
+	for _, segment := range segments {
+		bytes += segment.Bytes
+		records += segment.Records
+		if segment.Compressed {
+			archives++
+			archivedBytes += segment.Bytes
+		}
+	}
+	stats := map[string]interface{}{
+		"backend":       config.StorageBackendFile,
+		"segments":      len(segments),
+		"archives":      archives,
+		"records":       records,
+		"bytes":         bytes,
+		"archivedBytes": archivedBytes,
+	}
+	if len(segments) > 0 {
+		stats["first"] = segments[0].First
+		stats["last"] = segments[len(segments)-1].Last
+	}
+	if s.objects != nil {
+		stats["objectStorage"] = s.objects.stats()
+	}
+	return stats
+}
+
+// Recovered returns what was salvaged from damaged segments on open
+func (s *journalStore) Recovered() []utils.RecoveryReport {
+	return s.journal.Recovered()
+}
+
+func (s *journalStore) Close() error {
+	return s.journal.Close()
+}
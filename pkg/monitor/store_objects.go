@@ -0,0 +1,451 @@
+package monitor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"k8s-monitor/pkg/config"
+	"k8s-monitor/pkg/utils"
+)
+
+const (
+	// Object keys carry the time range of their segment so the bucket can be
+	// listed without reading any object, and sort oldest first
+	objectTimeLayout  = "20060102T150405.000000000Z"
+	objectSegmentsDir = "segments/"
+	objectSuffix      = ".ndjson.gz"
+	objectTimeout     = 2 * time.Minute
+)
+
+// remoteSegment is a journal segment stored in the bucket
+type remoteSegment struct {
+	Key   string
+	File  string // segment name in the local journal
+	First time.Time
+	Last  time.Time
+	Bytes int64
+}
+
+// objectArchive keeps closed journal segments in an S3 compatible bucket.
+// Segments are gzipped into a local spool directory first and uploaded from
+// there, so an unreachable bucket only delays the upload.
+type objectArchive struct {
+	client   *minio.Client
+	endpoint string
+	bucket   string
+	prefix   string
+	spoolDir string
+	maxAge   time.Duration
+
+	mutex      sync.Mutex
+	segments   []remoteSegment // oldest first
+	listed     bool
+	uploaded   int
+	lastUpload time.Time
+	lastError  string
+	errorAt    time.Time
+}
+
+func openObjectArchive(cfg config.ObjectStorageConfig, journalDir string) (*objectArchive, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("object storage needs an endpoint and a bucket")
+	}
+
+	creds, err := objectCredentials(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{Creds: creds, Secure: !cfg.Insecure, Region: cfg.Region})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create object storage client: %v", err)
+	}
+
+	spoolDir := cfg.SpoolDir
+	if spoolDir == "" {
+		spoolDir = filepath.Join(journalDir, "spool")
+	}
+	if err := os.MkdirAll(spoolDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %v", err)
+	}
+
+	return &objectArchive{
+		client:   client,
+		endpoint: cfg.Endpoint,
+		bucket:   cfg.Bucket,
+		prefix:   cfg.Prefix,
+		spoolDir: spoolDir,
+		maxAge:   time.Duration(cfg.MaxAge) * time.Second,
+	}, nil
+}
+
+// objectCredentials reads static keys from files or the environment and
+// falls back to the instance or web identity role when there are none
+func objectCredentials(cfg config.ObjectStorageConfig) (*credentials.Credentials, error) {
+	read := func(file, env string) (string, error) {
+		if file != "" {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return "", fmt.Errorf("failed to read object storage credentials: %v", err)
+			}
+			return strings.TrimSpace(string(data)), nil
+		}
+		return os.Getenv(env), nil
+	}
+
+	accessKey, err := read(cfg.AccessKeyFile, cfg.AccessKeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	secretKey, err := read(cfg.SecretKeyFile, cfg.SecretKeyEnv)
+	if err != nil {
+		return nil, err
+	}
+	if accessKey == "" && secretKey == "" {
+		return credentials.NewIAM(""), nil
+	}
+	return credentials.NewStaticV4(accessKey, secretKey, ""), nil
+}
+
+// objectName names the object of a segment, without the prefix
+func objectName(segment utils.JournalSegment) string {
+	file := strings.TrimSuffix(segment.File, ".gz")
+	file = strings.TrimSuffix(file, ".ndjson")
+	return segment.First.UTC().Format(objectTimeLayout) + "_" + segment.Last.UTC().Format(objectTimeLayout) + "_" + file + objectSuffix
+}
+
+// parseObjectName reverses objectName
+func parseObjectName(name string) (remoteSegment, bool) {
+	parts := strings.SplitN(strings.TrimSuffix(name, objectSuffix), "_", 3)
+	if len(parts) != 3 || !strings.HasSuffix(name, objectSuffix) {
+		return remoteSegment{}, false
+	}
+	first, err := time.Parse(objectTimeLayout, parts[0])
+	if err != nil {
+		return remoteSegment{}, false
+	}
+	last, err := time.Parse(objectTimeLayout, parts[1])
+	if err != nil {
+		return remoteSegment{}, false
+	}
+	return remoteSegment{File: parts[2] + ".ndjson", First: first, Last: last}, true
+}
+
+// sameSegment reports whether a remote segment is a copy of a local one
+func (r remoteSegment) sameSegment(segment utils.JournalSegment) bool {
+	return r.First.Equal(segment.First) && r.File == strings.TrimSuffix(segment.File, ".gz")
+}
+
+func (a *objectArchive) fail(err error) error {
+	a.mutex.Lock()
+	a.lastError = err.Error()
+	a.errorAt = time.Now()
+	a.mutex.Unlock()
+	return err
+}
+
+// list returns the segments in the bucket, listing it on first use
+func (a *objectArchive) list() ([]remoteSegment, error) {
+	a.mutex.Lock()
+	if a.listed {
+		segments := a.segments
+		a.mutex.Unlock()
+		return segments, nil
+	}
+	a.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), objectTimeout)
+	defer cancel()
+
+	var segments []remoteSegment
+	for object := range a.client.ListObjects(ctx, a.bucket, minio.ListObjectsOptions{Prefix: a.prefix + objectSegmentsDir, Recursive: true}) {
+		if object.Err != nil {
+			return nil, a.fail(fmt.Errorf("failed to list bucket %s: %v", a.bucket, object.Err))
+		}
+		segment, ok := parseObjectName(strings.TrimPrefix(object.Key, a.prefix+objectSegmentsDir))
+		if !ok {
+			continue
+		}
+		segment.Key = object.Key
+		segment.Bytes = object.Size
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].First.Before(segments[j].First)
+	})
+
+	a.mutex.Lock()
+	a.segments, a.listed = segments, true
+	a.mutex.Unlock()
+	return segments, nil
+}
+
+// spool copies closed segments that are not in the bucket yet into the spool
+// directory and returns how many were copied
+func (a *objectArchive) spool(journal *utils.Journal) (int, error) {
+	// Spool even while the bucket is unreachable so compaction never removes
+	// a segment that exists nowhere else. Uploading a segment twice just
+	// replaces the object with the same content.
+	remote, _ := a.list()
+
+	spooled := 0
+	for _, segment := range journal.Segments() {
+		if !segment.Closed || segment.Records == 0 {
+			continue
+		}
+		uploaded := false
+		for _, r := range remote {
+			if r.sameSegment(segment) {
+				uploaded = true
+				break
+			}
+		}
+		path := filepath.Join(a.spoolDir, objectName(segment))
+		if _, err := os.Stat(path); uploaded || err == nil {
+			continue
+		}
+
+		data, err := os.ReadFile(journal.SegmentPath(segment))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return spooled, fmt.Errorf("failed to read journal segment: %v", err)
+		}
+		if !segment.Compressed {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Name = segment.File
+			gz.Write(data)
+			if err := gz.Close(); err != nil {
+				return spooled, fmt.Errorf("failed to compress journal segment: %v", err)
+			}
+			data = buf.Bytes()
+		}
+		if err := utils.WriteFileAtomic(path, data, 0600); err != nil {
+			return spooled, fmt.Errorf("failed to spool journal segment: %v", err)
+		}
+		spooled++
+	}
+	return spooled, nil
+}
+
+// upload sends spooled segments to the bucket, oldest first, and removes them
+// from the spool. It stops at the first failure, the rest is retried later.
+func (a *objectArchive) upload() (int, error) {
+	names, err := a.spooled()
+	if err != nil {
+		return 0, err
+	}
+
+	uploaded := 0
+	for _, name := range names {
+		segment, _ := parseObjectName(name)
+		segment.Key = a.prefix + objectSegmentsDir + name
+		if err := a.put(filepath.Join(a.spoolDir, name), &segment); err != nil {
+			return uploaded, a.fail(err)
+		}
+		os.Remove(filepath.Join(a.spoolDir, name))
+
+		// Queries may be reading the current list, it is replaced rather than modified
+		a.mutex.Lock()
+		segments := make([]remoteSegment, 0, len(a.segments)+1)
+		for _, s := range a.segments {
+			if s.Key != segment.Key {
+				segments = append(segments, s)
+			}
+		}
+		segments = append(segments, segment)
+		sort.Slice(segments, func(i, j int) bool {
+			return segments[i].First.Before(segments[j].First)
+		})
+		a.segments = segments
+		a.uploaded++
+		a.lastUpload = time.Now()
+		a.mutex.Unlock()
+		uploaded++
+	}
+	return uploaded, nil
+}
+
+// spooled lists the segments waiting in the spool, oldest first
+func (a *objectArchive) spooled() ([]string, error) {
+	entries, err := os.ReadDir(a.spoolDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if _, ok := parseObjectName(entry.Name()); ok && !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (a *objectArchive) put(path string, segment *remoteSegment) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open spooled segment: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open spooled segment: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), objectTimeout)
+	defer cancel()
+	_, err = a.client.PutObject(ctx, a.bucket, segment.Key, file, info.Size(), minio.PutObjectOptions{ContentType: "application/gzip"})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %v", segment.Key, err)
+	}
+	segment.Bytes = info.Size()
+	return nil
+}
+
+// expire removes segments older than the configured maximum age from the bucket
+func (a *objectArchive) expire(now time.Time) (int, error) {
+	if a.maxAge <= 0 {
+		return 0, nil
+	}
+	segments, err := a.list()
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := now.Add(-a.maxAge)
+	removed := 0
+	for _, segment := range segments {
+		if !segment.Last.Before(cutoff) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), objectTimeout)
+		err := a.client.RemoveObject(ctx, a.bucket, segment.Key, minio.RemoveObjectOptions{})
+		cancel()
+		if err != nil {
+			return removed, a.fail(fmt.Errorf("failed to remove %s: %v", segment.Key, err))
+		}
+		removed++
+	}
+
+	a.mutex.Lock()
+	var kept []remoteSegment
+	for _, segment := range a.segments {
+		if !segment.Last.Before(cutoff) {
+			kept = append(kept, segment)
+		}
+	}
+	a.segments = kept
+	a.mutex.Unlock()
+	return removed, nil
+}
+
+// older returns the bucket segments overlapping [from, to] that are no longer
+// in the local journal, oldest first
+func (a *objectArchive) older(local []utils.JournalSegment, from, to time.Time) ([]remoteSegment, error) {
+	segments, err := a.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var older []remoteSegment
+	for _, segment := range segments {
+		if !from.IsZero() && segment.Last.Before(from) {
+			continue
+		}
+		if !to.IsZero() && segment.First.After(to) {
+			continue
+		}
+		present := false
+		for _, l := range local {
+			if segment.sameSegment(l) {
+				present = true
+				break
+			}
+		}
+		if !present {
+			older = append(older, segment)
+		}
+	}
+	return older, nil
+}
+
+// read downloads a segment and streams its records to fn
+func (a *objectArchive) read(segment remoteSegment, fn func(line []byte) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), objectTimeout)
+	defer cancel()
+
+	object, err := a.client.GetObject(ctx, a.bucket, segment.Key, minio.GetObjectOptions{})
+	if err != nil {
+		return a.fail(fmt.Errorf("failed to download %s: %v", segment.Key, err))
+	}
+	defer object.Close()
+
+	// Download before replaying so a failed download does not leave a half
+	// replayed segment behind
+	data, err := io.ReadAll(object)
+	if err != nil {
+		return a.fail(fmt.Errorf("failed to download %s: %v", segment.Key, err))
+	}
+	damaged, err := utils.ReadSegment(bytes.NewReader(data), true, fn)
+	if err != nil {
+		return err
+	}
+	if damaged > 0 {
+		log.Printf("Warning: Skipped %d damaged records in %s", damaged, segment.Key)
+	}
+	return nil
+}
+
+func (a *objectArchive) stats() map[string]interface{} {
+	names, _ := a.spooled()
+	var spoolBytes int64
+	for _, name := range names {
+		if info, err := os.Stat(filepath.Join(a.spoolDir, name)); err == nil {
+			spoolBytes += info.Size()
+		}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var bytes int64
+	for _, segment := range a.segments {
+		bytes += segment.Bytes
+	}
+	stats := map[string]interface{}{
+		"endpoint":   a.endpoint,
+		"bucket":     a.bucket,
+		"prefix":     a.prefix,
+		"segments":   len(a.segments),
+		"bytes":      bytes,
+		"uploaded":   a.uploaded,
+		"spooled":    len(names),
+		"spoolBytes": spoolBytes,
+	}
+	if len(a.segments) > 0 {
+		stats["first"] = a.segments[0].First
+	}
+	if !a.lastUpload.IsZero() {
+		stats["lastUpload"] = a.lastUpload
+	}
+	if a.lastError != "" {
+		stats["lastError"] = a.lastError
+		stats["lastErrorAt"] = a.errorAt
+	}
+	return stats
+}
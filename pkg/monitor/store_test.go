@@ -0,0 +1,366 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s-monitor/pkg/utils"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// storeBackend opens a backend for the contract tests. Opening it again with
+// the same env returns the same stored data.
+type storeBackend struct {
+	name string
+	// persistent backends keep their data when reopened
+	persistent bool
+	open       func(t *testing.T, env *storeEnv, keyring *utils.Keyring, invalid *invalidRecords) ChangeStore
+}
+
+func storeBackends() []storeBackend {
+	return []storeBackend{
+		{
+			name: "memory",
+			open: func(t *testing.T, env *storeEnv, keyring *utils.Keyring, invalid *invalidRecords) ChangeStore {
+				return newMemoryStore()
+			},
+		},
+		{
+			name:       "file",
+			persistent: true,
+			open: func(t *testing.T, env *storeEnv, keyring *utils.Keyring, invalid *invalidRecords) ChangeStore {
+				// Every append starts a new segment, so compaction can drop single changes
+				store, err := openJournalStore(filepath.Join(env.dir, "journal"), 1, 0, keyring, invalid)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return store
+			},
+		},
+		{
+			name:       "bolt",
+			persistent: true,
+			open: func(t *testing.T, env *storeEnv, keyring *utils.Keyring, invalid *invalidRecords) ChangeStore {
+				store, err := openBoltStore(filepath.Join(env.dir, "changes.db"), keyring, invalid)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return store
+			},
+		},
+		{
+			name:       "configmap",
+			persistent: true,
+			open: func(t *testing.T, env *storeEnv, keyring *utils.Keyring, invalid *invalidRecords) ChangeStore {
+				store, err := openConfigMapStore(env.client, "monitor", "changes", keyring, invalid)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// A chunk holds a single change, so compaction can drop single changes
+				store.maxBytes = 0
+				for _, change := range storeFixture(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)) {
+					if size := recordBytes(t, change); size > store.maxBytes {
+						store.maxBytes = size
+					}
+				}
+				// Sealed records are base64 encoded and carry a nonce
+				if keyring != nil {
+					store.maxBytes *= 2
+				}
+				return store
+			},
+		},
+	}
+}
+
+// storeEnv is where a backend keeps its data during one test
+type storeEnv struct {
+	dir    string
+	client *fake.Clientset
+}
+
+func newStoreEnv(t *testing.T) *storeEnv {
+	client := fake.NewSimpleClientset()
+	checkResourceVersions(client)
+	return &storeEnv{dir: t.TempDir(), client: client}
+}
+
+// storeFixture are six changes a minute apart, across two resource types and
+// two namespaces
+func storeFixture(start time.Time) []Change {
+	var changes []Change
+	for i, spec := range []struct{ resourceType, namespace, name string }{
+		{"pods", "default", "web-1"},
+		{"pods", "kube-system", "dns-1"},
+		{"deployments", "default", "web"},
+		{"pods", "default", "web-2"},
+		{"deployments", "kube-system", "dns"},
+		{"pods", "default", "worker-1"},
+	} {
+		change := testChange(fmt.Sprintf("c%d", i), start.Add(time.Duration(i)*time.Minute))
+		change.ResourceType = spec.resourceType
+		change.Namespace = spec.namespace
+		change.Name = spec.name
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func TestStoreQuery(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		filter ChangeFilter
+		want   string
+	}{
+		{name: "everything", filter: ChangeFilter{}, want: "[c0 c1 c2 c3 c4 c5]"},
+		{name: "time range", filter: ChangeFilter{From: start.Add(time.Minute), To: start.Add(3 * time.Minute)}, want: "[c1 c2 c3]"},
+		{name: "resource type", filter: ChangeFilter{ResourceTypes: []string{"deployments"}}, want: "[c2 c4]"},
+		{name: "namespace", filter: ChangeFilter{Namespaces: []string{"kube-system"}}, want: "[c1 c4]"},
+		{name: "name pattern", filter: ChangeFilter{Name: "web*"}, want: "[c0 c2 c3]"},
+		{name: "limit keeps the newest", filter: ChangeFilter{Limit: 2}, want: "[c4 c5]"},
+		{name: "limit with index", filter: ChangeFilter{ResourceTypes: []string{"pods"}, Limit: 2}, want: "[c3 c5]"},
+		{name: "index and time range", filter: ChangeFilter{Namespaces: []string{"default"}, To: start.Add(2 * time.Minute)}, want: "[c0 c2]"},
+		{name: "allow", filter: ChangeFilter{Allow: func(change Change) bool { return change.Namespace == "default" }}, want: "[c0 c2 c3 c5]"},
+		{name: "nothing matches", filter: ChangeFilter{ResourceTypes: []string{"secrets"}}, want: "[]"},
+	}
+
+	for _, backend := range storeBackends() {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t, newStoreEnv(t), nil, newInvalidRecords())
+			defer store.Close()
+			if err := store.Append(storeFixture(start)...); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					changes, err := store.Query(test.filter)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := changeIDs(changes); got != test.want {
+						t.Errorf("Query() = %s, want %s", got, test.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestStoreReadStateAndCompaction(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		// apply changes the store after the fixture was appended
+		apply      func(store ChangeStore) error
+		wantRead   string
+		wantStored string
+	}{
+		{
+			name:       "nothing read",
+			apply:      func(store ChangeStore) error { return nil },
+			wantRead:   "[]",
+			wantStored: "[c0 c1 c2 c3 c4 c5]",
+		},
+		{
+			name: "read by ID",
+			apply: func(store ChangeStore) error {
+				return store.MarkRead(start.Add(time.Hour), "c1", "c4", "missing")
+			},
+			wantRead:   "[c1 c4]",
+			wantStored: "[c0 c1 c2 c3 c4 c5]",
+		},
+		{
+			name: "read up to a time",
+			apply: func(store ChangeStore) error {
+				return store.MarkAllRead(start.Add(2 * time.Minute))
+			},
+			wantRead:   "[c0 c1 c2]",
+			wantStored: "[c0 c1 c2 c3 c4 c5]",
+		},
+		{
+			name: "compacted",
+			apply: func(store ChangeStore) error {
+				removed, err := store.Compact(start.Add(2*time.Minute + time.Second))
+				if err == nil && removed != 3 {
+					err = fmt.Errorf("Compact() removed %d changes, want 3", removed)
+				}
+				return err
+			},
+			wantRead:   "[]",
+			wantStored: "[c3 c4 c5]",
+		},
+		{
+			name: "read marks outlive compaction",
+			apply: func(store ChangeStore) error {
+				if err := store.MarkRead(start.Add(time.Hour), "c0", "c5"); err != nil {
+					return err
+				}
+				_, err := store.Compact(start.Add(time.Minute))
+				return err
+			},
+			wantRead:   "[c5]",
+			wantStored: "[c1 c2 c3 c4 c5]",
+		},
+	}
+
+	for _, backend := range storeBackends() {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					env := newStoreEnv(t)
+					store := backend.open(t, env, nil, newInvalidRecords())
+					// Appended one by one, as the writer does across batches
+					for _, change := range storeFixture(start) {
+						if err := store.Append(change); err != nil {
+							t.Fatal(err)
+						}
+					}
+					if err := test.apply(store); err != nil {
+						t.Fatal(err)
+					}
+					if backend.persistent {
+						store.Close()
+						store = backend.open(t, env, nil, newInvalidRecords())
+					}
+					defer store.Close()
+
+					stored, err := store.Query(ChangeFilter{})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := changeIDs(stored); got != test.wantStored {
+						t.Errorf("stored %s, want %s", got, test.wantStored)
+					}
+					read, err := store.Query(ChangeFilter{ReadOnly: true})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := changeIDs(read); got != test.wantRead {
+						t.Errorf("read %s, want %s", got, test.wantRead)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestStoreUserReadState(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	changes := storeFixture(start)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	keyring, err := utils.NewKeyring([][]byte{bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, backend := range storeBackends() {
+		t.Run(backend.name, func(t *testing.T) {
+			env := newStoreEnv(t)
+			store := backend.open(t, env, keyring, newInvalidRecords())
+			state := newReadState()
+			if err := state.open(store); err != nil {
+				t.Fatal(err)
+			}
+			for _, record := range []readRecord{
+				{Op: readOpRead, Time: at(10), User: "alice", IDs: []string{"c4"}},
+				{Op: readOpReadAll, Time: at(1), User: "alice"},
+				{Op: readOpRead, Time: at(11), User: "alice", IDs: []string{"c3"}},
+				{Op: readOpRead, Time: at(11), User: "bob", IDs: []string{"c5"}},
+			} {
+				if err := state.add(record); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := state.acknowledge("c2", Acknowledgement{User: "bob", Time: at(12), Comment: "expected"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if backend.persistent {
+				store.Close()
+				store = backend.open(t, env, keyring, newInvalidRecords())
+			}
+			defer store.Close()
+			reopened := newReadState()
+			if err := reopened.open(store); err != nil {
+				t.Fatal(err)
+			}
+			if read, acked := readView(reopened, "alice", changes); read != "[c0 c1 c3]" || acked != "[c2]" {
+				t.Errorf("alice sees read %s, acknowledged %s, want [c0 c1 c3] and [c2]", read, acked)
+			}
+			if read, _ := readView(reopened, "bob", changes); read != "[c5]" {
+				t.Errorf("bob sees read %s, want [c5]", read)
+			}
+			// Per-user reads do not mark the changes read for everyone
+			if read, err := store.Query(ChangeFilter{ReadOnly: true}); err != nil || len(read) != 0 {
+				t.Errorf("Query(ReadOnly) = %s, %v, want nothing", changeIDs(read), err)
+			}
+		})
+	}
+}
+
+func TestStoreEncryption(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	keyring := func(keys ...[]byte) *utils.Keyring {
+		if len(keys) == 0 {
+			return nil
+		}
+		k, err := utils.NewKeyring(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	tests := []struct {
+		name        string
+		readWith    [][]byte
+		want        string
+		wantInvalid int
+	}{
+		{name: "same key", readWith: [][]byte{oldKey}, want: "[c0 c1 c2 c3 c4 c5]"},
+		{name: "rotated key", readWith: [][]byte{newKey, oldKey}, want: "[c0 c1 c2 c3 c4 c5]"},
+		{name: "key removed", readWith: [][]byte{newKey}, want: "[]", wantInvalid: 6},
+		{name: "no keys", want: "[]", wantInvalid: 6},
+	}
+
+	for _, backend := range storeBackends() {
+		if !backend.persistent {
+			continue
+		}
+		t.Run(backend.name, func(t *testing.T) {
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					env := newStoreEnv(t)
+					store := backend.open(t, env, keyring(oldKey), newInvalidRecords())
+					if err := store.Append(storeFixture(start)...); err != nil {
+						t.Fatal(err)
+					}
+					store.Close()
+
+					invalid := newInvalidRecords()
+					store = backend.open(t, env, keyring(test.readWith...), invalid)
+					defer store.Close()
+					changes, err := store.Query(ChangeFilter{})
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := changeIDs(changes); got != test.want {
+						t.Errorf("Query() = %s, want %s", got, test.want)
+					}
+					if count := invalid.stats()["count"].(int); count != test.wantInvalid {
+						t.Errorf("%d invalid records reported, want %d", count, test.wantInvalid)
+					}
+				})
+			}
+		})
+	}
+}
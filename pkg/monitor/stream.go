@@ -0,0 +1,302 @@
+package monitor
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Stream event types
+const (
+	StreamChange = "change" // a new change
+	StreamRead   = "read"   // changes were marked read
+	StreamAck    = "ack"    // a change was acknowledged
+	StreamStats  = "stats"  // statistics that changed since the previous stats event
+	StreamReset  = "reset"  // events were missed, clients should reload
+)
+
+const (
+	// streamBacklog recent events are kept so reconnecting clients can resume
+	streamBacklog = 1024
+	// streamBuffer events are buffered per subscriber before it is dropped
+	streamBuffer = 256
+	// Stats events are coalesced to at most one per streamStatsInterval
+	streamStatsInterval = time.Second
+)
+
+// StreamEvent is pushed to subscribers as things happen
+type StreamEvent struct {
+	ID     uint64                 `json:"-"`
+	Type   string                 `json:"-"`
+	Change *Change                `json:"change,omitempty"` // StreamChange and StreamAck
+	IDs    []string               `json:"ids,omitempty"`    // StreamRead, the changes marked read
+	Before *time.Time             `json:"before,omitempty"` // StreamRead, everything up to this time was marked read
+	Stats  map[string]interface{} `json:"stats,omitempty"`  // StreamStats
+	User   string                 `json:"-"`                // StreamRead, the user who read, empty for everyone
+}
+
+// Subscription receives stream events. C is closed when the subscriber fell
+// too far behind or was closed; a client can resume from the last event ID.
+type Subscription struct {
+	C <-chan StreamEvent
+
+	ch     chan StreamEvent
+	done   chan struct{} // closed with ch, stops the authorizing goroutine
+	filter ChangeFilter
+	hub    *streamHub
+	closed bool // guarded by the hub mutex
+
+	// lastStats were sent to a subscriber with an Allow filter or a user,
+	// which gets its own stats events. Guarded by the hub mutex.
+	lastStats map[string]interface{}
+}
+
+// streamHub fans events out to subscribers. Publishing never blocks, a
+// subscriber whose buffer is full is disconnected instead.
+type streamHub struct {
+	mutex       sync.Mutex
+	lastID      uint64
+	backlog     []StreamEvent // the newest events, oldest first
+	subscribers map[*Subscription]bool
+	dropped     int64
+	statsDirty  bool
+	lastStats   map[string]interface{}
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{subscribers: make(map[*Subscription]bool)}
+}
+
+// wants reports whether an event passes the subscription's filter
+func (s *Subscription) wants(event StreamEvent) bool {
+	switch event.Type {
+	case StreamStats:
+		return !s.personal()
+	case StreamRead:
+		return event.User == "" || event.User == s.filter.User
+	case StreamChange, StreamAck:
+		// Authorization is checked by authorize, outside the hub mutex
+		filter := s.filter
+		filter.Allow = nil
+		if event.Type == StreamAck {
+			// An ack changes the read and acknowledgement state the filter
+			// would select on, subscribers listing unacknowledged changes
+			// need it to remove the change
+			filter.UnreadOnly, filter.ReadOnly = false, false
+			filter.UnacknowledgedOnly, filter.AcknowledgedOnly = false, false
+		}
+		return filter.inRange(event.Change.Timestamp) && filter.matches(*event.Change)
+	}
+	return true
+}
+
+// authorize passes the events of a subscription with an Allow filter on to
+// C, leaving out changes the subscriber may not see. Decisions that need an
+// API call only hold up this subscriber.
+func (s *Subscription) authorize(out chan<- StreamEvent) {
+	defer close(out)
+	for event := range s.ch {
+		if event.Change != nil {
+			if s.filter.Prepare != nil {
+				s.filter.Prepare([]Scope{ScopeOf(*event.Change)})
+			}
+			if !s.filter.Allow(*event.Change) {
+				continue
+			}
+		}
+		select {
+		case out <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// personal reports whether a subscriber gets its own stats events
+func (s *Subscription) personal() bool {
+	return s.filter.Allow != nil || s.filter.User != ""
+}
+
+// publish numbers an event and hands it to every interested subscriber
+func (h *streamHub) publish(event StreamEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.lastID++
+	event.ID = h.lastID
+	h.backlog = append(h.backlog, event)
+	if len(h.backlog) > streamBacklog {
+		h.backlog = append([]StreamEvent(nil), h.backlog[len(h.backlog)-streamBacklog:]...)
+	}
+	if event.Type != StreamStats {
+		h.statsDirty = true
+	}
+
+	for sub := range h.subscribers {
+		if sub.wants(event) {
+			h.sendLocked(sub, event)
+		}
+	}
+}
+
+// sendLocked hands an event to a subscriber, which is dropped when its
+// buffer is full
+func (h *streamHub) sendLocked(sub *Subscription, event StreamEvent) {
+	select {
+	case sub.ch <- event:
+	default:
+		h.dropped++
+		h.removeLocked(sub)
+	}
+}
+
+func (h *streamHub) removeLocked(sub *Subscription) {
+	if !sub.closed {
+		sub.closed = true
+		close(sub.ch)
+		close(sub.done)
+		delete(h.subscribers, sub)
+	}
+}
+
+// touch makes the next stats tick publish, for updates that are not events
+func (h *streamHub) touch() {
+	h.mutex.Lock()
+	h.statsDirty = true
+	h.mutex.Unlock()
+}
+
+// closeAll disconnects every subscriber
+func (h *streamHub) closeAll() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for sub := range h.subscribers {
+		h.removeLocked(sub)
+	}
+}
+
+// Subscribe streams events matching filter. With a non-zero lastEventID the
+// events after it are delivered first; when they are no longer kept the
+// first event is a StreamReset.
+func (m *K8sMonitor) Subscribe(filter ChangeFilter, lastEventID uint64) *Subscription {
+	h := m.stream
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var missed []StreamEvent
+	if lastEventID > 0 && lastEventID < h.lastID {
+		if len(h.backlog) == 0 || h.backlog[0].ID > lastEventID+1 {
+			missed = []StreamEvent{{ID: h.lastID, Type: StreamReset}}
+		} else {
+			missed = h.backlog[lastEventID+1-h.backlog[0].ID:]
+		}
+	}
+
+	ch := make(chan StreamEvent, streamBuffer+len(missed))
+	sub := &Subscription{C: ch, ch: ch, done: make(chan struct{}), filter: filter, hub: h}
+	for _, event := range missed {
+		if sub.wants(event) {
+			ch <- event
+		}
+	}
+	if filter.Allow != nil {
+		out := make(chan StreamEvent)
+		sub.C = out
+		go sub.authorize(out)
+	}
+	h.subscribers[sub] = true
+	return sub
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+	s.hub.removeLocked(s)
+}
+
+// publishStats sends the statistics that changed since the last stats event.
+// Subscribers with an Allow filter or a user get the statistics of the
+// changes they may see with their read state, sent to them alone with the ID
+// of the latest event.
+func (m *K8sMonitor) publishStats() {
+	h := m.stream
+	h.mutex.Lock()
+	dirty := h.statsDirty && len(h.subscribers) > 0
+	h.statsDirty = false
+	var restricted []*Subscription
+	for sub := range h.subscribers {
+		if dirty && sub.personal() {
+			restricted = append(restricted, sub)
+		}
+	}
+	h.mutex.Unlock()
+	if !dirty {
+		return
+	}
+
+	current := streamStats(m.GetStats())
+	h.mutex.Lock()
+	delta := statsDelta(h.lastStats, current)
+	h.lastStats = current
+	h.mutex.Unlock()
+
+	if len(delta) > 0 {
+		m.stream.publish(StreamEvent{Type: StreamStats, Stats: delta})
+	}
+
+	for _, sub := range restricted {
+		current := streamStats(m.GetStatsFiltered(ChangeFilter{Allow: sub.filter.Allow, Prepare: sub.filter.Prepare, User: sub.filter.User}))
+		h.mutex.Lock()
+		if delta := statsDelta(sub.lastStats, current); len(delta) > 0 && !sub.closed {
+			h.sendLocked(sub, StreamEvent{ID: h.lastID, Type: StreamStats, Stats: delta})
+		}
+		sub.lastStats = current
+		h.mutex.Unlock()
+	}
+}
+
+// streamStats picks the counters sent in stats events
+func streamStats(all map[string]interface{}) map[string]interface{} {
+	current := make(map[string]interface{})
+	for _, key := range []string{"totalChanges", "unreadChanges", "unacknowledgedChanges", "currentSession", "loadedFromFile", "severityCounts", "unreadSeverityCounts", "unacknowledgedSeverityCounts", "eventCounts", "resourceCounts"} {
+		current[key] = all[key]
+	}
+	return current
+}
+
+// statsDelta returns the counters that differ from the previous ones
+func statsDelta(previous, current map[string]interface{}) map[string]interface{} {
+	delta := make(map[string]interface{})
+	for key, value := range current {
+		if !reflect.DeepEqual(previous[key], value) {
+			delta[key] = value
+		}
+	}
+	return delta
+}
+
+// startStreamStats publishes stats deltas while there are subscribers
+func (m *K8sMonitor) startStreamStats() {
+	ticker := time.NewTicker(streamStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.publishStats()
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+func (h *streamHub) stats() map[string]interface{} {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return map[string]interface{}{
+		"subscribers": len(h.subscribers),
+		"lastEventId": h.lastID,
+		"dropped":     h.dropped,
+	}
+}
@@ -0,0 +1,187 @@
+package monitor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// received drains the events waiting on a subscription
+func received(sub *Subscription) []StreamEvent {
+	var events []StreamEvent
+	for {
+		select {
+		case event, ok := <-sub.C:
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		case <-time.After(50 * time.Millisecond):
+			return events
+		}
+	}
+}
+
+// eventIDs describes events by type and change, as "change:c1"
+func eventIDs(events []StreamEvent) string {
+	ids := make([]string, 0, len(events))
+	for _, event := range events {
+		switch {
+		case event.Change != nil:
+			ids = append(ids, event.Type+":"+event.Change.ID)
+		case event.User != "":
+			ids = append(ids, event.Type+":"+event.User)
+		default:
+			ids = append(ids, event.Type)
+		}
+	}
+	return fmt.Sprint(ids)
+}
+
+func TestStreamFilters(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	changes := storeFixture(start)
+	acked := changes[1]
+	acked.Acknowledgement = &Acknowledgement{User: "bob", Time: start.Add(time.Hour)}
+	acked.IsRead = true
+
+	events := []StreamEvent{
+		{Type: StreamChange, Change: &changes[0]},
+		{Type: StreamChange, Change: &changes[1]},
+		{Type: StreamChange, Change: &changes[2]},
+		{Type: StreamAck, Change: &acked},
+		{Type: StreamRead, IDs: []string{"c0"}},
+		{Type: StreamRead, IDs: []string{"c2"}, User: "alice"},
+		{Type: StreamStats, Stats: map[string]interface{}{"totalChanges": 3}},
+	}
+
+	tests := []struct {
+		name   string
+		filter ChangeFilter
+		want   string
+	}{
+		{
+			name:   "everything",
+			filter: ChangeFilter{},
+			want:   "[change:c0 change:c1 change:c2 ack:c1 read stats]",
+		},
+		{
+			name:   "namespace applies to acks",
+			filter: ChangeFilter{Namespaces: []string{"default"}},
+			want:   "[change:c0 change:c2 read stats]",
+		},
+		{
+			name:   "resource type applies to acks",
+			filter: ChangeFilter{ResourceTypes: []string{"pods"}},
+			want:   "[change:c0 change:c1 ack:c1 read stats]",
+		},
+		{
+			name:   "severity applies to acks",
+			filter: ChangeFilter{Severities: []string{SeverityWarning}},
+			want:   "[read stats]",
+		},
+		{
+			name:   "time range applies to acks",
+			filter: ChangeFilter{From: start.Add(90 * time.Second)},
+			want:   "[change:c2 read stats]",
+		},
+		{
+			name:   "unacknowledged subscribers hear of acks",
+			filter: ChangeFilter{UnacknowledgedOnly: true, UnreadOnly: true},
+			want:   "[change:c0 change:c1 change:c2 ack:c1 read stats]",
+		},
+		{
+			name:   "reads of a user go to their subscribers",
+			filter: ChangeFilter{User: "alice"},
+			want:   "[change:c0 change:c1 change:c2 ack:c1 read read:alice]",
+		},
+		{
+			name:   "allow applies to changes and acks",
+			filter: ChangeFilter{Allow: func(change Change) bool { return change.Namespace == "default" }},
+			want:   "[change:c0 change:c2 read]",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &K8sMonitor{stream: newStreamHub()}
+			sub := m.Subscribe(test.filter, 0)
+			defer sub.Close()
+			for _, event := range events {
+				m.stream.publish(event)
+			}
+			if got := eventIDs(received(sub)); got != test.want {
+				t.Errorf("received %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// eventNumber describes an event by ID and type, as "3:change"
+func eventNumber(event StreamEvent) string {
+	return fmt.Sprintf("%d:%s", event.ID, event.Type)
+}
+
+func TestStreamResume(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	changes := storeFixture(start)
+
+	tests := []struct {
+		name        string
+		published   int // changes published before subscribing, cycling through the fixture
+		filter      ChangeFilter
+		lastEventID uint64
+		wantCount   int // missed events delivered
+		wantFirst   string
+		wantLast    string
+	}{
+		{name: "new subscriber", published: 4},
+		{name: "events after the last one", published: 4, lastEventID: 2, wantCount: 2, wantFirst: "3:change", wantLast: "4:change"},
+		{name: "up to date", published: 4, lastEventID: 4},
+		{name: "filter applies to missed events", published: 6, filter: ChangeFilter{Namespaces: []string{"kube-system"}}, lastEventID: 1, wantCount: 2, wantFirst: "2:change", wantLast: "5:change"},
+		{
+			name:        "whole backlog",
+			published:   streamBacklog + 1,
+			lastEventID: 1,
+			wantCount:   streamBacklog,
+			wantFirst:   "2:change",
+			wantLast:    fmt.Sprintf("%d:change", streamBacklog+1),
+		},
+		{
+			name:        "missed events no longer kept",
+			published:   streamBacklog + 2,
+			lastEventID: 1,
+			wantCount:   1,
+			wantFirst:   fmt.Sprintf("%d:reset", streamBacklog+2),
+			wantLast:    fmt.Sprintf("%d:reset", streamBacklog+2),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &K8sMonitor{stream: newStreamHub()}
+			for i := 0; i < test.published; i++ {
+				m.stream.publish(StreamEvent{Type: StreamChange, Change: &changes[i%len(changes)]})
+			}
+			sub := m.Subscribe(test.filter, test.lastEventID)
+			defer sub.Close()
+
+			missed := received(sub)
+			if len(missed) != test.wantCount {
+				t.Fatalf("received %d missed events, want %d", len(missed), test.wantCount)
+			}
+			if len(missed) > 0 {
+				if first, last := eventNumber(missed[0]), eventNumber(missed[len(missed)-1]); first != test.wantFirst || last != test.wantLast {
+					t.Errorf("received %s to %s, want %s to %s", first, last, test.wantFirst, test.wantLast)
+				}
+			}
+
+			// Events published after subscribing follow
+			m.stream.publish(StreamEvent{Type: StreamChange, Change: &changes[1]})
+			next := received(sub)
+			if len(next) != 1 || next[0].ID != uint64(test.published+1) {
+				t.Errorf("then received %v, want event %d", next, test.published+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package monitor
+
+import (
+	"sort"
+	"time"
+)
+
+// ObjectState is one object as it existed at a point in time
+type ObjectState struct {
+	ResourceType string                 `json:"resourceType"`
+	Namespace    string                 `json:"namespace"`
+	Name         string                 `json:"name"`
+	ChangeID     string                 `json:"changeId"`  // change that produced this version
+	ChangedAt    time.Time              `json:"changedAt"` // timestamp of that change
+	Manifest     map[string]interface{} `json:"manifest,omitempty"`
+}
+
+// StateAt rebuilds the set of objects that existed at the given time by
+// replaying the stored changes, including those no longer held in memory.
+// Empty namespace or resourceType match everything. Only objects that
+// changed while the monitor was watching are known, and objects without a
+// stored snapshot are returned without manifest.
+func (m *K8sMonitor) StateAt(at time.Time, namespace, resourceType string) ([]ObjectState, error) {
+	filter := ChangeFilter{To: at}
+	if namespace != "" {
+		filter.Namespaces = []string{namespace}
+	}
+	if resourceType != "" {
+		filter.ResourceTypes = []string{resourceType}
+	}
+	changes, err := m.QueryHistory(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[string]Change)
+	for _, change := range changes {
+		key := change.ResourceType + "/" + change.Namespace + "/" + change.Name
+		if change.EventType == "DELETED" {
+			delete(latest, key)
+		} else if change.EventType != "ERROR" {
+			latest[key] = change
+		}
+	}
+
+	states := make([]ObjectState, 0, len(latest))
+	for _, change := range latest {
+		state := ObjectState{
+			ResourceType: change.ResourceType,
+			Namespace:    change.Namespace,
+			Name:         change.Name,
+			ChangeID:     change.ID,
+			ChangedAt:    change.Timestamp,
+		}
+		if content, ok := m.snapshot(change.AfterHash); ok {
+			state.Manifest = content
+		}
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		a, b := states[i], states[j]
+		if a.ResourceType != b.ResourceType {
+			return a.ResourceType < b.ResourceType
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return states, nil
+}
@@ -0,0 +1,330 @@
+package monitor
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Flushes that fail are retried no sooner than this
+const writerRetryDelay = 5 * time.Second
+
+// queuedRecord is a journal record waiting to be written, numbered in the
+// order it was queued, with the snapshots a change references
+type queuedRecord struct {
+	seq    uint64
+	record journalRecord
+	blobs  []string
+}
+
+// storeWriter is the only writer of the change store. Records are queued
+// with a sequence number and written in batches once maxRecords are queued
+// or the oldest has waited maxDelay, so bursts of changes and mark-read
+// updates become a few appends instead of one write per event. While writes
+// fail at most maxQueued records are kept, the oldest are dropped.
+type storeWriter struct {
+	m          *K8sMonitor
+	maxRecords int
+	maxDelay   time.Duration
+	maxQueued  int
+
+	wake     chan struct{}   // something was queued
+	requests chan chan error // synchronous flushes
+	stop     chan struct{}
+	done     chan struct{}
+
+	mutex   sync.Mutex
+	pending []queuedRecord
+	queued  uint64 // sequence number of the newest queued record
+	flushed uint64 // sequence number of the newest written record
+
+	// Flush statistics
+	flushes     int64
+	lastFlush   time.Time
+	lastLatency time.Duration
+	lastBatch   int
+	lastError   string
+	dropped     int64 // records dropped from a full queue
+	dropsLogged int64
+	missing     int64 // snapshots gone from memory before they were written
+}
+
+func newStoreWriter(m *K8sMonitor) *storeWriter {
+	cfg := m.config.Persistence
+	maxDelay := time.Duration(cfg.FlushDelay) * time.Millisecond
+	if cfg.AutoSave {
+		maxDelay = time.Duration(cfg.SaveInterval) * time.Second
+	}
+
+	return &storeWriter{
+		m:          m,
+		maxRecords: cfg.FlushMaxRecords,
+		maxDelay:   maxDelay,
+		maxQueued:  cfg.MaxQueuedRecords,
+		wake:       make(chan struct{}, 1),
+		requests:   make(chan chan error),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// enqueue queues a record and wakes the worker
+func (w *storeWriter) enqueue(record journalRecord, blobs ...string) {
+	queued := queuedRecord{record: record}
+	for _, hash := range blobs {
+		if hash != "" {
+			queued.blobs = append(queued.blobs, hash)
+		}
+	}
+
+	w.mutex.Lock()
+	w.queued++
+	queued.seq = w.queued
+	w.pending = append(w.pending, queued)
+	w.trimLocked()
+	w.mutex.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// trimLocked drops the oldest records beyond maxQueued. The caller must hold
+// the mutex.
+func (w *storeWriter) trimLocked() {
+	if w.maxQueued <= 0 || len(w.pending) <= w.maxQueued {
+		return
+	}
+	excess := len(w.pending) - w.maxQueued
+	w.pending = append([]queuedRecord(nil), w.pending[excess:]...)
+	w.dropped += int64(excess)
+}
+
+// queuedRecords returns the records that are not written yet, oldest first
+func (w *storeWriter) queuedRecords() []journalRecord {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	records := make([]journalRecord, len(w.pending))
+	for i, queued := range w.pending {
+		records[i] = queued.record
+	}
+	return records
+}
+
+// dirty reports whether records are waiting to be written
+func (w *storeWriter) dirty() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.queued != w.flushed
+}
+
+func (w *storeWriter) depth() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.pending)
+}
+
+// run writes queued records until close is called, then flushes what is left
+func (w *storeWriter) run() {
+	defer close(w.done)
+
+	var timer *time.Timer
+	var deadline <-chan time.Time
+	arm := func(delay time.Duration) {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.NewTimer(delay)
+		deadline = timer.C
+	}
+	flush := func() {
+		deadline = nil
+		if _, err := w.flush(); err != nil {
+			arm(w.retryDelay())
+		} else if w.dirty() {
+			arm(w.maxDelay)
+		}
+	}
+
+	for {
+		select {
+		case <-w.wake:
+			if w.depth() >= w.maxRecords {
+				flush()
+			} else if deadline == nil {
+				arm(w.maxDelay)
+			}
+		case <-deadline:
+			flush()
+		case reply := <-w.requests:
+			deadline = nil
+			_, err := w.flush()
+			reply <- err
+			if err != nil {
+				arm(w.retryDelay())
+			}
+		case <-w.stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			w.flush()
+			return
+		}
+	}
+}
+
+func (w *storeWriter) retryDelay() time.Duration {
+	if w.maxDelay > writerRetryDelay {
+		return w.maxDelay
+	}
+	return writerRetryDelay
+}
+
+// Flush waits until everything queued so far is written
+func (w *storeWriter) Flush() error {
+	reply := make(chan error, 1)
+	select {
+	case w.requests <- reply:
+		return <-reply
+	case <-w.done:
+		return fmt.Errorf("the change store is closed")
+	}
+}
+
+// close stops the worker after a final flush
+func (w *storeWriter) close() {
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	<-w.done
+}
+
+// flush writes all queued records to the store and returns how many were
+// written. Only the worker calls it, so there is never more than one writer.
+func (w *storeWriter) flush() (int, error) {
+	w.mutex.Lock()
+	records := w.pending
+	w.pending = nil
+	w.mutex.Unlock()
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	start := time.Now()
+	written, err := w.write(records)
+	latency := time.Since(start)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if written > 0 {
+		w.flushed = records[written-1].seq
+	}
+	if err != nil {
+		// Put what failed back in front of the queue
+		w.pending = append(records[written:len(records):len(records)], w.pending...)
+		w.trimLocked()
+		w.lastError = err.Error()
+		if w.m.config.Logging.Enabled && w.m.config.Logging.LogOperations {
+			log.Printf("Error writing changes to %s store: %v", w.m.config.Persistence.Backend, err)
+		}
+		if dropped := w.dropped - w.dropsLogged; dropped > 0 {
+			log.Printf("Warning: Dropped %d queued records while the %s store is failing", dropped, w.m.config.Persistence.Backend)
+			w.dropsLogged = w.dropped
+		}
+	} else {
+		w.lastError = ""
+	}
+	w.flushes++
+	w.lastFlush = start
+	w.lastLatency = latency
+	w.lastBatch = written
+	if written > 0 && w.m.config.Logging.Enabled && w.m.config.Logging.LogOperations {
+		log.Printf("Wrote %d records to %s store in %v", written, w.m.config.Persistence.Backend, latency)
+	}
+	return written, err
+}
+
+// write appends records to the store, consecutive changes as one batch, and
+// returns how many records were written before an error
+func (w *storeWriter) write(records []queuedRecord) (int, error) {
+	m := w.m
+
+	// Snapshots go first so no stored change references a missing blob.
+	// Records that are retried do not write theirs again.
+	for i, queued := range records {
+		for _, hash := range queued.blobs {
+			data, ok := m.snapshots.raw(hash)
+			if !ok {
+				w.mutex.Lock()
+				w.missing++
+				w.mutex.Unlock()
+				log.Printf("Warning: Snapshot %s of change %s was dropped from memory before it was written", hash, queued.record.Change.ID)
+				continue
+			}
+			if err := m.blobs.Put(hash, data); err != nil {
+				return 0, err
+			}
+		}
+		records[i].blobs = nil
+	}
+
+	for written := 0; written < len(records); {
+		var batch []Change
+		for _, queued := range records[written:] {
+			if queued.record.Op != opChange {
+				break
+			}
+			batch = append(batch, *queued.record.Change)
+		}
+
+		var err error
+		if len(batch) > 0 {
+			err = m.store.Append(batch...)
+		} else if record := records[written].record; record.Op == opRead {
+			err = m.store.MarkRead(record.Time, record.IDs...)
+		} else {
+			err = m.store.MarkAllRead(record.Time)
+		}
+		if err != nil {
+			return written, err
+		}
+
+		if len(batch) > 0 {
+			written += len(batch)
+		} else {
+			written++
+		}
+	}
+	return len(records), nil
+}
+
+func (w *storeWriter) stats() map[string]interface{} {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	stats := map[string]interface{}{
+		"queueDepth":         len(w.pending),
+		"dirty":              w.queued != w.flushed,
+		"queuedSeq":          w.queued,
+		"flushedSeq":         w.flushed,
+		"flushes":            w.flushes,
+		"lastFlushRecords":   w.lastBatch,
+		"lastFlushLatencyMs": float64(w.lastLatency.Microseconds()) / 1000,
+		"maxRecords":         w.maxRecords,
+		"maxDelayMs":         w.maxDelay.Milliseconds(),
+		"maxQueued":          w.maxQueued,
+		"dropped":            w.dropped,
+		"missingSnapshots":   w.missing,
+	}
+	if !w.lastFlush.IsZero() {
+		stats["lastFlush"] = w.lastFlush
+	}
+	if w.lastError != "" {
+		stats["lastError"] = w.lastError
+	}
+	return stats
+}
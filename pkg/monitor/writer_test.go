@@ -0,0 +1,225 @@
+package monitor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"k8s-monitor/pkg/config"
+	"k8s-monitor/pkg/utils"
+)
+
+// flakyStore fails every write while fail is set and counts the change writes
+type flakyStore struct {
+	ChangeStore
+	fail   error
+	writes int
+}
+
+func (s *flakyStore) Append(changes ...Change) error {
+	if s.fail != nil {
+		return s.fail
+	}
+	s.writes++
+	return s.ChangeStore.Append(changes...)
+}
+
+func (s *flakyStore) MarkRead(at time.Time, ids ...string) error {
+	if s.fail != nil {
+		return s.fail
+	}
+	s.writes++
+	return s.ChangeStore.MarkRead(at, ids...)
+}
+
+func (s *flakyStore) MarkAllRead(before time.Time) error {
+	if s.fail != nil {
+		return s.fail
+	}
+	s.writes++
+	return s.ChangeStore.MarkAllRead(before)
+}
+
+func (s *flakyStore) AppendReadState(records ...readRecord) error {
+	if s.fail != nil {
+		return s.fail
+	}
+	return s.ChangeStore.AppendReadState(records...)
+}
+
+// newWriterMonitor returns a monitor with a memory store behind a writer
+// whose worker is not running, tests flush it themselves
+func newWriterMonitor(t *testing.T, maxQueued int) (*K8sMonitor, *flakyStore) {
+	t.Helper()
+	blobs, err := utils.OpenBlobStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &flakyStore{ChangeStore: newMemoryStore()}
+	m := &K8sMonitor{
+		config:    &config.Config{Persistence: config.PersistenceConfig{Backend: "memory", FlushMaxRecords: 100, FlushDelay: 100, MaxQueuedRecords: maxQueued}},
+		store:     store,
+		blobs:     blobs,
+		snapshots: newSnapshotStore(),
+		reads:     newReadState(),
+	}
+	m.writer = newStoreWriter(m)
+	return m, store
+}
+
+func queueChanges(m *K8sMonitor, changes ...Change) {
+	for i := range changes {
+		change := changes[i]
+		m.record(journalRecord{Op: opChange, Time: change.Timestamp, Change: &change}, change.BeforeHash, change.AfterHash)
+	}
+}
+
+func storedIDs(t *testing.T, store ChangeStore, filter ChangeFilter) string {
+	t.Helper()
+	changes, err := store.Query(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changeIDs(changes)
+}
+
+func TestStoreWriterBatches(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	changes := storeFixture(start)
+	m, store := newWriterMonitor(t, 0)
+
+	queueChanges(m, changes[:3]...)
+	m.record(journalRecord{Op: opRead, Time: start.Add(time.Hour), IDs: []string{"c1"}})
+	queueChanges(m, changes[3:]...)
+	m.record(journalRecord{Op: opReadAll, Time: start.Add(time.Minute)})
+
+	written, err := m.writer.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Consecutive changes are appended together
+	if written != 8 || store.writes != 4 {
+		t.Errorf("flush() wrote %d records in %d writes, want 8 in 4", written, store.writes)
+	}
+	if got := storedIDs(t, store, ChangeFilter{}); got != "[c0 c1 c2 c3 c4 c5]" {
+		t.Errorf("stored %s", got)
+	}
+	if got := storedIDs(t, store, ChangeFilter{ReadOnly: true}); got != "[c0 c1]" {
+		t.Errorf("read %s, want [c0 c1]", got)
+	}
+	stats := m.writer.stats()
+	if stats["dirty"] != false || stats["queueDepth"] != 0 || stats["flushedSeq"] != uint64(8) {
+		t.Errorf("stats %v, want everything written", stats)
+	}
+}
+
+func TestStoreWriterQueueLimit(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	changes := storeFixture(start)
+	m, store := newWriterMonitor(t, 3)
+	store.fail = errors.New("store unavailable")
+
+	queueChanges(m, changes[:2]...)
+	if _, err := m.writer.flush(); err == nil {
+		t.Fatal("flush() succeeded while the store fails")
+	}
+	// The failed records are queued again and count against the limit
+	queueChanges(m, changes[2:5]...)
+	if _, err := m.writer.flush(); err == nil {
+		t.Fatal("flush() succeeded while the store fails")
+	}
+	stats := m.writer.stats()
+	if stats["queueDepth"] != 3 || stats["dropped"] != int64(2) || stats["lastError"] != "store unavailable" {
+		t.Errorf("stats %v, want 3 queued and 2 dropped", stats)
+	}
+
+	store.fail = nil
+	queueChanges(m, changes[5])
+	if _, err := m.writer.flush(); err != nil {
+		t.Fatal(err)
+	}
+	// The oldest were dropped
+	if got := storedIDs(t, store, ChangeFilter{}); got != "[c3 c4 c5]" {
+		t.Errorf("stored %s, want [c3 c4 c5]", got)
+	}
+	if stats := m.writer.stats(); stats["dropped"] != int64(3) || stats["dirty"] != false {
+		t.Errorf("stats %v, want 3 dropped and nothing left", stats)
+	}
+}
+
+func TestStoreWriterSnapshots(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	m, store := newWriterMonitor(t, 0)
+
+	change := testChange("c0", start)
+	change.BeforeHash = m.snapshots.put(map[string]interface{}{"kind": "Pod", "spec": "before"})
+	change.AfterHash = m.snapshots.put(map[string]interface{}{"kind": "Pod", "spec": "after"})
+	queueChanges(m, change)
+	// The snapshot before the change leaves memory before it is written
+	m.snapshots.retain(map[string]bool{change.AfterHash: true})
+
+	store.fail = errors.New("store unavailable")
+	if _, err := m.writer.flush(); err == nil {
+		t.Fatal("flush() succeeded while the store fails")
+	}
+	store.fail = nil
+	if _, err := m.writer.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.blobs.Get(change.AfterHash); err != nil {
+		t.Errorf("snapshot after the change not written: %v", err)
+	}
+	if _, err := m.blobs.Get(change.BeforeHash); err == nil {
+		t.Error("a snapshot that was no longer in memory was written")
+	}
+	// Counted once, the retry does not look for it again
+	if missing := m.writer.stats()["missingSnapshots"]; missing != int64(1) {
+		t.Errorf("%v missing snapshots reported, want 1", missing)
+	}
+	if got := storedIDs(t, store, ChangeFilter{}); got != "[c0]" {
+		t.Errorf("stored %s, want [c0]", got)
+	}
+}
+
+func TestQueryHistoryMergesQueued(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	changes := storeFixture(start)
+
+	tests := []struct {
+		name   string
+		filter ChangeFilter
+		want   string
+	}{
+		{name: "everything", filter: ChangeFilter{}, want: "[c0 c1 c2 c3 c4 c5]"},
+		{name: "filters apply to queued changes", filter: ChangeFilter{Namespaces: []string{"default"}}, want: "[c0 c2 c3 c5]"},
+		{name: "limit keeps the newest", filter: ChangeFilter{Limit: 2}, want: "[c4 c5]"},
+		{name: "queued read marks", filter: ChangeFilter{ReadOnly: true}, want: "[c0 c1 c4]"},
+		{name: "unread with a limit", filter: ChangeFilter{UnreadOnly: true, Limit: 2}, want: "[c3 c5]"},
+		{name: "time range", filter: ChangeFilter{From: start.Add(2 * time.Minute), To: start.Add(4 * time.Minute)}, want: "[c2 c3 c4]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, _ := newWriterMonitor(t, 0)
+			queueChanges(m, changes[:3]...)
+			if _, err := m.writer.flush(); err != nil {
+				t.Fatal(err)
+			}
+			m.record(journalRecord{Op: opReadAll, Time: start.Add(time.Minute)})
+			queueChanges(m, changes[3:]...)
+			m.record(journalRecord{Op: opRead, Time: start.Add(time.Hour), IDs: []string{"c4"}})
+
+			got, err := m.QueryHistory(test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := changeIDs(got); ids != test.want {
+				t.Errorf("QueryHistory() = %s, want %s", ids, test.want)
+			}
+			if depth := m.writer.depth(); depth != 5 {
+				t.Errorf("%d records queued after the query, want 5 left unflushed", depth)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RecoveryReport describes a damaged file that was salvaged on startup
+type RecoveryReport struct {
+	File      string    `json:"file"`
+	MovedTo   string    `json:"movedTo,omitempty"` // where the damaged original was kept
+	Recovered int       `json:"recovered"`         // valid records that were kept
+	Lost      int       `json:"lost"`              // records that could not be read
+	At        time.Time `json:"at"`
+}
+
+// WriteFileAtomic writes data to a temporary file in the same directory,
+// syncs it and renames it over path, so readers see either the old or the
+// new content but never a partial write
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	tmpName := tmp.Name()
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmpName)
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		cleanup()
+		return fmt.Errorf("failed to write temporary file: %v", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		cleanup()
+		return fmt.Errorf("failed to set permissions: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		cleanup()
+		return fmt.Errorf("failed to sync temporary file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to close temporary file: %v", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to rename temporary file: %v", err)
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %v", err)
+	}
+	defer d.Close()
+	// Some filesystems don't support syncing directories, the rename is done regardless
+	d.Sync()
+	return nil
+}
+
+// moveAside renames a damaged file out of the way and returns its new path
+func moveAside(path string) (string, error) {
+	target := fmt.Sprintf("%s.damaged-%s", path, time.Now().Format("20060102T150405"))
+	if err := os.Rename(path, target); err != nil {
+		return "", fmt.Errorf("failed to move damaged file aside: %v", err)
+	}
+	return target, nil
+}
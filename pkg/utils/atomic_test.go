@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "changes.json")
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFileAtomic(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != content {
+			t.Errorf("read %q (%v), want %q", data, err, content)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("file mode %v, want 0600", info.Mode().Perm())
+	}
+	// The temporary files were renamed over the target, none are left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the written one", len(entries))
+	}
+
+	if err := WriteFileAtomic(filepath.Join(dir, "missing", "changes.json"), []byte("third"), 0600); err == nil {
+		t.Error("WriteFileAtomic() succeeded in a missing directory")
+	}
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore keeps immutable content-addressed blobs as one file each,
+// encrypted when it has a keyring
+type BlobStore struct {
+	dir     string
+	keyring *Keyring
+}
+
+// OpenBlobStore opens or creates the blob store in dir. keyring may be nil.
+func OpenBlobStore(dir string, keyring *Keyring) (*BlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %v", err)
+	}
+	return &BlobStore{dir: dir, keyring: keyring}, nil
+}
+
+func (b *BlobStore) path(hash string) string {
+	return filepath.Join(b.dir, hash+".json")
+}
+
+// Put writes a blob unless a blob with the same hash already exists
+func (b *BlobStore) Put(hash string, data []byte) error {
+	if _, err := os.Stat(b.path(hash)); err == nil {
+		return nil
+	}
+	if b.keyring != nil {
+		sealed, err := b.keyring.Seal(data)
+		if err != nil {
+			return err
+		}
+		data = sealed
+	}
+	if err := WriteFileAtomic(b.path(hash), data, 0600); err != nil {
+		return fmt.Errorf("failed to write blob: %v", err)
+	}
+	return nil
+}
+
+// Get reads a blob
+func (b *BlobStore) Get(hash string) ([]byte, error) {
+	data, err := os.ReadFile(b.path(hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob: %v", err)
+	}
+	// Blobs written before encryption was enabled stay readable
+	if IsSealed(data) {
+		if b.keyring == nil {
+			return nil, fmt.Errorf("blob is encrypted but no encryption keys are configured")
+		}
+		return b.keyring.Open(data)
+	}
+	return data, nil
+}
+
+// Delete removes a blob, deleting a missing blob is not an error
+func (b *BlobStore) Delete(hash string) error {
+	if err := os.Remove(b.path(hash)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete blob: %v", err)
+	}
+	return nil
+}
+
+// List returns the hashes of all stored blobs
+func (b *BlobStore) List() ([]string, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blobs: %v", err)
+	}
+	hashes := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if name := entry.Name(); !entry.IsDir() && strings.HasSuffix(name, ".json") {
+			hashes = append(hashes, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	return hashes, nil
+}
+
+// Size returns the total size of all stored blobs in bytes
+func (b *BlobStore) Size() (int64, error) {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list blobs: %v", err)
+	}
+	var size int64
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && !entry.IsDir() {
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlobStoreEncryption(t *testing.T) {
+	oldKey, newKey := testKey(1, 32), testKey(2, 32)
+	data := []byte(`{"kind":"Secret","data":{"password":"hunter2"}}`)
+
+	tests := []struct {
+		name       string
+		writeKeys  [][]byte // nil writes without encryption
+		readKeys   [][]byte
+		wantSealed bool
+		wantErr    bool
+	}{
+		{name: "not encrypted", wantSealed: false},
+		{name: "encrypted", writeKeys: [][]byte{newKey}, readKeys: [][]byte{newKey}, wantSealed: true},
+		{name: "rotated key", writeKeys: [][]byte{oldKey}, readKeys: [][]byte{newKey, oldKey}, wantSealed: true},
+		{name: "removed key", writeKeys: [][]byte{oldKey}, readKeys: [][]byte{newKey}, wantSealed: true, wantErr: true},
+		{name: "no keys configured", writeKeys: [][]byte{newKey}, wantSealed: true, wantErr: true},
+		{name: "written before encryption was enabled", readKeys: [][]byte{newKey}, wantSealed: false},
+	}
+
+	openStore := func(t *testing.T, dir string, keys [][]byte) *BlobStore {
+		t.Helper()
+		var keyring *Keyring
+		if keys != nil {
+			var err error
+			if keyring, err = NewKeyring(keys); err != nil {
+				t.Fatal(err)
+			}
+		}
+		blobs, err := OpenBlobStore(dir, keyring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return blobs
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writer := openStore(t, dir, test.writeKeys)
+			if err := writer.Put("abc", data); err != nil {
+				t.Fatal(err)
+			}
+
+			onDisk, err := os.ReadFile(writer.path("abc"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if IsSealed(onDisk) != test.wantSealed || bytes.Contains(onDisk, []byte("hunter2")) == test.wantSealed {
+				t.Errorf("stored %q, want sealed %v", onDisk, test.wantSealed)
+			}
+			info, err := os.Stat(writer.path("abc"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("blob mode %v, want 0600", info.Mode().Perm())
+			}
+
+			got, err := openStore(t, dir, test.readKeys).Get("abc")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Get() error = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, data) {
+				t.Errorf("Get() = %s, want %s", got, data)
+			}
+		})
+	}
+}
+
+func TestOpenBlobStorePermissions(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "blobs")
+	if _, err := OpenBlobStore(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("blob directory mode %v, want 0700", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sealedPrefix marks data encrypted by a Keyring, it is followed by the key
+// ID, a colon and the base64 encoded nonce and ciphertext
+const sealedPrefix = "enc1:"
+
+// ErrUnknownKey is returned when sealed data was written with a key that is
+// not in the keyring
+var ErrUnknownKey = errors.New("encrypted with a key that is not configured")
+
+// Keyring encrypts with its first key and decrypts with any of its keys, so
+// keys can be rotated by putting the new key first and keeping the old ones
+// until all data written with them is gone
+type Keyring struct {
+	ids   []string
+	aeads map[string]cipher.AEAD
+}
+
+// NewKeyring builds a keyring from raw AES keys of 16, 24 or 32 bytes
+func NewKeyring(keys [][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption keys configured")
+	}
+
+	k := &Keyring{aeads: make(map[string]cipher.AEAD)}
+	for i, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %v", i+1, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %v", i+1, err)
+		}
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:4])
+		if _, ok := k.aeads[id]; ok {
+			continue
+		}
+		k.ids = append(k.ids, id)
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// LoadKeyring reads base64 encoded keys from a file, one per line, and from
+// an environment variable, comma separated. Keys from the file come first.
+func LoadKeyring(keyFile, keyEnv string) (*Keyring, error) {
+	var encoded []string
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		encoded = append(encoded, strings.Split(string(data), "\n")...)
+	}
+	if keyEnv != "" {
+		encoded = append(encoded, strings.Split(os.Getenv(keyEnv), ",")...)
+	}
+
+	var keys [][]byte
+	for _, value := range encoded {
+		value = strings.TrimSpace(value)
+		if value == "" || strings.HasPrefix(value, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("encryption keys must be base64 encoded: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys)
+}
+
+// KeyID identifies the key new data is encrypted with
+func (k *Keyring) KeyID() string {
+	return k.ids[0]
+}
+
+// KeyIDs lists all keys that can decrypt, the current key first
+func (k *Keyring) KeyIDs() []string {
+	return append([]string(nil), k.ids...)
+}
+
+// Seal encrypts data with the current key
+func (k *Keyring) Seal(data []byte) ([]byte, error) {
+	id := k.ids[0]
+	aead := k.aeads[id]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	// The key ID is authenticated so a record can't be passed off under another key
+	sealed := aead.Seal(nonce, nonce, data, []byte(id))
+	return []byte(sealedPrefix + id + ":" + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// Open decrypts data sealed with any key of the keyring
+func (k *Keyring) Open(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return nil, errors.New("data is not encrypted")
+	}
+	rest := data[len(sealedPrefix):]
+	sep := bytes.IndexByte(rest, ':')
+	if sep < 0 {
+		return nil, errors.New("malformed encrypted data")
+	}
+	id := string(rest[:sep])
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w (key %s)", ErrUnknownKey, id)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(string(rest[sep+1:]))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed encrypted data")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with key %s: %v", id, err)
+	}
+	return plaintext, nil
+}
+
+// IsSealed reports whether data was produced by Seal
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sealedPrefix))
+}
@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(fill byte, size int) []byte {
+	return bytes.Repeat([]byte{fill}, size)
+}
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    [][]byte
+		wantIDs int
+		wantErr bool
+	}{
+		{name: "no keys", wantErr: true},
+		{name: "AES-128", keys: [][]byte{testKey(1, 16)}, wantIDs: 1},
+		{name: "AES-192", keys: [][]byte{testKey(1, 24)}, wantIDs: 1},
+		{name: "AES-256", keys: [][]byte{testKey(1, 32)}, wantIDs: 1},
+		{name: "invalid length", keys: [][]byte{testKey(1, 32), testKey(2, 10)}, wantErr: true},
+		{name: "duplicate keys", keys: [][]byte{testKey(1, 32), testKey(2, 32), testKey(1, 32)}, wantIDs: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyring, err := NewKeyring(test.keys)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("NewKeyring() error = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && len(keyring.KeyIDs()) != test.wantIDs {
+				t.Errorf("got %d key IDs, want %d", len(keyring.KeyIDs()), test.wantIDs)
+			}
+		})
+	}
+}
+
+func TestKeyringSeal(t *testing.T) {
+	keyring, err := NewKeyring([][]byte{testKey(1, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte(`{"id":"change-1"}`)
+
+	first, err := keyring.Seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := keyring.Seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(first) || IsSealed(plaintext) {
+		t.Errorf("IsSealed() does not tell sealed data from plaintext")
+	}
+	if !bytes.Contains(first, []byte(keyring.KeyID())) || bytes.Contains(first, plaintext) {
+		t.Errorf("Seal() = %s, want the key ID and no plaintext", first)
+	}
+	// Every seal uses a fresh nonce
+	if bytes.Equal(first, second) {
+		t.Error("Seal() returned the same ciphertext twice")
+	}
+}
+
+func TestKeyringOpen(t *testing.T) {
+	oldKey, newKey := testKey(1, 32), testKey(2, 32)
+	plaintext := []byte(`{"id":"change-1"}`)
+
+	sealWith := func(keys ...[]byte) []byte {
+		keyring, err := NewKeyring(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := keyring.Seal(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sealed
+	}
+
+	tests := []struct {
+		name        string
+		sealed      []byte
+		keys        [][]byte
+		wantErr     bool
+		wantUnknown bool
+	}{
+		{name: "same key", sealed: sealWith(newKey), keys: [][]byte{newKey}},
+		{name: "rotated key", sealed: sealWith(oldKey), keys: [][]byte{newKey, oldKey}},
+		{name: "removed key", sealed: sealWith(oldKey), keys: [][]byte{newKey}, wantErr: true, wantUnknown: true},
+		{
+			name: "tampered ciphertext",
+			sealed: func() []byte {
+				sealed := sealWith(newKey)
+				tampered := append([]byte{}, sealed...)
+				tampered[len(tampered)-3] ^= 0x01
+				return tampered
+			}(),
+			keys:    [][]byte{newKey},
+			wantErr: true,
+		},
+		{
+			name: "key ID swapped",
+			sealed: func() []byte {
+				keyring, _ := NewKeyring([][]byte{oldKey})
+				sealed := sealWith(newKey)
+				other := keyring.KeyID()
+				newID := string(sealed[len(sealedPrefix) : len(sealedPrefix)+len(other)])
+				return bytes.Replace(sealed, []byte(newID), []byte(other), 1)
+			}(),
+			keys:    [][]byte{newKey, oldKey},
+			wantErr: true,
+		},
+		{name: "not encrypted", sealed: plaintext, keys: [][]byte{newKey}, wantErr: true},
+		{name: "malformed", sealed: []byte(sealedPrefix + "nokeyid"), keys: [][]byte{newKey}, wantErr: true},
+		{name: "truncated", sealed: sealWith(newKey)[:len(sealedPrefix)+10], keys: [][]byte{newKey}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyring, err := NewKeyring(test.keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opened, err := keyring.Open(test.sealed)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Open() error = %v, want error %v", err, test.wantErr)
+			}
+			if errors.Is(err, ErrUnknownKey) != test.wantUnknown {
+				t.Errorf("Open() error = %v, want ErrUnknownKey %v", err, test.wantUnknown)
+			}
+			if err == nil && !bytes.Equal(opened, plaintext) {
+				t.Errorf("Open() = %s, want %s", opened, plaintext)
+			}
+		})
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	first, second, third := testKey(1, 32), testKey(2, 32), testKey(3, 16)
+	encode := base64.StdEncoding.EncodeToString
+
+	tests := []struct {
+		name      string
+		file      string
+		env       string
+		wantFirst []byte // the key new data is sealed with
+		wantIDs   int
+		wantErr   bool
+	}{
+		{name: "file only", file: encode(first) + "\n" + encode(second) + "\n", wantFirst: first, wantIDs: 2},
+		{name: "comments and blank lines", file: "# current\n" + encode(second) + "\n\n# old\n" + encode(first), wantFirst: second, wantIDs: 2},
+		{name: "env only", env: encode(third) + ", " + encode(first), wantFirst: third, wantIDs: 2},
+		{name: "file before env", file: encode(second), env: encode(first), wantFirst: second, wantIDs: 2},
+		{name: "not base64", env: "not-base64!", wantErr: true},
+		{name: "nothing configured", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyFile := ""
+			if test.file != "" {
+				keyFile = filepath.Join(t.TempDir(), "keys")
+				if err := os.WriteFile(keyFile, []byte(test.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("TEST_ENCRYPTION_KEYS", test.env)
+
+			keyring, err := LoadKeyring(keyFile, "TEST_ENCRYPTION_KEYS")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("LoadKeyring() error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(keyring.KeyIDs()) != test.wantIDs {
+				t.Errorf("got %d key IDs, want %d", len(keyring.KeyIDs()), test.wantIDs)
+			}
+			want, err := NewKeyring([][]byte{test.wantFirst})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyring.KeyID() != want.KeyID() {
+				t.Errorf("sealing with key %s, want %s", keyring.KeyID(), want.KeyID())
+			}
+		})
+	}
+}
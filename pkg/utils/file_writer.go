@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -10,20 +11,28 @@ import (
 
 type ChangeFileData struct {
 	SavedAt time.Time `json:"savedAt"`
-	Changes []interface{} `json:"changes"`
+	// SchemaVersion is the format of the changes, files without it predate versioning
+	SchemaVersion int               `json:"schemaVersion,omitempty"`
+	Changes       []json.RawMessage `json:"changes"`
+}
+
+type SnapshotFileData struct {
+	SavedAt   time.Time                  `json:"savedAt"`
+	Snapshots map[string]json.RawMessage `json:"snapshots"`
 }
 
 var (
 	mu sync.Mutex
 )
 
-func SaveChangesToFile(filePath string, changes interface{}) error {
+func SaveChangesToFile(filePath string, schemaVersion int, changes []json.RawMessage) error {
 	mu.Lock()
 	defer mu.Unlock()
 
 	data := ChangeFileData{
-		SavedAt: time.Now(),
-		Changes: changes.([]interface{}),
+		SavedAt:       time.Now(),
+		SchemaVersion: schemaVersion,
+		Changes:       changes,
 	}
 
 	jsonData, err := json.MarshalIndent(data, "", "  ")
@@ -31,19 +40,20 @@ func SaveChangesToFile(filePath string, changes interface{}) error {
 		return fmt.Errorf("failed to marshal changes: %v", err)
 	}
 
-	if err := os.WriteFile(filePath, jsonData, 0644); err != nil {
+	if err := WriteFileAtomic(filePath, jsonData, 0600); err != nil {
 		return fmt.Errorf("failed to write to file: %v", err)
 	}
 
 	return nil
 }
 
-func LoadChangesFromFile(filePath string) ([]interface{}, error) {
+// LoadChangesFromFile reads the raw change records of a changes file
+func LoadChangesFromFile(filePath string) (*ChangeFileData, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return []interface{}{}, nil // Return empty slice if file doesn't exist
+		return &ChangeFileData{}, nil // Return no changes if file doesn't exist
 	}
 
 	data, err := os.ReadFile(filePath)
@@ -56,36 +66,94 @@ func LoadChangesFromFile(filePath string) ([]interface{}, error) {
 		return nil, fmt.Errorf("failed to unmarshal changes: %v", err)
 	}
 
-	return fileData.Changes, nil
+	return &fileData, nil
 }
 
-func AppendChangeToFile(filePath string, change interface{}) error {
+func LoadSnapshotsFromFile(filePath string) (map[string]json.RawMessage, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	// Load existing changes
-	var existingData ChangeFileData
-	if data, err := os.ReadFile(filePath); err == nil {
-		json.Unmarshal(data, &existingData)
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return map[string]json.RawMessage{}, nil // Return empty map if file doesn't exist
 	}
 
-	// Append new change
-	existingData.Changes = append(existingData.Changes, change)
-	existingData.SavedAt = time.Now()
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
 
-	// Keep only last 10000 changes to prevent file from growing too large
-	if len(existingData.Changes) > 10000 {
-		existingData.Changes = existingData.Changes[len(existingData.Changes)-10000:]
+	var fileData SnapshotFileData
+	if err := json.Unmarshal(data, &fileData); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snapshots: %v", err)
 	}
 
-	jsonData, err := json.MarshalIndent(existingData, "", "  ")
+	return fileData.Snapshots, nil
+}
+
+// RecoverChangesFromFile salvages the readable changes of a damaged changes
+// file. The damaged original is moved aside and the changes that could be
+// read are written back in its place.
+func RecoverChangesFromFile(filePath string) (*ChangeFileData, *RecoveryReport, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	data, err := os.ReadFile(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to marshal changes: %v", err)
+		return nil, nil, fmt.Errorf("failed to read file: %v", err)
 	}
 
-	if err := os.WriteFile(filePath, jsonData, 0644); err != nil {
-		return fmt.Errorf("failed to write to file: %v", err)
+	// Every change starts on its own line in the indented format, so after a
+	// damaged element decoding resumes at the next one
+	marker := []byte("\n    {")
+	start := bytes.Index(data, []byte(`"changes"`))
+	if start < 0 {
+		return nil, nil, fmt.Errorf("no changes found in %s", filePath)
 	}
 
-	return nil
-}
\ No newline at end of file
+	// The version precedes the changes, it survives any damage to them
+	var header struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	json.Unmarshal(append(append([]byte(nil), data[:start]...), []byte(`"_":0}`)...), &header)
+
+	var changes []json.RawMessage
+	lost := 0
+	offset := start
+	for {
+		next := bytes.Index(data[offset:], marker)
+		if next < 0 {
+			break
+		}
+		offset += next + 1
+
+		var change json.RawMessage
+		decoder := json.NewDecoder(bytes.NewReader(data[offset:]))
+		if err := decoder.Decode(&change); err != nil || !bytes.HasPrefix(change, []byte("{")) {
+			lost++
+			continue
+		}
+		changes = append(changes, change)
+		offset += int(decoder.InputOffset())
+	}
+
+	movedTo, err := moveAside(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileData := &ChangeFileData{SavedAt: time.Now(), SchemaVersion: header.SchemaVersion, Changes: changes}
+	jsonData, err := json.MarshalIndent(fileData, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal changes: %v", err)
+	}
+	if err := WriteFileAtomic(filePath, jsonData, 0600); err != nil {
+		return nil, nil, err
+	}
+
+	return fileData, &RecoveryReport{
+		File:      filePath,
+		MovedTo:   movedTo,
+		Recovered: len(changes),
+		Lost:      lost,
+		At:        time.Now(),
+	}, nil
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecoverChangesFromFile(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage changes the file after c0, c1 and c2 were saved
+		damage        func(data []byte) []byte
+		want          string
+		wantLost      int
+		wantNoChanges bool
+	}{
+		{
+			name:   "intact file",
+			damage: func(data []byte) []byte { return data },
+			want:   "[c0 c1 c2]",
+		},
+		{
+			name: "damaged change in the middle",
+			damage: func(data []byte) []byte {
+				return bytes.Replace(data, []byte(`"id": "c1"`), []byte(`"id": c1"`), 1)
+			},
+			want:     "[c0 c2]",
+			wantLost: 1,
+		},
+		{
+			name: "torn last change",
+			damage: func(data []byte) []byte {
+				return data[:bytes.Index(data, []byte(`"c2"`))+2]
+			},
+			want:     "[c0 c1]",
+			wantLost: 1,
+		},
+		{
+			name: "changes cut off",
+			damage: func(data []byte) []byte {
+				return data[:bytes.Index(data, []byte(`"changes"`))]
+			},
+			wantNoChanges: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "changes.json")
+			var changes []json.RawMessage
+			for i := 0; i < 3; i++ {
+				changes = append(changes, mustMarshal(t, map[string]string{"id": fmt.Sprintf("c%d", i), "name": "web"}))
+			}
+			if err := SaveChangesToFile(path, 2, changes); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			damaged := test.damage(data)
+			if err := os.WriteFile(path, damaged, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			recovered, report, err := RecoverChangesFromFile(path)
+			if test.wantNoChanges {
+				if err == nil {
+					t.Fatal("RecoverChangesFromFile() succeeded without changes to recover")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+			for _, raw := range recovered.Changes {
+				var change struct {
+					ID string `json:"id"`
+				}
+				if err := json.Unmarshal(raw, &change); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, change.ID)
+			}
+			if fmt.Sprint(ids) != test.want || report.Recovered != len(ids) || report.Lost != test.wantLost {
+				t.Errorf("recovered %v (report %+v), want %s with %d lost", ids, report, test.want, test.wantLost)
+			}
+			if recovered.SchemaVersion != 2 {
+				t.Errorf("schema version %d, want 2", recovered.SchemaVersion)
+			}
+
+			// The damaged original is kept and the salvaged changes replace it
+			original, err := os.ReadFile(report.MovedTo)
+			if err != nil || !bytes.Equal(original, damaged) {
+				t.Errorf("damaged original not kept at %s: %v", report.MovedTo, err)
+			}
+			loaded, err := LoadChangesFromFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded.Changes) != len(ids) || loaded.SchemaVersion != 2 {
+				t.Errorf("rewritten file holds %d changes in version %d, want %d in version 2", len(loaded.Changes), loaded.SchemaVersion, len(ids))
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("rewritten file mode %v, want 0600", info.Mode().Perm())
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const journalIndexFile = "index.json"
+
+// JournalSegment describes one segment file of a journal
+type JournalSegment struct {
+	File      string    `json:"file"`
+	CreatedAt time.Time `json:"createdAt"`
+	First     time.Time `json:"first"` // timestamp of the oldest record
+	Last      time.Time `json:"last"`  // timestamp of the newest record
+	Records   int       `json:"records"`
+	Bytes     int64     `json:"bytes"` // size on disk
+	Closed    bool      `json:"closed"`
+	// Compressed segments are gzip archives of closed segments
+	Compressed bool `json:"compressed,omitempty"`
+}
+
+type journalIndex struct {
+	NextSegment int              `json:"nextSegment"`
+	Segments    []JournalSegment `json:"segments"`
+}
+
+// JournalRecord is a record that can be written to a journal. Its JSON form
+// must carry the same timestamp in a top-level "time" field.
+type JournalRecord interface {
+	RecordTime() time.Time
+}
+
+// Journal is an append-only log of NDJSON records split into segments that
+// rotate by size and age. Every record must carry its timestamp in a
+// top-level "time" field so segment time ranges can be rebuilt from disk.
+// Each line ends with a checksum so torn or damaged records are detected.
+type Journal struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mutex    sync.Mutex
+	index    journalIndex
+	active   *os.File
+	recovery []RecoveryReport
+}
+
+// OpenJournal opens or creates the journal in dir
+func OpenJournal(dir string, maxBytes int64, maxAge time.Duration) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %v", err)
+	}
+	os.Chmod(dir, 0700)
+
+	j := &Journal{dir: dir, maxBytes: maxBytes, maxAge: maxAge}
+
+	indexPath := filepath.Join(dir, journalIndexFile)
+	data, err := os.ReadFile(indexPath)
+	if err == nil {
+		if err := json.Unmarshal(data, &j.index); err != nil {
+			// The segments are the source of truth, rebuild the index from them
+			movedTo, moveErr := moveAside(indexPath)
+			if moveErr != nil {
+				return nil, moveErr
+			}
+			j.recovery = append(j.recovery, RecoveryReport{File: indexPath, MovedTo: movedTo, Lost: 1, At: time.Now()})
+			j.index = journalIndex{}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read journal index: %v", err)
+	}
+
+	if err := j.recover(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Append writes records to the active segment, rotating it first if it is
+// too large or too old
+func (j *Journal) Append(records ...JournalRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	var buf []byte
+	first, last := records[0].RecordTime(), records[0].RecordTime()
+	for _, record := range records {
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal journal record: %v", err)
+		}
+		buf = appendJournalLine(buf, payload)
+
+		if at := record.RecordTime(); at.Before(first) {
+			first = at
+		} else if at.After(last) {
+			last = at
+		}
+	}
+
+	segment, err := j.activeSegment(time.Now())
+	if err != nil {
+		return err
+	}
+
+	size := segment.Bytes
+	if info, err := j.active.Stat(); err == nil {
+		size = info.Size()
+	}
+	n, err := j.active.Write(buf)
+	segment.Bytes = size + int64(n)
+	if err == nil {
+		if err = j.active.Sync(); err != nil {
+			err = fmt.Errorf("failed to sync journal segment: %v", err)
+		}
+	} else {
+		err = fmt.Errorf("failed to write journal segment: %v", err)
+	}
+	if err != nil {
+		j.rollback(segment, size)
+		return err
+	}
+
+	if segment.Records == 0 || first.Before(segment.First) {
+		segment.First = first
+	}
+	if last.After(segment.Last) {
+		segment.Last = last
+	}
+	segment.Records += len(records)
+
+	return j.writeIndex()
+}
+
+// activeSegment returns the segment to append to, rotating when needed. The
+// caller must hold the mutex.
+func (j *Journal) activeSegment(now time.Time) (*JournalSegment, error) {
+	if n := len(j.index.Segments); n > 0 && !j.index.Segments[n-1].Closed {
+		segment := &j.index.Segments[n-1]
+		tooLarge := j.maxBytes > 0 && segment.Bytes >= j.maxBytes
+		tooOld := j.maxAge > 0 && now.Sub(segment.CreatedAt) >= j.maxAge
+		if !tooLarge && !tooOld {
+			if j.active == nil {
+				file, err := os.OpenFile(filepath.Join(j.dir, segment.File), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+				if err != nil {
+					return nil, fmt.Errorf("failed to open journal segment: %v", err)
+				}
+				j.active = file
+			}
+			return segment, nil
+		}
+		if err := j.closeActive(); err != nil {
+			return nil, err
+		}
+	}
+
+	j.index.NextSegment++
+	name := fmt.Sprintf("segment-%06d.ndjson", j.index.NextSegment)
+	file, err := os.OpenFile(filepath.Join(j.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal segment: %v", err)
+	}
+	j.active = file
+	j.index.Segments = append(j.index.Segments, JournalSegment{File: name, CreatedAt: now})
+	return &j.index.Segments[len(j.index.Segments)-1], nil
+}
+
+// rollback cuts the active segment back to size after a failed write, so
+// the next append does not continue a torn line. When that fails too the
+// segment is closed and the next append starts a new one. The caller must
+// hold the mutex.
+func (j *Journal) rollback(segment *JournalSegment, size int64) {
+	if err := j.active.Truncate(size); err == nil {
+		segment.Bytes = size
+		return
+	}
+	j.active.Close()
+	j.active = nil
+	segment.Closed = true
+	j.writeIndex()
+}
+
+// closeActive closes the active segment file and marks it closed. The caller
+// must hold the mutex.
+func (j *Journal) closeActive() error {
+	if j.active != nil {
+		if err := j.active.Close(); err != nil {
+			return fmt.Errorf("failed to close journal segment: %v", err)
+		}
+		j.active = nil
+	}
+	if n := len(j.index.Segments); n > 0 {
+		j.index.Segments[n-1].Closed = true
+	}
+	return nil
+}
+
+// Replay streams every record of the segments overlapping [from, to] to fn,
+// oldest first. Zero times leave the range open. Records are not filtered
+// individually, so fn may see records just outside the range.
+func (j *Journal) Replay(from, to time.Time, fn func(line []byte) error) error {
+	for _, segment := range j.Segments() {
+		if !from.IsZero() && segment.Records > 0 && segment.Last.Before(from) {
+			continue
+		}
+		if !to.IsZero() && segment.Records > 0 && segment.First.After(to) {
+			continue
+		}
+		if _, err := j.replaySegment(segment.File, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySegment streams the valid records of a segment to fn and returns the
+// number of damaged lines that were skipped
+func (j *Journal) replaySegment(name string, fn func(line []byte) error) (int, error) {
+	file, err := os.Open(filepath.Join(j.dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open journal segment: %v", err)
+	}
+	defer file.Close()
+
+	return ReadSegment(file, strings.HasSuffix(name, archiveSuffix), fn)
+}
+
+// ReadSegment streams the valid records of segment data to fn and returns the
+// number of damaged lines that were skipped. Compressed data is a gzip archive.
+func ReadSegment(r io.Reader, compressed bool, fn func(line []byte) error) (int, error) {
+	source := r
+	if compressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return 1, nil
+		}
+		defer gz.Close()
+		source = gz
+	}
+
+	damaged := 0
+	reader := bufio.NewReader(source)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			// Every record ends with a newline, a last line without one is
+			// torn even if what remains happens to parse
+			if payload, ok := parseJournalLine(line); ok && readErr == nil {
+				if err := fn(payload); err != nil {
+					return damaged, err
+				}
+			} else {
+				damaged++
+			}
+		}
+		if readErr == io.EOF {
+			return damaged, nil
+		}
+		if readErr != nil {
+			// A damaged archive loses the rest of its records
+			if compressed {
+				return damaged + 1, nil
+			}
+			return damaged, fmt.Errorf("failed to read journal segment: %v", readErr)
+		}
+	}
+}
+
+// SegmentPath returns where a segment of the journal is stored
+func (j *Journal) SegmentPath(segment JournalSegment) string {
+	return filepath.Join(j.dir, segment.File)
+}
+
+// Segments returns a copy of the segment index, oldest first
+func (j *Journal) Segments() []JournalSegment {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	segments := make([]JournalSegment, len(j.index.Segments))
+	copy(segments, j.index.Segments)
+	return segments
+}
+
+// RemoveSegmentsBefore deletes closed segments whose newest record is older
+// than t and returns how many were removed
+func (j *Journal) RemoveSegmentsBefore(t time.Time) (int, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	kept := j.index.Segments[:0]
+	removed := 0
+	for _, segment := range j.index.Segments {
+		if segment.Closed && segment.Last.Before(t) {
+			if err := os.Remove(filepath.Join(j.dir, segment.File)); err != nil && !os.IsNotExist(err) {
+				kept = append(kept, segment)
+				continue
+			}
+			removed++
+			continue
+		}
+		kept = append(kept, segment)
+	}
+	j.index.Segments = kept
+
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, j.writeIndex()
+}
+
+// Close closes the active segment, it is reopened by the next Append
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.active == nil {
+		return nil
+	}
+	err := j.active.Close()
+	j.active = nil
+	return err
+}
+
+// writeIndex persists the segment index. The caller must hold the mutex.
+func (j *Journal) writeIndex() error {
+	data, err := json.MarshalIndent(j.index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal index: %v", err)
+	}
+	if err := WriteFileAtomic(filepath.Join(j.dir, journalIndexFile), data, 0600); err != nil {
+		return fmt.Errorf("failed to write journal index: %v", err)
+	}
+	return nil
+}
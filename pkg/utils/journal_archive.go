@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const archiveSuffix = ".gz"
+
+// ArchiveSegmentsBefore compresses closed segments whose newest record is
+// older than t into gzip archives and returns how many were archived.
+// Archives are replayed like any other segment.
+func (j *Journal) ArchiveSegmentsBefore(t time.Time) (int, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	archived := 0
+	for i := range j.index.Segments {
+		segment := &j.index.Segments[i]
+		if !segment.Closed || segment.Compressed || !segment.Last.Before(t) {
+			continue
+		}
+
+		original := segment.File
+		size, err := j.compressSegment(original)
+		if err != nil {
+			return archived, err
+		}
+
+		// The index points at the archive before the original goes away, a
+		// leftover original is ignored on open
+		segment.File = original + archiveSuffix
+		segment.Compressed = true
+		segment.Bytes = size
+		if err := j.writeIndex(); err != nil {
+			return archived, err
+		}
+		if err := os.Remove(filepath.Join(j.dir, original)); err != nil && !os.IsNotExist(err) {
+			return archived, fmt.Errorf("failed to remove archived segment: %v", err)
+		}
+		archived++
+	}
+	return archived, nil
+}
+
+// compressSegment writes a gzip copy of a segment next to it and returns its size
+func (j *Journal) compressSegment(name string) (int64, error) {
+	file, err := os.Open(filepath.Join(j.dir, name))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open journal segment: %v", err)
+	}
+	defer file.Close()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Name = name
+	if _, err := io.Copy(gz, file); err != nil {
+		return 0, fmt.Errorf("failed to compress journal segment: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return 0, fmt.Errorf("failed to compress journal segment: %v", err)
+	}
+
+	if err := WriteFileAtomic(filepath.Join(j.dir, name+archiveSuffix), buf.Bytes(), 0600); err != nil {
+		return 0, fmt.Errorf("failed to write journal archive: %v", err)
+	}
+	return int64(buf.Len()), nil
+}
+
+// EnforceBudget deletes the oldest archives, then the oldest closed
+// segments, until the journal fits in maxBytes. It returns how many segments
+// were removed; the active segment is never removed.
+func (j *Journal) EnforceBudget(maxBytes int64) (int, error) {
+	if maxBytes <= 0 {
+		return 0, nil
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	var total int64
+	for _, segment := range j.index.Segments {
+		total += segment.Bytes
+	}
+
+	removed := 0
+	for _, archivesOnly := range []bool{true, false} {
+		kept := j.index.Segments[:0]
+		for _, segment := range j.index.Segments {
+			evict := total > maxBytes && segment.Closed && (segment.Compressed || !archivesOnly)
+			if evict {
+				if err := os.Remove(filepath.Join(j.dir, segment.File)); err == nil || os.IsNotExist(err) {
+					total -= segment.Bytes
+					removed++
+					continue
+				}
+			}
+			kept = append(kept, segment)
+		}
+		j.index.Segments = kept
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, j.writeIndex()
+}
@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// appendJournalLine appends a record followed by a tab, its CRC32 checksum
+// and a newline. JSON never contains a raw tab, so the separator is unambiguous.
+func appendJournalLine(buf, payload []byte) []byte {
+	buf = append(buf, payload...)
+	buf = append(buf, '\t')
+	buf = append(buf, fmt.Sprintf("%08x", crc32.ChecksumIEEE(payload))...)
+	return append(buf, '\n')
+}
+
+// parseJournalLine verifies a journal line and returns its record. Lines
+// without a checksum, written by older versions, are accepted if they are
+// valid JSON.
+func parseJournalLine(line []byte) ([]byte, bool) {
+	line = bytes.TrimRight(line, "\r\n")
+	sep := bytes.LastIndexByte(line, '\t')
+	if sep < 0 {
+		return line, json.Valid(line)
+	}
+
+	payload, checksum := line[:sep], line[sep+1:]
+	expected, err := strconv.ParseUint(string(checksum), 16, 32)
+	if err != nil || uint32(expected) != crc32.ChecksumIEEE(payload) {
+		return nil, false
+	}
+	return payload, true
+}
+
+// Recovered returns what was salvaged from damaged files when the journal was opened
+func (j *Journal) Recovered() []RecoveryReport {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	reports := make([]RecoveryReport, len(j.recovery))
+	copy(reports, j.recovery)
+	return reports
+}
+
+// recover verifies every segment, refreshes the index from what is on disk
+// and rewrites damaged segments with only their valid records, keeping the
+// damaged original next to it
+func (j *Journal) recover() error {
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list journal directory: %v", err)
+	}
+
+	// Segments written after the last index update are picked up from disk
+	known := make(map[string]bool)
+	for _, segment := range j.index.Segments {
+		known[segment.File] = true
+	}
+	onDisk := make(map[string]bool)
+	for _, entry := range entries {
+		onDisk[entry.Name()] = true
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		compressed := strings.HasSuffix(name, ".ndjson"+archiveSuffix)
+		if entry.IsDir() || !strings.HasPrefix(name, "segment-") || known[name] {
+			continue
+		}
+		if !compressed && !strings.HasSuffix(name, ".ndjson") {
+			continue
+		}
+		// An original left behind by an interrupted archival is already in its archive
+		if !compressed && (known[name+archiveSuffix] || onDisk[name+archiveSuffix]) {
+			os.Remove(filepath.Join(j.dir, name))
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat journal segment: %v", err)
+		}
+		j.index.Segments = append(j.index.Segments, JournalSegment{
+			File:       name,
+			CreatedAt:  info.ModTime(),
+			Closed:     compressed,
+			Compressed: compressed,
+		})
+	}
+	sort.SliceStable(j.index.Segments, func(a, b int) bool {
+		return j.index.Segments[a].File < j.index.Segments[b].File
+	})
+
+	kept := j.index.Segments[:0]
+	for _, segment := range j.index.Segments {
+		if _, err := os.Stat(filepath.Join(j.dir, segment.File)); os.IsNotExist(err) {
+			continue
+		}
+		if err := j.verifySegment(&segment); err != nil {
+			return err
+		}
+		// Journals written by older versions were readable by everyone
+		os.Chmod(filepath.Join(j.dir, segment.File), 0600)
+		kept = append(kept, segment)
+
+		var number int
+		if _, err := fmt.Sscanf(segment.File, "segment-%06d.ndjson", &number); err == nil && number > j.index.NextSegment {
+			j.index.NextSegment = number
+		}
+	}
+	j.index.Segments = kept
+
+	// Only the newest segment may still be appended to
+	for i := range j.index.Segments {
+		j.index.Segments[i].Closed = i < len(j.index.Segments)-1 || j.index.Segments[i].Closed
+	}
+
+	if len(j.recovery) > 0 || len(j.index.Segments) > 0 {
+		return j.writeIndex()
+	}
+	return nil
+}
+
+// verifySegment recomputes the statistics of a segment and salvages it if
+// it contains damaged records
+func (j *Journal) verifySegment(segment *JournalSegment) error {
+	path := filepath.Join(j.dir, segment.File)
+	// Archives are written atomically, their statistics are trusted once indexed
+	if segment.Compressed && segment.Records > 0 {
+		return nil
+	}
+	segment.Records, segment.Bytes = 0, 0
+	segment.First, segment.Last = time.Time{}, time.Time{}
+
+	var valid []byte
+	damaged, err := j.replaySegment(segment.File, func(payload []byte) error {
+		var record struct {
+			Time time.Time `json:"time"`
+		}
+		json.Unmarshal(payload, &record)
+		if segment.Records == 0 || record.Time.Before(segment.First) {
+			segment.First = record.Time
+		}
+		if record.Time.After(segment.Last) {
+			segment.Last = record.Time
+		}
+		segment.Records++
+		valid = appendJournalLine(valid, payload)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if damaged > 0 && segment.Compressed {
+		// Archives are read-only, what can be read stays available
+		j.recovery = append(j.recovery, RecoveryReport{File: path, Recovered: segment.Records, Lost: damaged, At: time.Now()})
+	}
+	if damaged == 0 || segment.Compressed {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to stat journal segment: %v", err)
+		}
+		segment.Bytes = info.Size()
+		return nil
+	}
+
+	movedTo, err := moveAside(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(path, valid, 0600); err != nil {
+		return fmt.Errorf("failed to write salvaged journal segment: %v", err)
+	}
+	segment.Bytes = int64(len(valid))
+	// Never append after a damaged tail, start a fresh segment instead
+	segment.Closed = true
+
+	j.recovery = append(j.recovery, RecoveryReport{
+		File:      path,
+		MovedTo:   movedTo,
+		Recovered: segment.Records,
+		Lost:      damaged,
+		At:        time.Now(),
+	})
+	return nil
+}
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseJournalLine(t *testing.T) {
+	payload := []byte(`{"time":"2024-01-01T00:00:00Z","id":"a"}`)
+	valid := appendJournalLine(nil, payload)
+
+	tests := []struct {
+		name   string
+		line   []byte
+		wantOK bool
+	}{
+		{name: "valid checksum", line: valid, wantOK: true},
+		{name: "carriage return", line: append(valid[:len(valid)-1:len(valid)-1], '\r', '\n'), wantOK: true},
+		{name: "changed payload", line: []byte(`{"time":"2024-01-01T00:00:00Z","id":"b"}` + string(valid[len(payload):])), wantOK: false},
+		{name: "changed checksum", line: append(append([]byte{}, payload...), []byte("\t00000000\n")...), wantOK: false},
+		{name: "checksum not hex", line: append(append([]byte{}, payload...), []byte("\tzzzzzzzz\n")...), wantOK: false},
+		{name: "torn line", line: valid[:len(valid)/2], wantOK: false},
+		{name: "legacy line without checksum", line: append(append([]byte{}, payload...), '\n'), wantOK: true},
+		{name: "legacy line with broken JSON", line: []byte(`{"time":` + "\n"), wantOK: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := parseJournalLine(test.line)
+			if ok != test.wantOK {
+				t.Fatalf("parseJournalLine() ok = %v, want %v", ok, test.wantOK)
+			}
+			if ok && string(got) != string(payload) {
+				t.Errorf("parseJournalLine() = %s, want %s", got, payload)
+			}
+		})
+	}
+}
+
+func TestJournalRecovery(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		// damage changes the segment file after "a", "b" and "c" were written
+		damage      func(data []byte) []byte
+		want        []string
+		wantLost    int
+		wantClosed  bool // appending continues in a new segment
+		wantMovedTo bool
+	}{
+		{
+			name:   "intact segment",
+			damage: func(data []byte) []byte { return data },
+			want:   []string{"a", "b", "c", "d"},
+		},
+		{
+			name: "torn last record",
+			damage: func(data []byte) []byte {
+				return data[:len(data)-10]
+			},
+			want:        []string{"a", "b", "d"},
+			wantLost:    1,
+			wantClosed:  true,
+			wantMovedTo: true,
+		},
+		{
+			name: "flipped byte in the middle",
+			damage: func(data []byte) []byte {
+				damaged := append([]byte{}, data...)
+				second := len(appendJournalLine(nil, mustMarshal(t, testRecord{Time: start, ID: "a"})))
+				damaged[second+2] ^= 0x01
+				return damaged
+			},
+			want:        []string{"a", "c", "d"},
+			wantLost:    1,
+			wantClosed:  true,
+			wantMovedTo: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			journal, err := OpenJournal(dir, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, id := range []string{"a", "b", "c"} {
+				if err := journal.Append(testRecord{Time: start.Add(time.Duration(i) * time.Minute), ID: id}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			journal.Close()
+
+			path := journal.SegmentPath(journal.Segments()[0])
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, test.damage(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened, err := OpenJournal(dir, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+
+			lost := 0
+			movedTo := false
+			for _, report := range reopened.Recovered() {
+				lost += report.Lost
+				movedTo = movedTo || report.MovedTo != ""
+			}
+			if lost != test.wantLost || movedTo != test.wantMovedTo {
+				t.Errorf("recovery lost %d (moved aside %v), want %d (%v)", lost, movedTo, test.wantLost, test.wantMovedTo)
+			}
+			if closed := reopened.Segments()[0].Closed; closed != test.wantClosed {
+				t.Errorf("damaged segment closed = %v, want %v", closed, test.wantClosed)
+			}
+
+			if err := reopened.Append(testRecord{Time: start.Add(time.Hour), ID: "d"}); err != nil {
+				t.Fatal(err)
+			}
+			if ids := replayIDs(t, reopened); fmt.Sprint(ids) != fmt.Sprint(test.want) {
+				t.Errorf("replayed %v, want %v", ids, test.want)
+			}
+		})
+	}
+}
+
+func TestJournalFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	journal, err := OpenJournal(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Append(testRecord{Time: start, ID: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A read-only handle fails the write and cannot be truncated either, so
+	// the segment is closed and appending continues in a new one
+	path := journal.SegmentPath(journal.Segments()[0])
+	readOnly, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.active.Close()
+	journal.active = readOnly
+	if err := journal.Append(testRecord{Time: start.Add(time.Minute), ID: "b"}); err == nil {
+		t.Fatal("Append() succeeded on a read-only segment")
+	}
+	if err := journal.Append(testRecord{Time: start.Add(2 * time.Minute), ID: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	reopened, err := OpenJournal(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	segments := reopened.Segments()
+	if len(segments) != 2 || !segments[0].Closed {
+		t.Errorf("segments %+v, want the failed one closed and a new one", segments)
+	}
+	if ids := replayIDs(t, reopened); fmt.Sprint(ids) != "[a c]" {
+		t.Errorf("replayed %v, want [a c]", ids)
+	}
+	if len(reopened.Recovered()) != 0 {
+		t.Errorf("recovered %+v, want nothing damaged", reopened.Recovered())
+	}
+}
+
+func TestJournalRebuildsIndex(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	journal, err := OpenJournal(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"a", "b"} {
+		if err := journal.Append(testRecord{Time: start.Add(time.Duration(i) * time.Minute), ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journal.Close()
+
+	if err := os.WriteFile(filepath.Join(dir, journalIndexFile), []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenJournal(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	segments := reopened.Segments()
+	if len(segments) != 1 || segments[0].Records != 2 || !segments[0].First.Equal(start) || !segments[0].Last.Equal(start.Add(time.Minute)) {
+		t.Errorf("rebuilt index %+v, want one segment with 2 records", segments)
+	}
+	if ids := replayIDs(t, reopened); fmt.Sprint(ids) != "[a b]" {
+		t.Errorf("replayed %v, want [a b]", ids)
+	}
+}
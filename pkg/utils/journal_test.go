@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testRecord struct {
+	Time time.Time `json:"time"`
+	ID   string    `json:"id"`
+}
+
+func (r testRecord) RecordTime() time.Time {
+	return r.Time
+}
+
+// replayIDs returns the IDs of all records in the journal, oldest first
+func replayIDs(t *testing.T, journal *Journal) []string {
+	t.Helper()
+	return replayRange(t, journal, time.Time{}, time.Time{})
+}
+
+// replayRange returns the IDs of the records replayed for [from, to]
+func replayRange(t *testing.T, journal *Journal, from, to time.Time) []string {
+	t.Helper()
+	var ids []string
+	err := journal.Replay(from, to, func(line []byte) error {
+		var record testRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		ids = append(ids, record.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestJournalRotation(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	lineSize := int64(len(appendJournalLine(nil, mustMarshal(t, testRecord{Time: start, ID: "r0"}))))
+
+	tests := []struct {
+		name         string
+		maxBytes     int64
+		maxAge       time.Duration
+		records      int
+		wait         time.Duration // between appends
+		wantSegments int
+	}{
+		{name: "no limits", records: 5, wantSegments: 1},
+		{name: "rotate by size", maxBytes: 2 * lineSize, records: 5, wantSegments: 3},
+		{name: "rotate by age", maxAge: 10 * time.Millisecond, records: 3, wait: 20 * time.Millisecond, wantSegments: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			journal, err := OpenJournal(t.TempDir(), test.maxBytes, test.maxAge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer journal.Close()
+
+			var want []string
+			for i := 0; i < test.records; i++ {
+				if i > 0 {
+					time.Sleep(test.wait)
+				}
+				id := fmt.Sprintf("r%d", i)
+				if err := journal.Append(testRecord{Time: start.Add(time.Duration(i) * time.Minute), ID: id}); err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, id)
+			}
+
+			segments := journal.Segments()
+			if len(segments) != test.wantSegments {
+				t.Fatalf("got %d segments, want %d", len(segments), test.wantSegments)
+			}
+			for i, segment := range segments {
+				if closed := i < len(segments)-1; segment.Closed != closed {
+					t.Errorf("segment %s closed = %v, want %v", segment.File, segment.Closed, closed)
+				}
+			}
+			if ids := replayIDs(t, journal); fmt.Sprint(ids) != fmt.Sprint(want) {
+				t.Errorf("replayed %v, want %v", ids, want)
+			}
+		})
+	}
+}
+
+// rotatedJournal returns a journal holding r0 to r5, one minute apart, in
+// three segments of two records
+func rotatedJournal(t *testing.T, start time.Time) *Journal {
+	t.Helper()
+	lineSize := int64(len(appendJournalLine(nil, mustMarshal(t, testRecord{Time: start, ID: "r0"}))))
+	journal, err := OpenJournal(t.TempDir(), 2*lineSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { journal.Close() })
+	for i := 0; i < 6; i++ {
+		if err := journal.Append(testRecord{Time: start.Add(time.Duration(i) * time.Minute), ID: fmt.Sprintf("r%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if segments := journal.Segments(); len(segments) != 3 {
+		t.Fatalf("got %d segments, want 3", len(segments))
+	}
+	return journal
+}
+
+func TestJournalReplayRange(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	journal := rotatedJournal(t, start)
+
+	tests := []struct {
+		name string
+		from time.Duration // after start, negative leaves the range open
+		to   time.Duration
+		want string
+	}{
+		{name: "open range", from: -1, to: -1, want: "[r0 r1 r2 r3 r4 r5]"},
+		{name: "from skips older segments", from: 3 * time.Minute, to: -1, want: "[r2 r3 r4 r5]"},
+		{name: "to skips newer segments", from: -1, to: time.Minute, want: "[r0 r1]"},
+		{name: "within one segment", from: 2*time.Minute + time.Second, to: 2*time.Minute + 30*time.Second, want: "[r2 r3]"},
+		{name: "after every record", from: time.Hour, to: -1, want: "[]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var from, to time.Time
+			if test.from >= 0 {
+				from = start.Add(test.from)
+			}
+			if test.to >= 0 {
+				to = start.Add(test.to)
+			}
+			if ids := replayRange(t, journal, from, to); fmt.Sprint(ids) != test.want {
+				t.Errorf("replayed %v, want %s", ids, test.want)
+			}
+		})
+	}
+}
+
+func TestJournalRemoveSegmentsBefore(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		before      time.Duration // after start
+		wantRemoved int
+		want        string
+	}{
+		{name: "nothing old enough", before: time.Minute, wantRemoved: 0, want: "[r0 r1 r2 r3 r4 r5]"},
+		{name: "oldest segment", before: 2 * time.Minute, wantRemoved: 1, want: "[r2 r3 r4 r5]"},
+		{name: "active segment is kept", before: time.Hour, wantRemoved: 2, want: "[r4 r5]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			journal := rotatedJournal(t, start)
+			oldest := journal.SegmentPath(journal.Segments()[0])
+
+			removed, err := journal.RemoveSegmentsBefore(start.Add(test.before))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != test.wantRemoved || len(journal.Segments()) != 3-test.wantRemoved {
+				t.Errorf("removed %d, %d segments left, want %d removed", removed, len(journal.Segments()), test.wantRemoved)
+			}
+			if _, err := os.Stat(oldest); (err == nil) != (test.wantRemoved == 0) {
+				t.Errorf("oldest segment file exists = %v, want %v", err == nil, test.wantRemoved == 0)
+			}
+			if ids := replayIDs(t, journal); fmt.Sprint(ids) != test.want {
+				t.Errorf("replayed %v, want %s", ids, test.want)
+			}
+
+			// The index on disk matches, a reopened journal sees the same segments
+			reopened, err := OpenJournal(filepath.Dir(oldest), 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			if ids := replayIDs(t, reopened); fmt.Sprint(ids) != test.want {
+				t.Errorf("reopened journal replayed %v, want %s", ids, test.want)
+			}
+		})
+	}
+}
+
+func mustMarshal(t *testing.T, value interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
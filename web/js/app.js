@@ -2,6 +2,9 @@
 class KubernetesMonitorApp {
     constructor() {
         this.autoRefreshInterval = null;
+        this.pageSize = 100;
+        this.visibleCount = this.pageSize;
+        this.nextCursor = null;
         this.init();
     }
 
@@ -30,7 +33,7 @@ class KubernetesMonitorApp {
                 const siblings = this.parentElement.querySelectorAll('.filter-chip');
                 siblings.forEach(sibling => sibling.classList.remove('selected'));
                 this.classList.add('selected');
-                window.app.loadChanges();
+                window.app.resetPaging();
             });
         });
         
@@ -38,7 +41,7 @@ class KubernetesMonitorApp {
         document.querySelectorAll('#eventTypeFilters .filter-chip').forEach(chip => {
             chip.addEventListener('click', function() {
                 this.classList.toggle('selected');
-                window.app.loadChanges();
+                window.app.resetPaging();
             });
         });
         
@@ -46,11 +49,17 @@ class KubernetesMonitorApp {
         document.addEventListener('click', function(e) {
             if (e.target.closest('#resourceTypeFilters .filter-chip')) {
                 e.target.closest('.filter-chip').classList.toggle('selected');
-                window.app.loadChanges();
+                window.app.resetPaging();
             }
         });
     }
 
+    // resetPaging goes back to the first page when the filters change
+    resetPaging() {
+        this.visibleCount = this.pageSize;
+        this.loadChanges();
+    }
+
     async loadInitialData() {
         await this.loadConfig();
         await this.loadChanges();
@@ -59,7 +68,7 @@ class KubernetesMonitorApp {
 
     async loadVersion() {
         try {
-            const response = await fetch('/api/debug');
+            const response = await fetch('/api/v1/status');
             const data = await response.json();
             const versionElement = document.getElementById('appVersion');
             if (versionElement) {
@@ -76,7 +85,11 @@ class KubernetesMonitorApp {
 
     async loadConfig() {
         try {
-            const response = await fetch('/api/config');
+            const response = await fetch('/api/v1/config');
+            if (!response.ok) {
+                // Only admins may read the configuration
+                return;
+            }
             const config = await response.json();
             
             this.populateResourceFilters(config.resources);
@@ -166,39 +179,83 @@ class KubernetesMonitorApp {
 
     async loadChanges() {
         try {
-            const response = await fetch('/api/changes');
-            const changes = await response.json();
-            
+            // Refreshes keep the pages loaded so far
+            const response = await fetch('/api/v1/changes?' + this.buildQuery(this.visibleCount));
+            const page = await response.json();
+            const changes = page.changes;
+            this.nextCursor = page.nextCursor;
+            this.updatePager(changes.length, page.total);
+
             const container = document.getElementById('changesList');
             if (!changes || changes.length === 0) {
-                container.innerHTML = this.getEmptyState();
-                return;
-            }
-
-            // Apply filters
-            let filteredChanges = this.applyFilters(changes);
-
-            // Sort changes
-            const sortChip = document.querySelector('#sortOrderFilters .filter-chip.selected');
-            const sortOrder = sortChip ? sortChip.dataset.value : 'newest';
-            filteredChanges.sort((a, b) => {
-                const dateA = new Date(a.timestamp);
-                const dateB = new Date(b.timestamp);
-                return sortOrder === 'newest' ? dateB - dateA : dateA - dateB;
-            });
-
-            if (filteredChanges.length === 0) {
-                container.innerHTML = this.getEmptyState('No changes match the current filters');
+                container.innerHTML = this.hasFilters() ? this.getEmptyState('No changes match the current filters') : this.getEmptyState();
                 return;
             }
 
-            container.innerHTML = filteredChanges.slice(0, 100).map(change => this.createChangeRow(change)).join('');
+            container.innerHTML = changes.map(change => this.createChangeRow(change)).join('');
         } catch (error) {
             console.error('Error loading changes:', error);
             document.getElementById('changesList').innerHTML = this.getEmptyState('Error loading changes');
         }
     }
 
+    async loadMoreChanges() {
+        if (!this.nextCursor) return;
+        try {
+            const response = await fetch('/api/v1/changes?' + this.buildQuery(this.pageSize, this.nextCursor));
+            const page = await response.json();
+            const changes = page.changes;
+            this.nextCursor = page.nextCursor;
+
+            const container = document.getElementById('changesList');
+            container.insertAdjacentHTML('beforeend', changes.map(change => this.createChangeRow(change)).join(''));
+            const shown = container.querySelectorAll('.change-item').length;
+            this.visibleCount = Math.max(this.visibleCount, shown);
+            this.updatePager(shown, page.total);
+        } catch (error) {
+            console.error('Error loading more changes:', error);
+        }
+    }
+
+    // buildQuery turns the selected filter chips into /api/changes parameters
+    buildQuery(limit, cursor) {
+        const params = new URLSearchParams();
+
+        const sortChip = document.querySelector('#sortOrderFilters .filter-chip.selected');
+        params.set('sort', sortChip ? sortChip.dataset.value : 'newest');
+
+        const statusChip = document.querySelector('#statusFilters .filter-chip.selected');
+        const status = statusChip ? statusChip.dataset.value : 'all';
+        if (status === 'unread') params.set('read', 'false');
+        if (status === 'read') params.set('read', 'true');
+
+        const selectedEventTypes = Array.from(document.querySelectorAll('#eventTypeFilters .filter-chip.selected'))
+            .map(chip => chip.dataset.value);
+        if (selectedEventTypes.length > 0) params.set('eventType', selectedEventTypes.join(','));
+
+        const selectedResources = Array.from(document.querySelectorAll('#resourceTypeFilters .filter-chip.selected'))
+            .map(chip => chip.dataset.value);
+        if (selectedResources.length > 0) params.set('resourceType', selectedResources.join(','));
+
+        params.set('limit', limit);
+        if (cursor) params.set('cursor', cursor);
+        return params.toString();
+    }
+
+    hasFilters() {
+        const statusChip = document.querySelector('#statusFilters .filter-chip.selected');
+        return (statusChip && statusChip.dataset.value !== 'all') ||
+            document.querySelectorAll('#eventTypeFilters .filter-chip.selected, #resourceTypeFilters .filter-chip.selected').length > 0;
+    }
+
+    updatePager(shown, total) {
+        const pager = document.getElementById('changesPager');
+        if (!pager) return;
+        pager.style.display = total > 0 ? 'flex' : 'none';
+        document.getElementById('changesPagerInfo').textContent = `Showing ${shown} of ${total} changes`;
+        document.getElementById('loadMoreButton').style.display = this.nextCursor ? 'inline-block' : 'none';
+    }
+
     createChangeRow(change) {
         return `
             <div class="change-item${change.isRead ? '' : ' unread'}">
@@ -206,44 +263,91 @@ class KubernetesMonitorApp {
                 <div class="event-type event-${change.eventType}">${change.eventType}</div>
                 <div class="resource-type">${change.resourceType}</div>
                 <div class="namespace">${change.namespace || 'default'}</div>
-                <div class="name">${change.name}</div>
-                <div class="details">${change.details}</div>
+                <div class="name"><a href="#" onclick="showChangeDetail('${change.id}'); return false;">${change.name}</a></div>
+                <div class="details"><span class="severity severity-${change.severity}">${change.severity}</span>${change.details}</div>
                 <div>${change.isRead ? '✓' : `<button class="mark-read-btn" onclick="markAsRead('${change.id}')">Mark Read</button>`}</div>
             </div>
         `;
     }
 
-    applyFilters(changes) {
-        // Get status filter from chips
-        const statusChip = document.querySelector('#statusFilters .filter-chip.selected');
-        const filterRead = statusChip ? statusChip.dataset.value : 'all';
-        
-        // Get selected event types from chips
-        const selectedEventTypes = Array.from(document.querySelectorAll('#eventTypeFilters .filter-chip.selected'))
-            .map(chip => chip.dataset.value);
-        
-        // Get selected resource types from chips
-        const selectedResources = Array.from(document.querySelectorAll('#resourceTypeFilters .filter-chip.selected'))
-            .map(chip => chip.dataset.value);
+    // showChangeDetail opens the detail panel for one change
+    async showChangeDetail(changeId) {
+        try {
+            const response = await fetch('/api/v1/changes/' + encodeURIComponent(changeId));
+            if (!response.ok) {
+                this.showNotification('Change not found', 'error');
+                return;
+            }
+            const detail = await response.json();
+            const change = detail.change;
+
+            document.getElementById('changeDetailTitle').textContent =
+                `🔍 ${change.eventType} ${change.resourceType}/${change.name}` + (change.namespace ? ` in ${change.namespace}` : '');
+            this.setDetailButton('previousChangeButton', detail.previous);
+            this.setDetailButton('nextChangeButton', detail.next);
+
+            let html = `<p style="margin-bottom: 15px;">${this.formatTimestamp(change.timestamp)} · <span class="severity severity-${change.severity}">${change.severity}</span>${change.details}${change.actor ? ' · by ' + this.escapeHtml(change.actor) : ''}</p>`;
+
+            if (detail.diff && detail.diff.length > 0) {
+                html += '<h4 style="margin-bottom: 10px;">Changed Fields</h4><table style="width: 100%; margin-bottom: 15px; border-collapse: collapse;">';
+                html += detail.diff.map(field => `
+                    <tr>
+                        <td style="padding: 4px 8px; font-family: monospace; vertical-align: top;">${this.escapeHtml(field.path)}</td>
+                        <td style="padding: 4px 8px; font-family: monospace; color: #dc3545;">${this.formatValue(field.before)}</td>
+                        <td style="padding: 4px 8px; font-family: monospace; color: #28a745;">${this.formatValue(field.after)}</td>
+                    </tr>`).join('');
+                html += '</table>';
+            }
+
+            if (detail.owners && detail.owners.length > 0) {
+                html += '<h4 style="margin-bottom: 10px;">Owners</h4>' + this.formatOwners(detail.owners);
+            }
 
-        return changes.filter(change => {
-            // Filter by read status
-            if (filterRead === 'unread' && change.isRead) return false;
-            if (filterRead === 'read' && !change.isRead) return false;
+            html += '<h4 style="margin: 15px 0 10px;">Events</h4>';
+            if (detail.eventsError) {
+                html += `<p>${this.escapeHtml(detail.eventsError)}</p>`;
+            } else if (detail.events && detail.events.length > 0) {
+                html += '<ul style="list-style: none;">' + detail.events.map(event => `
+                    <li style="margin-bottom: 5px;">${this.formatTimestamp(event.lastSeen)} <strong>${this.escapeHtml(event.type)} ${this.escapeHtml(event.reason)}</strong>${event.count > 1 ? ` (x${event.count})` : ''}: ${this.escapeHtml(event.message)}</li>`).join('') + '</ul>';
+            } else {
+                html += '<p>No events around this change</p>';
+            }
 
-            // Filter by event type (if any are selected)
-            if (selectedEventTypes.length > 0 && !selectedEventTypes.includes(change.eventType)) return false;
+            document.getElementById('changeDetailContent').innerHTML = html;
+            const panel = document.getElementById('changeDetailPanel');
+            panel.style.display = 'block';
+            panel.scrollIntoView({ behavior: 'smooth' });
+        } catch (error) {
+            console.error('Error loading change detail:', error);
+            this.showNotification('Error loading change detail', 'error');
+        }
+    }
 
-            // Filter by resource type (if any are selected)
-            if (selectedResources.length > 0 && !selectedResources.includes(change.resourceType)) return false;
+    setDetailButton(id, change) {
+        const button = document.getElementById(id);
+        button.disabled = !change;
+        button.onclick = change ? () => this.showChangeDetail(change.id) : null;
+    }
 
-            return true;
-        });
+    formatOwners(owners) {
+        return '<ul style="margin-left: 20px;">' + owners.map(owner =>
+            `<li>${this.escapeHtml(owner.kind)} ${this.escapeHtml(owner.name)}${owner.owners ? this.formatOwners(owner.owners) : ''}</li>`).join('') + '</ul>';
+    }
+
+    formatValue(value) {
+        if (value === undefined) return '';
+        return this.escapeHtml(typeof value === 'string' ? value : JSON.stringify(value));
+    }
+
+    escapeHtml(text) {
+        const div = document.createElement('div');
+        div.textContent = text === undefined || text === null ? '' : String(text);
+        return div.innerHTML;
     }
 
     async loadStats() {
         try {
-            const response = await fetch('/api/stats');
+            const response = await fetch('/api/v1/stats');
             const stats = await response.json();
             
             document.getElementById('totalChanges').textContent = stats.totalChanges || 0;
@@ -287,18 +391,53 @@ class KubernetesMonitorApp {
     toggleAutoRefresh() {
         const checkbox = document.getElementById('autoRefresh');
         if (checkbox.checked) {
-            this.autoRefreshInterval = setInterval(() => {
-                this.loadChanges();
-                this.loadStats();
-            }, 2000);
+            if (window.EventSource) {
+                this.openStream();
+            } else {
+                this.autoRefreshInterval = setInterval(() => {
+                    this.loadChanges();
+                    this.loadStats();
+                }, 2000);
+            }
         } else {
             clearInterval(this.autoRefreshInterval);
+            if (this.eventSource) {
+                this.eventSource.close();
+                this.eventSource = null;
+            }
         }
     }
 
+    // openStream follows /api/changes/stream, the browser reconnects and
+    // resumes on its own when the connection drops
+    openStream() {
+        this.eventSource = new EventSource('/api/v1/changes/stream');
+        this.eventSource.addEventListener('change', () => this.scheduleReload());
+        this.eventSource.addEventListener('read', () => this.scheduleReload());
+        this.eventSource.addEventListener('reset', () => {
+            this.scheduleReload();
+            this.loadStats();
+        });
+        this.eventSource.addEventListener('stats', (event) => {
+            const stats = JSON.parse(event.data);
+            ['totalChanges', 'unreadChanges', 'currentSession'].forEach(key => {
+                if (key in stats) document.getElementById(key).textContent = stats[key];
+            });
+        });
+    }
+
+    // scheduleReload reloads the list once per burst of stream events
+    scheduleReload() {
+        if (this.reloadTimer) return;
+        this.reloadTimer = setTimeout(() => {
+            this.reloadTimer = null;
+            this.loadChanges();
+        }, 250);
+    }
+
     async markAllAsRead() {
         try {
-            const response = await fetch('/api/mark-all-read', { method: 'POST' });
+            const response = await fetch('/api/v1/changes/read-all', { method: 'POST' });
             const data = await response.json();
             console.log('Marked', data.count, 'changes as read');
             await this.loadChanges();
@@ -312,15 +451,15 @@ class KubernetesMonitorApp {
 
     async markAsRead(changeId) {
         try {
-            const response = await fetch('/api/mark-read', {
+            const response = await fetch('/api/v1/changes/read', {
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
                 },
-                body: JSON.stringify({ id: changeId })
+                body: JSON.stringify({ ids: [changeId] })
             });
             const data = await response.json();
-            if (data.success) {
+            if (data.marked && data.marked.length > 0) {
                 await this.loadChanges();
                 await this.loadStats();
             }
@@ -331,12 +470,12 @@ class KubernetesMonitorApp {
 
     async saveToFile() {
         try {
-            const response = await fetch('/api/save-now', { method: 'POST' });
+            const response = await fetch('/api/v1/save', { method: 'POST' });
             const data = await response.json();
-            if (data.success) {
+            if (response.ok) {
                 this.showNotification('Changes saved to file successfully!', 'success');
             } else {
-                this.showNotification('Error saving to file: ' + (data.error || 'Unknown error'), 'error');
+                this.showNotification('Error saving to file: ' + (data.error ? data.error.message : 'Unknown error'), 'error');
             }
         } catch (error) {
             console.error('Error saving to file:', error);
@@ -443,6 +582,18 @@ function saveToFile() {
     window.app.saveToFile();
 }
 
+function showChangeDetail(changeId) {
+    window.app.showChangeDetail(changeId);
+}
+
+function closeChangeDetail() {
+    document.getElementById('changeDetailPanel').style.display = 'none';
+}
+
+function loadMoreChanges() {
+    window.app.loadMoreChanges();
+}
+
 function toggleTheme() {
     window.app.toggleTheme();
 }